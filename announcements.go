@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func postAnnouncement(ctx context.Context, req db.NewAnnouncementRequest) (*db.Announcement, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	a, err := db.AddAnnouncement(params["id"], req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add announcement")
+	}
+	//delivered by a job, progress is visible in the recipients status
+	wakeJobWorker()
+	return a, nil
+}
+
+//getAnnouncements returns the announcements that URL param person_id may
+//see, or only those to everybody
+func getAnnouncements(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	announcements, err := db.ListAnnouncements(params["id"], params["person_id"])
+	if err != nil {
+		return nil, err
+	}
+	return announcements, nil
+}
+
+func getAnnouncementRecipients(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	announcement, err := db.GetAnnouncement(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AuthoriseEventOrganiser(announcement.EventID, params["by_person_id"]); err != nil {
+		return nil, err
+	}
+	recipients, err := db.ListAnnouncementRecipients(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
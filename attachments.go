@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+func postEventAttachment(ctx context.Context, req db.AttachDocumentRequest) (*db.Attachment, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.AttachDocument(params["id"], req)
+}
+
+//getEventAttachments returns the attachments that URL param person_id may
+//see, or only the public ones
+func getEventAttachments(ctx context.Context) ([]db.Attachment, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListEventAttachments(params["id"], params["person_id"])
+}
+
+//postDetachAttachment expects URL param by_person_id
+func postDetachAttachment(ctx context.Context) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.DetachDocument(params["id"], params["by_person_id"])
+}
+
+type AttachmentLink struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+//getAttachmentLink returns a signed download link for URL param person_id,
+//valid for URL param ttl_hours (default a week). URL param by_person_id is
+//the same person or an organiser of the event.
+func getAttachmentLink(ctx context.Context) (*AttachmentLink, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	ttl := 7 * 24 * time.Hour
+	if s := params["ttl_hours"]; s != "" {
+		hours, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, errors.Errorc(http.StatusBadRequest, "invalid URL param ttl_hours")
+		}
+		ttl = time.Duration(hours) * time.Hour
+	}
+	query, expires, err := db.AttachmentLink(params["id"], params["person_id"], params["by_person_id"], ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &AttachmentLink{
+		URL:     apiURL + "/attachment/" + params["id"] + "/download?" + query.Encode(),
+		Expires: expires,
+	}, nil
+}
+
+//getAttachmentDownload streams public attachments to anyone and others only
+//with a valid signed link for a person that may still see the attachment
+func getAttachmentDownload(httpRes http.ResponseWriter, httpReq *http.Request) {
+	id := mux.Vars(httpReq)["id"]
+	fail := func(err error) {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("cannot download: %+s", err), code)
+	}
+	personID := ""
+	if query := httpReq.URL.Query(); query.Get("sig") != "" {
+		var err error
+		if personID, err = db.VerifyAttachmentLink(id, query, time.Now()); err != nil {
+			fail(err)
+			return
+		}
+	}
+	a, err := db.AuthoriseAttachment(id, personID)
+	if err != nil {
+		fail(err)
+		return
+	}
+	doc, content, err := db.OpenDocument(a.DocumentID)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer content.Close()
+	serveContent(httpRes, httpReq, doc, content)
+}
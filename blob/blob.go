@@ -0,0 +1,85 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/go-msvc/errors"
+)
+
+//Store keeps blobs by the SHA-256 of their content, so the same content is
+//only stored once and a blob never changes after it was written
+type Store interface {
+	//Put stores the content read from r and returns its ID
+	Put(r io.Reader) (id string, size int64, err error)
+
+	//Get returns the content, which the caller must close. It is an
+	//io.ReadSeeker when the store supports it, e.g. for range requests.
+	Get(id string) (io.ReadCloser, error)
+
+	//Exists checks if the blob is stored
+	Exists(id string) (bool, error)
+
+	Delete(id string) error
+}
+
+//ErrNotFound is returned by Get and Delete for an unknown blob
+var ErrNotFound = errors.Errorf("blob not found")
+
+//ValidID checks that the ID is a hex SHA-256, so it is also safe to use as a
+//file name or object key
+func ValidID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+//spool copies r to a temp file in dir while hashing it, and returns the file
+//positioned at the start with its ID and size. The caller must close and
+//remove the file.
+func spool(dir string, r io.Reader) (*os.File, string, int64, error) {
+	f, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return nil, "", 0, errors.Wrapf(err, "failed to create temp file")
+	}
+	h := sha256.New()
+	size, err := io.Copy(f, io.TeeReader(r, h))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", 0, errors.Wrapf(err, "failed to read content")
+	}
+	return f, hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+//NewFromEnv returns the store selected with env BLOB_STORE=local|s3
+func NewFromEnv() (Store, error) {
+	switch os.Getenv("BLOB_STORE") {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "./blobs"
+		}
+		return NewLocal(dir)
+	case "s3":
+		return NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+	}
+	return nil, errors.Errorf("unknown BLOB_STORE=%s, expecting local|s3", os.Getenv("BLOB_STORE"))
+}
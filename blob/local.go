@@ -0,0 +1,90 @@
+package blob
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-msvc/errors"
+)
+
+//Local stores blobs as files in a directory, in sub-directories named by the
+//first two characters of the ID to keep directories small
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrapf(err, "failed to create blob dir %s", dir)
+	}
+	return &Local{dir: dir}, nil
+}
+
+func (l *Local) path(id string) string {
+	return filepath.Join(l.dir, id[:2], id)
+}
+
+func (l *Local) Put(r io.Reader) (string, int64, error) {
+	f, id, size, err := spool(l.dir, r)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Close(); err != nil {
+		return "", 0, errors.Wrapf(err, "failed to write blob")
+	}
+	if ok, _ := l.Exists(id); ok {
+		return id, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path(id)), 0750); err != nil {
+		return "", 0, errors.Wrapf(err, "failed to create blob dir")
+	}
+	//rename is atomic, so a blob is never seen half written
+	if err := os.Rename(f.Name(), l.path(id)); err != nil {
+		return "", 0, errors.Wrapf(err, "failed to store blob")
+	}
+	return id, size, nil
+}
+
+func (l *Local) Get(id string) (io.ReadCloser, error) {
+	if !ValidID(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(l.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open blob")
+	}
+	return f, nil
+}
+
+func (l *Local) Exists(id string) (bool, error) {
+	if !ValidID(id) {
+		return false, nil
+	}
+	_, err := os.Stat(l.path(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to check blob")
+	}
+	return true, nil
+}
+
+func (l *Local) Delete(id string) error {
+	if !ValidID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(l.path(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete blob")
+	}
+	return nil
+}
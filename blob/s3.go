@@ -0,0 +1,242 @@
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//S3Config is for Amazon S3 or a compatible store like MinIO. Objects are
+//addressed path-style as <endpoint>/<bucket>/<id>, which all of them support.
+type S3Config struct {
+	Endpoint  string //e.g. "https://s3.af-south-1.amazonaws.com" or "http://localhost:9000"
+	Region    string //default "us-east-1"
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+func (c S3Config) Validate() error {
+	if c.Endpoint == "" {
+		return errors.Errorf("missing endpoint")
+	}
+	if c.Bucket == "" {
+		return errors.Errorf("missing bucket")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return errors.Errorf("missing access key or secret key")
+	}
+	return nil
+}
+
+type S3 struct {
+	config S3Config
+	client *http.Client
+}
+
+func NewS3(config S3Config) (*S3, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid S3 config")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &S3{config: config, client: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+//emptyPayloadHash is the SHA-256 of no content
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3) do(method, id string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.config.Endpoint+"/"+s.config.Bucket+"/"+id, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create request")
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	s.config.Sign(req, payloadHash, time.Now())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to %s %s", method, req.URL.Path)
+	}
+	return res, nil
+}
+
+//statusError describes an unexpected response and closes it
+func statusError(res *http.Response) error {
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 500))
+	return errors.Errorf("%s %s: %s %s", res.Request.Method, res.Request.URL.Path, res.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *S3) Put(r io.Reader) (string, int64, error) {
+	f, id, size, err := spool("", r)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	if ok, err := s.Exists(id); err != nil {
+		return "", 0, err
+	} else if ok {
+		return id, size, nil
+	}
+	//the ID is the SHA-256 of the content which is also what S3 verifies
+	res, err := s.do(http.MethodPut, id, f, size, id)
+	if err != nil {
+		return "", 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", 0, statusError(res)
+	}
+	res.Body.Close()
+	return id, size, nil
+}
+
+func (s *S3) Get(id string) (io.ReadCloser, error) {
+	if !ValidID(id) {
+		return nil, ErrNotFound
+	}
+	res, err := s.do(http.MethodGet, id, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	return nil, statusError(res)
+}
+
+func (s *S3) Exists(id string) (bool, error) {
+	if !ValidID(id) {
+		return false, nil
+	}
+	res, err := s.do(http.MethodHead, id, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return false, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		res.Body.Close()
+		return true, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return false, nil
+	}
+	return false, statusError(res)
+}
+
+func (s *S3) Delete(id string) error {
+	//S3 does not say if the object existed
+	if ok, err := s.Exists(id); err != nil {
+		return err
+	} else if !ok {
+		return ErrNotFound
+	}
+	res, err := s.do(http.MethodDelete, id, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return statusError(res)
+	}
+	res.Body.Close()
+	return nil
+}
+
+//Sign adds AWS Signature Version 4 headers to the request. All headers
+//already set on the request are signed.
+func (c S3Config) Sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	scope := t.Format("20060102") + "/" + c.Region + "/s3/aws4_request"
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	canonicalQuery := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			canonicalQuery = append(canonicalQuery, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + c.SecretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s", c.AccessKey, scope, signedHeaders, signature))
+} //S3Config.Sign()
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+//awsEscape encodes everything except the unreserved characters of RFC 3986
+func awsEscape(s string) string {
+	e := ""
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			e += string(b)
+		} else {
+			e += fmt.Sprintf("%%%02X", b)
+		}
+	}
+	return e
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jansemmelink/events/db"
+)
+
+//ledger-check verifies that the ledger balances to zero and exits with
+//status 1 when it does not, so it can run from cron or CI
+func main() {
+	problems, err := db.CheckLedger()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: failed to check ledger: %+v\n", err)
+		os.Exit(2)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("ledger balances")
+}
@@ -1,12 +1,109 @@
 CREATE DATABASE IF NOT EXISTS `events`;
 GRANT ALL PRIVILEGES ON `events`.* to 'events'@'%' IDENTIFIED BY 'events';
 
+DROP TABLE IF EXISTS `migrations`;
+DROP TABLE IF EXISTS `event_waitlist`;
+DROP TABLE IF EXISTS `jobs`;
+DROP TABLE IF EXISTS `event_reminders`;
+DROP TABLE IF EXISTS `entry_transfers`;
+DROP TABLE IF EXISTS `event_transfer_policies`;
+DROP TABLE IF EXISTS `entry_results`;
+DROP TABLE IF EXISTS `entry_members`;
+DROP TABLE IF EXISTS `memberships`;
+DROP TABLE IF EXISTS `membership_types`;
+DROP TABLE IF EXISTS `organisation_members`;
+DROP TABLE IF EXISTS `photo_tags`;
+DROP TABLE IF EXISTS `photos`;
+DROP TABLE IF EXISTS `waiver_acceptances`;
+DROP TABLE IF EXISTS `event_waivers`;
+DROP TABLE IF EXISTS `event_attachments`;
+DROP TABLE IF EXISTS `documents`;
+DROP TABLE IF EXISTS `event_course_checkpoints`;
+DROP TABLE IF EXISTS `event_courses`;
+DROP TABLE IF EXISTS `announcement_recipients`;
+DROP TABLE IF EXISTS `announcements`;
+DROP TABLE IF EXISTS `ledger_entries`;
+DROP TABLE IF EXISTS `ledger_transactions`;
+DROP TABLE IF EXISTS `invoices`;
+DROP TABLE IF EXISTS `credit_note_redemptions`;
+DROP TABLE IF EXISTS `credit_notes`;
+DROP TABLE IF EXISTS `refunds`;
+DROP TABLE IF EXISTS `event_refund_rules`;
+DROP TABLE IF EXISTS `event_refund_policies`;
+DROP TABLE IF EXISTS `bank_statement_lines`;
+DROP TABLE IF EXISTS `payments`;
+DROP TABLE IF EXISTS `order_lines`;
+DROP TABLE IF EXISTS `orders`;
+DROP TABLE IF EXISTS `promo_redemptions`;
+DROP TABLE IF EXISTS `promo_codes`;
+DROP TABLE IF EXISTS `event_family_discounts`;
+DROP TABLE IF EXISTS `event_prices`;
+DROP TABLE IF EXISTS `entry_answers`;
+DROP TABLE IF EXISTS `event_form_fields`;
+DROP TABLE IF EXISTS `entries`;
+DROP TABLE IF EXISTS `event_categories`;
+DROP TABLE IF EXISTS `event_organisers`;
+DROP TABLE IF EXISTS `volunteer_signups`;
+DROP TABLE IF EXISTS `volunteer_shifts`;
+DROP TABLE IF EXISTS `volunteer_roles`;
 DROP TABLE IF EXISTS `events`;
+DROP TABLE IF EXISTS `organisations`;
+DROP TABLE IF EXISTS `locations`;
+CREATE TABLE `locations` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `street` VARCHAR(200) NOT NULL DEFAULT '',
+  `suburb` VARCHAR(100) NOT NULL DEFAULT '',
+  `town` VARCHAR(100) NOT NULL DEFAULT '',
+  `province` VARCHAR(100) NOT NULL DEFAULT '',
+  `postal_code` VARCHAR(10) NOT NULL DEFAULT '',
+  `country` VARCHAR(100) NOT NULL DEFAULT '',
+  `lat` DOUBLE NOT NULL,
+  `lon` DOUBLE NOT NULL,
+  `directions` VARCHAR(1000) NOT NULL DEFAULT '',
+  `time_zone` VARCHAR(64) NOT NULL DEFAULT '',
+  `added_by_person_id` VARCHAR(40) DEFAULT NULL,
+  UNIQUE KEY `locations_id` (`id`),
+  KEY `locations_lat_lon` (`lat`,`lon`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `organisations` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `address` VARCHAR(400) NOT NULL DEFAULT '',
+  `email` VARCHAR(200) NOT NULL DEFAULT '',
+  `phone` VARCHAR(40) NOT NULL DEFAULT '',
+  `website` VARCHAR(200) NOT NULL DEFAULT '',
+  `logo_document_id` VARCHAR(40) DEFAULT NULL,
+  `brand_colour` VARCHAR(7) NOT NULL DEFAULT '',
+  `vat_number` VARCHAR(20) NOT NULL DEFAULT '',
+  `vat_percent` INT NOT NULL DEFAULT 15,
+  `invoice_prefix` VARCHAR(10) NOT NULL,
+  `next_invoice_nr` INT NOT NULL DEFAULT 1,
+  UNIQUE KEY `organisations_id` (`id`),
+  UNIQUE KEY `organisations_name` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
 CREATE TABLE `events` (
   `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
   `name` VARCHAR(100) NOT NULL,
   `date` DATE NOT NULL,
+  `time_zone` VARCHAR(64) DEFAULT NULL,
+  `start_time` DATETIME DEFAULT NULL,
+  `end_time` DATETIME DEFAULT NULL,
+  `entries_close` DATETIME DEFAULT NULL,
+  `parent_event_id` VARCHAR(40) DEFAULT NULL,
+  `cancelled` DATETIME DEFAULT NULL,
+  `organisation_id` VARCHAR(40) DEFAULT NULL,
+  `members_only` BOOLEAN NOT NULL DEFAULT FALSE,
+  `membership_organisation_id` VARCHAR(40) DEFAULT NULL,
+  `cost` VARCHAR(40) DEFAULT NULL,
+  `location_id` VARCHAR(40) DEFAULT NULL,
   UNIQUE KEY `events_id` (`id`),
+  KEY `events_parent` (`parent_event_id`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`membership_organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`location_id`) REFERENCES `locations`(`id`),
   UNIQUE KEY `events_name` (`name`)  
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
@@ -73,3 +170,674 @@ INSERT INTO `family_person` SET
     JOIN `persons` AS p ON f.person_id=p.id
     WHERE `p`.`nat_id`="7311185229089"),
   `person_id`=(SELECT `id` FROM `persons` WHERE `nat_id`="0602271356084");
+
+CREATE TABLE `volunteer_roles` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `description` VARCHAR(1000) NOT NULL DEFAULT '',
+  UNIQUE KEY `volunteer_roles_id` (`id`),
+  UNIQUE KEY `volunteer_roles_event_name` (`event_id`, `name`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `volunteer_shifts` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `role_id` VARCHAR(40) NOT NULL,
+  `location` VARCHAR(200) NOT NULL DEFAULT '',
+  `start_time` DATETIME NOT NULL,
+  `end_time` DATETIME NOT NULL,
+  `headcount` INT NOT NULL,
+  UNIQUE KEY `volunteer_shifts_id` (`id`),
+  KEY `volunteer_shifts_start` (`event_id`, `start_time`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`role_id`) REFERENCES `volunteer_roles`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `volunteer_signups` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `shift_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `signed_up` DATETIME NOT NULL,
+  `reminded` DATETIME DEFAULT NULL,
+  UNIQUE KEY `volunteer_signups_id` (`id`),
+  UNIQUE KEY `volunteer_signups_shift_person` (`shift_id`, `person_id`),
+  KEY `volunteer_signups_person` (`person_id`),
+  FOREIGN KEY (`shift_id`) REFERENCES `volunteer_shifts`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_organisers` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `role` VARCHAR(40) NOT NULL,
+  UNIQUE KEY `event_organisers_event_person` (`event_id`, `person_id`),
+  KEY `event_organisers_person` (`person_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_categories` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `team_size` INT NOT NULL DEFAULT 0,
+  `gender` VARCHAR(10) NOT NULL DEFAULT '',
+  `min_age` INT NOT NULL DEFAULT 0,
+  `max_age` INT NOT NULL DEFAULT 0,
+  UNIQUE KEY `event_categories_id` (`id`),
+  UNIQUE KEY `event_categories_event_name` (`event_id`, `name`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `entries` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `category_id` VARCHAR(40) DEFAULT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `created` DATETIME NOT NULL,
+  `bib` VARCHAR(20) DEFAULT NULL,
+  `team_name` VARCHAR(100) DEFAULT NULL,
+  `checked_in` DATETIME DEFAULT NULL,
+  `checked_in_by_person_id` VARCHAR(40) DEFAULT NULL,
+  `entered_person_id` VARCHAR(40) AS (IF(`status`='withdrawn', NULL, `person_id`)) PERSISTENT,
+  UNIQUE KEY `entries_id` (`id`),
+  UNIQUE KEY `entries_event_entered` (`event_id`, `entered_person_id`),
+  UNIQUE KEY `entries_event_bib` (`event_id`, `bib`),
+  KEY `entries_category` (`category_id`),
+  KEY `entries_person` (`person_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`category_id`) REFERENCES `event_categories`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_waitlist` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `added` DATETIME NOT NULL,
+  UNIQUE KEY `event_waitlist_person` (`event_id`, `person_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `announcements` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `target_type` VARCHAR(20) NOT NULL,
+  `target_id` VARCHAR(100) NOT NULL DEFAULT '',
+  `subject` VARCHAR(200) NOT NULL,
+  `content` TEXT NOT NULL,
+  `by_person_id` VARCHAR(40) NOT NULL,
+  `created` DATETIME NOT NULL,
+  UNIQUE KEY `announcements_id` (`id`),
+  KEY `announcements_event` (`event_id`, `created`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`by_person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `announcement_recipients` (
+  `announcement_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `channel` VARCHAR(10) NOT NULL,
+  `address` VARCHAR(200) NOT NULL,
+  `content` TEXT NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `error` VARCHAR(1000) NOT NULL DEFAULT '',
+  `sent` DATETIME DEFAULT NULL,
+  UNIQUE KEY `announcement_recipients_person` (`announcement_id`, `person_id`),
+  KEY `announcement_recipients_status` (`announcement_id`, `status`),
+  FOREIGN KEY (`announcement_id`) REFERENCES `announcements`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_form_fields` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `key` VARCHAR(40) NOT NULL,
+  `label` VARCHAR(200) NOT NULL,
+  `type` VARCHAR(20) NOT NULL,
+  `required` BOOLEAN NOT NULL DEFAULT FALSE,
+  `options` TEXT NOT NULL,
+  `condition` TEXT NOT NULL,
+  `position` INT NOT NULL,
+  UNIQUE KEY `event_form_fields_key` (`event_id`, `key`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `entry_answers` (
+  `entry_id` VARCHAR(40) NOT NULL,
+  `key` VARCHAR(40) NOT NULL,
+  `value` TEXT NOT NULL,
+  UNIQUE KEY `entry_answers_key` (`entry_id`, `key`),
+  FOREIGN KEY (`entry_id`) REFERENCES `entries`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_prices` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `description` VARCHAR(100) NOT NULL,
+  `category_id` VARCHAR(40) DEFAULT NULL,
+  `member` BOOLEAN DEFAULT NULL,
+  `valid_from` DATETIME DEFAULT NULL,
+  `valid_until` DATETIME DEFAULT NULL,
+  `fee_cents` INT NOT NULL,
+  `position` INT NOT NULL,
+  UNIQUE KEY `event_prices_id` (`id`),
+  KEY `event_prices_event` (`event_id`, `position`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`category_id`) REFERENCES `event_categories`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_family_discounts` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `min_entries` INT NOT NULL,
+  `percent_off` INT NOT NULL,
+  UNIQUE KEY `event_family_discounts_event` (`event_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `promo_codes` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `code` VARCHAR(40) NOT NULL,
+  `description` VARCHAR(100) NOT NULL DEFAULT '',
+  `kind` VARCHAR(10) NOT NULL,
+  `percent_off` INT NOT NULL DEFAULT 0,
+  `amount_off_cents` INT NOT NULL DEFAULT 0,
+  `category_id` VARCHAR(40) DEFAULT NULL,
+  `valid_from` DATETIME DEFAULT NULL,
+  `valid_until` DATETIME DEFAULT NULL,
+  `max_redemptions` INT NOT NULL DEFAULT 0,
+  `max_per_person` INT NOT NULL DEFAULT 0,
+  `stackable` BOOLEAN NOT NULL DEFAULT FALSE,
+  UNIQUE KEY `promo_codes_id` (`id`),
+  UNIQUE KEY `promo_codes_event_code` (`event_id`, `code`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`category_id`) REFERENCES `event_categories`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `promo_redemptions` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `promo_code_id` VARCHAR(40) NOT NULL,
+  `order_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `discount_cents` INT NOT NULL,
+  `redeemed` DATETIME NOT NULL,
+  UNIQUE KEY `promo_redemptions_id` (`id`),
+  KEY `promo_redemptions_code_person` (`promo_code_id`, `person_id`),
+  KEY `promo_redemptions_order` (`order_id`),
+  FOREIGN KEY (`promo_code_id`) REFERENCES `promo_codes`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `orders` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) DEFAULT NULL,
+  `organisation_id` VARCHAR(40) DEFAULT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `total_cents` INT NOT NULL,
+  `credit_cents` INT NOT NULL DEFAULT 0,
+  `provider` VARCHAR(20) NOT NULL,
+  `reference` VARCHAR(12) NOT NULL,
+  `bill_to_name` VARCHAR(200) NOT NULL DEFAULT '',
+  `bill_to_address` VARCHAR(400) NOT NULL DEFAULT '',
+  `bill_to_vat_number` VARCHAR(20) NOT NULL DEFAULT '',
+  `created` DATETIME NOT NULL,
+  `expires` DATETIME NOT NULL,
+  `paid` DATETIME DEFAULT NULL,
+  UNIQUE KEY `orders_id` (`id`),
+  UNIQUE KEY `orders_reference` (`reference`),
+  KEY `orders_status_expires` (`status`, `expires`),
+  KEY `orders_event` (`event_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `order_lines` (
+  `order_id` VARCHAR(40) NOT NULL,
+  `line` INT NOT NULL,
+  `entry_id` VARCHAR(40) NOT NULL,
+  `membership_id` VARCHAR(40) DEFAULT NULL,
+  `transfer_id` VARCHAR(40) DEFAULT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `description` VARCHAR(200) NOT NULL,
+  `amount_cents` INT NOT NULL,
+  `promo_code_id` VARCHAR(40) DEFAULT NULL,
+  UNIQUE KEY `order_lines_line` (`order_id`, `line`),
+  KEY `order_lines_entry` (`entry_id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `payments` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `order_id` VARCHAR(40) NOT NULL,
+  `provider` VARCHAR(20) NOT NULL,
+  `provider_ref` VARCHAR(100) NOT NULL,
+  `amount_cents` INT NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `note` VARCHAR(200) NOT NULL DEFAULT '',
+  `received` DATETIME NOT NULL,
+  `payload` TEXT NOT NULL,
+  UNIQUE KEY `payments_id` (`id`),
+  UNIQUE KEY `payments_provider_ref` (`provider`, `provider_ref`),
+  KEY `payments_order` (`order_id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `bank_statement_lines` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `organisation_id` VARCHAR(40) NOT NULL,
+  `hash` VARCHAR(100) NOT NULL,
+  `date` DATETIME NOT NULL,
+  `amount_cents` INT NOT NULL,
+  `description` VARCHAR(500) NOT NULL,
+  `reference` VARCHAR(12) NOT NULL DEFAULT '',
+  `order_id` VARCHAR(40) DEFAULT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `note` VARCHAR(200) NOT NULL DEFAULT '',
+  `imported` DATETIME NOT NULL,
+  UNIQUE KEY `bank_statement_lines_id` (`id`),
+  UNIQUE KEY `bank_statement_lines_hash` (`organisation_id`, `hash`),
+  KEY `bank_statement_lines_order` (`order_id`),
+  KEY `bank_statement_lines_status` (`organisation_id`, `status`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_refund_policies` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `admin_fee_cents` INT NOT NULL DEFAULT 0,
+  `method` VARCHAR(10) NOT NULL,
+  `cancelled_percent` INT NOT NULL DEFAULT 100,
+  PRIMARY KEY (`event_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_refund_rules` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `days_before` INT NOT NULL,
+  `percent` INT NOT NULL,
+  UNIQUE KEY `event_refund_rules_days` (`event_id`, `days_before`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `refunds` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `order_id` VARCHAR(40) NOT NULL,
+  `entry_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `reason` VARCHAR(20) NOT NULL,
+  `method` VARCHAR(10) NOT NULL,
+  `amount_cents` INT NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `note` VARCHAR(200) NOT NULL DEFAULT '',
+  `requested` DATETIME NOT NULL,
+  `decided_by` VARCHAR(40) DEFAULT NULL,
+  `decided` DATETIME DEFAULT NULL,
+  `refund_ref` VARCHAR(100) DEFAULT NULL,
+  `completed` DATETIME DEFAULT NULL,
+  UNIQUE KEY `refunds_id` (`id`),
+  KEY `refunds_event_status` (`event_id`, `status`),
+  KEY `refunds_order` (`order_id`),
+  KEY `refunds_entry` (`entry_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `credit_notes` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `refund_id` VARCHAR(40) NOT NULL,
+  `amount_cents` INT NOT NULL,
+  `balance_cents` INT NOT NULL,
+  `issued` DATETIME NOT NULL,
+  UNIQUE KEY `credit_notes_id` (`id`),
+  KEY `credit_notes_person` (`person_id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`),
+  FOREIGN KEY (`refund_id`) REFERENCES `refunds`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `credit_note_redemptions` (
+  `credit_note_id` VARCHAR(40) NOT NULL,
+  `order_id` VARCHAR(40) NOT NULL,
+  `amount_cents` INT NOT NULL,
+  `redeemed` DATETIME NOT NULL,
+  UNIQUE KEY `credit_note_redemptions_note_order` (`credit_note_id`, `order_id`),
+  KEY `credit_note_redemptions_order` (`order_id`),
+  FOREIGN KEY (`credit_note_id`) REFERENCES `credit_notes`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `invoices` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `organisation_id` VARCHAR(40) NOT NULL,
+  `order_id` VARCHAR(40) NOT NULL,
+  `number` VARCHAR(20) NOT NULL,
+  `issued` DATETIME NOT NULL,
+  `bill_to_name` VARCHAR(200) NOT NULL,
+  `bill_to_address` VARCHAR(400) NOT NULL DEFAULT '',
+  `bill_to_vat_number` VARCHAR(20) NOT NULL DEFAULT '',
+  `bill_to_email` VARCHAR(200) NOT NULL DEFAULT '',
+  `total_cents` INT NOT NULL,
+  `vat_percent` INT NOT NULL,
+  `vat_cents` INT NOT NULL,
+  UNIQUE KEY `invoices_id` (`id`),
+  UNIQUE KEY `invoices_order` (`order_id`),
+  UNIQUE KEY `invoices_number` (`organisation_id`, `number`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `ledger_transactions` (
+  `id` VARCHAR(40) NOT NULL,
+  `event_id` VARCHAR(40) DEFAULT NULL,
+  `organisation_id` VARCHAR(40) DEFAULT NULL,
+  `kind` VARCHAR(20) NOT NULL,
+  `reference` VARCHAR(100) NOT NULL,
+  `description` VARCHAR(200) NOT NULL,
+  `created` DATETIME NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `ledger_transactions_reference` (`kind`, `reference`),
+  KEY `ledger_transactions_event` (`event_id`),
+  KEY `ledger_transactions_organisation` (`organisation_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `ledger_entries` (
+  `seq` BIGINT NOT NULL AUTO_INCREMENT,
+  `transaction_id` VARCHAR(40) NOT NULL,
+  `account` VARCHAR(40) NOT NULL,
+  `event_id` VARCHAR(40) DEFAULT NULL,
+  `organisation_id` VARCHAR(40) DEFAULT NULL,
+  `amount_cents` INT NOT NULL,
+  PRIMARY KEY (`seq`),
+  KEY `ledger_entries_event_account` (`event_id`, `account`),
+  KEY `ledger_entries_organisation_account` (`organisation_id`, `account`),
+  FOREIGN KEY (`transaction_id`) REFERENCES `ledger_transactions`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+-- the ledger is append-only, corrections are new transactions
+CREATE TRIGGER `ledger_transactions_no_update` BEFORE UPDATE ON `ledger_transactions` FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT='ledger is append-only';
+CREATE TRIGGER `ledger_transactions_no_delete` BEFORE DELETE ON `ledger_transactions` FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT='ledger is append-only';
+CREATE TRIGGER `ledger_entries_no_update` BEFORE UPDATE ON `ledger_entries` FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT='ledger is append-only';
+CREATE TRIGGER `ledger_entries_no_delete` BEFORE DELETE ON `ledger_entries` FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT='ledger is append-only';
+
+CREATE TABLE `event_courses` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `name` VARCHAR(200) NOT NULL DEFAULT '',
+  `format` VARCHAR(10) NOT NULL,
+  `distance_m` INT NOT NULL,
+  `elevation_gain_m` INT NOT NULL,
+  `elevation_loss_m` INT NOT NULL,
+  `points` MEDIUMTEXT NOT NULL,
+  UNIQUE KEY `event_courses_id` (`id`),
+  UNIQUE KEY `event_courses_event` (`event_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_course_checkpoints` (
+  `course_id` VARCHAR(40) NOT NULL,
+  `seq` INT NOT NULL,
+  `name` VARCHAR(200) NOT NULL DEFAULT '',
+  `lat` DOUBLE NOT NULL,
+  `lon` DOUBLE NOT NULL,
+  `distance_m` INT NOT NULL,
+  UNIQUE KEY `event_course_checkpoints_seq` (`course_id`,`seq`),
+  FOREIGN KEY (`course_id`) REFERENCES `event_courses`(`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `documents` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `name` VARCHAR(200) NOT NULL,
+  `revision` INT NOT NULL,
+  `timestamp` DATETIME NOT NULL,
+  `loaded_by_person_id` VARCHAR(40) NOT NULL,
+  `content_id` VARCHAR(64) NOT NULL,
+  `content_type` VARCHAR(200) NOT NULL,
+  `filename` VARCHAR(200) NOT NULL DEFAULT '',
+  `size` BIGINT NOT NULL,
+  UNIQUE KEY `documents_id` (`id`),
+  UNIQUE KEY `documents_revision` (`name`,`revision`),
+  KEY `documents_content` (`content_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_attachments` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `document_id` VARCHAR(40) NOT NULL,
+  `document_name` VARCHAR(200) NOT NULL,
+  `title` VARCHAR(200) NOT NULL,
+  `visibility` VARCHAR(20) NOT NULL,
+  `attached` DATETIME NOT NULL,
+  `attached_by_person_id` VARCHAR(40) NOT NULL,
+  UNIQUE KEY `event_attachments_id` (`id`),
+  UNIQUE KEY `event_attachments_document` (`event_id`,`document_name`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`document_id`) REFERENCES `documents`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_waivers` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `document_id` VARCHAR(40) NOT NULL,
+  `document_name` VARCHAR(200) NOT NULL,
+  `title` VARCHAR(200) NOT NULL,
+  `created` DATETIME NOT NULL,
+  `created_by_person_id` VARCHAR(40) NOT NULL,
+  UNIQUE KEY `event_waivers_id` (`id`),
+  UNIQUE KEY `event_waivers_document` (`event_id`,`document_name`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`document_id`) REFERENCES `documents`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `waiver_acceptances` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `document_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `accepted_by_person_id` VARCHAR(40) NOT NULL,
+  `capacity` VARCHAR(20) NOT NULL,
+  `accepted` DATETIME NOT NULL,
+  `ip` VARCHAR(45) NOT NULL,
+  UNIQUE KEY `waiver_acceptances_id` (`id`),
+  UNIQUE KEY `waiver_acceptances_person` (`event_id`,`document_id`,`person_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`document_id`) REFERENCES `documents`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`),
+  FOREIGN KEY (`accepted_by_person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `photos` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `document_id` VARCHAR(40) NOT NULL,
+  `web_document_id` VARCHAR(40) DEFAULT NULL,
+  `thumb_document_id` VARCHAR(40) DEFAULT NULL,
+  `width` INT NOT NULL,
+  `height` INT NOT NULL,
+  `caption` VARCHAR(200) NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `moderation` VARCHAR(20) NOT NULL,
+  `uploaded` DATETIME NOT NULL,
+  `uploaded_by_person_id` VARCHAR(40) NOT NULL,
+  `claimed` DATETIME DEFAULT NULL,
+  `error` VARCHAR(200) NOT NULL,
+  UNIQUE KEY `photos_id` (`id`),
+  KEY `photos_event` (`event_id`, `uploaded`),
+  KEY `photos_status` (`status`, `uploaded`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`document_id`) REFERENCES `documents`(`id`),
+  FOREIGN KEY (`web_document_id`) REFERENCES `documents`(`id`),
+  FOREIGN KEY (`thumb_document_id`) REFERENCES `documents`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `photo_tags` (
+  `photo_id` VARCHAR(40) NOT NULL,
+  `bib` VARCHAR(20) NOT NULL,
+  UNIQUE KEY `photo_tags_photo_bib` (`photo_id`, `bib`),
+  KEY `photo_tags_bib` (`bib`),
+  FOREIGN KEY (`photo_id`) REFERENCES `photos`(`id`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `organisation_members` (
+  `organisation_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `role` VARCHAR(20) NOT NULL,
+  UNIQUE KEY `organisation_members_organisation_person` (`organisation_id`, `person_id`),
+  KEY `organisation_members_person` (`person_id`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `membership_types` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `organisation_id` VARCHAR(40) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `description` VARCHAR(400) NOT NULL DEFAULT '',
+  `valid_months` INT NOT NULL,
+  `season_start_month` INT NOT NULL DEFAULT 0,
+  `fee_cents` INT NOT NULL,
+  `active` BOOLEAN NOT NULL DEFAULT TRUE,
+  UNIQUE KEY `membership_types_id` (`id`),
+  UNIQUE KEY `membership_types_name` (`organisation_id`, `name`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `memberships` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `organisation_id` VARCHAR(40) NOT NULL,
+  `type_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `number` VARCHAR(40) NOT NULL DEFAULT '',
+  `status` VARCHAR(20) NOT NULL,
+  `valid_from` DATE NOT NULL,
+  `valid_until` DATE NOT NULL,
+  `source` VARCHAR(20) NOT NULL,
+  `order_id` VARCHAR(40) DEFAULT NULL,
+  `created` DATETIME NOT NULL,
+  UNIQUE KEY `memberships_id` (`id`),
+  UNIQUE KEY `memberships_period` (`organisation_id`, `person_id`, `valid_from`),
+  KEY `memberships_person` (`person_id`, `valid_until`),
+  KEY `memberships_order` (`order_id`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`type_id`) REFERENCES `membership_types`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `entry_members` (
+  `entry_id` VARCHAR(40) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `position` INT NOT NULL,
+  `captain` BOOLEAN NOT NULL DEFAULT FALSE,
+  `status` VARCHAR(20) NOT NULL,
+  `responded` DATETIME DEFAULT NULL,
+  `entered_person_id` VARCHAR(40) AS (IF(`status` IN ('declined','withdrawn'), NULL, `person_id`)) PERSISTENT,
+  UNIQUE KEY `entry_members_entry_person` (`entry_id`, `person_id`),
+  UNIQUE KEY `entry_members_event_entered` (`event_id`, `entered_person_id`),
+  KEY `entry_members_person` (`person_id`),
+  FOREIGN KEY (`entry_id`) REFERENCES `entries`(`id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `entry_results` (
+  `entry_id` VARCHAR(40) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `elapsed_ms` BIGINT DEFAULT NULL,
+  `recorded` DATETIME NOT NULL,
+  `recorded_by_person_id` VARCHAR(40) NOT NULL,
+  UNIQUE KEY `entry_results_entry` (`entry_id`),
+  KEY `entry_results_event` (`event_id`),
+  FOREIGN KEY (`entry_id`) REFERENCES `entries`(`id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_transfer_policies` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `allowed` BOOLEAN NOT NULL DEFAULT FALSE,
+  `deadline` DATETIME DEFAULT NULL,
+  `fee_cents` INT NOT NULL DEFAULT 0,
+  UNIQUE KEY `event_transfer_policies_event` (`event_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `entry_transfers` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `entry_id` VARCHAR(40) NOT NULL,
+  `from_person_id` VARCHAR(40) NOT NULL,
+  `to_person_id` VARCHAR(40) NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `note` VARCHAR(400) NOT NULL DEFAULT '',
+  `fee_cents` INT NOT NULL DEFAULT 0,
+  `order_id` VARCHAR(40) DEFAULT NULL,
+  `answers` TEXT NOT NULL,
+  `problem` VARCHAR(400) NOT NULL DEFAULT '',
+  `requested` DATETIME NOT NULL,
+  `responded` DATETIME DEFAULT NULL,
+  `completed` DATETIME DEFAULT NULL,
+  UNIQUE KEY `entry_transfers_id` (`id`),
+  KEY `entry_transfers_entry` (`entry_id`),
+  KEY `entry_transfers_event` (`event_id`, `status`),
+  KEY `entry_transfers_from` (`from_person_id`),
+  KEY `entry_transfers_to` (`to_person_id`),
+  KEY `entry_transfers_order` (`order_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`entry_id`) REFERENCES `entries`(`id`),
+  FOREIGN KEY (`from_person_id`) REFERENCES `persons`(`id`),
+  FOREIGN KEY (`to_person_id`) REFERENCES `persons`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `event_reminders` (
+  `kind` VARCHAR(20) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `sent` DATETIME NOT NULL,
+  UNIQUE KEY `event_reminders_kind_event_person` (`kind`, `event_id`, `person_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `jobs` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `name` VARCHAR(100) DEFAULT NULL,
+  `kind` VARCHAR(40) NOT NULL,
+  `args` TEXT DEFAULT NULL,
+  `schedule` VARCHAR(100) DEFAULT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `next_run` DATETIME NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `last_run` DATETIME DEFAULT NULL,
+  `last_error` VARCHAR(400) NOT NULL DEFAULT '',
+  `lease_owner` VARCHAR(40) DEFAULT NULL,
+  `lease_until` DATETIME DEFAULT NULL,
+  `created` DATETIME NOT NULL,
+  UNIQUE KEY `jobs_id` (`id`),
+  UNIQUE KEY `jobs_name` (`name`),
+  KEY `jobs_due` (`status`, `next_run`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+INSERT INTO `jobs` SET `name`='expire_orders',`kind`='expire_orders',`schedule`='* * * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+INSERT INTO `jobs` SET `name`='volunteer_reminders',`kind`='volunteer_reminders',`schedule`='*/15 * * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+INSERT INTO `jobs` SET `name`='entries_closing_reminders',`kind`='entries_closing_reminders',`schedule`='*/15 * * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+INSERT INTO `jobs` SET `name`='event_reminders',`kind`='event_reminders',`schedule`='0 * * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+INSERT INTO `jobs` SET `name`='purge_tokens',`kind`='purge_tokens',`schedule`='30 3 * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+
+-- migrations that ran, new databases need none of them
+CREATE TABLE `migrations` (
+  `name` VARCHAR(100) NOT NULL,
+  `applied` DATETIME NOT NULL,
+  UNIQUE KEY `migrations_name` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+INSERT INTO `migrations` SET `name`='utc_times',`applied`=UTC_TIMESTAMP();
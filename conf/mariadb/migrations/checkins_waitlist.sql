@@ -0,0 +1,17 @@
+-- Records when entrants arrive on the day and who waits for a place in an
+-- event, both counted on the organiser dashboard.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/checkins_waitlist.sql
+
+ALTER TABLE `entries` ADD COLUMN IF NOT EXISTS `checked_in` DATETIME DEFAULT NULL AFTER `team_name`;
+ALTER TABLE `entries` ADD COLUMN IF NOT EXISTS `checked_in_by_person_id` VARCHAR(40) DEFAULT NULL AFTER `checked_in`;
+
+CREATE TABLE IF NOT EXISTS `event_waitlist` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `added` DATETIME NOT NULL,
+  UNIQUE KEY `event_waitlist_person` (`event_id`, `person_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
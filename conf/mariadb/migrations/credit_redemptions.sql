@@ -0,0 +1,18 @@
+-- Lets the payer spend open credit notes at checkout, recording what was paid
+-- with each credit note on the order.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/credit_redemptions.sql
+
+ALTER TABLE `orders` ADD COLUMN IF NOT EXISTS `credit_cents` INT NOT NULL DEFAULT 0 AFTER `total_cents`;
+
+CREATE TABLE IF NOT EXISTS `credit_note_redemptions` (
+  `credit_note_id` VARCHAR(40) NOT NULL,
+  `order_id` VARCHAR(40) NOT NULL,
+  `amount_cents` INT NOT NULL,
+  `redeemed` DATETIME NOT NULL,
+  UNIQUE KEY `credit_note_redemptions_note_order` (`credit_note_id`, `order_id`),
+  KEY `credit_note_redemptions_order` (`order_id`),
+  FOREIGN KEY (`credit_note_id`) REFERENCES `credit_notes`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
@@ -0,0 +1,21 @@
+-- Scopes imported bank statement lines to the organisation whose statement
+-- they are on.
+--
+-- Lines of an order get the organisation of the order or its event. Lines
+-- without an order cannot be assigned and keep organisation_id NULL, so they
+-- are no longer listed for review: resolve them before running this.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/eft_organisations.sql
+
+ALTER TABLE `bank_statement_lines` ADD COLUMN IF NOT EXISTS `organisation_id` VARCHAR(40) DEFAULT NULL AFTER `id`;
+
+UPDATE `bank_statement_lines` l JOIN `orders` o ON o.`id`=l.`order_id` LEFT JOIN `events` e ON e.`id`=o.`event_id`
+  SET l.`organisation_id`=COALESCE(o.`organisation_id`,e.`organisation_id`)
+  WHERE l.`organisation_id` IS NULL;
+
+ALTER TABLE `bank_statement_lines` DROP INDEX IF EXISTS `bank_statement_lines_hash`;
+ALTER TABLE `bank_statement_lines` ADD UNIQUE KEY `bank_statement_lines_hash` (`organisation_id`, `hash`);
+ALTER TABLE `bank_statement_lines` DROP INDEX IF EXISTS `bank_statement_lines_status`;
+ALTER TABLE `bank_statement_lines` ADD KEY `bank_statement_lines_status` (`organisation_id`, `status`);
+ALTER TABLE `bank_statement_lines` ADD FOREIGN KEY IF NOT EXISTS (`organisation_id`) REFERENCES `organisations`(`id`);
@@ -0,0 +1,46 @@
+-- Adds the job scheduler with its recurring jobs, reminders of events and
+-- when entries close.
+--
+-- The jobs replace the loops that expired orders and sent volunteer
+-- reminders in each instance. Events have no closing time for entries until
+-- the organisers set one.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/jobs.sql
+
+ALTER TABLE `events` ADD COLUMN IF NOT EXISTS `entries_close` DATETIME DEFAULT NULL AFTER `end_time`;
+
+CREATE TABLE IF NOT EXISTS `event_reminders` (
+  `kind` VARCHAR(20) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `sent` DATETIME NOT NULL,
+  UNIQUE KEY `event_reminders_kind_event_person` (`kind`, `event_id`, `person_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE IF NOT EXISTS `jobs` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `name` VARCHAR(100) DEFAULT NULL,
+  `kind` VARCHAR(40) NOT NULL,
+  `args` TEXT DEFAULT NULL,
+  `schedule` VARCHAR(100) DEFAULT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `next_run` DATETIME NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `last_run` DATETIME DEFAULT NULL,
+  `last_error` VARCHAR(400) NOT NULL DEFAULT '',
+  `lease_owner` VARCHAR(40) DEFAULT NULL,
+  `lease_until` DATETIME DEFAULT NULL,
+  `created` DATETIME NOT NULL,
+  UNIQUE KEY `jobs_id` (`id`),
+  UNIQUE KEY `jobs_name` (`name`),
+  KEY `jobs_due` (`status`, `next_run`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+INSERT IGNORE INTO `jobs` SET `name`='expire_orders',`kind`='expire_orders',`schedule`='* * * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+INSERT IGNORE INTO `jobs` SET `name`='volunteer_reminders',`kind`='volunteer_reminders',`schedule`='*/15 * * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+INSERT IGNORE INTO `jobs` SET `name`='entries_closing_reminders',`kind`='entries_closing_reminders',`schedule`='*/15 * * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+INSERT IGNORE INTO `jobs` SET `name`='event_reminders',`kind`='event_reminders',`schedule`='0 * * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
+INSERT IGNORE INTO `jobs` SET `name`='purge_tokens',`kind`='purge_tokens',`schedule`='30 3 * * *',`status`='scheduled',`next_run`=UTC_TIMESTAMP(),`created`=UTC_TIMESTAMP();
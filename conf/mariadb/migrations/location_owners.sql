@@ -0,0 +1,8 @@
+-- Records who added each location, the only person who can change, delete
+-- or merge it. Locations added before have no owner and can only be changed
+-- after setting added_by_person_id by hand.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/location_owners.sql
+
+ALTER TABLE `locations` ADD COLUMN IF NOT EXISTS `added_by_person_id` VARCHAR(40) DEFAULT NULL AFTER `time_zone`;
@@ -0,0 +1,60 @@
+-- Adds club memberships with their types, member-only events and orders
+-- and ledger postings that belong to an organisation instead of an event,
+-- as used for membership fees.
+--
+-- Existing orders and ledger postings keep their event.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/memberships.sql
+
+ALTER TABLE `events` ADD COLUMN IF NOT EXISTS `members_only` BOOLEAN NOT NULL DEFAULT FALSE AFTER `organisation_id`;
+ALTER TABLE `events` ADD COLUMN IF NOT EXISTS `membership_organisation_id` VARCHAR(40) DEFAULT NULL AFTER `members_only`;
+ALTER TABLE `events` ADD FOREIGN KEY IF NOT EXISTS `events_membership_organisation` (`membership_organisation_id`) REFERENCES `organisations`(`id`);
+
+ALTER TABLE `orders` MODIFY COLUMN `event_id` VARCHAR(40) DEFAULT NULL;
+ALTER TABLE `orders` ADD COLUMN IF NOT EXISTS `organisation_id` VARCHAR(40) DEFAULT NULL AFTER `event_id`;
+ALTER TABLE `orders` ADD FOREIGN KEY IF NOT EXISTS `orders_organisation` (`organisation_id`) REFERENCES `organisations`(`id`);
+ALTER TABLE `order_lines` ADD COLUMN IF NOT EXISTS `membership_id` VARCHAR(40) DEFAULT NULL AFTER `entry_id`;
+
+ALTER TABLE `ledger_transactions` MODIFY COLUMN `event_id` VARCHAR(40) DEFAULT NULL;
+ALTER TABLE `ledger_transactions` ADD COLUMN IF NOT EXISTS `organisation_id` VARCHAR(40) DEFAULT NULL AFTER `event_id`;
+ALTER TABLE `ledger_transactions` ADD KEY IF NOT EXISTS `ledger_transactions_organisation` (`organisation_id`);
+ALTER TABLE `ledger_entries` MODIFY COLUMN `event_id` VARCHAR(40) DEFAULT NULL;
+ALTER TABLE `ledger_entries` ADD COLUMN IF NOT EXISTS `organisation_id` VARCHAR(40) DEFAULT NULL AFTER `event_id`;
+ALTER TABLE `ledger_entries` ADD KEY IF NOT EXISTS `ledger_entries_organisation_account` (`organisation_id`, `account`);
+
+CREATE TABLE IF NOT EXISTS `membership_types` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `organisation_id` VARCHAR(40) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `description` VARCHAR(400) NOT NULL DEFAULT '',
+  `valid_months` INT NOT NULL,
+  `season_start_month` INT NOT NULL DEFAULT 0,
+  `fee_cents` INT NOT NULL,
+  `active` BOOLEAN NOT NULL DEFAULT TRUE,
+  UNIQUE KEY `membership_types_id` (`id`),
+  UNIQUE KEY `membership_types_name` (`organisation_id`, `name`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE IF NOT EXISTS `memberships` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `organisation_id` VARCHAR(40) NOT NULL,
+  `type_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `number` VARCHAR(40) NOT NULL DEFAULT '',
+  `status` VARCHAR(20) NOT NULL,
+  `valid_from` DATE NOT NULL,
+  `valid_until` DATE NOT NULL,
+  `source` VARCHAR(20) NOT NULL,
+  `order_id` VARCHAR(40) DEFAULT NULL,
+  `created` DATETIME NOT NULL,
+  UNIQUE KEY `memberships_id` (`id`),
+  UNIQUE KEY `memberships_period` (`organisation_id`, `person_id`, `valid_from`),
+  KEY `memberships_person` (`person_id`, `valid_until`),
+  KEY `memberships_order` (`order_id`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`type_id`) REFERENCES `membership_types`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
@@ -0,0 +1,28 @@
+-- Adds members to organisations and their branding and contact profile.
+--
+-- Organisations made before had no members. The organisers of the events
+-- they own become their admins, so someone can manage each organisation.
+-- Events without an organisation keep their own organisers.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/organisation_members.sql
+
+ALTER TABLE `organisations` ADD COLUMN IF NOT EXISTS `phone` VARCHAR(40) NOT NULL DEFAULT '' AFTER `email`;
+ALTER TABLE `organisations` ADD COLUMN IF NOT EXISTS `website` VARCHAR(200) NOT NULL DEFAULT '' AFTER `phone`;
+ALTER TABLE `organisations` ADD COLUMN IF NOT EXISTS `logo_document_id` VARCHAR(40) DEFAULT NULL AFTER `website`;
+ALTER TABLE `organisations` ADD COLUMN IF NOT EXISTS `brand_colour` VARCHAR(7) NOT NULL DEFAULT '' AFTER `logo_document_id`;
+
+CREATE TABLE IF NOT EXISTS `organisation_members` (
+  `organisation_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `role` VARCHAR(20) NOT NULL,
+  UNIQUE KEY `organisation_members_organisation_person` (`organisation_id`, `person_id`),
+  KEY `organisation_members_person` (`person_id`),
+  FOREIGN KEY (`organisation_id`) REFERENCES `organisations`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+INSERT IGNORE INTO `organisation_members` (`organisation_id`, `person_id`, `role`)
+  SELECT DISTINCT e.`organisation_id`, o.`person_id`, 'admin'
+  FROM `events` e JOIN `event_organisers` o ON o.`event_id`=e.`id`
+  WHERE e.`organisation_id` IS NOT NULL;
@@ -0,0 +1,16 @@
+-- Lets withdrawn entrants and members who declined or whose entry was
+-- withdrawn enter the event again. A person is still only entered once in
+-- entries that are not withdrawn and places that are not declined.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/team_reentry.sql
+
+UPDATE `entry_members` SET `status`='withdrawn' WHERE `entry_id` IN (SELECT `id` FROM `entries` WHERE `status`='withdrawn');
+
+ALTER TABLE `entries` ADD COLUMN IF NOT EXISTS `entered_person_id` VARCHAR(40) AS (IF(`status`='withdrawn', NULL, `person_id`)) PERSISTENT AFTER `team_name`;
+ALTER TABLE `entries` DROP INDEX IF EXISTS `entries_event_person`;
+ALTER TABLE `entries` ADD UNIQUE KEY IF NOT EXISTS `entries_event_entered` (`event_id`, `entered_person_id`);
+
+ALTER TABLE `entry_members` ADD COLUMN IF NOT EXISTS `entered_person_id` VARCHAR(40) AS (IF(`status` IN ('declined','withdrawn'), NULL, `person_id`)) PERSISTENT AFTER `responded`;
+ALTER TABLE `entry_members` DROP INDEX IF EXISTS `entry_members_event_person`;
+ALTER TABLE `entry_members` ADD UNIQUE KEY IF NOT EXISTS `entry_members_event_entered` (`event_id`, `entered_person_id`);
@@ -0,0 +1,42 @@
+-- Adds team categories with gender and age limits, crew entries with their
+-- members and results per entry.
+--
+-- Existing categories become individual categories for any gender and age.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/teams.sql
+
+ALTER TABLE `event_categories` ADD COLUMN IF NOT EXISTS `team_size` INT NOT NULL DEFAULT 0 AFTER `name`;
+ALTER TABLE `event_categories` ADD COLUMN IF NOT EXISTS `gender` VARCHAR(10) NOT NULL DEFAULT '' AFTER `team_size`;
+ALTER TABLE `event_categories` ADD COLUMN IF NOT EXISTS `min_age` INT NOT NULL DEFAULT 0 AFTER `gender`;
+ALTER TABLE `event_categories` ADD COLUMN IF NOT EXISTS `max_age` INT NOT NULL DEFAULT 0 AFTER `min_age`;
+ALTER TABLE `entries` ADD COLUMN IF NOT EXISTS `team_name` VARCHAR(100) DEFAULT NULL AFTER `bib`;
+
+CREATE TABLE IF NOT EXISTS `entry_members` (
+  `entry_id` VARCHAR(40) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `position` INT NOT NULL,
+  `captain` BOOLEAN NOT NULL DEFAULT FALSE,
+  `status` VARCHAR(20) NOT NULL,
+  `responded` DATETIME DEFAULT NULL,
+  UNIQUE KEY `entry_members_entry_person` (`entry_id`, `person_id`),
+  UNIQUE KEY `entry_members_event_person` (`event_id`, `person_id`),
+  KEY `entry_members_person` (`person_id`),
+  FOREIGN KEY (`entry_id`) REFERENCES `entries`(`id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`person_id`) REFERENCES `persons`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE IF NOT EXISTS `entry_results` (
+  `entry_id` VARCHAR(40) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `elapsed_ms` BIGINT DEFAULT NULL,
+  `recorded` DATETIME NOT NULL,
+  `recorded_by_person_id` VARCHAR(40) NOT NULL,
+  UNIQUE KEY `entry_results_entry` (`entry_id`),
+  KEY `entry_results_event` (`event_id`),
+  FOREIGN KEY (`entry_id`) REFERENCES `entries`(`id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
@@ -0,0 +1,47 @@
+-- Adds entry transfers with a transfer policy per event and order lines for
+-- transfer fees.
+--
+-- Events have no policy until the organisers set one, so no transfers are
+-- allowed before that.
+--
+-- Run it only once, e.g.
+--   mariadb events < conf/mariadb/migrations/transfers.sql
+
+ALTER TABLE `order_lines` ADD COLUMN IF NOT EXISTS `transfer_id` VARCHAR(40) DEFAULT NULL AFTER `membership_id`;
+
+CREATE TABLE IF NOT EXISTS `event_transfer_policies` (
+  `event_id` VARCHAR(40) NOT NULL,
+  `allowed` BOOLEAN NOT NULL DEFAULT FALSE,
+  `deadline` DATETIME DEFAULT NULL,
+  `fee_cents` INT NOT NULL DEFAULT 0,
+  UNIQUE KEY `event_transfer_policies_event` (`event_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE IF NOT EXISTS `entry_transfers` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `event_id` VARCHAR(40) NOT NULL,
+  `entry_id` VARCHAR(40) NOT NULL,
+  `from_person_id` VARCHAR(40) NOT NULL,
+  `to_person_id` VARCHAR(40) NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `note` VARCHAR(400) NOT NULL DEFAULT '',
+  `fee_cents` INT NOT NULL DEFAULT 0,
+  `order_id` VARCHAR(40) DEFAULT NULL,
+  `answers` TEXT NOT NULL,
+  `problem` VARCHAR(400) NOT NULL DEFAULT '',
+  `requested` DATETIME NOT NULL,
+  `responded` DATETIME DEFAULT NULL,
+  `completed` DATETIME DEFAULT NULL,
+  UNIQUE KEY `entry_transfers_id` (`id`),
+  KEY `entry_transfers_entry` (`entry_id`),
+  KEY `entry_transfers_event` (`event_id`, `status`),
+  KEY `entry_transfers_from` (`from_person_id`),
+  KEY `entry_transfers_to` (`to_person_id`),
+  KEY `entry_transfers_order` (`order_id`),
+  FOREIGN KEY (`event_id`) REFERENCES `events`(`id`),
+  FOREIGN KEY (`entry_id`) REFERENCES `entries`(`id`),
+  FOREIGN KEY (`from_person_id`) REFERENCES `persons`(`id`),
+  FOREIGN KEY (`to_person_id`) REFERENCES `persons`(`id`),
+  FOREIGN KEY (`order_id`) REFERENCES `orders`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
@@ -0,0 +1,90 @@
+-- Converts DATETIME values written before times were stored in UTC.
+--
+-- Until then times were written in the local time of the server, except
+-- persons.tpx which the driver already wrote in UTC, and
+-- bank_statement_lines.date which is a date at midnight, not an instant.
+-- Set @legacy_tz to the zone the server ran in. Named zones need the zone
+-- tables (mariadb-tzinfo-to-sql), an offset such as '+02:00' does not, but
+-- is only correct for zones without daylight saving time.
+--
+-- Stop the server while this runs, e.g.
+--   mariadb events < conf/mariadb/migrations/utc_times.sql
+-- It records itself in `migrations` and refuses to run again. The times are
+-- converted in one transaction, so after an error nothing is converted and
+-- it can be run again.
+
+SET @legacy_tz = '+02:00';
+SET time_zone = '+00:00';
+
+-- columns added with time zones
+ALTER TABLE `locations` ADD COLUMN IF NOT EXISTS `time_zone` VARCHAR(64) NOT NULL DEFAULT '' AFTER `directions`;
+ALTER TABLE `events` ADD COLUMN IF NOT EXISTS `time_zone` VARCHAR(64) DEFAULT NULL AFTER `date`;
+ALTER TABLE `events` ADD COLUMN IF NOT EXISTS `start_time` DATETIME DEFAULT NULL AFTER `time_zone`;
+ALTER TABLE `events` ADD COLUMN IF NOT EXISTS `end_time` DATETIME DEFAULT NULL AFTER `start_time`;
+
+CREATE TABLE IF NOT EXISTS `migrations` (
+  `name` VARCHAR(100) NOT NULL,
+  `applied` DATETIME NOT NULL,
+  UNIQUE KEY `migrations_name` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+DELIMITER //
+
+-- stop before changing anything when it already ran
+BEGIN NOT ATOMIC
+  IF EXISTS (SELECT 1 FROM `migrations` WHERE `name`='utc_times') THEN
+    SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT='utc_times already ran';
+  END IF;
+END//
+
+-- the ledger is append-only, allow this one correction by this session only.
+-- The trigger is replaced, never dropped, so other sessions cannot update.
+SET @utc_times_converting=1, @utc_times_error=NULL//
+CREATE OR REPLACE TRIGGER `ledger_transactions_no_update` BEFORE UPDATE ON `ledger_transactions` FOR EACH ROW
+  IF @utc_times_converting IS NULL THEN
+    SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT='ledger is append-only';
+  END IF//
+
+-- on an error the transaction is rolled back and the trigger still restored
+BEGIN NOT ATOMIC
+  DECLARE EXIT HANDLER FOR SQLEXCEPTION
+  BEGIN
+    GET DIAGNOSTICS CONDITION 1 @utc_times_error=MESSAGE_TEXT;
+    ROLLBACK;
+  END;
+  START TRANSACTION;
+  INSERT INTO `migrations` SET `name`='utc_times',`applied`=UTC_TIMESTAMP();
+  UPDATE `events` SET `cancelled`=CONVERT_TZ(`cancelled`,@legacy_tz,'+00:00');
+  UPDATE `volunteer_shifts` SET `start_time`=CONVERT_TZ(`start_time`,@legacy_tz,'+00:00'),`end_time`=CONVERT_TZ(`end_time`,@legacy_tz,'+00:00');
+  UPDATE `volunteer_signups` SET `signed_up`=CONVERT_TZ(`signed_up`,@legacy_tz,'+00:00'),`reminded`=CONVERT_TZ(`reminded`,@legacy_tz,'+00:00');
+  UPDATE `entries` SET `created`=CONVERT_TZ(`created`,@legacy_tz,'+00:00');
+  UPDATE `announcements` SET `created`=CONVERT_TZ(`created`,@legacy_tz,'+00:00');
+  UPDATE `announcement_recipients` SET `sent`=CONVERT_TZ(`sent`,@legacy_tz,'+00:00');
+  UPDATE `event_prices` SET `valid_from`=CONVERT_TZ(`valid_from`,@legacy_tz,'+00:00'),`valid_until`=CONVERT_TZ(`valid_until`,@legacy_tz,'+00:00');
+  UPDATE `promo_codes` SET `valid_from`=CONVERT_TZ(`valid_from`,@legacy_tz,'+00:00'),`valid_until`=CONVERT_TZ(`valid_until`,@legacy_tz,'+00:00');
+  UPDATE `promo_redemptions` SET `redeemed`=CONVERT_TZ(`redeemed`,@legacy_tz,'+00:00');
+  UPDATE `orders` SET `created`=CONVERT_TZ(`created`,@legacy_tz,'+00:00'),`expires`=CONVERT_TZ(`expires`,@legacy_tz,'+00:00'),`paid`=CONVERT_TZ(`paid`,@legacy_tz,'+00:00');
+  UPDATE `payments` SET `received`=CONVERT_TZ(`received`,@legacy_tz,'+00:00');
+  UPDATE `bank_statement_lines` SET `imported`=CONVERT_TZ(`imported`,@legacy_tz,'+00:00');
+  UPDATE `refunds` SET `requested`=CONVERT_TZ(`requested`,@legacy_tz,'+00:00'),`decided`=CONVERT_TZ(`decided`,@legacy_tz,'+00:00'),`completed`=CONVERT_TZ(`completed`,@legacy_tz,'+00:00');
+  UPDATE `credit_notes` SET `issued`=CONVERT_TZ(`issued`,@legacy_tz,'+00:00');
+  UPDATE `invoices` SET `issued`=CONVERT_TZ(`issued`,@legacy_tz,'+00:00');
+  UPDATE `ledger_transactions` SET `created`=CONVERT_TZ(`created`,@legacy_tz,'+00:00');
+  UPDATE `documents` SET `timestamp`=CONVERT_TZ(`timestamp`,@legacy_tz,'+00:00');
+  UPDATE `event_attachments` SET `attached`=CONVERT_TZ(`attached`,@legacy_tz,'+00:00');
+  UPDATE `event_waivers` SET `created`=CONVERT_TZ(`created`,@legacy_tz,'+00:00');
+  UPDATE `waiver_acceptances` SET `accepted`=CONVERT_TZ(`accepted`,@legacy_tz,'+00:00');
+  UPDATE `photos` SET `uploaded`=CONVERT_TZ(`uploaded`,@legacy_tz,'+00:00'),`claimed`=CONVERT_TZ(`claimed`,@legacy_tz,'+00:00');
+  COMMIT;
+END//
+
+SET @utc_times_converting=NULL//
+CREATE OR REPLACE TRIGGER `ledger_transactions_no_update` BEFORE UPDATE ON `ledger_transactions` FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT='ledger is append-only'//
+
+BEGIN NOT ATOMIC
+  IF @utc_times_error IS NOT NULL THEN
+    SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT=@utc_times_error;
+  END IF;
+END//
+
+DELIMITER ;
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+//postEventCourse sets the course of an event from a GPX or KML file sent as
+//the request body or as multipart form file "route", with URL param
+//by_person_id for the organiser
+func postEventCourse(httpRes http.ResponseWriter, httpReq *http.Request) {
+	httpReq.Body = http.MaxBytesReader(httpRes, httpReq.Body, 20<<20)
+	var r io.Reader = httpReq.Body
+	if f, _, err := httpReq.FormFile("route"); err == nil {
+		defer f.Close()
+		r = f
+	}
+	course, err := db.ParseRoute(r)
+	if err != nil {
+		http.Error(httpRes, fmt.Sprintf("invalid route: %+s", err), http.StatusBadRequest)
+		return
+	}
+	course, err = db.SetEventCourse(mux.Vars(httpReq)["id"], httpReq.URL.Query().Get("by_person_id"), *course)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to set course: %+s", err), code)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(course)
+}
+
+func getEventCourse(ctx context.Context) (*db.Course, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	course, err := db.GetEventCourse(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	if course == nil {
+		return nil, errors.Errorc(http.StatusNotFound, "event has no course")
+	}
+	return course, nil
+}
+
+func getEventCourseGeoJSON(ctx context.Context) (*db.GeoJSON, error) {
+	course, err := getEventCourse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	g := course.GeoJSON()
+	return &g, nil
+}
+
+//postDeleteEventCourse expects URL param by_person_id
+func postDeleteEventCourse(ctx context.Context) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.DeleteEventCourse(params["id"], params["by_person_id"])
+}
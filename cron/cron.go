@@ -0,0 +1,150 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Schedule is a parsed cron expression with the five fields minute, hour,
+//day of month, month and day of week, e.g. "*/15 * * * *" or "30 3 * * 1-5".
+//Fields may be *, a value, a range a-b, lists a,b and steps */n or a-b/n.
+//Days of week are 0-6 from Sunday, and 7 is also Sunday.
+type Schedule struct {
+	expr    string
+	minutes uint64
+	hours   uint64
+	days    uint64
+	months  uint64
+	weekday uint64
+	anyDay  bool //day of month is *
+	anyWeek bool //day of week is *
+}
+
+//macros are the supported shorthands
+var macros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+//Parse parses a cron expression or one of @hourly, @daily, @weekly and
+//@monthly
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	fields := strings.Fields(expr)
+	if m, ok := macros[expr]; ok {
+		fields = strings.Fields(m)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule \"%s\", expecting minute hour day month weekday", expr)
+	}
+	s := Schedule{expr: expr, anyDay: fields[2] == "*", anyWeek: fields[4] == "*"}
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minutes, 0, 59},
+		{&s.hours, 0, 23},
+		{&s.days, 1, 31},
+		{&s.months, 1, 12},
+		{&s.weekday, 0, 7},
+	} {
+		bits, err := parseField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule \"%s\": %v", expr, err)
+		}
+		*f.bits = bits
+	}
+	if s.weekday&(1<<7) != 0 {
+		s.weekday |= 1
+	}
+	return &s, nil
+} //Parse()
+
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in \"%s\"", part)
+			}
+			rangePart, step = part[:i], n
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value \"%s\"", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value \"%s\"", part)
+				}
+			} else if step > 1 {
+				to = max //e.g. 5/10 is 5,15,25...
+			}
+			if from < min || to > max || from > to {
+				return 0, fmt.Errorf("\"%s\" not in %d-%d", part, min, max)
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+} //parseField()
+
+func (s Schedule) String() string {
+	return s.expr
+}
+
+//Next returns the first time after t that matches the schedule, in the
+//location of t. It returns the zero time when nothing matches within five
+//years, e.g. for 30 February.
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+} //Schedule.Next()
+
+//matchDay applies the cron rule that when both day of month and day of week
+//are restricted, either may match
+func (s Schedule) matchDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	week := s.weekday&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDay && s.anyWeek:
+		return true
+	case s.anyDay:
+		return week
+	case s.anyWeek:
+		return day
+	}
+	return day || week
+}
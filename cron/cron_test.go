@@ -0,0 +1,62 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/events/cron"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2022, 6, 24, 10, 7, 30, 0, time.UTC) //a Friday
+	for _, test := range []struct {
+		expr string
+		next string
+	}{
+		{"* * * * *", "2022-06-24 10:08"},
+		{"*/15 * * * *", "2022-06-24 10:15"},
+		{"5/20 * * * *", "2022-06-24 10:25"},
+		{"0 * * * *", "2022-06-24 11:00"},
+		{"@hourly", "2022-06-24 11:00"},
+		{"30 3 * * *", "2022-06-25 03:30"},
+		{"0 9 * * 1-5", "2022-06-27 09:00"},
+		{"0 0 * * 7", "2022-06-26 00:00"},
+		{"0 0 1 * *", "2022-07-01 00:00"},
+		{"0 12 1,15 * *", "2022-07-01 12:00"},
+		{"0 0 13 * 5", "2022-07-01 00:00"}, //day 13 or any Friday
+		{"0 0 29 2 *", "2024-02-29 00:00"},
+	} {
+		s, err := cron.Parse(test.expr)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %+v", test.expr, err)
+		}
+		if next := s.Next(from).Format("2006-01-02 15:04"); next != test.next {
+			t.Fatalf("%s next %s instead of %s", test.expr, next, test.next)
+		}
+	}
+}
+
+func TestNextInLocation(t *testing.T) {
+	loc := time.FixedZone("SAST", 2*60*60)
+	s, _ := cron.Parse("@daily")
+	next := s.Next(time.Date(2022, 6, 24, 23, 0, 0, 0, time.UTC))
+	if next.Format(time.RFC3339) != "2022-06-25T00:00:00Z" {
+		t.Fatalf("next %s", next)
+	}
+	next = s.Next(time.Date(2022, 6, 24, 23, 0, 0, 0, time.UTC).In(loc))
+	if next.Format(time.RFC3339) != "2022-06-26T00:00:00+02:00" {
+		t.Fatalf("next %s", next)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@yearly", "0 0 30 2 *x"} {
+		if _, err := cron.Parse(expr); err == nil {
+			t.Fatalf("accepted %q", expr)
+		}
+	}
+	s, _ := cron.Parse("0 0 30 2 *")
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Fatalf("30 Feb next %s", next)
+	}
+}
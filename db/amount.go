@@ -1,103 +1,409 @@
 package db
 
 import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/go-msvc/errors"
 )
 
+//Amount is money in the minor units of its currency, e.g. cents for rand.
+//An amount without currency takes the currency of amounts it is added to.
 type Amount struct {
 	Currency *Currency
 	Cents    int
 }
 
+//String shows the amount with its symbol, e.g. "R350" or "R45.65", and
+//without grouping so it is also easy to read back with Parse
 func (a Amount) String() string {
+	c := a.currency()
+	abs := a.Cents
+	if abs < 0 {
+		abs = -abs
+	}
+	s := strconv.Itoa(abs / c.unit())
+	if c.MinorUnits > 0 && (abs < c.unit() || abs%c.unit() != 0) {
+		s += "." + fmt.Sprintf("%0*d", c.MinorUnits, abs%c.unit())
+	}
+	return a.withSymbol(s)
+}
+
+//Format shows the amount with all minor digits and the separators of the
+//locale, e.g. "R1 234,50" for en-ZA or "R1,234.50" for en
+func (a Amount) Format(l Locale) string {
+	c := a.currency()
+	abs := a.Cents
+	if abs < 0 {
+		abs = -abs
+	}
+	whole := strconv.Itoa(abs / c.unit())
 	s := ""
-	if a.Cents < 100 || a.Cents%100 != 0 {
-		s = fmt.Sprintf("%d.%02d", a.Cents/100, a.Cents%100)
-	} else {
-		s = fmt.Sprintf("%d", a.Cents/100)
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			s += l.Group
+		}
+		s += string(d)
+	}
+	if c.MinorUnits > 0 {
+		s += l.Decimal + fmt.Sprintf("%0*d", c.MinorUnits, abs%c.unit())
+	}
+	return a.withSymbol(s)
+}
+
+//withSymbol adds the sign and currency to the formatted absolute value
+func (a Amount) withSymbol(s string) string {
+	sign := ""
+	if a.Cents < 0 {
+		sign = "-"
+	}
+	switch {
+	case a.Currency == nil:
+		return sign + s
+	case a.Currency.Symbol == "":
+		return sign + a.Currency.Code + " " + s
+	case a.Currency.Prefix:
+		return sign + a.Currency.Symbol + s
+	default:
+		return sign + s + " " + a.Currency.Symbol
+	}
+}
+
+//decimal is the amount as a plain number with all minor digits, e.g. "-12.50"
+func (a Amount) decimal() string {
+	c := a.currency()
+	s := ""
+	abs := a.Cents
+	if abs < 0 {
+		s, abs = "-", -abs
+	}
+	s += strconv.Itoa(abs / c.unit())
+	if c.MinorUnits > 0 {
+		s += "." + fmt.Sprintf("%0*d", c.MinorUnits, abs%c.unit())
+	}
+	return s
+}
+
+//Number is the amount in major units, e.g. 12.5 for spreadsheets
+func (a Amount) Number() float64 {
+	return float64(a.Cents) / float64(a.currency().unit())
+}
+
+//currency is the currency of the amount, or the default when not set
+func (a Amount) currency() *Currency {
+	if a.Currency == nil {
+		return DefaultCurrency
 	}
+	return a.Currency
+}
+
+//Add returns the sum of two amounts in the same currency
+func (a Amount) Add(b Amount) Amount {
+	return Amount{Currency: a.sameCurrency(b), Cents: a.Cents + b.Cents}
+}
+
+//Sub returns the difference of two amounts in the same currency
+func (a Amount) Sub(b Amount) Amount {
+	return Amount{Currency: a.sameCurrency(b), Cents: a.Cents - b.Cents}
+}
+
+//Neg returns the amount with the opposite sign, e.g. for a discount or refund
+func (a Amount) Neg() Amount {
+	return Amount{Currency: a.Currency, Cents: -a.Cents}
+}
+
+//Percent returns p percent of the amount, rounded half away from zero to a whole cent
+func (a Amount) Percent(p int) Amount {
+	c := a.Cents * p
+	if c < 0 {
+		return Amount{Currency: a.Currency, Cents: -((-c + 50) / 100)}
+	}
+	return Amount{Currency: a.Currency, Cents: (c + 50) / 100}
+}
+
+//sameCurrency returns the currency of both amounts, where an amount without
+//currency takes the currency of the other. Mixing currencies is a bug.
+func (a Amount) sameCurrency(b Amount) *Currency {
 	if a.Currency == nil {
-		return s
+		return b.Currency
 	}
-	if a.Currency.Prefix {
-		return a.Currency.Symbol + s
+	if b.Currency != nil && b.Currency != a.Currency {
+		panic(fmt.Sprintf("cannot mix currencies %s and %s", a.Currency.Code, b.Currency.Code))
 	}
-	return s + a.Currency.Symbol
+	return a.Currency
 }
 
+//ParseAmount parses an amount, see Amount.Parse
+func ParseAmount(s string) (Amount, error) {
+	var a Amount
+	err := a.Parse(s)
+	return a, err
+}
+
+//Parse accepts amounts like "R10.5", "-R1,234.50", "(R100)", "ZAR 100",
+//"100 EUR" or "1 234,50". Without a locale a separator is taken as the
+//decimal point when it is the last of both kinds or appears only once, except
+//for a single comma followed by three digits, so "1,234" is 1234, "1,23" is
+//1.23 and "1.234" is an error in rand. Use ParseLocale when the separators
+//are known. An amount without currency
+//keeps a nil currency and is parsed with the minor units of the default.
 func (a *Amount) Parse(s string) error {
-	s = strings.TrimSpace(s)
-	if len(s) == 0 {
+	return a.parse(s, nil)
+}
+
+//ParseLocale parses an amount written with the separators of the locale
+func (a *Amount) ParseLocale(s string, l Locale) error {
+	return a.parse(s, &l)
+}
+
+func (a *Amount) parse(s string, l *Locale) error {
+	v := strings.TrimSpace(s)
+	if v == "" {
 		a.Cents = 0
 		a.Currency = nil
 		return nil
 	}
+	negative := false
+	if strings.HasPrefix(v, "(") && strings.HasSuffix(v, ")") {
+		v = strings.TrimSpace(v[1 : len(v)-1])
+		negative = true
+	}
+	v, negative = amountSign(v, negative)
+
+	//currency code or symbol before or after the value
 	var currency *Currency
-	var valueStr string
-	for _, c := range CurrencyBySymbol {
-		if c.Prefix && strings.HasPrefix(s, c.Symbol) {
-			currency = c
-			valueStr = s[len(c.Symbol):]
-			break
-		}
-		if !c.Prefix && strings.HasSuffix(s, c.Symbol) {
-			currency = c
-			valueStr = s[0 : len(s)-len(c.Symbol)]
-			break
+	if len(v) >= 3 {
+		if c, ok := CurrencyByCode[strings.ToUpper(v[:3])]; ok && !startsWithLetter(v[3:]) {
+			currency, v = c, v[3:]
+		} else if c, ok := CurrencyByCode[strings.ToUpper(v[len(v)-3:])]; ok && !endsWithLetter(v[:len(v)-3]) {
+			currency, v = c, v[:len(v)-3]
 		}
 	}
-	if valueStr == "" && currency != nil {
-		return errors.Errorf("invalid amount \"%s\" with currency symbol and no value", s)
-	}
-	//value Str must now be XXX for full currency or X.XX for cents
-	l := len(valueStr)
-	if l >= 4 && valueStr[l-2] == '.' {
-		//with cents
-		if i64, err := strconv.ParseInt(valueStr[0:l-3]+valueStr[l-2:], 10, 64); err != nil {
-			return errors.Errorf("invalid amount \"%s\" expected X.XX", s)
-		} else {
-			a.Cents = int(i64)
-		}
-	} else {
-		//full currency, no cents
-		if i64, err := strconv.ParseInt(valueStr, 10, 64); err != nil {
-			return errors.Errorf("invalid amount \"%s\" expected integer value", s)
-		} else {
-			a.Cents = int(i64) * 100
+	if currency == nil {
+		for _, symbol := range currencySymbols {
+			if strings.HasPrefix(v, symbol) {
+				currency, v = CurrencyBySymbol[symbol], v[len(symbol):]
+				break
+			}
+			if strings.HasSuffix(v, symbol) {
+				currency, v = CurrencyBySymbol[symbol], v[:len(v)-len(symbol)]
+				break
+			}
 		}
 	}
+	v, negative = amountSign(strings.TrimSpace(v), negative)
+	if v == "" {
+		return errors.Errorf("invalid amount \"%s\" without a value", s)
+	}
+
+	minorUnits := DefaultCurrency.MinorUnits
+	if currency != nil {
+		minorUnits = currency.MinorUnits
+	}
+	whole, frac, err := splitAmount(v, l, minorUnits)
+	if err != nil {
+		return errors.Wrapf(err, "invalid amount \"%s\"", s)
+	}
+	if len(frac) > minorUnits {
+		return errors.Errorf("invalid amount \"%s\" with more than %d decimals", s, minorUnits)
+	}
+	frac += strings.Repeat("0", minorUnits-len(frac))
+	i64, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return errors.Errorf("invalid amount \"%s\"", s)
+	}
+	a.Cents = int(i64)
+	if negative {
+		a.Cents = -a.Cents
+	}
+	a.Currency = currency
 	return nil
+} //Amount.parse()
+
+//amountSign removes a leading sign and returns the new sign
+func amountSign(v string, negative bool) (string, bool) {
+	if strings.HasPrefix(v, "-") {
+		return strings.TrimSpace(v[1:]), !negative
+	}
+	if strings.HasPrefix(v, "+") {
+		return strings.TrimSpace(v[1:]), negative
+	}
+	return v, negative
 }
 
-type Currency struct {
-	Name   string //e.g. "South African Rand"
-	Symbol string //e.g. "R"
-	Prefix bool   //true then Rxxx, false then xxx$
+func startsWithLetter(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsLetter(r)
 }
 
-var (
-	DefaultCurrency  *Currency
-	CurrencyBySymbol = map[string]*Currency{}
-)
+func endsWithLetter(s string) bool {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return unicode.IsLetter(r)
+}
+
+//splitAmount returns the digits before and after the decimal point
+func splitAmount(v string, l *Locale, minorUnits int) (string, string, error) {
+	v = strings.NewReplacer(" ", "", "\u00a0", "", "\u202f", "", "'", "").Replace(v)
+	decimal, group := "", ""
+	if l != nil {
+		decimal, group = l.Decimal, strings.TrimSpace(l.Group)
+	} else {
+		lastDot, lastComma := strings.LastIndex(v, "."), strings.LastIndex(v, ",")
+		switch {
+		case lastDot >= 0 && lastComma >= 0:
+			if lastDot > lastComma {
+				decimal, group = ".", ","
+			} else {
+				decimal, group = ",", "."
+			}
+		case lastDot >= 0 || lastComma >= 0:
+			sep, i := ".", lastDot
+			if lastComma >= 0 {
+				sep, i = ",", lastComma
+			}
+			if strings.Count(v, sep) > 1 || (sep == "," && i > 0 && len(v)-i-1 == 3 && minorUnits < 3) {
+				group = sep
+			} else {
+				decimal = sep
+			}
+		}
+	}
+	whole, frac := v, ""
+	if decimal != "" {
+		if i := strings.LastIndex(v, decimal); i >= 0 {
+			whole, frac = v[:i], v[i+len(decimal):]
+		}
+	}
+	if group != "" {
+		parts := strings.Split(whole, group)
+		for i, part := range parts {
+			if part == "" || (i > 0 && len(part) != 3) {
+				return "", "", errors.Errorf("invalid digit grouping")
+			}
+		}
+		whole = strings.Join(parts, "")
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	for _, part := range []string{whole, frac} {
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return "", "", errors.Errorf("unexpected '%c'", r)
+			}
+		}
+	}
+	return whole, frac, nil
+} //splitAmount()
+
+//Value stores the amount with its currency code, e.g. "ZAR 12.50"
+func (a Amount) Value() (driver.Value, error) {
+	if a.Currency == nil {
+		return a.decimal(), nil
+	}
+	return a.Currency.Code + " " + a.decimal(), nil
+}
 
-func AddCurrency(c Currency) {
-	if _, ok := CurrencyBySymbol[c.Symbol]; ok {
-		panic(fmt.Sprintf("duplicate currency: %+v", c))
+//Scan reads an amount stored by Value, or a whole nr of minor units in the
+//default currency from an integer column
+func (a *Amount) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*a = Amount{}
+		return nil
+	case []byte:
+		return a.Parse(string(v))
+	case string:
+		return a.Parse(v)
+	case int64:
+		*a = Amount{Currency: DefaultCurrency, Cents: int(v)}
+		return nil
+	case float64:
+		*a = Amount{Currency: DefaultCurrency, Cents: int(math.Round(v * float64(DefaultCurrency.unit())))}
+		return nil
 	}
-	CurrencyBySymbol[c.Symbol] = &c
-	if DefaultCurrency == nil {
-		DefaultCurrency = &c
+	return errors.Errorf("cannot scan %T into an amount", value)
+}
+
+//MarshalJSON writes the amount as a string with its code, e.g. "ZAR 12.50"
+func (a Amount) MarshalJSON() ([]byte, error) {
+	s, _ := a.Value()
+	return json.Marshal(s)
+}
+
+//UnmarshalJSON accepts anything Parse accepts, a number in major units,
+//null, or {"currency":"ZAR","cents":1250}
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*a = Amount{}
+		return nil
+	case bytes.HasPrefix(data, []byte("\"")):
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		return a.Parse(s)
+	case bytes.HasPrefix(data, []byte("{")):
+		var v struct {
+			Currency string `json:"currency"`
+			Cents    int    `json:"cents"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return errors.Wrapf(err, "invalid amount")
+		}
+		*a = Amount{Cents: v.Cents}
+		if v.Currency != "" {
+			if a.Currency = CurrencyByCode[strings.ToUpper(v.Currency)]; a.Currency == nil {
+				return errors.Errorf("unknown currency \"%s\"", v.Currency)
+			}
+		}
+		return nil
 	}
+	return a.Parse(string(data))
+} //Amount.UnmarshalJSON()
+
+//Locale is how amounts are written in a language or country
+type Locale struct {
+	Decimal string
+	Group   string
 }
 
-func init() {
-	AddCurrency(Currency{
-		Name:   "South African Rand",
-		Symbol: "R",
-		Prefix: true,
-	})
+var locales = map[string]Locale{
+	"en":    {Decimal: ".", Group: ","},
+	"en-ZA": {Decimal: ",", Group: "\u00a0"},
+	"af":    {Decimal: ",", Group: "\u00a0"},
+	"de":    {Decimal: ",", Group: "."},
+	"de-CH": {Decimal: ".", Group: "'"},
+	"fr":    {Decimal: ",", Group: "\u202f"},
+	"nl":    {Decimal: ",", Group: "."},
+	"pt":    {Decimal: ",", Group: "."},
+	"es":    {Decimal: ",", Group: "."},
+	"it":    {Decimal: ",", Group: "."},
+}
+
+//GetLocale returns the locale for a tag like "en-ZA", falling back to the
+//language and then to English
+func GetLocale(tag string) Locale {
+	tag = strings.ReplaceAll(tag, "_", "-")
+	if l, ok := locales[tag]; ok {
+		return l
+	}
+	if i := strings.Index(tag, "-"); i > 0 {
+		if l, ok := locales[strings.ToLower(tag[:i])]; ok {
+			return l
+		}
+	}
+	if l, ok := locales[strings.ToLower(tag)]; ok {
+		return l
+	}
+	return locales["en"]
 }
@@ -0,0 +1,209 @@
+package db_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestAmountParse(t *testing.T) {
+	zar := db.CurrencyByCode["ZAR"]
+	tests := []struct {
+		s        string
+		currency *db.Currency
+		cents    int
+		err      bool
+	}{
+		{s: "", cents: 0},
+		{s: "100", cents: 10000},
+		{s: "R100", currency: zar, cents: 10000},
+		{s: "R10.5", currency: zar, cents: 1050},
+		{s: "R 10.50", currency: zar, cents: 1050},
+		{s: "-R10.50", currency: zar, cents: -1050},
+		{s: "R-10.50", currency: zar, cents: -1050},
+		{s: "(R10.50)", currency: zar, cents: -1050},
+		{s: "R1,234.50", currency: zar, cents: 123450},
+		{s: "R1 234,50", currency: zar, cents: 123450},
+		{s: "R1 234,50", currency: zar, cents: 123450},
+		{s: "1.234.567,89", cents: 123456789},
+		{s: "1,234", cents: 123400},
+		{s: "1,23", cents: 123},
+		{s: "1.234", err: true},
+		{s: "ZAR 100", currency: zar, cents: 10000},
+		{s: "zar100", currency: zar, cents: 10000},
+		{s: "100 ZAR", currency: zar, cents: 10000},
+		{s: "N$50", currency: db.CurrencyByCode["NAD"], cents: 5000},
+		{s: "$5.99", currency: db.CurrencyByCode["USD"], cents: 599},
+		{s: "€3,50", currency: db.CurrencyByCode["EUR"], cents: 350},
+		{s: "JPY 1,000", currency: db.CurrencyByCode["JPY"], cents: 1000},
+		{s: "¥1000", currency: db.CurrencyByCode["JPY"], cents: 1000},
+		{s: "KWD 1.250", currency: db.CurrencyByCode["KWD"], cents: 1250},
+		{s: "CHF 1'000.05", currency: db.CurrencyByCode["CHF"], cents: 100005},
+		{s: "12 zł", currency: db.CurrencyByCode["PLN"], cents: 1200},
+		{s: "R", err: true},
+		{s: "R10.555", err: true},
+		{s: "JPY 1.5", err: true},
+		{s: "R1,2,3", err: true},
+		{s: "ten", err: true},
+		{s: "ZARR 10", err: true},
+	}
+	for _, test := range tests {
+		a, err := db.ParseAmount(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: parsed %+v instead of error", test.s, a)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %+v", test.s, err)
+			continue
+		}
+		if a.Cents != test.cents || a.Currency != test.currency {
+			t.Errorf("%q: got %d %+v, expected %d %+v", test.s, a.Cents, a.Currency, test.cents, test.currency)
+		}
+	}
+}
+
+func TestAmountParseLocale(t *testing.T) {
+	tests := []struct {
+		s      string
+		locale string
+		cents  int
+	}{
+		{s: "1.234", locale: "de", cents: 123400},
+		{s: "1.234,5", locale: "de-DE", cents: 123450},
+		{s: "1,5", locale: "en-ZA", cents: 150},
+		{s: "R1 234,50", locale: "af-ZA", cents: 123450},
+		{s: "1,234", locale: "en_US", cents: 123400},
+	}
+	for _, test := range tests {
+		var a db.Amount
+		if err := a.ParseLocale(test.s, db.GetLocale(test.locale)); err != nil {
+			t.Errorf("%q %s: %+v", test.s, test.locale, err)
+		} else if a.Cents != test.cents {
+			t.Errorf("%q %s: got %d expected %d", test.s, test.locale, a.Cents, test.cents)
+		}
+	}
+	var a db.Amount
+	if err := a.ParseLocale("1.5", db.GetLocale("de")); err == nil {
+		t.Errorf("parsed 1.5 in de as %d", a.Cents)
+	}
+}
+
+func TestAmountFormat(t *testing.T) {
+	amount := func(code string, cents int) db.Amount {
+		return db.Amount{Currency: db.CurrencyByCode[code], Cents: cents}
+	}
+	tests := []struct {
+		a      db.Amount
+		locale string
+		str    string
+		format string
+	}{
+		{a: amount("ZAR", 35000), locale: "en", str: "R350", format: "R350.00"},
+		{a: amount("ZAR", 4565), locale: "en", str: "R45.65", format: "R45.65"},
+		{a: amount("ZAR", 50), locale: "en", str: "R0.50", format: "R0.50"},
+		{a: amount("ZAR", -4565), locale: "en", str: "-R45.65", format: "-R45.65"},
+		{a: amount("ZAR", -5), locale: "en", str: "-R0.05", format: "-R0.05"},
+		{a: amount("ZAR", 123456789), locale: "en-ZA", str: "R1234567.89", format: "R1 234 567,89"},
+		{a: amount("EUR", 123450), locale: "de", str: "€1234.50", format: "€1.234,50"},
+		{a: amount("JPY", 1000), locale: "en", str: "¥1000", format: "¥1,000"},
+		{a: amount("KWD", 1250), locale: "en", str: "KWD 1.250", format: "KWD 1.250"},
+		{a: amount("PLN", 1200), locale: "en", str: "12 zł", format: "12.00 zł"},
+		{a: db.Amount{Cents: 100}, locale: "en", str: "1", format: "1.00"},
+	}
+	for _, test := range tests {
+		if s := test.a.String(); s != test.str {
+			t.Errorf("%+v: String() = %q expected %q", test.a, s, test.str)
+		}
+		if s := test.a.Format(db.GetLocale(test.locale)); s != test.format {
+			t.Errorf("%+v: Format(%s) = %q expected %q", test.a, test.locale, s, test.format)
+		}
+		//what we show must read back the same
+		if a, err := db.ParseAmount(test.a.String()); err != nil || a.Cents != test.a.Cents || a.Currency != test.a.Currency {
+			t.Errorf("%+v: String() %q parsed as %+v, %+v", test.a, test.a.String(), a, err)
+		}
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	type doc struct {
+		Cost db.Amount `json:"cost"`
+	}
+	for _, a := range []db.Amount{
+		{Currency: db.DefaultCurrency, Cents: 25000},
+		{Currency: db.DefaultCurrency, Cents: -1},
+		{Currency: db.CurrencyByCode["JPY"], Cents: 1000},
+		{Currency: db.CurrencyByCode["KWD"], Cents: 1},
+		{Cents: 1050},
+	} {
+		data, err := json.Marshal(doc{Cost: a})
+		if err != nil {
+			t.Fatalf("%+v: %+v", a, err)
+		}
+		var parsed doc
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			t.Fatalf("%s: %+v", data, err)
+		}
+		if parsed.Cost != a {
+			t.Errorf("%+v: %s parsed as %+v", a, data, parsed.Cost)
+		}
+	}
+	if data, _ := json.Marshal(doc{Cost: db.Amount{Currency: db.DefaultCurrency, Cents: 25000}}); string(data) != `{"cost":"ZAR 250.00"}` {
+		t.Errorf("marshalled %s", data)
+	}
+
+	tests := map[string]db.Amount{
+		`{"cost":"R10.5"}`: {Currency: db.DefaultCurrency, Cents: 1050},
+		`{"cost":12.5}`:    {Cents: 1250},
+		`{"cost":null}`:    {},
+		`{"cost":{"currency":"usd","cents":199}}`: {Currency: db.CurrencyByCode["USD"], Cents: 199},
+		`{"cost":{"Cents":500}}`:                  {Cents: 500},
+	}
+	for s, expected := range tests {
+		var parsed doc
+		if err := json.Unmarshal([]byte(s), &parsed); err != nil {
+			t.Errorf("%s: %+v", s, err)
+		} else if parsed.Cost != expected {
+			t.Errorf("%s: parsed %+v expected %+v", s, parsed.Cost, expected)
+		}
+	}
+	for _, s := range []string{`{"cost":"R1.234"}`, `{"cost":{"currency":"XYZ","cents":1}}`, `{"cost":true}`} {
+		var parsed doc
+		if err := json.Unmarshal([]byte(s), &parsed); err == nil {
+			t.Errorf("%s: parsed %+v instead of error", s, parsed.Cost)
+		}
+	}
+}
+
+func TestAmountSQL(t *testing.T) {
+	for _, a := range []db.Amount{
+		{Currency: db.DefaultCurrency, Cents: 1250},
+		{Currency: db.CurrencyByCode["EUR"], Cents: -99},
+		{Currency: db.CurrencyByCode["JPY"], Cents: 5000},
+	} {
+		v, err := a.Value()
+		if err != nil {
+			t.Fatalf("%+v: %+v", a, err)
+		}
+		var scanned db.Amount
+		if err := scanned.Scan([]byte(v.(string))); err != nil {
+			t.Fatalf("%+v: %+v", v, err)
+		}
+		if scanned != a {
+			t.Errorf("%+v stored as %v scanned as %+v", a, v, scanned)
+		}
+	}
+	if v, _ := (db.Amount{Currency: db.DefaultCurrency, Cents: 1250}).Value(); v != "ZAR 12.50" {
+		t.Errorf("stored as %v", v)
+	}
+	var a db.Amount
+	if err := a.Scan(nil); err != nil || a != (db.Amount{}) {
+		t.Errorf("scanned NULL as %+v, %+v", a, err)
+	}
+	if err := a.Scan(int64(350)); err != nil || a != (db.Amount{Currency: db.DefaultCurrency, Cents: 350}) {
+		t.Errorf("scanned 350 as %+v, %+v", a, err)
+	}
+}
@@ -0,0 +1,410 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/email"
+)
+
+//Announcement is a message from the organisers, e.g. "course changed" or
+//"start delayed", sent to everybody in the target group of an event
+type Announcement struct {
+	ID           string  `json:"id" db:"id"`
+	EventID      string  `json:"event_id" db:"event_id"`
+	TargetType   string  `json:"target_type" db:"target_type"`
+	TargetID     string  `json:"target_id" db:"target_id"`
+	Subject      string  `json:"subject" db:"subject"`
+	Content      string  `json:"content" db:"content" doc:"HTML template rendered for each recipient"`
+	ByPersonID   string  `json:"by_person_id" db:"by_person_id"`
+	Created      SqlTime `json:"created" db:"created"`
+	NrRecipients int     `json:"nr_recipients" db:"nr_recipients"`
+	NrSent       int     `json:"nr_sent" db:"nr_sent"`
+	NrFailed     int     `json:"nr_failed" db:"nr_failed" doc:"Unreachable, failed, or not sent yet after an error"`
+}
+
+const (
+	AnnounceToEvent    = "event"     //all entrants and organisers of the event and its sub-events
+	AnnounceToSubEvent = "sub_event" //entrants and organisers of one sub-event, target_id is the sub-event id
+	AnnounceToCategory = "category"  //entrants in one category, target_id is the category id
+	AnnounceToRole     = "role"      //organisers and volunteers in a role, target_id is the role name
+)
+
+//AnnouncementRecipient records the delivery of an announcement to one person
+type AnnouncementRecipient struct {
+	AnnouncementID string   `json:"announcement_id" db:"announcement_id"`
+	PersonID       string   `json:"person_id" db:"person_id"`
+	FirstName      string   `json:"first_name" db:"first_name"`
+	LastName       string   `json:"last_name" db:"last_name"`
+	Channel        string   `json:"channel" db:"channel" doc:"email|sms|none"`
+	Address        string   `json:"address" db:"address" doc:"Email address or phone nr used for delivery"`
+	Content        string   `json:"-" db:"content"`
+	Status         string   `json:"status" db:"status"`
+	Error          string   `json:"error,omitempty" db:"error"`
+	Sent           *SqlTime `json:"sent,omitempty" db:"sent"`
+}
+
+const (
+	DeliveryPending     = "pending" //also after a failed attempt, with the error, until sent
+	DeliverySent        = "sent"
+	DeliveryFailed      = "failed"      //still not sent when the delivery job gave up
+	DeliveryUnreachable = "unreachable" //person has no address for any supported channel
+)
+
+//announcementSenders delivers rendered announcements on each channel
+//todo: add "sms" when we have an SMS gateway
+var announcementSenders = map[string]func(r AnnouncementRecipient, subject string) error{
+	"email": sendAnnouncementEmail,
+}
+
+type NewAnnouncementRequest struct {
+	TargetType string `json:"target_type" doc:"event|sub_event|category|role"`
+	TargetID   string `json:"target_id" doc:"Not used for target_type event"`
+	Subject    string `json:"subject"`
+	Content    string `json:"content" doc:"HTML that may refer to {{.FirstName}}, {{.LastName}} and {{.EventName}}"`
+	ByPersonID string `json:"by_person_id"`
+}
+
+func (req *NewAnnouncementRequest) Validate() error {
+	switch req.TargetType {
+	case AnnounceToEvent:
+		req.TargetID = ""
+	case AnnounceToSubEvent, AnnounceToCategory, AnnounceToRole:
+		if req.TargetID == "" {
+			return errors.Errorf("missing target_id for target_type %s", req.TargetType)
+		}
+	default:
+		return errors.Errorf("invalid target_type \"%s\", expecting event|sub_event|category|role", req.TargetType)
+	}
+	req.Subject = strings.TrimSpace(req.Subject)
+	if req.Subject == "" {
+		return errors.Errorf("missing subject")
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		return errors.Errorf("missing content")
+	}
+	if _, err := template.New("content").Parse(req.Content); err != nil {
+		return errors.Errorf("invalid content template: %s", err)
+	}
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	return nil
+}
+
+//AddAnnouncement stores the announcement with a rendered message for each
+//recipient in the target group, and schedules a job to deliver it.
+func AddAnnouncement(eventID string, req NewAnnouncementRequest) (*Announcement, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	var event EventSummary
+	if err := NamedGet(&event,
+		"SELECT `id`,`name`,`date` FROM `events` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": eventID,
+		}); err != nil {
+		return nil, errors.Errorc(http.StatusNotFound, "unknown event")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return nil, err
+	}
+
+	recipients, err := announcementRecipients(eventID, req.TargetType, req.TargetID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get recipients")
+	}
+	if len(recipients) == 0 {
+		return nil, errors.Errorf("no recipients in %s %s", req.TargetType, req.TargetID)
+	}
+
+	a := Announcement{
+		ID:           uuid.New().String(),
+		EventID:      eventID,
+		TargetType:   req.TargetType,
+		TargetID:     req.TargetID,
+		Subject:      req.Subject,
+		Content:      req.Content,
+		ByPersonID:   req.ByPersonID,
+		Created:      SqlTime(time.Now()),
+		NrRecipients: len(recipients),
+	}
+	tmpl := template.Must(template.New("content").Parse(req.Content)) //already parsed in Validate()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.NamedExec(
+		"INSERT INTO `announcements` SET `id`=:id,`event_id`=:event_id,`target_type`=:target_type,`target_id`=:target_id,`subject`=:subject,`content`=:content,`by_person_id`=:by_person_id,`created`=:created",
+		a,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add announcement")
+	}
+	for _, r := range recipients {
+		r.AnnouncementID = a.ID
+		r.Status = DeliveryPending
+		if r.Channel == "none" {
+			r.Status = DeliveryUnreachable
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := tmpl.Execute(buf, map[string]interface{}{
+			"FirstName": r.FirstName,
+			"LastName":  r.LastName,
+			"EventName": event.Name,
+		}); err != nil {
+			return nil, errors.Errorf("cannot render content for %s %s: %s", r.FirstName, r.LastName, err)
+		}
+		r.Content = buf.String()
+		if _, err := tx.NamedExec(
+			"INSERT INTO `announcement_recipients` SET `announcement_id`=:announcement_id,`person_id`=:person_id,`channel`=:channel,`address`=:address,`content`=:content,`status`=:status",
+			r,
+		); err != nil {
+			return nil, errors.Wrapf(err, "failed to add announcement recipient")
+		}
+	}
+	if _, err := ScheduleJob(tx, "deliver_announcement", map[string]string{"announcement_id": a.ID}, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit announcement")
+	}
+	return &a, nil
+} //AddAnnouncement()
+
+//announcementRecipients selects the distinct persons in the target group,
+//preferring email over sms as delivery channel
+func announcementRecipients(eventID, targetType, targetID string) ([]AnnouncementRecipient, error) {
+	entrants := "SELECT COALESCE(m.`person_id`,n.`person_id`) AS `person_id` FROM `entries` AS n" +
+		" LEFT JOIN `entry_members` AS m ON m.`entry_id`=n.`id` AND m.`status`!='" + TeamMemberDeclined + "'" +
+		" WHERE n.`status`!='" + EntryStatusWithdrawn + "'"
+	organisers := "SELECT o.`person_id` FROM `event_organisers` AS o"
+	var query string
+	switch targetType {
+	case AnnounceToEvent:
+		query = entrants + " AND (n.`event_id`=:event_id OR n.`event_id` IN (SELECT `id` FROM `events` WHERE `parent_event_id`=:event_id))" +
+			" UNION " + organisers + " WHERE o.`event_id`=:event_id"
+	case AnnounceToSubEvent:
+		var nr int
+		if err := NamedGet(&nr,
+			"SELECT COUNT(*) FROM `events` WHERE `id`=:target_id AND `parent_event_id`=:event_id",
+			map[string]interface{}{"event_id": eventID, "target_id": targetID},
+		); err != nil || nr != 1 {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown sub-event")
+		}
+		query = entrants + " AND n.`event_id`=:target_id" +
+			" UNION " + organisers + " WHERE o.`event_id`=:target_id"
+	case AnnounceToCategory:
+		query = entrants + " AND n.`category_id`=:target_id AND n.`category_id` IN (SELECT `id` FROM `event_categories` WHERE `event_id`=:event_id)"
+	case AnnounceToRole:
+		query = organisers + " WHERE o.`event_id`=:event_id AND o.`role`=:target_id" +
+			" UNION SELECT v.`person_id` FROM `volunteer_signups` AS v" +
+			" JOIN `volunteer_shifts` AS s ON v.`shift_id`=s.`id`" +
+			" JOIN `volunteer_roles` AS r ON s.`role_id`=r.`id`" +
+			" WHERE r.`event_id`=:event_id AND r.`name`=:target_id"
+	default:
+		return nil, errors.Errorf("invalid target_type %s", targetType)
+	}
+
+	var recipients []AnnouncementRecipient
+	if err := NamedSelect(
+		&recipients,
+		"SELECT p.`id` AS person_id,p.`first_name`,p.`last_name`,"+
+			"IF(p.`email` IS NOT NULL,'email',IF(p.`phone` IS NOT NULL,'sms','none')) AS channel,"+
+			"COALESCE(p.`email`,p.`phone`,'') AS address"+
+			" FROM `persons` AS p WHERE p.`id` IN ("+query+")",
+		map[string]interface{}{
+			"event_id":  eventID,
+			"target_id": targetID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to select recipients")
+	}
+	return recipients, nil
+} //announcementRecipients()
+
+//DeliverAnnouncement sends all pending messages of the announcement and
+//records the status of each. Messages that could not be sent stay pending
+//with the error, and an error is returned so the job runs again.
+func DeliverAnnouncement(id string) error {
+	var a Announcement
+	if err := NamedGet(&a,
+		"SELECT `id`,`event_id`,`target_type`,`target_id`,`subject`,`content`,`by_person_id`,`created` FROM `announcements` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.Errorc(http.StatusNotFound, "unknown announcement")
+		}
+		return errors.Wrapf(err, "failed to get announcement")
+	}
+	var pending []AnnouncementRecipient
+	if err := NamedSelect(
+		&pending,
+		"SELECT r.`announcement_id`,r.`person_id`,p.`first_name`,p.`last_name`,r.`channel`,r.`address`,r.`content`,r.`status`,r.`error`,r.`sent`"+
+			" FROM `announcement_recipients` AS r JOIN `persons` AS p ON r.`person_id`=p.`id`"+
+			" WHERE r.`announcement_id`=:id AND r.`status`='"+DeliveryPending+"'",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		return errors.Wrapf(err, "failed to get pending recipients")
+	}
+	nrFailed := 0
+	for _, r := range pending {
+		if send, ok := announcementSenders[r.Channel]; !ok {
+			r.Status = DeliveryUnreachable
+			r.Error = "channel " + r.Channel + " not supported"
+		} else {
+			err := send(r, a.Subject)
+			if err != nil {
+				log.Errorf("failed to send announcement(%s) to %s: %+v", id, r.Address, err)
+				nrFailed++
+			}
+			r.Attempted(err, time.Now())
+		}
+		if _, err := db.NamedExec(
+			"UPDATE `announcement_recipients` SET `status`=:status,`error`=:error,`sent`=:sent WHERE `announcement_id`=:announcement_id AND `person_id`=:person_id",
+			r,
+		); err != nil {
+			return errors.Wrapf(err, "failed to update delivery status")
+		}
+	}
+	if nrFailed > 0 {
+		return errors.Errorf("failed to send announcement(%s) to %d of %d recipients", id, nrFailed, len(pending))
+	}
+	return nil
+} //DeliverAnnouncement()
+
+//Attempted records the result of an attempt to send to the recipient. After
+//an error the recipient stays pending with the error, to try again.
+func (r *AnnouncementRecipient) Attempted(sendErr error, now time.Time) {
+	if sendErr != nil {
+		r.Status = DeliveryPending
+		r.Error = fmt.Sprintf("%.1000s", sendErr.Error())
+		r.Sent = nil
+		return
+	}
+	r.Status = DeliverySent
+	r.Error = ""
+	sent := SqlTime(now)
+	r.Sent = &sent
+}
+
+//FailAnnouncementDelivery marks the recipients still pending as failed, when
+//the delivery job gave up
+func FailAnnouncementDelivery(id string) error {
+	if _, err := db.Exec(
+		"UPDATE `announcement_recipients` SET `status`=? WHERE `announcement_id`=? AND `status`=?",
+		DeliveryFailed, id, DeliveryPending,
+	); err != nil {
+		return errors.Wrapf(err, "failed to mark deliveries failed")
+	}
+	return nil
+}
+
+func sendAnnouncementEmail(r AnnouncementRecipient, subject string) error {
+	msg := email.Message{
+		From:        email.Email{Addr: "no-reply@events.net", Name: "Events"},
+		To:          []email.Email{{Addr: r.Address, Name: r.FirstName + " " + r.LastName}},
+		Subject:     subject,
+		ContentType: "text/html",
+		Content:     r.Content,
+	}
+	return email.Send(msg)
+}
+
+const selectAnnouncementSQL = "SELECT a.`id`,a.`event_id`,a.`target_type`,a.`target_id`,a.`subject`,a.`content`,a.`by_person_id`,a.`created`," +
+	"(SELECT COUNT(*) FROM `announcement_recipients` AS r WHERE r.`announcement_id`=a.`id`) AS nr_recipients," +
+	"(SELECT COUNT(*) FROM `announcement_recipients` AS r WHERE r.`announcement_id`=a.`id` AND r.`status`='" + DeliverySent + "') AS nr_sent," +
+	"(SELECT COUNT(*) FROM `announcement_recipients` AS r WHERE r.`announcement_id`=a.`id` AND (r.`status` IN ('" + DeliveryFailed + "','" + DeliveryUnreachable + "') OR (r.`status`='" + DeliveryPending + "' AND r.`error`<>''))) AS nr_failed" +
+	" FROM `announcements` AS a"
+
+//ListAnnouncements returns the announcements of an event that the person
+//may see, newest first, see CanSeeAnnouncement
+func ListAnnouncements(eventID, personID string) ([]Announcement, error) {
+	role, err := EventRole(eventID, personID)
+	if err != nil {
+		return nil, err
+	}
+	all := []Announcement{}
+	if err := NamedSelect(
+		&all,
+		selectAnnouncementSQL+" WHERE a.`event_id`=:event_id ORDER BY a.`created` DESC",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get announcements")
+	}
+	received := map[string]bool{}
+	if personID != "" && role != EventRoleOrganiser {
+		var ids []string
+		if err := NamedSelect(
+			&ids,
+			"SELECT r.`announcement_id` FROM `announcement_recipients` AS r JOIN `announcements` AS a ON a.`id`=r.`announcement_id` WHERE a.`event_id`=:event_id AND r.`person_id`=:person_id",
+			map[string]interface{}{
+				"event_id":  eventID,
+				"person_id": personID,
+			}); err != nil {
+			return nil, errors.Wrapf(err, "failed to get received announcements")
+		}
+		for _, id := range ids {
+			received[id] = true
+		}
+	}
+	announcements := []Announcement{}
+	for _, a := range all {
+		if CanSeeAnnouncement(role, a.TargetType, received[a.ID]) {
+			announcements = append(announcements, a)
+		}
+	}
+	return announcements, nil
+} //ListAnnouncements()
+
+//CanSeeAnnouncement checks if a role may see an announcement to the target
+//type. Organisers see all, others only those to the whole event, a sub-event
+//or a category, and those they received, e.g. as volunteer in a role.
+func CanSeeAnnouncement(role, targetType string, received bool) bool {
+	if role == EventRoleOrganiser || received {
+		return true
+	}
+	return targetType != AnnounceToRole
+}
+
+func GetAnnouncement(id string) (*Announcement, error) {
+	var a Announcement
+	if err := NamedGet(
+		&a,
+		selectAnnouncementSQL+" WHERE a.`id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown announcement")
+		}
+		return nil, errors.Wrapf(err, "failed to get announcement")
+	}
+	return &a, nil
+}
+
+//ListAnnouncementRecipients returns the delivery status per recipient
+func ListAnnouncementRecipients(id string) ([]AnnouncementRecipient, error) {
+	var recipients []AnnouncementRecipient
+	if err := NamedSelect(
+		&recipients,
+		"SELECT r.`announcement_id`,r.`person_id`,p.`first_name`,p.`last_name`,r.`channel`,r.`address`,r.`content`,r.`status`,r.`error`,r.`sent`"+
+			" FROM `announcement_recipients` AS r JOIN `persons` AS p ON r.`person_id`=p.`id`"+
+			" WHERE r.`announcement_id`=:id ORDER BY p.`last_name`,p.`first_name`",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get announcement recipients")
+	}
+	return recipients, nil
+}
@@ -0,0 +1,93 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestAnnouncementTargets(t *testing.T) {
+	tests := []struct {
+		targetType string
+		targetID   string
+		valid      bool
+	}{
+		{db.AnnounceToEvent, "", true},
+		{db.AnnounceToEvent, "ignored", true},
+		{db.AnnounceToSubEvent, "e2", true},
+		{db.AnnounceToSubEvent, "", false},
+		{db.AnnounceToCategory, "c1", true},
+		{db.AnnounceToCategory, "", false},
+		{db.AnnounceToRole, "marshal", true},
+		{db.AnnounceToRole, "", false},
+		{"everybody", "", false},
+	}
+	for _, test := range tests {
+		req := db.NewAnnouncementRequest{TargetType: test.targetType, TargetID: test.targetID, Subject: "Start delayed", Content: "Hi {{.FirstName}}", ByPersonID: "p1"}
+		err := req.Validate()
+		if (err == nil) != test.valid {
+			t.Fatalf("%s %q: valid=%v: %+v", test.targetType, test.targetID, err == nil, err)
+		}
+		if err == nil && test.targetType == db.AnnounceToEvent && req.TargetID != "" {
+			t.Fatalf("target_id kept for the whole event: %q", req.TargetID)
+		}
+	}
+}
+
+func TestCanSeeAnnouncement(t *testing.T) {
+	tests := []struct {
+		role       string
+		targetType string
+		received   bool
+		expected   bool
+	}{
+		{db.EventRolePublic, db.AnnounceToEvent, false, true},
+		{db.EventRolePublic, db.AnnounceToSubEvent, false, true},
+		{db.EventRolePublic, db.AnnounceToCategory, false, true},
+		{db.EventRolePublic, db.AnnounceToRole, false, false},
+		{db.EventRoleEntrant, db.AnnounceToRole, false, false},
+		{db.EventRolePublic, db.AnnounceToRole, true, true}, //volunteer in the role
+		{db.EventRoleOrganiser, db.AnnounceToRole, false, true},
+	}
+	for _, test := range tests {
+		if ok := db.CanSeeAnnouncement(test.role, test.targetType, test.received); ok != test.expected {
+			t.Errorf("%s sees %s (received=%v): %v, expected %v", test.role, test.targetType, test.received, ok, test.expected)
+		}
+	}
+}
+
+func TestAnnouncementRetries(t *testing.T) {
+	now := time.Date(2022, 6, 24, 10, 0, 0, 0, time.UTC)
+	r := db.AnnouncementRecipient{Status: db.DeliveryPending}
+	r.Attempted(errors.New("mailbox unavailable"), now)
+	if r.Status != db.DeliveryPending || r.Error != "mailbox unavailable" || r.Sent != nil {
+		t.Fatalf("failed attempt must stay pending with the error: %+v", r)
+	}
+	r.Attempted(nil, now.Add(time.Minute))
+	if r.Status != db.DeliverySent || r.Error != "" || r.Sent == nil || time.Time(*r.Sent) != now.Add(time.Minute) {
+		t.Fatalf("retry that succeeded must be sent without error: %+v", r)
+	}
+
+	//the delivery job gives up after its last attempt, when recipients
+	//still pending are marked failed
+	failed := errors.New("failed to send announcement")
+	j := db.Job{Kind: "deliver_announcement", Status: db.JobScheduled}
+	for attempt := 1; attempt < 5; attempt++ {
+		j.Reschedule(failed, now)
+		if j.GaveUp() {
+			t.Fatalf("gave up after attempt %d: %+v", attempt, j)
+		}
+	}
+	j.Reschedule(failed, now)
+	if !j.GaveUp() {
+		t.Fatalf("did not give up after 5 attempts: %+v", j)
+	}
+	every15 := "*/15 * * * *"
+	j = db.Job{Schedule: &every15, Status: db.JobScheduled, Attempts: 10}
+	j.Reschedule(failed, now)
+	if j.GaveUp() {
+		t.Fatalf("recurring job gave up: %+v", j)
+	}
+}
@@ -0,0 +1,290 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//Attachment is a document attached to an event, e.g. the rules, a route map
+//or an indemnity form, shown to those allowed by its visibility
+type Attachment struct {
+	ID                 string  `json:"id" db:"id"`
+	EventID            string  `json:"event_id" db:"event_id"`
+	DocumentID         string  `json:"document_id" db:"document_id"`
+	DocumentName       string  `json:"document_name" db:"document_name"`
+	Title              string  `json:"title" db:"title"`
+	Visibility         string  `json:"visibility" db:"visibility"`
+	Attached           SqlTime `json:"attached" db:"attached"`
+	AttachedByPersonID string  `json:"attached_by_person_id" db:"attached_by_person_id"`
+	ContentType        string  `json:"content_type" db:"content_type"`
+	Size               int64   `json:"size" db:"size"`
+}
+
+const attachmentColumns = "a.`id`,a.`event_id`,a.`document_id`,d.`name` AS `document_name`,a.`title`,a.`visibility`,a.`attached`,a.`attached_by_person_id`,d.`content_type`,d.`size`"
+
+const (
+	VisibilityPublic     = "public"
+	VisibilityEntrants   = "entrants"   //confirmed entrants and organisers
+	VisibilityOrganisers = "organisers" //organisers only
+)
+
+//Roles of a person in an event, from least to most access
+const (
+	EventRolePublic    = ""
+	EventRoleEntrant   = "entrant"
+	EventRoleOrganiser = "organiser"
+)
+
+//EventRole returns the role of the person in the event, which decides what
+//the person may see
+func EventRole(eventID, personID string) (string, error) {
+	return eventRole(db, eventID, personID)
+}
+
+func eventRole(q sqlx.Queryer, eventID, personID string) (string, error) {
+	if personID == "" {
+		return EventRolePublic, nil
+	}
+	if ok, err := isEventOrganiser(q, eventID, personID); err != nil {
+		return "", err
+	} else if ok {
+		return EventRoleOrganiser, nil
+	}
+	var n int
+	if err := sqlx.Get(q, &n,
+		"SELECT COUNT(*) FROM `entries` WHERE `event_id`=? AND `status`=? AND (`person_id`=? OR `id` IN (SELECT `entry_id` FROM `entry_members` WHERE `person_id`=? AND `status`=?))",
+		eventID, EntryStatusConfirmed, personID, personID, TeamMemberConfirmed,
+	); err != nil {
+		return "", errors.Wrapf(err, "failed to check entry")
+	}
+	if n > 0 {
+		return EventRoleEntrant, nil
+	}
+	return EventRolePublic, nil
+}
+
+//CanSee checks if a role may see something with the visibility
+func CanSee(role, visibility string) bool {
+	switch visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityEntrants:
+		return role == EventRoleEntrant || role == EventRoleOrganiser
+	case VisibilityOrganisers:
+		return role == EventRoleOrganiser
+	}
+	return false
+}
+
+type AttachDocumentRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	DocumentID string `json:"document_id" doc:"Revision to attach, replaces an attached revision of the same document"`
+	Title      string `json:"title" doc:"Shown on the event, default is the document name"`
+	Visibility string `json:"visibility" doc:"public, entrants or organisers"`
+}
+
+func (req AttachDocumentRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.DocumentID == "" {
+		return errors.Errorf("missing document_id")
+	}
+	if !CanSee(EventRoleOrganiser, req.Visibility) {
+		return errors.Errorf("invalid visibility \"%s\", expecting public|entrants|organisers", req.Visibility)
+	}
+	return nil
+}
+
+//AttachDocument attaches a document revision to the event. Attaching a new
+//revision of an attached document replaces the old revision.
+func AttachDocument(eventID string, req AttachDocumentRequest) (*Attachment, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if ok, err := IsEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can attach documents")
+	}
+	doc, err := AuthoriseDocument(req.DocumentID, req.ByPersonID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Title == "" {
+		req.Title = doc.Name
+	}
+	if _, err := db.Exec(
+		"INSERT INTO `event_attachments` SET `id`=?,`event_id`=?,`document_id`=?,`document_name`=?,`title`=?,`visibility`=?,`attached`=?,`attached_by_person_id`=?"+
+			" ON DUPLICATE KEY UPDATE `document_id`=VALUES(`document_id`),`title`=VALUES(`title`),`visibility`=VALUES(`visibility`),`attached`=VALUES(`attached`),`attached_by_person_id`=VALUES(`attached_by_person_id`)",
+		uuid.New().String(), eventID, doc.ID, doc.Name, req.Title, req.Visibility, SqlTime(time.Now()), req.ByPersonID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to attach document")
+	}
+	var a Attachment
+	if err := db.Get(&a,
+		"SELECT "+attachmentColumns+" FROM `event_attachments` a JOIN `documents` d ON d.`id`=a.`document_id` WHERE a.`event_id`=? AND a.`document_name`=?",
+		eventID, doc.Name,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get attachment")
+	}
+	return &a, nil
+} //AttachDocument()
+
+func DetachDocument(attachmentID, byPersonID string) error {
+	a, err := GetAttachment(attachmentID)
+	if err != nil {
+		return err
+	}
+	if ok, err := IsEventOrganiser(a.EventID, byPersonID); err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorc(http.StatusForbidden, "only organisers can detach documents")
+	}
+	if _, err := db.Exec("DELETE FROM `event_attachments` WHERE `id`=?", attachmentID); err != nil {
+		return errors.Wrapf(err, "failed to detach document")
+	}
+	return nil
+}
+
+func GetAttachment(id string) (*Attachment, error) {
+	var a Attachment
+	if err := NamedGet(&a,
+		"SELECT "+attachmentColumns+" FROM `event_attachments` a JOIN `documents` d ON d.`id`=a.`document_id` WHERE a.`id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown attachment")
+		}
+		return nil, errors.Wrapf(err, "failed to get attachment")
+	}
+	return &a, nil
+}
+
+//ListEventAttachments returns the attachments the person may see, or only
+//the public ones without a person
+func ListEventAttachments(eventID, personID string) ([]Attachment, error) {
+	role, err := EventRole(eventID, personID)
+	if err != nil {
+		return nil, err
+	}
+	var all []Attachment
+	if err := NamedSelect(&all,
+		"SELECT "+attachmentColumns+" FROM `event_attachments` a JOIN `documents` d ON d.`id`=a.`document_id` WHERE a.`event_id`=:event_id ORDER BY a.`title`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list attachments")
+	}
+	visible := []Attachment{}
+	for _, a := range all {
+		if CanSee(role, a.Visibility) {
+			visible = append(visible, a)
+		}
+	}
+	return visible, nil
+}
+
+//AuthoriseAttachment returns the attachment when the person may download it
+func AuthoriseAttachment(attachmentID, personID string) (*Attachment, error) {
+	a, err := GetAttachment(attachmentID)
+	if err != nil {
+		return nil, err
+	}
+	role, err := EventRole(a.EventID, personID)
+	if err != nil {
+		return nil, err
+	}
+	if !CanSee(role, a.Visibility) {
+		return nil, errors.Errorc(http.StatusForbidden, "not allowed to download "+a.Title)
+	}
+	return a, nil
+}
+
+//linkSecret signs download links. Without env LINK_SECRET links are only
+//valid until the server restarts.
+var linkSecret = func() []byte {
+	if s := os.Getenv("LINK_SECRET"); s != "" {
+		return []byte(s)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("no random numbers: %+v", err))
+	}
+	return b
+}()
+
+//MaxLinkTTL limits how long a signed download link is valid
+const MaxLinkTTL = 30 * 24 * time.Hour
+
+//AttachmentLink returns the URL query of a signed link for the person to
+//download the attachment until it expires, e.g. to put in an email. People
+//make links for themselves, and organisers of the event for people who may
+//see the attachment. The person is authorised again when the link is used.
+func AttachmentLink(attachmentID, personID, byPersonID string, ttl time.Duration) (url.Values, time.Time, error) {
+	if ttl <= 0 || ttl > MaxLinkTTL {
+		return nil, time.Time{}, errors.Errorf("link ttl must be 0..%v", MaxLinkTTL)
+	}
+	if personID == "" || byPersonID == "" {
+		return nil, time.Time{}, errors.Errorc(http.StatusBadRequest, "missing person_id or by_person_id")
+	}
+	a, err := AuthoriseAttachment(attachmentID, personID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if byPersonID != personID {
+		if role, err := EventRole(a.EventID, byPersonID); err != nil {
+			return nil, time.Time{}, err
+		} else if role != EventRoleOrganiser {
+			return nil, time.Time{}, errors.Errorc(http.StatusForbidden, "only organisers make links for others")
+		}
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	return SignAttachmentLink(attachmentID, personID, expires), expires, nil
+}
+
+//SignAttachmentLink returns the URL query of a link valid until expires
+func SignAttachmentLink(attachmentID, personID string, expires time.Time) url.Values {
+	return url.Values{
+		"person_id": {personID},
+		"expires":   {strconv.FormatInt(expires.Unix(), 10)},
+		"sig":       {linkSignature(attachmentID, personID, expires.Unix())},
+	}
+}
+
+//VerifyAttachmentLink checks the signature and expiry of a link made by
+//AttachmentLink and returns the person it was made for
+func VerifyAttachmentLink(attachmentID string, query url.Values, now time.Time) (string, error) {
+	personID := query.Get("person_id")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return "", errors.Errorc(http.StatusForbidden, "invalid link")
+	}
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(linkSignature(attachmentID, personID, expires))) {
+		return "", errors.Errorc(http.StatusForbidden, "invalid link")
+	}
+	if now.Unix() > expires {
+		return "", errors.Errorc(http.StatusGone, "link expired")
+	}
+	return personID, nil
+}
+
+func linkSignature(attachmentID, personID string, expires int64) string {
+	h := hmac.New(sha256.New, linkSecret)
+	fmt.Fprintf(h, "%s\n%s\n%d", attachmentID, personID, expires)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,62 @@
+package db_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func TestCanSee(t *testing.T) {
+	for _, tc := range []struct {
+		role       string
+		visibility string
+		exp        bool
+	}{
+		{db.EventRolePublic, db.VisibilityPublic, true},
+		{db.EventRolePublic, db.VisibilityEntrants, false},
+		{db.EventRolePublic, db.VisibilityOrganisers, false},
+		{db.EventRoleEntrant, db.VisibilityPublic, true},
+		{db.EventRoleEntrant, db.VisibilityEntrants, true},
+		{db.EventRoleEntrant, db.VisibilityOrganisers, false},
+		{db.EventRoleOrganiser, db.VisibilityEntrants, true},
+		{db.EventRoleOrganiser, db.VisibilityOrganisers, true},
+		{db.EventRoleOrganiser, "secret", false},
+	} {
+		if got := db.CanSee(tc.role, tc.visibility); got != tc.exp {
+			t.Errorf("CanSee(%q,%q)=%v, expected %v", tc.role, tc.visibility, got, tc.exp)
+		}
+	}
+}
+
+func TestAttachmentLink(t *testing.T) {
+	now := time.Now()
+	query := db.SignAttachmentLink("a1", "p1", now.Add(time.Hour))
+
+	personID, err := db.VerifyAttachmentLink("a1", query, now)
+	if err != nil {
+		t.Fatalf("valid link failed: %+v", err)
+	}
+	if personID != "p1" {
+		t.Fatalf("got person %q, expected p1", personID)
+	}
+
+	if _, err := db.VerifyAttachmentLink("a2", query, now); errors.Code(err) != http.StatusForbidden {
+		t.Errorf("other attachment gave %+v, expected 403", err)
+	}
+	wrongPerson := db.SignAttachmentLink("a1", "p1", now.Add(time.Hour))
+	wrongPerson.Set("person_id", "p2")
+	if _, err := db.VerifyAttachmentLink("a1", wrongPerson, now); errors.Code(err) != http.StatusForbidden {
+		t.Errorf("other person gave %+v, expected 403", err)
+	}
+	extended := db.SignAttachmentLink("a1", "p1", now.Add(time.Hour))
+	extended.Set("expires", query.Get("expires")+"0")
+	if _, err := db.VerifyAttachmentLink("a1", extended, now); errors.Code(err) != http.StatusForbidden {
+		t.Errorf("changed expiry gave %+v, expected 403", err)
+	}
+	if _, err := db.VerifyAttachmentLink("a1", query, now.Add(2*time.Hour)); errors.Code(err) != http.StatusGone {
+		t.Errorf("expired link gave %+v, expected 410", err)
+	}
+}
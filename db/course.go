@@ -0,0 +1,513 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
+
+//Course is the route of an event or sub-event, parsed from an uploaded GPX or
+//KML file. Only a simplified line is kept for display on a map.
+type Course struct {
+	ID             string       `json:"id" db:"id"`
+	EventID        string       `json:"event_id" db:"event_id"`
+	Name           string       `json:"name" db:"name"`
+	Format         string       `json:"format" db:"format" doc:"gpx or kml"`
+	DistanceM      int          `json:"distance_m" db:"distance_m"`
+	ElevationGainM int          `json:"elevation_gain_m" db:"elevation_gain_m"`
+	ElevationLossM int          `json:"elevation_loss_m" db:"elevation_loss_m"`
+	Start          RoutePoint   `json:"start" db:"-"`
+	Finish         RoutePoint   `json:"finish" db:"-"`
+	Checkpoints    []Checkpoint `json:"checkpoints" db:"-"`
+	Points         []RoutePoint `json:"-" db:"-" doc:"Simplified line"`
+	PointsJSON     string       `json:"-" db:"points"`
+}
+
+//RoutePoint has no elevation when Ele is nil
+type RoutePoint struct {
+	Lat float64
+	Lon float64
+	Ele *float64
+}
+
+//MarshalJSON writes the point as a GeoJSON position [lon,lat(,ele)]
+func (p RoutePoint) MarshalJSON() ([]byte, error) {
+	if p.Ele == nil {
+		return json.Marshal([]float64{p.Lon, p.Lat})
+	}
+	return json.Marshal([]float64{p.Lon, p.Lat, *p.Ele})
+}
+
+func (p *RoutePoint) UnmarshalJSON(data []byte) error {
+	var v []float64
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if len(v) < 2 {
+		return errors.Errorf("point needs lon and lat")
+	}
+	*p = RoutePoint{Lon: v[0], Lat: v[1]}
+	if len(v) > 2 {
+		p.Ele = &v[2]
+	}
+	return nil
+}
+
+//Checkpoint is a named point on the course, e.g. a water point
+type Checkpoint struct {
+	Name      string  `json:"name" db:"name"`
+	Lat       float64 `json:"lat" db:"lat"`
+	Lon       float64 `json:"lon" db:"lon"`
+	DistanceM int     `json:"distance_m" db:"distance_m" doc:"Along the course from the start"`
+}
+
+const (
+	//elevationNoiseM is ignored as GPS noise when adding up elevation changes
+	elevationNoiseM = 3.0
+	//simplifyToleranceM is how far the simplified line may be from the route
+	simplifyToleranceM = 5.0
+	//checkpointMaxKm is how far a waypoint may be from the route to be a checkpoint
+	checkpointMaxKm = 1.0
+)
+
+//ParseRoute parses a GPX or KML file and calculates the course stats
+func ParseRoute(r io.Reader) (*Course, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read route")
+	}
+	start := strings.ToLower(string(data[:minInt(len(data), 1024)]))
+	var (
+		name      string
+		track     []RoutePoint
+		waypoints []Checkpoint
+		format    string
+	)
+	switch {
+	case strings.Contains(start, "<gpx"):
+		format = "gpx"
+		name, track, waypoints, err = parseGPX(data)
+	case strings.Contains(start, "<kml"):
+		format = "kml"
+		name, track, waypoints, err = parseKML(data)
+	default:
+		return nil, errors.Errorf("route is not a GPX or KML file")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", strings.ToUpper(format))
+	}
+	if len(track) < 2 {
+		return nil, errors.Errorf("%s has no track or route with at least two points", strings.ToUpper(format))
+	}
+	for _, p := range track {
+		if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 {
+			return nil, errors.Errorf("invalid point %f,%f", p.Lat, p.Lon)
+		}
+	}
+
+	c := Course{
+		Name:        name,
+		Format:      format,
+		Start:       track[0],
+		Finish:      track[len(track)-1],
+		Checkpoints: []Checkpoint{},
+		Points:      SimplifyRoute(track, simplifyToleranceM),
+	}
+	//distance along the route to each point
+	along := make([]float64, len(track))
+	for i := 1; i < len(track); i++ {
+		along[i] = along[i-1] + DistanceKm(track[i-1].Lat, track[i-1].Lon, track[i].Lat, track[i].Lon)
+	}
+	c.DistanceM = int(math.Round(along[len(along)-1] * 1000))
+	gain, loss := elevationChange(track)
+	c.ElevationGainM, c.ElevationLossM = int(math.Round(gain)), int(math.Round(loss))
+
+	for _, w := range waypoints {
+		nearest, nearestKm := 0, math.MaxFloat64
+		for i, p := range track {
+			if d := DistanceKm(w.Lat, w.Lon, p.Lat, p.Lon); d < nearestKm {
+				nearest, nearestKm = i, d
+			}
+		}
+		if nearestKm > checkpointMaxKm {
+			continue
+		}
+		w.DistanceM = int(math.Round(along[nearest] * 1000))
+		c.Checkpoints = append(c.Checkpoints, w)
+	}
+	sort.SliceStable(c.Checkpoints, func(i, j int) bool { return c.Checkpoints[i].DistanceM < c.Checkpoints[j].DistanceM })
+	return &c, nil
+} //ParseRoute()
+
+type gpxPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele"`
+	Name string   `xml:"name"`
+}
+
+func (p gpxPoint) routePoint() RoutePoint {
+	return RoutePoint{Lat: p.Lat, Lon: p.Lon, Ele: p.Ele}
+}
+
+//parseGPX uses the tracks, else the routes, and the waypoints as checkpoints
+func parseGPX(data []byte) (string, []RoutePoint, []Checkpoint, error) {
+	var gpx struct {
+		Name   string `xml:"metadata>name"`
+		Tracks []struct {
+			Name     string `xml:"name"`
+			Segments []struct {
+				Points []gpxPoint `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+		Routes []struct {
+			Name   string     `xml:"name"`
+			Points []gpxPoint `xml:"rtept"`
+		} `xml:"rte"`
+		Waypoints []gpxPoint `xml:"wpt"`
+	}
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		return "", nil, nil, err
+	}
+	name := gpx.Name
+	track := []RoutePoint{}
+	for _, t := range gpx.Tracks {
+		if name == "" {
+			name = t.Name
+		}
+		for _, s := range t.Segments {
+			for _, p := range s.Points {
+				track = append(track, p.routePoint())
+			}
+		}
+	}
+	if len(track) == 0 {
+		for _, r := range gpx.Routes {
+			if name == "" {
+				name = r.Name
+			}
+			for _, p := range r.Points {
+				track = append(track, p.routePoint())
+			}
+		}
+	}
+	waypoints := []Checkpoint{}
+	for _, w := range gpx.Waypoints {
+		waypoints = append(waypoints, Checkpoint{Name: strings.TrimSpace(w.Name), Lat: w.Lat, Lon: w.Lon})
+	}
+	return strings.TrimSpace(name), track, waypoints, nil
+} //parseGPX()
+
+//parseKML uses LineString and gx:Track placemarks as the track and Point
+//placemarks as checkpoints
+func parseKML(data []byte) (string, []RoutePoint, []Checkpoint, error) {
+	name := ""
+	track := []RoutePoint{}
+	waypoints := []Checkpoint{}
+	stack := []string{}
+	inside := func(element string) bool {
+		for _, e := range stack {
+			if e == element {
+				return true
+			}
+		}
+		return false
+	}
+	var placemarkName string
+	var placemarkPoint *RoutePoint
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if t.Name.Local == "Placemark" {
+				placemarkName, placemarkPoint = "", nil
+			}
+		case xml.EndElement:
+			if t.Name.Local == "Placemark" && placemarkPoint != nil {
+				waypoints = append(waypoints, Checkpoint{Name: placemarkName, Lat: placemarkPoint.Lat, Lon: placemarkPoint.Lon})
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) < 2 {
+				continue
+			}
+			element, parent := stack[len(stack)-1], stack[len(stack)-2]
+			text := strings.TrimSpace(string(t))
+			switch {
+			case element == "name" && parent == "Placemark":
+				placemarkName = text
+			case element == "name" && parent == "Document" && name == "":
+				name = text
+			case element == "coordinates" && inside("LineString"):
+				for _, tuple := range strings.Fields(text) {
+					p, err := kmlPoint(strings.Split(tuple, ","))
+					if err != nil {
+						return "", nil, nil, err
+					}
+					track = append(track, p)
+				}
+				if name == "" {
+					name = placemarkName
+				}
+			case element == "coordinates" && inside("Point"):
+				p, err := kmlPoint(strings.Split(text, ","))
+				if err != nil {
+					return "", nil, nil, err
+				}
+				placemarkPoint = &p
+			case element == "coord" && inside("Track"):
+				p, err := kmlPoint(strings.Fields(text))
+				if err != nil {
+					return "", nil, nil, err
+				}
+				track = append(track, p)
+			}
+		}
+	}
+	return name, track, waypoints, nil
+} //parseKML()
+
+//kmlPoint parses lon, lat and optional altitude
+func kmlPoint(values []string) (RoutePoint, error) {
+	if len(values) < 2 {
+		return RoutePoint{}, errors.Errorf("invalid coordinates %v", values)
+	}
+	var f [3]float64
+	for i := 0; i < len(values) && i < 3; i++ {
+		var err error
+		if f[i], err = strconv.ParseFloat(strings.TrimSpace(values[i]), 64); err != nil {
+			return RoutePoint{}, errors.Errorf("invalid coordinates %v", values)
+		}
+	}
+	p := RoutePoint{Lon: f[0], Lat: f[1]}
+	if len(values) > 2 {
+		p.Ele = &f[2]
+	}
+	return p, nil
+}
+
+//elevationChange adds up the climbs and descents of the points with an
+//elevation, ignoring changes smaller than the GPS noise
+func elevationChange(points []RoutePoint) (gain, loss float64) {
+	var ref *float64
+	for _, p := range points {
+		if p.Ele == nil {
+			continue
+		}
+		if ref == nil {
+			ref = p.Ele
+			continue
+		}
+		if d := *p.Ele - *ref; d >= elevationNoiseM {
+			gain += d
+			ref = p.Ele
+		} else if d <= -elevationNoiseM {
+			loss -= d
+			ref = p.Ele
+		}
+	}
+	return gain, loss
+}
+
+//SimplifyRoute removes points that are within toleranceM of the line between
+//the points kept (Douglas-Peucker)
+func SimplifyRoute(points []RoutePoint, toleranceM float64) []RoutePoint {
+	if len(points) < 3 {
+		return points
+	}
+	//project to metres on a plane, good enough over the length of a course
+	lat0 := points[0].Lat * math.Pi / 180
+	x := make([]float64, len(points))
+	y := make([]float64, len(points))
+	for i, p := range points {
+		x[i] = p.Lon * math.Pi / 180 * math.Cos(lat0) * earthRadiusKm * 1000
+		y[i] = p.Lat * math.Pi / 180 * earthRadiusKm * 1000
+	}
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		furthest, furthestM := 0, 0.0
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistance(x[i], y[i], x[first], y[first], x[last], y[last]); d > furthestM {
+				furthest, furthestM = i, d
+			}
+		}
+		if furthestM > toleranceM {
+			keep[furthest] = true
+			stack = append(stack, [2]int{first, furthest}, [2]int{furthest, last})
+		}
+	}
+	simplified := []RoutePoint{}
+	for i, p := range points {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+} //SimplifyRoute()
+
+//segmentDistance is the distance from point p to the segment a-b
+func segmentDistance(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((px-ax)*dx+(py-ay)*dy)/l))
+	}
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
+
+//SetEventCourse replaces the course of an event or sub-event
+func SetEventCourse(eventID, byPersonID string, c Course) (*Course, error) {
+	if ok, err := IsEventOrganiser(eventID, byPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can set the course")
+	}
+	pointsJSON, err := json.Marshal(c.Points)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode points")
+	}
+	c.ID = uuid.New().String()
+	c.EventID = eventID
+	c.PointsJSON = string(pointsJSON)
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM `event_courses` WHERE `event_id`=?", eventID); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete old course")
+	}
+	if _, err := tx.NamedExec(
+		"INSERT INTO `event_courses` SET `id`=:id,`event_id`=:event_id,`name`=:name,`format`=:format,`distance_m`=:distance_m,`elevation_gain_m`=:elevation_gain_m,`elevation_loss_m`=:elevation_loss_m,`points`=:points",
+		c,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add course")
+	}
+	for i, cp := range c.Checkpoints {
+		if _, err := tx.Exec(
+			"INSERT INTO `event_course_checkpoints` SET `course_id`=?,`seq`=?,`name`=?,`lat`=?,`lon`=?,`distance_m`=?",
+			c.ID, i, cp.Name, cp.Lat, cp.Lon, cp.DistanceM,
+		); err != nil {
+			return nil, errors.Wrapf(err, "failed to add checkpoint")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit course")
+	}
+	return &c, nil
+} //SetEventCourse()
+
+//GetEventCourse returns nil when the event has no course
+func GetEventCourse(eventID string) (*Course, error) {
+	var c Course
+	if err := NamedGet(&c,
+		"SELECT `id`,`event_id`,`name`,`format`,`distance_m`,`elevation_gain_m`,`elevation_loss_m`,`points` FROM `event_courses` WHERE `event_id`=:event_id",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get course")
+	}
+	if err := json.Unmarshal([]byte(c.PointsJSON), &c.Points); err != nil || len(c.Points) < 2 {
+		return nil, errors.Errorf("course %s has invalid points", c.ID)
+	}
+	c.Start, c.Finish = c.Points[0], c.Points[len(c.Points)-1]
+	c.Checkpoints = []Checkpoint{}
+	if err := NamedSelect(&c.Checkpoints,
+		"SELECT `name`,`lat`,`lon`,`distance_m` FROM `event_course_checkpoints` WHERE `course_id`=:course_id ORDER BY `seq`",
+		map[string]interface{}{
+			"course_id": c.ID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get checkpoints")
+	}
+	return &c, nil
+} //GetEventCourse()
+
+func DeleteEventCourse(eventID, byPersonID string) error {
+	if ok, err := IsEventOrganiser(eventID, byPersonID); err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorc(http.StatusForbidden, "only organisers can delete the course")
+	}
+	if _, err := db.Exec("DELETE FROM `event_courses` WHERE `event_id`=?", eventID); err != nil {
+		return errors.Wrapf(err, "failed to delete course")
+	}
+	return nil
+}
+
+//GeoJSON is a feature collection for map display
+type GeoJSON struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+//GeoJSON returns the course line with the start, finish and checkpoints
+func (c Course) GeoJSON() GeoJSON {
+	point := func(kind, name string, p RoutePoint, distanceM int) GeoJSONFeature {
+		return GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: GeoJSONGeometry{Type: "Point", Coordinates: p},
+			Properties: map[string]interface{}{
+				"kind":       kind,
+				"name":       name,
+				"distance_m": distanceM,
+			},
+		}
+	}
+	g := GeoJSON{Type: "FeatureCollection", Features: []GeoJSONFeature{
+		{
+			Type:     "Feature",
+			Geometry: GeoJSONGeometry{Type: "LineString", Coordinates: c.Points},
+			Properties: map[string]interface{}{
+				"kind":             "course",
+				"name":             c.Name,
+				"distance_m":       c.DistanceM,
+				"elevation_gain_m": c.ElevationGainM,
+				"elevation_loss_m": c.ElevationLossM,
+			},
+		},
+		point("start", "Start", c.Start, 0),
+	}}
+	for _, cp := range c.Checkpoints {
+		g.Features = append(g.Features, point("checkpoint", cp.Name, RoutePoint{Lat: cp.Lat, Lon: cp.Lon}, cp.DistanceM))
+	}
+	g.Features = append(g.Features, point("finish", "Finish", c.Finish, c.DistanceM))
+	return g
+} //Course.GeoJSON()
@@ -0,0 +1,149 @@
+package db_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestParseRouteGPX(t *testing.T) {
+	//straight line south, 0.001 degrees (111m) between points
+	gpx := `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+  <metadata><name>Swartvlei 1km</name></metadata>
+  <wpt lat="-34.005" lon="22.0001"><name>Water</name></wpt>
+  <wpt lat="-35" lon="22"><name>Far away</name></wpt>
+  <trk><name>Track</name><trkseg>`
+	for i, ele := range []int{10, 12, 15, 20, 19, 21, 15, 10, 11, 10, 5} {
+		gpx += fmt.Sprintf(`<trkpt lat="%.3f" lon="22"><ele>%d</ele></trkpt>`, -34-float64(i)/1000, ele)
+	}
+	gpx += `</trkseg></trk></gpx>`
+
+	c, err := db.ParseRoute(strings.NewReader(gpx))
+	if err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	if c.Name != "Swartvlei 1km" || c.Format != "gpx" {
+		t.Errorf("name=%q format=%q", c.Name, c.Format)
+	}
+	if c.DistanceM < 1110 || c.DistanceM > 1114 {
+		t.Errorf("distance %dm", c.DistanceM)
+	}
+	//small ups and downs are GPS noise
+	if c.ElevationGainM != 10 || c.ElevationLossM != 15 {
+		t.Errorf("gain %dm loss %dm, expected 10m and 15m", c.ElevationGainM, c.ElevationLossM)
+	}
+	if c.Start.Lat != -34 || math.Abs(c.Finish.Lat+34.01) > 1e-9 {
+		t.Errorf("start %+v finish %+v", c.Start, c.Finish)
+	}
+	if len(c.Points) != 2 {
+		t.Errorf("straight line simplified to %d points", len(c.Points))
+	}
+	if len(c.Checkpoints) != 1 || c.Checkpoints[0].Name != "Water" || c.Checkpoints[0].DistanceM != 556 {
+		t.Errorf("checkpoints %+v", c.Checkpoints)
+	}
+}
+
+func TestParseRouteKML(t *testing.T) {
+	kml := `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2">
+<Document>
+  <name>Branders</name>
+  <Placemark>
+    <name>Route</name>
+    <LineString><coordinates>
+      22,-34,0 22,-34.001,5
+      22.001,-34.001,0
+    </coordinates></LineString>
+  </Placemark>
+  <Placemark>
+    <name>Turn</name>
+    <Point><coordinates>22,-34.001,0</coordinates></Point>
+  </Placemark>
+</Document>
+</kml>`
+	c, err := db.ParseRoute(strings.NewReader(kml))
+	if err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	if c.Name != "Branders" || c.Format != "kml" {
+		t.Errorf("name=%q format=%q", c.Name, c.Format)
+	}
+	if c.DistanceM < 201 || c.DistanceM > 205 {
+		t.Errorf("distance %dm", c.DistanceM)
+	}
+	if c.ElevationGainM != 5 || c.ElevationLossM != 5 {
+		t.Errorf("gain %dm loss %dm", c.ElevationGainM, c.ElevationLossM)
+	}
+	if len(c.Points) != 3 {
+		t.Errorf("corner simplified to %d points", len(c.Points))
+	}
+	if len(c.Checkpoints) != 1 || c.Checkpoints[0].Name != "Turn" || c.Checkpoints[0].DistanceM != 111 {
+		t.Errorf("checkpoints %+v", c.Checkpoints)
+	}
+
+	data, err := json.Marshal(c.GeoJSON())
+	if err != nil {
+		t.Fatalf("failed to marshal: %+v", err)
+	}
+	var g struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &g); err != nil {
+		t.Fatalf("invalid GeoJSON %s: %+v", data, err)
+	}
+	if g.Type != "FeatureCollection" || len(g.Features) != 4 {
+		t.Fatalf("unexpected GeoJSON %s", data)
+	}
+	if f := g.Features[0]; f.Geometry.Type != "LineString" || string(f.Geometry.Coordinates) != "[[22,-34,0],[22,-34.001,5],[22.001,-34.001,0]]" {
+		t.Errorf("line %s %s", f.Geometry.Type, f.Geometry.Coordinates)
+	}
+	for i, kind := range []string{"course", "start", "checkpoint", "finish"} {
+		if g.Features[i].Properties["kind"] != kind {
+			t.Errorf("feature[%d] is %v, expected %s", i, g.Features[i].Properties["kind"], kind)
+		}
+	}
+}
+
+func TestParseRouteInvalid(t *testing.T) {
+	for name, s := range map[string]string{
+		"not a route": "date,amount\n",
+		"one point":   `<gpx><trk><trkseg><trkpt lat="-34" lon="22"/></trkseg></trk></gpx>`,
+		"bad lat":     `<gpx><rte><rtept lat="-134" lon="22"/><rtept lat="-34" lon="22"/></rte></gpx>`,
+		"bad KML":     `<kml><Placemark><LineString><coordinates>22,x 22,-34</coordinates></LineString></Placemark></kml>`,
+		"broken XML":  `<gpx><trk>`,
+	} {
+		if _, err := db.ParseRoute(strings.NewReader(s)); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestSimplifyRoute(t *testing.T) {
+	//zig-zag of 1m either side of a straight line is removed
+	points := []db.RoutePoint{}
+	for i := 0; i <= 100; i++ {
+		lon := 22.0
+		if i%2 == 1 {
+			lon += 0.00001
+		}
+		points = append(points, db.RoutePoint{Lat: -34 - float64(i)/10000, Lon: lon})
+	}
+	if simplified := db.SimplifyRoute(points, 5); len(simplified) != 2 {
+		t.Errorf("simplified to %d points", len(simplified))
+	}
+	if simplified := db.SimplifyRoute(points, 0.1); len(simplified) != len(points) {
+		t.Errorf("with small tolerance simplified to %d points", len(simplified))
+	}
+}
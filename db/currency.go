@@ -0,0 +1,92 @@
+package db
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Currency is an ISO 4217 currency
+type Currency struct {
+	Code       string //e.g. "ZAR"
+	Numeric    string //e.g. "710"
+	MinorUnits int    //digits after the decimal point, e.g. 2 for cents, 0 for JPY
+	Name       string //e.g. "South African Rand"
+	Symbol     string //e.g. "R", empty to show the code instead
+	Prefix     bool   //true then Rxxx, false then xxx zł
+}
+
+//unit is the nr of minor units in one major unit, e.g. 100 cents in a rand
+func (c *Currency) unit() int {
+	u := 1
+	for i := 0; i < c.MinorUnits; i++ {
+		u *= 10
+	}
+	return u
+}
+
+var (
+	DefaultCurrency  *Currency
+	CurrencyByCode   = map[string]*Currency{}
+	CurrencyBySymbol = map[string]*Currency{}
+
+	//currencySymbols is sorted longest first so "N$" matches before "$"
+	currencySymbols = []string{}
+)
+
+//AddCurrency registers a currency. The first currency added is the default
+//and when currencies share a symbol, the symbol refers to the first one.
+func AddCurrency(c Currency) {
+	if _, ok := CurrencyByCode[c.Code]; ok {
+		panic(fmt.Sprintf("duplicate currency: %+v", c))
+	}
+	CurrencyByCode[c.Code] = &c
+	if c.Symbol != "" {
+		if _, ok := CurrencyBySymbol[c.Symbol]; !ok {
+			CurrencyBySymbol[c.Symbol] = &c
+			currencySymbols = append(currencySymbols, c.Symbol)
+			sort.SliceStable(currencySymbols, func(i, j int) bool {
+				return len(currencySymbols[i]) > len(currencySymbols[j])
+			})
+		}
+	}
+	if DefaultCurrency == nil {
+		DefaultCurrency = &c
+	}
+}
+
+//iso4217 lists the currencies we know with the default first
+//
+//go:embed iso4217.csv
+var iso4217 []byte
+
+func init() {
+	rows, err := csv.NewReader(bytes.NewReader(iso4217)).ReadAll()
+	if err != nil {
+		panic(fmt.Sprintf("invalid iso4217.csv: %+v", err))
+	}
+	for i, row := range rows {
+		if i == 0 {
+			continue //header
+		}
+		if len(row) != 6 || len(row[0]) != 3 {
+			panic(fmt.Sprintf("invalid iso4217.csv line %d: %v", i+1, row))
+		}
+		minorUnits, err := strconv.Atoi(row[2])
+		if err != nil || minorUnits < 0 || minorUnits > 4 {
+			panic(fmt.Sprintf("invalid iso4217.csv line %d minor units \"%s\"", i+1, row[2]))
+		}
+		AddCurrency(Currency{
+			Code:       strings.ToUpper(row[0]),
+			Numeric:    row[1],
+			MinorUnits: minorUnits,
+			Name:       row[3],
+			Symbol:     row[4],
+			Prefix:     row[4] == "" || row[5] == "prefix",
+		})
+	}
+}
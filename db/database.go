@@ -136,8 +136,10 @@ func (c *Config) Validate() error {
 	return nil
 } //Config.Validate()
 
+//ConnectString sets the session time zone to UTC, the zone of all DATETIME
+//values, so SQL time functions agree with them
 func (c Config) ConnectString() string {
-	return fmt.Sprintf("%s:%s@(%s:%d)/%s",
+	return fmt.Sprintf("%s:%s@(%s:%d)/%s?time_zone=%%27%%2B00%%3A00%%27",
 		c.Username,
 		c.Password,
 		c.Host,
@@ -1,11 +1,314 @@
 package db
 
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/blob"
+)
+
+//Document is a revision of a named document. Uploading to the same name adds
+//a revision, older revisions stay available, e.g. for waivers accepted before.
+//The person who uploaded the first revision owns the document. Only the owner
+//can add revisions and get the content by id, others get it through what the
+//owner used it for, e.g. an attachment, waiver or logo.
 type Document struct {
-	ID               string  `json:"id"`
-	Name             string  `json:"name"`
-	Revision         int     `json:"revision"`
-	Timestamp        SqlTime `json:"timestamp"`
-	LoadedByPersonID string  `json:"loaded_by_person_id"`
-	ContentID        string  `json:"content_id"`   //in object db
-	ContentType      string  `json:"content_type"` //e.g. "pdf", "text/html"
+	ID               string  `json:"id" db:"id"`
+	Name             string  `json:"name" db:"name"`
+	Revision         int     `json:"revision" db:"revision"`
+	Timestamp        SqlTime `json:"timestamp" db:"timestamp"`
+	LoadedByPersonID string  `json:"loaded_by_person_id" db:"loaded_by_person_id"`
+	ContentID        string  `json:"content_id" db:"content_id"`     //in object db
+	ContentType      string  `json:"content_type" db:"content_type"` //e.g. "application/pdf", "text/html"
+	Filename         string  `json:"filename,omitempty" db:"filename"`
+	Size             int64   `json:"size" db:"size"`
+}
+
+const documentColumns = "`id`,`name`,`revision`,`timestamp`,`loaded_by_person_id`,`content_id`,`content_type`,`filename`,`size`"
+
+//blobs stores the content of documents
+var blobs blob.Store
+
+func SetBlobStore(s blob.Store) {
+	blobs = s
+}
+
+type UploadDocumentRequest struct {
+	Name        string `json:"name"`
+	ByPersonID  string `json:"by_person_id"`
+	Filename    string `json:"filename,omitempty" doc:"Used for the content type when it cannot be detected"`
+	ContentType string `json:"content_type,omitempty" doc:"Used when the content type cannot be detected or derived from the filename"`
+}
+
+func (req UploadDocumentRequest) Validate() error {
+	if req.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	if len(req.Name) > 200 {
+		return errors.Errorf("name longer than 200")
+	}
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	return nil
+}
+
+//UploadDocument streams the content into the blob store and adds it as the
+//next revision of the named document, which only the owner can do. Uploading
+//the same content as the latest revision returns that revision.
+func UploadDocument(req UploadDocumentRequest, r io.Reader) (*Document, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if strings.HasPrefix(req.Name, photoDocumentPrefix) {
+		return nil, errors.Errorc(http.StatusBadRequest, "names starting with \""+photoDocumentPrefix+"\" are used for photos")
+	}
+	return uploadDocument(req, r)
+}
+
+//uploadDocument uploads without the checks of names that are only used
+//internally, e.g. for photos
+func uploadDocument(req UploadDocumentRequest, r io.Reader) (*Document, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if blobs == nil {
+		return nil, errors.Errorf("no blob store")
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to read content")
+	}
+	if n == 0 {
+		return nil, errors.Errorc(http.StatusBadRequest, "empty document")
+	}
+	head = head[:n]
+	d := Document{
+		ID:               uuid.New().String(),
+		Name:             req.Name,
+		Timestamp:        SqlTime(time.Now()),
+		LoadedByPersonID: req.ByPersonID,
+		ContentType:      SniffContentType(head, req.Filename, req.ContentType),
+		Filename:         req.Filename[strings.LastIndexAny(req.Filename, "/\\")+1:],
+	}
+	if d.ContentID, d.Size, err = blobs.Put(io.MultiReader(bytes.NewReader(head), r)); err != nil {
+		return nil, errors.Wrapf(err, "failed to store content")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	var latest Document
+	if err := tx.Get(&latest,
+		"SELECT "+documentColumns+" FROM `documents` WHERE `name`=? ORDER BY `revision` DESC LIMIT 1 FOR UPDATE",
+		d.Name,
+	); err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "failed to get latest revision")
+	}
+	if latest.ID != "" {
+		var ownerID string
+		if err := tx.Get(&ownerID, "SELECT `loaded_by_person_id` FROM `documents` WHERE `name`=? ORDER BY `revision` LIMIT 1", d.Name); err != nil {
+			return nil, errors.Wrapf(err, "failed to get document owner")
+		}
+		if ownerID != req.ByPersonID {
+			return nil, errors.Errorc(http.StatusForbidden, "only the owner of \""+d.Name+"\" can add revisions")
+		}
+		if latest.ContentID == d.ContentID {
+			return &latest, nil
+		}
+	}
+	d.Revision = latest.Revision + 1
+	if _, err := tx.NamedExec(
+		"INSERT INTO `documents` SET `id`=:id,`name`=:name,`revision`=:revision,`timestamp`=:timestamp,`loaded_by_person_id`=:loaded_by_person_id,`content_id`=:content_id,`content_type`=:content_type,`filename`=:filename,`size`=:size",
+		d,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorc(http.StatusConflict, "document was changed at the same time, try again")
+		}
+		return nil, errors.Wrapf(err, "failed to add document")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit document")
+	}
+	return &d, nil
+} //UploadDocument()
+
+//contentTypeByExtension is used when the content itself is not recognised,
+//e.g. text formats and office documents which are zip files
+var contentTypeByExtension = map[string]string{
+	".csv":  "text/csv; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".json": "application/json",
+	".gpx":  "application/gpx+xml",
+	".kml":  "application/vnd.google-earth.kml+xml",
+	".kmz":  "application/vnd.google-earth.kmz",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".doc":  "application/msword",
+	".xls":  "application/vnd.ms-excel",
+}
+
+//SniffContentType detects the content type from the first 512 bytes. When
+//that only gives a generic type, the filename extension and then the type
+//declared by the uploader are used.
+func SniffContentType(head []byte, filename, declared string) string {
+	sniffed := http.DetectContentType(head)
+	switch sniffed {
+	case "application/octet-stream", "text/plain; charset=utf-8", "application/zip", "text/xml; charset=utf-8":
+	default:
+		return sniffed
+	}
+	if t, ok := contentTypeByExtension[strings.ToLower(filepath.Ext(filename))]; ok {
+		return t
+	}
+	if declared != "" && declared != "application/octet-stream" && !strings.HasPrefix(declared, "text/html") {
+		return declared
+	}
+	return sniffed
+}
+
+func GetDocument(id string) (*Document, error) {
+	var d Document
+	if err := NamedGet(&d,
+		"SELECT "+documentColumns+" FROM `documents` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown document")
+		}
+		return nil, errors.Wrapf(err, "failed to get document")
+	}
+	return &d, nil
+}
+
+//GetDocumentRevision returns a revision of the named document, or the latest
+//when revision is 0
+func GetDocumentRevision(name string, revision int) (*Document, error) {
+	var d Document
+	query := "SELECT " + documentColumns + " FROM `documents` WHERE `name`=:name AND `revision`=:revision"
+	if revision == 0 {
+		query = "SELECT " + documentColumns + " FROM `documents` WHERE `name`=:name ORDER BY `revision` DESC LIMIT 1"
+	}
+	if err := NamedGet(&d, query,
+		map[string]interface{}{
+			"name":     name,
+			"revision": revision,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown document")
+		}
+		return nil, errors.Wrapf(err, "failed to get document")
+	}
+	return &d, nil
+}
+
+//ownedDocumentsSQL selects the documents d owned by :person_id, except those
+//of photos
+const ownedDocumentsSQL = " `name` NOT LIKE :photos AND `name` IN (SELECT `name` FROM `documents` WHERE `revision`=1 AND `loaded_by_person_id`=:person_id)"
+
+//ListDocumentRevisions returns all revisions of a document owned by the
+//person, latest first
+func ListDocumentRevisions(name, personID string) ([]Document, error) {
+	docs := []Document{}
+	if err := NamedSelect(&docs,
+		"SELECT "+documentColumns+" FROM `documents` WHERE `name`=:name AND"+ownedDocumentsSQL+" ORDER BY `revision` DESC",
+		map[string]interface{}{
+			"name":      name,
+			"person_id": personID,
+			"photos":    photoDocumentPrefix + "%",
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list revisions")
+	}
+	return docs, nil
+}
+
+//ListDocuments returns the latest revision of each document owned by the
+//person, except those of photos
+func ListDocuments(filter, personID string) ([]Document, error) {
+	docs := []Document{}
+	if err := NamedSelect(&docs,
+		"SELECT d.`id`,d.`name`,d.`revision`,d.`timestamp`,d.`loaded_by_person_id`,d.`content_id`,d.`content_type`,d.`filename`,d.`size` FROM `documents` d JOIN (SELECT `name`,MAX(`revision`) AS `revision` FROM `documents` WHERE `name` LIKE :filter AND"+ownedDocumentsSQL+" GROUP BY `name`) l ON l.`name`=d.`name` AND l.`revision`=d.`revision` ORDER BY d.`name`",
+		map[string]interface{}{
+			"filter":    "%" + filter + "%",
+			"person_id": personID,
+			"photos":    photoDocumentPrefix + "%",
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list documents")
+	}
+	return docs, nil
+}
+
+//AuthoriseDocument returns the document revision when the person owns the
+//document, i.e. uploaded its first revision. Documents of photos are only
+//available through their photos.
+func AuthoriseDocument(id, personID string) (*Document, error) {
+	if personID == "" {
+		return nil, errors.Errorc(http.StatusForbidden, "missing by_person_id")
+	}
+	d, err := GetDocument(id)
+	if err != nil {
+		return nil, err
+	}
+	var ownerID string
+	if err := db.Get(&ownerID, "SELECT `loaded_by_person_id` FROM `documents` WHERE `name`=? ORDER BY `revision` LIMIT 1", d.Name); err != nil {
+		return nil, errors.Wrapf(err, "failed to get document owner")
+	}
+	if ownerID != personID || strings.HasPrefix(d.Name, photoDocumentPrefix) {
+		return nil, errors.Errorc(http.StatusForbidden, "not your document")
+	}
+	return d, nil
+}
+
+//OpenDocument returns the document with its content, which the caller must
+//close. The content is an io.ReadSeeker when the blob store supports it.
+func OpenDocument(id string) (*Document, io.ReadCloser, error) {
+	d, err := GetDocument(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if blobs == nil {
+		return nil, nil, errors.Errorf("no blob store")
+	}
+	content, err := blobs.Get(d.ContentID)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to get content %s", d.ContentID)
+	}
+	return d, content, nil
+}
+
+//deleteDocument deletes a document revision and its content when no other
+//revision has the same content
+func deleteDocument(id string) error {
+	d, err := GetDocument(id)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM `documents` WHERE `id`=?", id); err != nil {
+		return errors.Wrapf(err, "failed to delete document")
+	}
+	var n int
+	if err := db.Get(&n, "SELECT COUNT(*) FROM `documents` WHERE `content_id`=?", d.ContentID); err != nil {
+		return errors.Wrapf(err, "failed to check content use")
+	}
+	if n == 0 && blobs != nil {
+		if err := blobs.Delete(d.ContentID); err != nil && err != blob.ErrNotFound {
+			return errors.Wrapf(err, "failed to delete content %s", d.ContentID)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,37 @@
+package db_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     string
+		filename string
+		declared string
+		expected string
+	}{
+		{name: "pdf", head: "%PDF-1.4\n", filename: "waiver.pdf", expected: "application/pdf"},
+		{name: "pdf declared as image", head: "%PDF-1.4\n", declared: "image/png", expected: "application/pdf"},
+		{name: "png", head: "\x89PNG\r\n\x1a\n", filename: "x.txt", expected: "image/png"},
+		{name: "html declared as pdf", head: "<html><script>alert(1)</script>", filename: "x.pdf", declared: "application/pdf", expected: "text/html; charset=utf-8"},
+		{name: "csv", head: "name,surname\nJan,Semmelink\n", filename: "entries.CSV", expected: "text/csv; charset=utf-8"},
+		{name: "docx is a zip", head: "PK\x03\x04", filename: "rules.docx", expected: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{name: "gpx", head: "<?xml version=\"1.0\"?><gpx>", filename: "route.gpx", expected: "application/gpx+xml"},
+		{name: "declared", head: "{\"a\":1}", declared: "application/json", expected: "application/json"},
+		{name: "declared html not trusted", head: "hello", declared: "text/html", expected: "text/plain; charset=utf-8"},
+		{name: "unknown", head: "\x00\x01\x02", expected: "application/octet-stream"},
+	}
+	for _, test := range tests {
+		if got := db.SniffContentType([]byte(test.head), test.filename, test.declared); got != test.expected {
+			t.Errorf("%s: %q expected %q", test.name, got, test.expected)
+		}
+	}
+	if got := db.SniffContentType([]byte(strings.Repeat("a", 512)), "", ""); got != "text/plain; charset=utf-8" {
+		t.Errorf("text: %q", got)
+	}
+}
@@ -0,0 +1,612 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//ProviderEFT is used for orders paid by bank transfer (EFT) and reconciled
+//from imported bank statements
+const ProviderEFT = "eft"
+
+//NewPaymentReference returns a reference "EV" + 8 digits + 2 check digits.
+//The check digits (ISO 7064 mod 97-10, as used in IBAN) catch any single
+//mistyped digit and any two swapped digits when the payer types it into the
+//bank's reference field.
+func NewPaymentReference() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+	if err != nil {
+		panic(fmt.Sprintf("no random numbers: %+v", err))
+	}
+	digits := fmt.Sprintf("%08d", n.Int64())
+	return "EV" + digits + fmt.Sprintf("%02d", 98-mod97(digits+"00"))
+}
+
+//ValidPaymentReference checks the format and check digits of a reference
+func ValidPaymentReference(ref string) bool {
+	if len(ref) != 12 || !strings.HasPrefix(ref, "EV") {
+		return false
+	}
+	for _, c := range ref[2:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return mod97(ref[2:]) == 1
+}
+
+func mod97(digits string) int {
+	m := 0
+	for _, c := range digits {
+		m = (m*10 + int(c-'0')) % 97
+	}
+	return m
+}
+
+//FindPaymentReference returns the first valid payment reference in the
+//description of a bank statement line, or "" if there is none. Banks often
+//change case and payers add spaces or dashes, so those are ignored.
+func FindPaymentReference(description string) string {
+	s := strings.ToUpper(description)
+	for i := strings.Index(s, "EV"); i >= 0; {
+		digits := ""
+		for _, c := range s[i+2:] {
+			if c >= '0' && c <= '9' {
+				digits += string(c)
+				if len(digits) == 10 {
+					break
+				}
+			} else if c != ' ' && c != '-' {
+				break
+			}
+		}
+		if ref := "EV" + digits; ValidPaymentReference(ref) {
+			return ref
+		}
+		next := strings.Index(s[i+2:], "EV")
+		if next < 0 {
+			break
+		}
+		i += 2 + next
+	}
+	return ""
+} //FindPaymentReference()
+
+//StatementLine is a credit on the bank statement of an organisation. Lines
+//that could not be applied in full to one order are flagged for manual
+//review.
+type StatementLine struct {
+	ID             string  `json:"id" db:"id"`
+	OrganisationID string  `json:"organisation_id" db:"organisation_id"`
+	Hash           string  `json:"-" db:"hash" doc:"Identifies the line when the same statement is imported again"`
+	Date           SqlTime `json:"date" db:"date"`
+	Amount         Amount  `json:"amount" db:"-"`
+	AmountCents    int     `json:"-" db:"amount_cents"`
+	Description    string  `json:"description" db:"description"`
+	Reference      string  `json:"reference,omitempty" db:"reference"`
+	OrderID        *string `json:"order_id,omitempty" db:"order_id"`
+	Status         string  `json:"status" db:"status"`
+	Note           string  `json:"note,omitempty" db:"note"`
+	Imported       SqlTime `json:"imported" db:"imported"`
+}
+
+const (
+	StatementMatched   = "matched"   //paid the order in full
+	StatementPartial   = "partial"   //order not yet paid in full
+	StatementOver      = "over"      //paid more than the order total, or order was already paid
+	StatementUnmatched = "unmatched" //no valid reference, unknown or expired order
+	StatementResolved  = "resolved"  //reviewed by hand
+)
+
+//ParseBankStatement parses an OFX or CSV bank statement export
+func ParseBankStatement(r io.Reader) ([]StatementLine, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read statement")
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) //UTF-8 BOM from spreadsheets
+	start := strings.ToUpper(string(data[:minInt(len(data), 1024)]))
+	if strings.Contains(start, "OFXHEADER") || strings.Contains(start, "<OFX>") {
+		return parseOFX(string(data))
+	}
+	return parseStatementCSV(data)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//parseOFX parses the transactions from OFX 1.x (SGML, often without closing
+//tags) or OFX 2.x (XML)
+func parseOFX(data string) ([]StatementLine, error) {
+	lines := []StatementLine{}
+	blocks := strings.Split(data, "<STMTTRN>")
+	for _, block := range blocks[1:] {
+		if end := strings.Index(block, "</STMTTRN>"); end >= 0 {
+			block = block[:end]
+		}
+		value := func(tag string) string {
+			i := strings.Index(block, "<"+tag+">")
+			if i < 0 {
+				return ""
+			}
+			v := block[i+len(tag)+2:]
+			if end := strings.Index(v, "<"); end >= 0 {
+				v = v[:end]
+			}
+			return strings.TrimSpace(v)
+		}
+		posted := value("DTPOSTED")
+		if len(posted) < 8 {
+			return nil, errors.Errorf("OFX transaction without DTPOSTED")
+		}
+		date, err := time.Parse("20060102", posted[:8])
+		if err != nil {
+			return nil, errors.Errorf("invalid OFX DTPOSTED \"%s\"", posted)
+		}
+		amount, err := parseStatementAmount(value("TRNAMT"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid OFX TRNAMT")
+		}
+		line := StatementLine{
+			Date:        SqlTime(date),
+			Amount:      amount,
+			AmountCents: amount.Cents,
+			Description: strings.TrimSpace(value("NAME") + " " + value("MEMO")),
+		}
+		if fitID := value("FITID"); fitID != "" {
+			line.Hash = "ofx:" + fitID
+		}
+		lines = append(lines, line)
+	}
+	setStatementHashes(lines)
+	return lines, nil
+} //parseOFX()
+
+//parseStatementCSV parses the CSV exports of the banks, which differ in
+//columns and may have account details above the header row. It looks for a
+//header with a date column and either an amount or credit/debit columns. All
+//reference/description columns are combined into the description.
+func parseStatementCSV(data []byte) ([]StatementLine, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid CSV")
+	}
+
+	dateCol, amountCol, creditCol, debitCol := -1, -1, -1, -1
+	descCols := []int{}
+	headerRow := -1
+	for i, record := range records {
+		dateCol, amountCol, creditCol, debitCol = -1, -1, -1, -1
+		descCols = []int{}
+		for c, name := range record {
+			name = strings.ToLower(strings.TrimSpace(name))
+			switch {
+			case strings.Contains(name, "date"):
+				if dateCol < 0 {
+					dateCol = c
+				}
+			case strings.Contains(name, "balance"):
+			case strings.Contains(name, "credit"):
+				creditCol = c
+			case strings.Contains(name, "debit"):
+				debitCol = c
+			case strings.Contains(name, "amount"):
+				amountCol = c
+			case strings.Contains(name, "desc") || strings.Contains(name, "detail") || strings.Contains(name, "narrative") || strings.Contains(name, "ref") || strings.Contains(name, "memo"):
+				descCols = append(descCols, c)
+			}
+		}
+		if dateCol >= 0 && (amountCol >= 0 || creditCol >= 0) {
+			headerRow = i
+			break
+		}
+	}
+	if headerRow < 0 {
+		return nil, errors.Errorf("CSV has no header row with date and amount or credit columns")
+	}
+
+	col := func(record []string, c int) string {
+		if c < 0 || c >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[c])
+	}
+	lines := []StatementLine{}
+	for i, record := range records[headerRow+1:] {
+		if col(record, dateCol) == "" {
+			continue //blank or summary lines
+		}
+		date, err := parseStatementDate(col(record, dateCol))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid row %d", headerRow+i+2)
+		}
+		var amount Amount
+		if amountCol >= 0 {
+			amount, err = parseStatementAmount(col(record, amountCol))
+		} else {
+			var credit, debit Amount
+			if credit, err = parseStatementAmount(col(record, creditCol)); err == nil {
+				if debit, err = parseStatementAmount(col(record, debitCol)); err == nil {
+					if debit.Cents < 0 {
+						debit = debit.Neg()
+					}
+					amount = credit.Sub(debit)
+				}
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid row %d", headerRow+i+2)
+		}
+		desc := []string{}
+		for _, c := range descCols {
+			if v := col(record, c); v != "" {
+				desc = append(desc, v)
+			}
+		}
+		lines = append(lines, StatementLine{
+			Date:        SqlTime(date),
+			Amount:      amount,
+			AmountCents: amount.Cents,
+			Description: strings.Join(desc, " "),
+		})
+	}
+	setStatementHashes(lines)
+	return lines, nil
+} //parseStatementCSV()
+
+//setStatementHashes identifies lines without a bank transaction id by their
+//content, counting identical lines so that two equal payments on the same day
+//stay two lines, while importing overlapping statements does not duplicate them
+func setStatementHashes(lines []StatementLine) {
+	seen := map[string]int{}
+	for i := range lines {
+		if lines[i].Hash != "" {
+			continue
+		}
+		content := fmt.Sprintf("%s|%d|%s", time.Time(lines[i].Date).Format("2006-01-02"), lines[i].AmountCents, lines[i].Description)
+		seen[content]++
+		lines[i].Hash = fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s|%d", content, seen[content]))))
+	}
+}
+
+var statementDateLayouts = []string{
+	"2006-01-02",
+	"2006/01/02",
+	"02/01/2006",
+	"02-01-2006",
+	"2 Jan 2006",
+	"02 Jan 2006",
+	"20060102",
+	"2006-01-02 15:04:05",
+}
+
+func parseStatementDate(s string) (time.Time, error) {
+	for _, layout := range statementDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid date \"%s\"", s)
+}
+
+//parseStatementAmount parses bank amounts like "1,250.00", "-350.5",
+//"(350.50)" and "350.50 Cr" or "350.50 Dr"
+func parseStatementAmount(s string) (Amount, error) {
+	a := Amount{Currency: DefaultCurrency}
+	v := strings.ToUpper(strings.TrimSpace(s))
+	if v == "" {
+		return a, nil
+	}
+	negative := false
+	switch {
+	case strings.HasSuffix(v, "CR"):
+		v = v[:len(v)-2]
+	case strings.HasSuffix(v, "DR"):
+		v = v[:len(v)-2]
+		negative = true
+	}
+	if err := a.Parse(v); err != nil {
+		return a, err
+	}
+	if a.Currency == nil {
+		a.Currency = DefaultCurrency
+	}
+	if a.Currency != DefaultCurrency {
+		return a, errors.Errorc(http.StatusBadRequest, "amount in "+a.Currency.Code+", only "+DefaultCurrency.Code+" is paid by EFT")
+	}
+	if negative {
+		a.Cents = -a.Cents
+	}
+	return a, nil
+} //parseStatementAmount()
+
+//StatementImport summarises the import of a bank statement
+type StatementImport struct {
+	Lines      []StatementLine `json:"lines" doc:"Credits imported from the statement"`
+	Duplicates int             `json:"duplicates" doc:"Nr of credits imported before"`
+	Matched    int             `json:"matched"`
+	Review     int             `json:"review" doc:"Nr of credits flagged for manual review"`
+}
+
+//ImportBankStatement applies the credits of the bank statement of an
+//organisation to its EFT orders by payment reference and amount, by an
+//organiser of the organisation. Debits are ignored. Lines imported before are
+//skipped, so overlapping statements can be imported.
+func ImportBankStatement(organisationID, byPersonID string, lines []StatementLine) (*StatementImport, error) {
+	if err := authoriseOrganisation(db, organisationID, byPersonID, OrganisationOrganiser); err != nil {
+		return nil, err
+	}
+	for i, line := range lines {
+		if line.Amount.Currency != nil && line.Amount.Currency != DefaultCurrency {
+			return nil, errors.Errorc(http.StatusBadRequest, fmt.Sprintf("line %d is in %s, only %s is paid by EFT", i+1, line.Amount.Currency.Code, DefaultCurrency.Code))
+		}
+	}
+	result := StatementImport{Lines: []StatementLine{}}
+	for _, line := range lines {
+		if line.AmountCents <= 0 {
+			continue
+		}
+		line.OrganisationID = organisationID
+		imported, err := importStatementLine(line)
+		if err != nil {
+			return &result, err
+		}
+		if imported == nil {
+			result.Duplicates++
+			continue
+		}
+		result.Lines = append(result.Lines, *imported)
+		if imported.Status == StatementMatched {
+			result.Matched++
+		} else {
+			result.Review++
+		}
+	}
+	return &result, nil
+}
+
+//importStatementLine returns nil if the line was imported before
+func importStatementLine(line StatementLine) (*StatementLine, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	line.ID = uuid.New().String()
+	line.Imported = SqlTime(time.Now())
+	line.Status = StatementUnmatched
+	line.Reference = FindPaymentReference(line.Description)
+	confirmed := false
+	if line.Reference == "" {
+		line.Note = "no valid payment reference"
+	} else {
+		var order Order
+		if err := tx.Get(&order,
+			statementOrderSQL+" WHERE o.`reference`=? AND COALESCE(o.`organisation_id`,e.`organisation_id`)=? FOR UPDATE",
+			line.Reference, line.OrganisationID,
+		); err != nil {
+			if err != sql.ErrNoRows {
+				return nil, errors.Wrapf(err, "failed to get order")
+			}
+			line.Note = "unknown payment reference"
+		} else if confirmed, err = applyStatementLine(tx, &line, order); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.NamedExec(
+		"INSERT INTO `bank_statement_lines` SET `id`=:id,`organisation_id`=:organisation_id,`hash`=:hash,`date`=:date,`amount_cents`=:amount_cents,`description`=:description,`reference`=:reference,`order_id`=:order_id,`status`=:status,`note`=:note,`imported`=:imported",
+		line,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, nil //imported before, rollback anything applied
+		}
+		return nil, errors.Wrapf(err, "failed to add statement line")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit statement line")
+	}
+	if confirmed {
+		if err := sendOrderConfirmation(*line.OrderID); err != nil {
+			log.Errorf("failed to send confirmation of order %s: %+v", *line.OrderID, err)
+		}
+	}
+	return &line, nil
+} //importStatementLine()
+
+//statementOrderSQL selects orders o with their events e, to only match lines
+//to the orders of the organisation that imported the statement
+const statementOrderSQL = "SELECT o.`id`,COALESCE(o.`event_id`,'') AS `event_id`,COALESCE(o.`organisation_id`,'') AS `organisation_id`,o.`status`,o.`total_cents`,o.`credit_cents` FROM `orders` o LEFT JOIN `events` e ON e.`id`=o.`event_id`"
+
+//applyStatementLine adds the line to what was received for the locked order
+//and confirms the order once paid in full. It returns true if confirmed.
+func applyStatementLine(tx *sqlx.Tx, line *StatementLine, order Order) (bool, error) {
+	line.OrderID = &order.ID
+	if err := postOrderLedger(tx, order, LedgerPayment, line.ID, "EFT for order "+order.ID, line.Amount, AccountBank, AccountOrganiser); err != nil {
+		return false, err
+	}
+	var receivedCents int
+	if err := tx.Get(&receivedCents,
+		"SELECT COALESCE(SUM(`amount_cents`),0) FROM `bank_statement_lines` WHERE `order_id`=? AND `id`!=?",
+		order.ID, line.ID,
+	); err != nil {
+		return false, errors.Wrapf(err, "failed to get amount received")
+	}
+	received := Amount{Currency: DefaultCurrency, Cents: receivedCents}.Add(line.Amount)
+	total := Amount{Currency: DefaultCurrency, Cents: order.DueCents()}
+	switch {
+	case order.Status == OrderExpired:
+		line.Status = StatementUnmatched
+		line.Note = "order expired before payment, entries were released"
+		return false, nil
+	case order.Status != OrderPending:
+		line.Status = StatementOver
+		line.Note = "order is already " + order.Status
+		return false, nil
+	case received.Cents < total.Cents:
+		line.Status = StatementPartial
+		line.Note = fmt.Sprintf("received %s of %s", received, total)
+		return false, nil
+	case received.Cents > total.Cents:
+		line.Status = StatementOver
+		line.Note = fmt.Sprintf("overpaid by %s", received.Sub(total))
+	default:
+		line.Status = StatementMatched
+	}
+	if err := confirmOrder(tx, order.ID); err != nil {
+		return false, err
+	}
+	return true, nil
+} //applyStatementLine()
+
+const statementLineColumns = "`id`,`organisation_id`,`hash`,`date`,`amount_cents`,`description`,`reference`,`order_id`,`status`,`note`,`imported`"
+
+//ListStatementLines lists the lines of the organisation with the specified
+//status, or all lines that need review when status is "review", to an
+//organiser of the organisation
+func ListStatementLines(organisationID, byPersonID, status string) ([]StatementLine, error) {
+	if err := authoriseOrganisation(db, organisationID, byPersonID, OrganisationOrganiser); err != nil {
+		return nil, err
+	}
+	statuses := []string{status}
+	if status == "review" {
+		statuses = []string{StatementPartial, StatementOver, StatementUnmatched}
+	}
+	query, args, err := sqlx.In(
+		"SELECT "+statementLineColumns+" FROM `bank_statement_lines` WHERE `organisation_id`=? AND `status` IN (?) ORDER BY `date`,`imported`",
+		organisationID, statuses,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to prepare query")
+	}
+	lines := []StatementLine{}
+	if err := db.Select(&lines, db.Rebind(query), args...); err != nil {
+		return nil, errors.Wrapf(err, "failed to list statement lines")
+	}
+	for i := range lines {
+		lines[i].Amount = Amount{Currency: DefaultCurrency, Cents: lines[i].AmountCents}
+	}
+	return lines, nil
+}
+
+type ResolveStatementLineRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the organisation of the statement"`
+	OrderID    string `json:"order_id,omitempty" doc:"Apply an unmatched line to this order of the organisation, e.g. when the payer used a wrong reference"`
+	Note       string `json:"note,omitempty" doc:"What was done, e.g. refunded the overpayment"`
+}
+
+func (req ResolveStatementLineRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.OrderID == "" && req.Note == "" {
+		return errors.Errorf("missing order_id or note")
+	}
+	return nil
+}
+
+//ResolveStatementLine applies an unmatched line to an order, or marks a line
+//that was handled by hand as resolved
+func ResolveStatementLine(id string, req ResolveStatementLineRequest) (*StatementLine, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	var line StatementLine
+	if err := tx.Get(&line,
+		"SELECT "+statementLineColumns+" FROM `bank_statement_lines` WHERE `id`=? FOR UPDATE",
+		id,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown statement line")
+		}
+		return nil, errors.Wrapf(err, "failed to get statement line")
+	}
+	if err := authoriseOrganisation(tx, line.OrganisationID, req.ByPersonID, OrganisationOrganiser); err != nil {
+		return nil, err
+	}
+	line.Amount = Amount{Currency: DefaultCurrency, Cents: line.AmountCents}
+	confirmed := false
+	if req.OrderID != "" {
+		if line.Status != StatementUnmatched || line.OrderID != nil {
+			return nil, errors.Errorc(http.StatusConflict, "only lines without an order can be applied to an order")
+		}
+		var order Order
+		if err := tx.Get(&order,
+			statementOrderSQL+" WHERE o.`id`=? AND COALESCE(o.`organisation_id`,e.`organisation_id`)=? FOR UPDATE",
+			req.OrderID, line.OrganisationID,
+		); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, errors.Errorc(http.StatusNotFound, "unknown order")
+			}
+			return nil, errors.Wrapf(err, "failed to get order")
+		}
+		if confirmed, err = applyStatementLine(tx, &line, order); err != nil {
+			return nil, err
+		}
+		if req.Note != "" {
+			line.Note = strings.TrimSpace(req.Note + ". " + line.Note)
+		}
+	} else {
+		line.Status = StatementResolved
+		line.Note = req.Note
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE `bank_statement_lines` SET `order_id`=:order_id,`status`=:status,`note`=:note WHERE `id`=:id",
+		line,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update statement line")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit")
+	}
+	if confirmed {
+		if err := sendOrderConfirmation(*line.OrderID); err != nil {
+			log.Errorf("failed to send confirmation of order %s: %+v", *line.OrderID, err)
+		}
+	}
+	return &line, nil
+} //ResolveStatementLine()
+
+//checkEFTEvent fails for events without an organisation, because EFT
+//payments are reconciled from the bank statements of organisations
+func checkEFTEvent(q sqlx.Queryer, eventID string) error {
+	var organisationID string
+	if err := sqlx.Get(q, &organisationID, "SELECT COALESCE(`organisation_id`,'') FROM `events` WHERE `id`=?", eventID); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.Errorc(http.StatusNotFound, "unknown event")
+		}
+		return errors.Wrapf(err, "failed to get event organisation")
+	}
+	if organisationID == "" {
+		return errors.Errorc(http.StatusBadRequest, "pay by EFT is only possible for events of an organisation")
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package db_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func TestPaymentReference(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		ref := db.NewPaymentReference()
+		if !db.ValidPaymentReference(ref) {
+			t.Fatalf("generated invalid reference %s", ref)
+		}
+		//every single digit typo and swap of adjacent digits must be detected
+		for p := 2; p < len(ref); p++ {
+			for d := '0'; d <= '9'; d++ {
+				if rune(ref[p]) == d {
+					continue
+				}
+				typo := ref[:p] + string(d) + ref[p+1:]
+				if db.ValidPaymentReference(typo) {
+					t.Fatalf("typo %s of %s is valid", typo, ref)
+				}
+			}
+			if p+1 < len(ref) && ref[p] != ref[p+1] {
+				swapped := ref[:p] + string(ref[p+1]) + string(ref[p]) + ref[p+2:]
+				if db.ValidPaymentReference(swapped) {
+					t.Fatalf("swapped %s of %s is valid", swapped, ref)
+				}
+			}
+		}
+		if found := db.FindPaymentReference("CAPITEC  " + strings.ToLower(ref[:6]) + " " + ref[6:] + " J SMITH"); found != ref {
+			t.Fatalf("found \"%s\" instead of %s", found, ref)
+		}
+	}
+	if found := db.FindPaymentReference("EVENT ENTRY EV1234567800"); found != "" {
+		t.Fatalf("found invalid reference \"%s\"", found)
+	}
+}
+
+func TestParseBankStatementCSV(t *testing.T) {
+	ref := db.NewPaymentReference()
+	csv := "\xef\xbb\xbfACCOUNT,62000000000\n" +
+		"Name,Events Club\n" +
+		"\n" +
+		"Date,Description,Reference,Amount,Balance\n" +
+		"2024/03/01,ACB CREDIT,\"" + ref + "\",\"1,250.00\",\"5,000.00\"\n" +
+		"2024/03/01,ACB CREDIT,\"" + ref + "\",\"1,250.00\",\"6,250.00\"\n" +
+		"2024/03/02,BANK CHARGES,,-35.5,\"6,214.50\"\n"
+	lines, err := db.ParseBankStatement(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines instead of 3", len(lines))
+	}
+	if lines[0].AmountCents != 125000 || lines[2].AmountCents != -3550 {
+		t.Fatalf("wrong amounts: %+v", lines)
+	}
+	if !time.Time(lines[0].Date).Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("wrong date %s", lines[0].Date)
+	}
+	if db.FindPaymentReference(lines[0].Description) != ref {
+		t.Fatalf("reference not in description \"%s\"", lines[0].Description)
+	}
+	if lines[0].Hash == lines[1].Hash {
+		t.Fatalf("equal payments on the same day got the same hash")
+	}
+
+	again, err := db.ParseBankStatement(strings.NewReader(csv))
+	if err != nil || again[1].Hash != lines[1].Hash {
+		t.Fatalf("hash differs when parsed again")
+	}
+
+	_, err = db.ParseBankStatement(strings.NewReader("a,b\n1,2\n"))
+	if err == nil {
+		t.Fatalf("parsed CSV without date and amount")
+	}
+
+	_, err = db.ParseBankStatement(strings.NewReader("Date,Description,Amount\n2024/03/01,ACB CREDIT,USD 100\n"))
+	if errors.Code(err) != http.StatusBadRequest {
+		t.Fatalf("parsed USD amount: %+v", err)
+	}
+}
+
+func TestParseBankStatementCreditDebitCSV(t *testing.T) {
+	lines, err := db.ParseBankStatement(strings.NewReader(
+		"Transaction Date,Details,Debit Amount,Credit Amount\n" +
+			"05/03/2024,PAYMENT RECEIVED,,300.5\n" +
+			"06/03/2024,FEE,12.00,\n"))
+	if err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	if len(lines) != 2 || lines[0].AmountCents != 30050 || lines[1].AmountCents != -1200 {
+		t.Fatalf("wrong lines: %+v", lines)
+	}
+	if time.Time(lines[0].Date).Month() != time.March || time.Time(lines[0].Date).Day() != 5 {
+		t.Fatalf("wrong date %s", lines[0].Date)
+	}
+}
+
+func TestParseBankStatementOFX(t *testing.T) {
+	ofx := `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+
+<OFX>
+<BANKMSGSRSV1><STMTTRNRS><STMTRS>
+<BANKTRANLIST>
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20240301120000[+2:SAST]
+<TRNAMT>250.00
+<FITID>202403010001
+<NAME>EFT J SMITH
+<MEMO>EV1234
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20240302
+<TRNAMT>-1500.25
+<FITID>202403020001
+<NAME>TRANSFER
+</STMTTRN>
+</BANKTRANLIST>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>`
+	lines, err := db.ParseBankStatement(strings.NewReader(ofx))
+	if err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines instead of 2", len(lines))
+	}
+	if lines[0].AmountCents != 25000 || lines[0].Description != "EFT J SMITH EV1234" || lines[0].Hash != "ofx:202403010001" {
+		t.Fatalf("wrong line: %+v", lines[0])
+	}
+	if lines[1].AmountCents != -150025 {
+		t.Fatalf("wrong line: %+v", lines[1])
+	}
+}
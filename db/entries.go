@@ -0,0 +1,468 @@
+package db
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//EventCategory divides the entrants of an event, e.g. "Men U/23" or "K2 Mixed".
+//Team categories are entered by crews of TeamSize members. The gender and age
+//limits are optional; for a crew the age is the combined age of the members.
+type EventCategory struct {
+	ID       string `json:"id" db:"id"`
+	EventID  string `json:"event_id" db:"event_id"`
+	Name     string `json:"name" db:"name"`
+	TeamSize int    `json:"team_size,omitempty" db:"team_size" doc:"Crew size, e.g. 2 for K2 or 4 for a relay, omit for individuals"`
+	Gender   string `json:"gender,omitempty" db:"gender" doc:"M, F or mixed, omit for any"`
+	MinAge   int    `json:"min_age,omitempty" db:"min_age" doc:"Age on the event date, combined age for crews"`
+	MaxAge   int    `json:"max_age,omitempty" db:"max_age"`
+}
+
+const CategoryGenderMixed = "mixed"
+
+const eventCategoryColumns = "`id`,`event_id`,`name`,`team_size`,`gender`,`min_age`,`max_age`"
+
+//Accepts returns true if entrants with the genders and ages on the event
+//date fit the category, which is one entrant for individual categories
+func (c EventCategory) Accepts(genders []string, ages []int) bool {
+	size := c.TeamSize
+	if size == 0 {
+		size = 1
+	}
+	if len(genders) != size || len(ages) != size {
+		return false
+	}
+	total := 0
+	for _, age := range ages {
+		total += age
+	}
+	if (c.MinAge > 0 && total < c.MinAge) || (c.MaxAge > 0 && total > c.MaxAge) {
+		return false
+	}
+	switch c.Gender {
+	case "":
+	case CategoryGenderMixed:
+		for _, g := range genders[1:] {
+			if g != genders[0] {
+				return true
+			}
+		}
+		return false
+	default:
+		for _, g := range genders {
+			if g != c.Gender {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//MatchingCategories returns the categories the entrants fit in
+func MatchingCategories(categories []EventCategory, genders []string, ages []int) []EventCategory {
+	matches := []EventCategory{}
+	for _, c := range categories {
+		if c.Accepts(genders, ages) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+//Entry is a person entered into an event (or sub-event) in a category, or a
+//crew in a team category with the person as captain
+type Entry struct {
+	ID         string       `json:"id" db:"id"`
+	EventID    string       `json:"event_id" db:"event_id"`
+	CategoryID *string      `json:"category_id,omitempty" db:"category_id"`
+	PersonID   string       `json:"person_id" db:"person_id"`
+	Status     string       `json:"status" db:"status"`
+	Created    SqlTime      `json:"created" db:"created"`
+	Bib        *string      `json:"bib,omitempty" db:"bib" doc:"Race number, set by organisers"`
+	TeamName   *string      `json:"team_name,omitempty" db:"team_name"`
+	CheckedIn  *SqlTime     `json:"checked_in,omitempty" db:"checked_in" doc:"Arrived on the day, set by organisers"`
+	Members    []TeamMember `json:"members,omitempty" db:"-" doc:"Crew of a team entry, including the captain"`
+}
+
+const (
+	EntryStatusPending   = "pending"
+	EntryStatusConfirmed = "confirmed"
+	EntryStatusWithdrawn = "withdrawn"
+)
+
+type NewEventCategoryRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	Name       string `json:"name"`
+	TeamSize   int    `json:"team_size,omitempty" doc:"Crew size for team categories, e.g. 2 for K2"`
+	Gender     string `json:"gender,omitempty" doc:"M, F or mixed, omit for any"`
+	MinAge     int    `json:"min_age,omitempty" doc:"Age on the event date, combined age for crews"`
+	MaxAge     int    `json:"max_age,omitempty"`
+}
+
+func (req *NewEventCategoryRequest) Validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	if req.TeamSize < 0 || req.TeamSize == 1 || req.TeamSize > 20 {
+		return errors.Errorf("team_size=%d, expecting 2..20 or 0 for individuals", req.TeamSize)
+	}
+	switch req.Gender {
+	case "", "M", "F":
+	case CategoryGenderMixed:
+		if req.TeamSize == 0 {
+			return errors.Errorf("gender mixed is only for team categories")
+		}
+	default:
+		return errors.Errorf("invalid gender \"%s\", expecting M|F|mixed", req.Gender)
+	}
+	if req.MinAge < 0 || req.MaxAge < 0 || (req.MaxAge > 0 && req.MaxAge < req.MinAge) {
+		return errors.Errorf("invalid ages %d..%d", req.MinAge, req.MaxAge)
+	}
+	return nil
+}
+
+func AddEventCategory(eventID string, req NewEventCategoryRequest) (*EventCategory, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	c := EventCategory{
+		ID:       uuid.New().String(),
+		EventID:  eventID,
+		Name:     req.Name,
+		TeamSize: req.TeamSize,
+		Gender:   req.Gender,
+		MinAge:   req.MinAge,
+		MaxAge:   req.MaxAge,
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO `event_categories` SET `id`=:id,`event_id`=:event_id,`name`=:name,`team_size`=:team_size,`gender`=:gender,`min_age`=:min_age,`max_age`=:max_age",
+		c,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorf("category \"%s\" already exists", req.Name)
+		}
+		return nil, errors.Wrapf(err, "failed to add category")
+	}
+	return &c, nil
+}
+
+func ListEventCategories(eventID string) ([]EventCategory, error) {
+	var categories []EventCategory
+	if err := NamedSelect(
+		&categories,
+		"SELECT "+eventCategoryColumns+" FROM `event_categories` WHERE `event_id`=:event_id ORDER BY `name`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get event categories")
+	}
+	return categories, nil
+}
+
+type NewEntryRequest struct {
+	PersonID   string                 `json:"person_id" doc:"Entrant, or captain of a crew"`
+	CategoryID string                 `json:"category_id" doc:"Omit to derive it from the entrants when only one category fits"`
+	Answers    map[string]interface{} `json:"answers" doc:"Answers to the event form by field key"`
+	TeamName   string                 `json:"team_name,omitempty" doc:"Default is the surnames of the crew"`
+	Members    []string               `json:"members,omitempty" doc:"Person IDs of the rest of the crew in team categories"`
+}
+
+func (req NewEntryRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	for i, id := range req.Members {
+		if id == "" {
+			return errors.Errorf("missing members[%d]", i)
+		}
+		if id == req.PersonID {
+			return errors.Errorf("members[%d] is the captain", i)
+		}
+		for _, other := range req.Members[:i] {
+			if other == id {
+				return errors.Errorf("members[%d] listed twice", i)
+			}
+		}
+	}
+	return nil
+}
+
+//AddEntry enters a person into a free event after validating the answers to
+//the event form. Entries into events with entry fees are made with Checkout().
+func AddEntry(eventID string, req NewEntryRequest) (*Entry, error) {
+	pricing, err := GetEventPricing(eventID)
+	if err != nil {
+		return nil, err
+	}
+	if len(pricing.Rules) > 0 {
+		return nil, errors.Errorc(http.StatusPaymentRequired, "event has entry fees, use checkout")
+	}
+	entry, values, err := prepareEntry(eventID, req)
+	if err != nil {
+		return nil, err
+	}
+	entry.Status = EntryStatusConfirmed
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if err := insertEntry(tx, *entry, values); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit entry")
+	}
+	notifyCrew(*entry)
+	return entry, nil
+} //AddEntry()
+
+//checkEntriesOpen refuses new entries once entries of the event closed
+func checkEntriesOpen(q sqlx.Queryer, eventID string, now time.Time) error {
+	var closes *SqlTime
+	if err := sqlx.Get(q, &closes, "SELECT `entries_close` FROM `events` WHERE `id`=?", eventID); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.Errorc(http.StatusNotFound, "unknown event")
+		}
+		return errors.Wrapf(err, "failed to get event")
+	}
+	if closes != nil && now.After(time.Time(*closes)) {
+		return errors.Errorc(http.StatusForbidden, "entries closed at "+closes.String())
+	}
+	return nil
+}
+
+//prepareEntry checks that entries are open, validates the category and the
+//answers to the event form, checks that the waivers were accepted and that the
+//person may enter members-only events, and returns the new entry with the
+//answers to store. The crew of a team entry is invited to confirm their
+//places, which checks their waivers and membership.
+func prepareEntry(eventID string, req NewEntryRequest) (*Entry, map[string]string, error) {
+	if err := req.Validate(); err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid request")
+	}
+	if err := checkEntriesOpen(db, eventID, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	entry := Entry{
+		ID:       uuid.New().String(),
+		EventID:  eventID,
+		PersonID: req.PersonID,
+		Status:   EntryStatusPending,
+		Created:  SqlTime(time.Now()),
+	}
+	categories, err := ListEventCategories(eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	crew, err := newCrew(db, eventID, append([]string{req.PersonID}, req.Members...))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(categories) > 0 {
+		if entry.CategoryID, err = crew.category(categories, req.CategoryID); err != nil {
+			return nil, nil, err
+		}
+	} else if req.CategoryID != "" {
+		return nil, nil, errors.Errorc(http.StatusBadRequest, "event has no categories")
+	} else if len(req.Members) > 0 {
+		return nil, nil, errors.Errorc(http.StatusBadRequest, "event has no team categories")
+	}
+	if len(req.Members) > 0 {
+		crew.team(&entry, req.TeamName)
+	}
+
+	form, err := GetEventForm(eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := form.ValidateAnswers(req.Answers, func(id string) (*Document, error) {
+		return AuthoriseDocument(id, req.PersonID)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkWaiversAccepted(db, eventID, req.PersonID); err != nil {
+		return nil, nil, err
+	}
+	if err := checkMembership(db, eventID, req.PersonID); err != nil {
+		return nil, nil, err
+	}
+	return &entry, values, nil
+} //prepareEntry()
+
+func insertEntry(tx *sqlx.Tx, entry Entry, values map[string]string) error {
+	if _, err := tx.NamedExec(
+		"INSERT INTO `entries` SET `id`=:id,`event_id`=:event_id,`category_id`=:category_id,`person_id`=:person_id,`status`=:status,`created`=:created,`team_name`=:team_name",
+		entry,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return errors.Errorc(http.StatusConflict, "person already entered")
+		}
+		return errors.Wrapf(err, "failed to add entry")
+	}
+	for _, m := range entry.Members {
+		if _, err := tx.NamedExec(
+			"INSERT INTO `entry_members` SET `entry_id`=:entry_id,`event_id`=:event_id,`person_id`=:person_id,`position`=:position,`captain`=:captain,`status`=:status,`responded`=:responded",
+			m,
+		); err != nil {
+			if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+				return errors.Errorc(http.StatusConflict, m.FirstName+" "+m.LastName+" already in a crew")
+			}
+			return errors.Wrapf(err, "failed to add crew member")
+		}
+	}
+	for key, value := range values {
+		if _, err := tx.Exec(
+			"INSERT INTO `entry_answers` SET `entry_id`=?,`key`=?,`value`=?",
+			entry.ID, key, value,
+		); err != nil {
+			return errors.Wrapf(err, "failed to add answer %s", key)
+		}
+	}
+	//entrants and their crew no longer wait for a place
+	personIDs := []string{entry.PersonID}
+	for _, m := range entry.Members {
+		personIDs = append(personIDs, m.PersonID)
+	}
+	query, args, err := sqlx.In("DELETE FROM `event_waitlist` WHERE `event_id`=? AND `person_id` IN (?)", entry.EventID, personIDs)
+	if err != nil {
+		return errors.Wrapf(err, "failed to make waitlist query")
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return errors.Wrapf(err, "failed to remove from waitlist")
+	}
+	return nil
+}
+
+//EntrySummary is an entry with the person and category names for listings
+type EntrySummary struct {
+	Entry
+	FirstName    string  `json:"first_name" db:"first_name"`
+	LastName     string  `json:"last_name" db:"last_name"`
+	Gender       string  `json:"gender" db:"gender"`
+	Dob          string  `json:"dob" db:"dob"`
+	CategoryName *string `json:"category_name,omitempty" db:"category_name"`
+}
+
+func ListEntries(eventID string) ([]EntrySummary, error) {
+	var entries []EntrySummary
+	if err := NamedSelect(
+		&entries,
+		"SELECT n.`id`,n.`event_id`,n.`category_id`,n.`person_id`,n.`status`,n.`created`,n.`bib`,n.`team_name`,n.`checked_in`,p.`first_name`,p.`last_name`,p.`gender`,p.`dob`,c.`name` AS category_name"+
+			" FROM `entries` AS n JOIN `persons` AS p ON n.`person_id`=p.`id`"+
+			" LEFT JOIN `event_categories` AS c ON n.`category_id`=c.`id`"+
+			" WHERE n.`event_id`=:event_id ORDER BY p.`last_name`,p.`first_name`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get entries")
+	}
+	return entries, nil
+}
+
+type SetEntryBibRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	Bib        string `json:"bib" doc:"Empty to remove the bib"`
+}
+
+func (req *SetEntryBibRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.Bib != "" {
+		var err error
+		if req.Bib, err = normaliseBib(req.Bib); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//SetEntryBib gives the entry a race number, which must be unique in the event
+func SetEntryBib(entryID string, req SetEntryBibRequest) error {
+	if err := req.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid request")
+	}
+	var eventID string
+	if err := db.Get(&eventID, "SELECT `event_id` FROM `entries` WHERE `id`=?", entryID); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.Errorc(http.StatusNotFound, "unknown entry")
+		}
+		return errors.Wrapf(err, "failed to get entry")
+	}
+	if ok, err := IsEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorc(http.StatusForbidden, "only organisers can set bibs")
+	}
+	var bib *string
+	if req.Bib != "" {
+		bib = &req.Bib
+	}
+	if _, err := db.Exec("UPDATE `entries` SET `bib`=? WHERE `id`=?", bib, entryID); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return errors.Errorc(http.StatusConflict, "bib "+req.Bib+" already used")
+		}
+		return errors.Wrapf(err, "failed to set bib")
+	}
+	return nil
+}
+
+type CheckInEntryRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	Undo       bool   `json:"undo,omitempty" doc:"true to undo a check-in made by mistake"`
+}
+
+func (req CheckInEntryRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	return nil
+}
+
+//CheckInEntry records that a confirmed entrant, with the crew, arrived on the
+//day. Checking in again keeps the first time.
+func CheckInEntry(entryID string, req CheckInEntryRequest) error {
+	if err := req.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid request")
+	}
+	var entry Entry
+	if err := db.Get(&entry, "SELECT `id`,`event_id`,`person_id`,`status` FROM `entries` WHERE `id`=?", entryID); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.Errorc(http.StatusNotFound, "unknown entry")
+		}
+		return errors.Wrapf(err, "failed to get entry")
+	}
+	if err := AuthoriseEventOrganiser(entry.EventID, req.ByPersonID); err != nil {
+		return err
+	}
+	if req.Undo {
+		if _, err := db.Exec("UPDATE `entries` SET `checked_in`=NULL,`checked_in_by_person_id`=NULL WHERE `id`=?", entryID); err != nil {
+			return errors.Wrapf(err, "failed to undo check-in")
+		}
+		return nil
+	}
+	if entry.Status != EntryStatusConfirmed {
+		return errors.Errorc(http.StatusConflict, "entry is "+entry.Status)
+	}
+	if _, err := db.Exec(
+		"UPDATE `entries` SET `checked_in`=?,`checked_in_by_person_id`=? WHERE `id`=? AND `checked_in` IS NULL",
+		SqlTime(time.Now()), req.ByPersonID, entryID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to check in")
+	}
+	return nil
+} //CheckInEntry()
@@ -1,7 +1,13 @@
 package db
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 )
 
 type EventSummary struct {
@@ -24,15 +30,25 @@ func ListEvents(filter string) ([]EventSummary, error) {
 }
 
 type Event struct {
-	Name          string `json:"name" db:"name"`
-	Description   string `json:"description"`
-	StartTime     string `json:"start_time" db:"start_time"`
-	EndTime       string `json:"end_time" db:"end_time"`
-	LocationID    string `json:"location_id" db:"location_id"`
-	Cost          Amount `json:"cost" db:"cost"`
-	ParentEventID string `json:"parent_event_id" db:"parent_event_id"`
+	ID                       string   `json:"id" db:"id"`
+	Name                     string   `json:"name" db:"name"`
+	Description              string   `json:"description"`
+	Date                     string   `json:"date" db:"date" doc:"Local date of the event CCYY-MM-DD"`
+	TimeZone                 string   `json:"time_zone" db:"time_zone" doc:"IANA time zone, e.g. Africa/Johannesburg, default from the location"`
+	StartTime                *SqlTime `json:"start_time,omitempty" db:"start_time" doc:"RFC 3339 with the offset of the event time zone"`
+	EndTime                  *SqlTime `json:"end_time,omitempty" db:"end_time"`
+	EntriesClose             *SqlTime `json:"entries_close,omitempty" db:"entries_close" doc:"No new entries after this time"`
+	LocationID               string   `json:"location_id" db:"location_id"`
+	Cost                     Amount   `json:"cost" db:"cost"`
+	ParentEventID            string   `json:"parent_event_id" db:"parent_event_id"`
+	OrganisationID           string   `json:"organisation_id,omitempty" db:"organisation_id" doc:"Owner of the event"`
+	MembersOnly              bool     `json:"members_only" db:"members_only"`
+	MembershipOrganisationID string   `json:"membership_organisation_id,omitempty" db:"membership_organisation_id" doc:"Whose members get member prices, when not the owner, e.g. a federation"`
 }
 
+//EventOrganiserRole is the role of the person who added the event
+const EventOrganiserRole = "organiser"
+
 type EventOrganiser struct {
 	EventID  string `json:"event_id"`
 	PersonID string `json:"person_id"`
@@ -44,28 +60,274 @@ type Filter struct {
 	Not  map[string]interface{}
 }
 
+//GetEvent returns the event with its times in its time zone
 func GetEvent(id string) (*Event, error) {
 	var event Event
 	if err := NamedGet(
 		&event,
-		"SELECT name,date FROM events WHERE id=:id",
+		"SELECT name,date,start_time,end_time,entries_close,COALESCE(location_id,'') AS location_id,COALESCE(organisation_id,'') AS organisation_id,members_only,COALESCE(membership_organisation_id,'') AS membership_organisation_id FROM events WHERE id=:id",
 		map[string]interface{}{
 			"id": id,
 		}); err != nil {
 		return nil, errors.Wrapf(err, "failed to get event details")
 	}
+	event.ID = id
+	loc, err := eventTimeZone(db, id)
+	if err != nil {
+		return nil, err
+	}
+	event.TimeZone = loc.String()
+	for _, t := range []*SqlTime{event.StartTime, event.EndTime, event.EntriesClose} {
+		if t != nil {
+			*t = t.In(loc)
+		}
+	}
 	return &event, nil
 }
 
+//Start is when the event starts, which is the start of its date in its time
+//zone when it has no start time
+func (e Event) Start() (time.Time, error) {
+	if e.StartTime != nil {
+		return time.Time(*e.StartTime), nil
+	}
+	loc, err := LoadTimeZone(e.TimeZone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	date := e.Date
+	if len(date) > 10 {
+		date = date[:10]
+	}
+	start, err := time.ParseInLocation("2006-01-02", date, loc)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid event date \"%s\"", e.Date)
+	}
+	return start, nil
+}
+
+type SetEventTimesRequest struct {
+	ByPersonID   string  `json:"by_person_id" doc:"Organiser of the event"`
+	TimeZone     string  `json:"time_zone,omitempty" doc:"IANA time zone, default is the current zone of the event"`
+	StartTime    string  `json:"start_time" doc:"RFC 3339, or CCYY-MM-DD HH:MM[:SS] in the time zone"`
+	EndTime      string  `json:"end_time,omitempty" doc:"RFC 3339, or CCYY-MM-DD HH:MM[:SS] in the time zone"`
+	EntriesClose *string `json:"entries_close,omitempty" doc:"RFC 3339, or CCYY-MM-DD HH:MM[:SS] in the time zone, not after start_time. Empty to clear, left out to keep."`
+}
+
+func (req SetEventTimesRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.StartTime == "" {
+		return errors.Errorf("missing start_time")
+	}
+	return nil
+}
+
+//SetEventTimes sets the time zone and times of the event, and when entries
+//close. Times are stored in UTC and the date of the event becomes the local
+//date of the start.
+func SetEventTimes(eventID string, req SetEventTimesRequest) (*Event, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if ok, err := IsEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can set event times")
+	}
+	var loc *time.Location
+	var err error
+	if req.TimeZone != "" {
+		loc, err = LoadTimeZone(req.TimeZone)
+	} else {
+		loc, err = eventTimeZone(db, eventID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	start, err := ParseEventTime(req.StartTime, loc)
+	if err != nil {
+		return nil, err
+	}
+	var end *SqlTime
+	if req.EndTime != "" {
+		t, err := ParseEventTime(req.EndTime, loc)
+		if err != nil {
+			return nil, err
+		}
+		if !t.After(start) {
+			return nil, errors.Errorc(http.StatusBadRequest, "end_time must be after start_time")
+		}
+		end = (*SqlTime)(&t)
+	}
+	var entriesClose *SqlTime
+	if req.EntriesClose == nil {
+		if err := db.Get(&entriesClose, "SELECT `entries_close` FROM `events` WHERE `id`=?", eventID); err != nil {
+			return nil, errors.Wrapf(err, "failed to get entries_close")
+		}
+	} else if *req.EntriesClose != "" {
+		t, err := ParseEventTime(*req.EntriesClose, loc)
+		if err != nil {
+			return nil, err
+		}
+		entriesClose = (*SqlTime)(&t)
+	}
+	if entriesClose != nil && time.Time(*entriesClose).After(start) {
+		return nil, errors.Errorc(http.StatusBadRequest, "entries_close must not be after start_time")
+	}
+	if _, err := db.Exec(
+		"UPDATE `events` SET `time_zone`=?,`start_time`=?,`end_time`=?,`entries_close`=?,`date`=? WHERE `id`=?",
+		loc.String(), SqlTime(start), end, entriesClose, start.Format("2006-01-02"), eventID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to set event times")
+	}
+	return GetEvent(eventID)
+} //SetEventTimes()
+
+//EventDetails is the event with everything shown on its detail page
+type EventDetails struct {
+	Event
+	Organisation  *Organisation  `json:"organisation,omitempty" doc:"Branding and contact details of the owner"`
+	Location      *Location      `json:"location,omitempty"`
+	Course        *GeoJSON       `json:"course,omitempty"`
+	Attachments   []Attachment   `json:"attachments" doc:"Those the person may see"`
+	Waivers       []Waiver       `json:"waivers" doc:"To accept before entering"`
+	Announcements []Announcement `json:"announcements"`
+}
+
+//GetEventDetails returns what the person may see, or what the public may see
+//without a person
+func GetEventDetails(id, personID string) (*EventDetails, error) {
+	event, err := GetEvent(id)
+	if err != nil {
+		return nil, err
+	}
+	details := EventDetails{Event: *event}
+	if event.OrganisationID != "" {
+		if details.Organisation, err = GetOrganisation(event.OrganisationID); err != nil {
+			return nil, err
+		}
+	}
+	if event.LocationID != "" {
+		if details.Location, err = GetLocation(event.LocationID); err != nil {
+			return nil, err
+		}
+	}
+	if course, err := GetEventCourse(id); err != nil {
+		return nil, err
+	} else if course != nil {
+		g := course.GeoJSON()
+		details.Course = &g
+	}
+	if details.Attachments, err = ListEventAttachments(id, personID); err != nil {
+		return nil, err
+	}
+	if details.Waivers, err = ListEventWaivers(id); err != nil {
+		return nil, err
+	}
+	if details.Announcements, err = ListAnnouncements(id, personID); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+func IsEventOrganiser(eventID, personID string) (bool, error) {
+	return isEventOrganiser(db, eventID, personID)
+}
+
+//AuthoriseEventOrganiser fails when the person is not an organiser of the
+//event, used to keep participant data within the organisers of each event
+func AuthoriseEventOrganiser(eventID, personID string) error {
+	if personID == "" {
+		return errors.Errorc(http.StatusForbidden, "missing by_person_id")
+	}
+	if ok, err := isEventOrganiser(db, eventID, personID); err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorc(http.StatusForbidden, "only organisers of the event can do this")
+	}
+	return nil
+}
+
+//isEventOrganiser checks if the person has any organiser role in the event,
+//or is an organiser or admin of the organisation that owns the event
+func isEventOrganiser(q sqlx.Queryer, eventID, personID string) (bool, error) {
+	var n int
+	if err := sqlx.Get(q, &n,
+		"SELECT (SELECT COUNT(*) FROM `event_organisers` WHERE `event_id`=? AND `person_id`=?)"+
+			"+(SELECT COUNT(*) FROM `events` e JOIN `organisation_members` m ON m.`organisation_id`=e.`organisation_id` WHERE e.`id`=? AND m.`person_id`=? AND m.`role` IN (?,?))",
+		eventID, personID,
+		eventID, personID, OrganisationOrganiser, OrganisationAdmin,
+	); err != nil {
+		return false, errors.Wrapf(err, "failed to check organiser")
+	}
+	return n > 0, nil
+}
+
 type NewEventRequest struct {
-	Name string `json:"name"`
-	Date string `json:"data"`
+	ByPersonID     string `json:"by_person_id" doc:"Becomes an organiser of the event"`
+	Name           string `json:"name"`
+	Date           string `json:"date" doc:"Local date CCYY-MM-DD"`
+	OrganisationID string `json:"organisation_id,omitempty" doc:"Owner of the event, by an organiser of the organisation"`
+}
+
+func (req NewEventRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	if _, err := time.Parse("2006-01-02", req.Date); err != nil {
+		return errors.Errorf("invalid date \"%s\", expecting CCYY-MM-DD", req.Date)
+	}
+	return nil
 }
 
-func AddEvent(NewEventRequest) (*Event, error) {
-	...get auth details to know who is the organiser
+//AddEvent adds an event with the person making it as organiser. An event of
+//an organisation can only be added by its organisers and admins, who are
+//then organisers of the event too.
+func AddEvent(req NewEventRequest) (*Event, error) {
 	//allow multiple persons to be added/removed as organisers
 	//create list of event contacts, e.g. "organisers":..., "enquiries":..., "admin":... and allow them to edit the list
 	//need ultimately to grant them individually access to event operations, but can do that later because will need profiles of what is allowed for role of helper.
-	return nil, errors.Errorf("NYI")
-}
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	var organisationID *string
+	if req.OrganisationID != "" {
+		if err := authoriseOrganisation(tx, req.OrganisationID, req.ByPersonID, OrganisationOrganiser); err != nil {
+			return nil, err
+		}
+		organisationID = &req.OrganisationID
+	}
+	id := uuid.New().String()
+	if _, err := tx.Exec(
+		"INSERT INTO `events` SET `id`=?,`name`=?,`date`=?,`organisation_id`=?",
+		id, req.Name, req.Date, organisationID,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorc(http.StatusConflict, "event \""+req.Name+"\" already exists")
+		}
+		return nil, errors.Wrapf(err, "failed to add event")
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO `event_organisers` SET `event_id`=?,`person_id`=?,`role`=?",
+		id, req.ByPersonID, EventOrganiserRole,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1452 {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown person")
+		}
+		return nil, errors.Wrapf(err, "failed to add organiser")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit event")
+	}
+	return GetEvent(id)
+} //AddEvent()
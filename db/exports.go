@@ -0,0 +1,234 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//ExportFilter selects the entries of an event to export. Entries of its
+//sub-events are included, unless one sub-event is selected.
+type ExportFilter struct {
+	EventID    string `db:"event_id"`
+	SubEventID string `db:"sub_event_id" doc:"Optional event or one of its sub-events"`
+	CategoryID string `db:"category_id" doc:"Optional category"`
+	ByPersonID string `db:"-" doc:"Organiser of the event"`
+}
+
+func (f ExportFilter) Validate() error {
+	if f.EventID == "" {
+		return errors.Errorf("missing event_id")
+	}
+	return AuthoriseEventOrganiser(f.EventID, f.ByPersonID)
+}
+
+//Where selects the entries n in events e
+func (f ExportFilter) Where() string {
+	where := " WHERE (e.`id`=:event_id OR e.`parent_event_id`=:event_id)"
+	if f.SubEventID != "" {
+		where += " AND e.`id`=:sub_event_id"
+	}
+	if f.CategoryID != "" {
+		where += " AND n.`category_id`=:category_id"
+	}
+	return where
+}
+
+//ExportEntry is an entry with the entrant, crew, answers and payment
+type ExportEntry struct {
+	EntryID       string            `db:"entry_id"`
+	EventID       string            `db:"event_id"`
+	EventName     string            `db:"event_name"`
+	Bib           *string           `db:"bib"`
+	CategoryName  *string           `db:"category_name"`
+	TeamName      *string           `db:"team_name"`
+	Crew          *string           `db:"crew" doc:"Names of the other members of a team entry"`
+	FirstName     string            `db:"first_name"`
+	LastName      string            `db:"last_name"`
+	Gender        string            `db:"gender"`
+	Dob           string            `db:"dob"`
+	Age           int               `db:"age" doc:"Age on the day of the event"`
+	Email         *string           `db:"email"`
+	Phone         *string           `db:"phone"`
+	Status        string            `db:"status"`
+	Created       SqlTime           `db:"created"`
+	PaymentStatus *string           `db:"payment_status" doc:"Status of the latest order of the entry, nil when never ordered"`
+	PaidCents     int               `db:"paid_cents"`
+	RefundedCents int               `db:"refunded_cents"`
+	Answers       map[string]string `db:"-"`
+	AnswersJSON   *string           `db:"answers"`
+}
+
+const exportEntrySelectSQL = "SELECT n.`id` AS `entry_id`,n.`event_id`,e.`name` AS `event_name`,n.`bib`,c.`name` AS `category_name`,n.`team_name`," +
+	"(SELECT GROUP_CONCAT(CONCAT(mp.`first_name`,' ',mp.`last_name`) ORDER BY m.`position` SEPARATOR ', ')" +
+	" FROM `entry_members` m JOIN `persons` mp ON mp.`id`=m.`person_id` WHERE m.`entry_id`=n.`id` AND m.`person_id`<>n.`person_id` AND m.`status`<>'" + TeamMemberDeclined + "') AS `crew`," +
+	"p.`first_name`,p.`last_name`,p.`gender`,p.`dob`,TIMESTAMPDIFF(YEAR,p.`dob`,e.`date`) AS `age`,p.`email`,p.`phone`,n.`status`,n.`created`," +
+	"(SELECT o.`status` FROM `order_lines` l JOIN `orders` o ON o.`id`=l.`order_id` WHERE l.`entry_id`=n.`id` ORDER BY o.`created` DESC LIMIT 1) AS `payment_status`," +
+	"(SELECT COALESCE(SUM(l.`amount_cents`),0) FROM `order_lines` l JOIN `orders` o ON o.`id`=l.`order_id` WHERE l.`entry_id`=n.`id` AND o.`status` IN ('" + OrderPaid + "','" + OrderRefunded + "')) AS `paid_cents`," +
+	"(SELECT COALESCE(SUM(r.`amount_cents`),0) FROM `refunds` r WHERE r.`entry_id`=n.`id` AND r.`status`='" + RefundCompleted + "') AS `refunded_cents`," +
+	"(SELECT JSON_OBJECTAGG(a.`key`,a.`value`) FROM `entry_answers` a WHERE a.`entry_id`=n.`id`) AS `answers`" +
+	" FROM `entries` n JOIN `events` e ON e.`id`=n.`event_id` JOIN `persons` p ON p.`id`=n.`person_id`" +
+	" LEFT JOIN `event_categories` c ON c.`id`=n.`category_id`"
+
+//Paid is the amount paid for the entry, before refunds
+func (x ExportEntry) Paid() Amount {
+	return Amount{Currency: DefaultCurrency, Cents: x.PaidCents}
+}
+
+//Refunded is the amount of completed refunds
+func (x ExportEntry) Refunded() Amount {
+	return Amount{Currency: DefaultCurrency, Cents: x.RefundedCents}
+}
+
+//ExportFields returns the questions of the selected events in form order,
+//the main event first, to use as columns for the answers
+func ExportFields(f ExportFilter) ([]FormField, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	var fields []FormField
+	if err := NamedSelect(
+		&fields,
+		"SELECT f.`event_id`,f.`key`,f.`label`,f.`type`,f.`required`,f.`position`"+
+			" FROM `event_form_fields` f JOIN `events` e ON e.`id`=f.`event_id`"+
+			" WHERE (e.`id`=:event_id OR e.`parent_event_id`=:event_id) AND (:sub_event_id='' OR e.`id`=:sub_event_id)"+
+			" ORDER BY e.`id`<>:event_id,e.`date`,e.`name`,f.`position`",
+		f,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get questions")
+	}
+	//sub-events may ask the same questions
+	unique := []FormField{}
+	keys := map[string]bool{}
+	for _, field := range fields {
+		if !keys[field.Key] {
+			keys[field.Key] = true
+			unique = append(unique, field)
+		}
+	}
+	return unique, nil
+} //ExportFields()
+
+//ExportEntries calls fnc for each selected entry by name, reading one row at
+//a time so that large events are not loaded into memory
+func ExportEntries(f ExportFilter, fnc func(ExportEntry) error) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	return exportEntries(exportEntrySelectSQL+f.Where()+" ORDER BY p.`last_name`,p.`first_name`", f, fnc)
+}
+
+//ExportStartList calls fnc for each confirmed entry in start order, which is
+//by event, category and bib
+func ExportStartList(f ExportFilter, fnc func(ExportEntry) error) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	return exportEntries(
+		exportEntrySelectSQL+f.Where()+" AND n.`status`='"+EntryStatusConfirmed+"'"+
+			" ORDER BY e.`date`,e.`name`,c.`name`,n.`bib` IS NULL,LENGTH(n.`bib`),n.`bib`,p.`last_name`,p.`first_name`",
+		f, fnc)
+}
+
+func exportEntries(query string, f ExportFilter, fnc func(ExportEntry) error) error {
+	loc, err := eventTimeZone(db, f.EventID)
+	if err != nil {
+		return err
+	}
+	rows, err := db.NamedQuery(query, f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get entries")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var x ExportEntry
+		if err := rows.StructScan(&x); err != nil {
+			return errors.Wrapf(err, "failed to read entry")
+		}
+		x.Created = x.Created.In(loc)
+		x.Answers = map[string]string{}
+		if x.AnswersJSON != nil {
+			if err := json.Unmarshal([]byte(*x.AnswersJSON), &x.Answers); err != nil {
+				return errors.Wrapf(err, "invalid answers of entry %s", x.EntryID)
+			}
+		}
+		if err := fnc(x); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+} //exportEntries()
+
+//ExportResult is a result with the names of the crew
+type ExportResult struct {
+	EntryResult
+	EventName string  `db:"event_name"`
+	Crew      *string `db:"crew"`
+}
+
+//ExportResults calls fnc for each result in ranked order, by event when
+//sub-events are included. Positions are counted while reading, as done by
+//RankResults, so that the results need not be loaded into memory.
+func ExportResults(f ExportFilter, fnc func(ExportResult) error) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	rows, err := db.NamedQuery(
+		"SELECT r.`entry_id`,r.`event_id`,e.`name` AS `event_name`,r.`status`,r.`elapsed_ms`,r.`recorded`,r.`recorded_by_person_id`,n.`bib`,n.`person_id`,p.`first_name`,p.`last_name`,n.`team_name`,n.`category_id`,c.`name` AS `category_name`,"+
+			"(SELECT GROUP_CONCAT(CONCAT(mp.`first_name`,' ',mp.`last_name`) ORDER BY m.`position` SEPARATOR ', ')"+
+			" FROM `entry_members` m JOIN `persons` mp ON mp.`id`=m.`person_id` WHERE m.`entry_id`=n.`id` AND m.`person_id`<>n.`person_id` AND m.`status`<>'"+TeamMemberDeclined+"') AS `crew`"+
+			" FROM `entry_results` r JOIN `entries` n ON n.`id`=r.`entry_id` JOIN `events` e ON e.`id`=r.`event_id` JOIN `persons` p ON p.`id`=n.`person_id`"+
+			" LEFT JOIN `event_categories` c ON c.`id`=n.`category_id`"+
+			f.Where()+
+			" ORDER BY e.`date`,e.`name`,r.`event_id`,FIELD(r.`status`,'"+ResultFinished+"','"+ResultDidNotFinish+"','"+ResultDisqualified+"','"+ResultDidNotStart+"'),r.`elapsed_ms`,p.`last_name`,p.`first_name`",
+		f,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get results")
+	}
+	defer rows.Close()
+	//overall positions are unknown when reading only one category
+	ranker := ResultRanker{Overall: f.CategoryID == ""}
+	for rows.Next() {
+		var x ExportResult
+		if err := rows.StructScan(&x); err != nil {
+			return errors.Wrapf(err, "failed to read result")
+		}
+		ranker.Rank(&x.EntryResult)
+		if err := fnc(x); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+} //ExportResults()
+
+//ResultRanker gives positions to results read one at a time in ranked
+//order, event by event
+type ResultRanker struct {
+	Overall    bool //false to give only category positions
+	eventID    string
+	overall    ranking
+	categories map[string]*ranking
+}
+
+func (rr *ResultRanker) Rank(r *EntryResult) {
+	if r.EventID != rr.eventID || rr.categories == nil {
+		rr.eventID = r.EventID
+		rr.overall = ranking{}
+		rr.categories = map[string]*ranking{}
+	}
+	if r.Status != ResultFinished || r.ElapsedMs == nil {
+		return
+	}
+	r.Elapsed = FormatElapsed(time.Duration(*r.ElapsedMs) * time.Millisecond)
+	if rr.Overall {
+		r.Position = rr.overall.next(*r.ElapsedMs)
+	}
+	if r.CategoryID != nil {
+		if rr.categories[*r.CategoryID] == nil {
+			rr.categories[*r.CategoryID] = &ranking{}
+		}
+		r.CategoryPosition = rr.categories[*r.CategoryID].next(*r.ElapsedMs)
+	}
+} //ResultRanker.Rank()
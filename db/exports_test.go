@@ -0,0 +1,89 @@
+package db_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestExportFilterWhere(t *testing.T) {
+	tests := []struct {
+		filter   db.ExportFilter
+		contains []string
+		excludes []string
+	}{
+		{
+			filter:   db.ExportFilter{EventID: "e1"},
+			contains: []string{"e.`parent_event_id`=:event_id"},
+			excludes: []string{":sub_event_id", ":category_id"},
+		},
+		{
+			filter:   db.ExportFilter{EventID: "e1", SubEventID: "e2"},
+			contains: []string{"e.`parent_event_id`=:event_id", "AND e.`id`=:sub_event_id"},
+			excludes: []string{":category_id"},
+		},
+		{
+			filter:   db.ExportFilter{EventID: "e1", CategoryID: "c1"},
+			contains: []string{"e.`parent_event_id`=:event_id", "AND n.`category_id`=:category_id"},
+			excludes: []string{":sub_event_id"},
+		},
+	}
+	for _, test := range tests {
+		where := test.filter.Where()
+		if !strings.HasPrefix(where, " WHERE ") {
+			t.Fatalf("%+v: not a where clause: %s", test.filter, where)
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(where, s) {
+				t.Fatalf("%+v: %s does not select %s", test.filter, where, s)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(where, s) {
+				t.Fatalf("%+v: %s selects %s", test.filter, where, s)
+			}
+		}
+	}
+}
+
+func TestResultRanker(t *testing.T) {
+	ms := func(ms int64) *int64 { return &ms }
+	cat := func(id string) *string { return &id }
+	//read in ranked order, event by event
+	results := []db.EntryResult{
+		{EventID: "e1", Status: db.ResultFinished, ElapsedMs: ms(3600000), CategoryID: cat("k1")},
+		{EventID: "e1", Status: db.ResultFinished, ElapsedMs: ms(3700000), CategoryID: cat("k2")},
+		{EventID: "e1", Status: db.ResultFinished, ElapsedMs: ms(3700000), CategoryID: cat("k1")},
+		{EventID: "e1", Status: db.ResultFinished, ElapsedMs: ms(3800000), CategoryID: cat("k1")},
+		{EventID: "e1", Status: db.ResultDidNotFinish, CategoryID: cat("k1")},
+		{EventID: "e2", Status: db.ResultFinished, ElapsedMs: ms(1800000), CategoryID: cat("k1")},
+	}
+	expected := []struct {
+		position, categoryPosition int
+		elapsed                    string
+	}{
+		{1, 1, "1:00:00"},
+		{2, 1, "1:01:40"},
+		{2, 2, "1:01:40"}, //tied
+		{4, 3, "1:03:20"},
+		{0, 0, ""},
+		{1, 1, "0:30:00"}, //next event starts again
+	}
+	ranker := db.ResultRanker{Overall: true}
+	for i := range results {
+		ranker.Rank(&results[i])
+		r := results[i]
+		if r.Position != expected[i].position || r.CategoryPosition != expected[i].categoryPosition || r.Elapsed != expected[i].elapsed {
+			t.Fatalf("result %d: got %d/%d %s instead of %+v", i, r.Position, r.CategoryPosition, r.Elapsed, expected[i])
+		}
+	}
+
+	//one category only has category positions
+	one := db.EntryResult{EventID: "e1", Status: db.ResultFinished, ElapsedMs: ms(3600000), CategoryID: cat("k1")}
+	ranker = db.ResultRanker{}
+	ranker.Rank(&one)
+	if one.Position != 0 || one.CategoryPosition != 1 {
+		t.Fatalf("got %d/%d for one category", one.Position, one.CategoryPosition)
+	}
+}
@@ -0,0 +1,359 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//FormField is an extra question asked when entering an event,
+//e.g. T-shirt size, club, boat class or dietary needs
+type FormField struct {
+	EventID   string         `json:"-" db:"event_id"`
+	Key       string         `json:"key" db:"key" doc:"Unique name of the field in the event form, e.g. \"tshirt_size\""`
+	Label     string         `json:"label" db:"label"`
+	Type      string         `json:"type" db:"type" doc:"text|number|select|multi_select|date|file"`
+	Required  bool           `json:"required" db:"required"`
+	Options   []string       `json:"options,omitempty" db:"-" doc:"Values allowed for select and multi_select, content types allowed for file, e.g. \"application/pdf\" or \"image/*\""`
+	Condition *FormCondition `json:"condition,omitempty" db:"-" doc:"Only ask this question when the condition is met"`
+	Position  int            `json:"-" db:"position"`
+
+	//stored as JSON text
+	OptionsJSON   string `json:"-" db:"options"`
+	ConditionJSON string `json:"-" db:"condition"`
+}
+
+//FormCondition makes a field applicable only when another field has one of the values
+type FormCondition struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+}
+
+const (
+	FieldText        = "text"
+	FieldNumber      = "number"
+	FieldSelect      = "select"
+	FieldMultiSelect = "multi_select"
+	FieldDate        = "date"
+	FieldFile        = "file" //answer is the id of an uploaded document
+)
+
+//MaxFileAnswerSize limits the document given as answer to a file field
+const MaxFileAnswerSize = 10 << 20
+
+var fieldKeyRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+//EventForm is the list of questions for entries into an event
+type EventForm struct {
+	Fields []FormField `json:"fields"`
+}
+
+func (form *EventForm) Validate() error {
+	keys := map[string]int{}
+	for i := range form.Fields {
+		f := &form.Fields[i]
+		if !fieldKeyRegex.MatchString(f.Key) {
+			return errors.Errorf("field[%d] invalid key \"%s\", expecting lowercase snake_case", i, f.Key)
+		}
+		if _, ok := keys[f.Key]; ok {
+			return errors.Errorf("field[%d] duplicate key \"%s\"", i, f.Key)
+		}
+		keys[f.Key] = i
+		f.Label = strings.TrimSpace(f.Label)
+		if f.Label == "" {
+			return errors.Errorf("field[%d] %s missing label", i, f.Key)
+		}
+		switch f.Type {
+		case FieldText, FieldNumber, FieldDate:
+			f.Options = nil
+		case FieldFile:
+			for _, contentType := range f.Options {
+				if parts := strings.SplitN(contentType, "/", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+					return errors.Errorf("field[%d] %s invalid content type \"%s\", expecting e.g. application/pdf or image/*", i, f.Key, contentType)
+				}
+			}
+		case FieldSelect, FieldMultiSelect:
+			if len(f.Options) == 0 {
+				return errors.Errorf("field[%d] %s type %s without options", i, f.Key, f.Type)
+			}
+		default:
+			return errors.Errorf("field[%d] %s invalid type \"%s\", expecting text|number|select|multi_select|date|file", i, f.Key, f.Type)
+		}
+		if f.Condition != nil {
+			//only refer to earlier fields, so conditions cannot loop
+			ci, ok := keys[f.Condition.Key]
+			if !ok || ci == i {
+				return errors.Errorf("field[%d] %s condition refers to \"%s\" which is not an earlier field", i, f.Key, f.Condition.Key)
+			}
+			if len(f.Condition.Values) == 0 {
+				return errors.Errorf("field[%d] %s condition without values", i, f.Key)
+			}
+		}
+		f.Position = i
+	}
+	return nil
+} //EventForm.Validate()
+
+func GetEventForm(eventID string) (*EventForm, error) {
+	var fields []FormField
+	if err := NamedSelect(
+		&fields,
+		"SELECT `event_id`,`key`,`label`,`type`,`required`,`options`,`condition`,`position` FROM `event_form_fields` WHERE `event_id`=:event_id ORDER BY `position`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get event form")
+	}
+	for i := range fields {
+		f := &fields[i]
+		if f.OptionsJSON != "" {
+			if err := json.Unmarshal([]byte(f.OptionsJSON), &f.Options); err != nil {
+				return nil, errors.Wrapf(err, "invalid options stored for field %s", f.Key)
+			}
+		}
+		if f.ConditionJSON != "" {
+			f.Condition = &FormCondition{}
+			if err := json.Unmarshal([]byte(f.ConditionJSON), f.Condition); err != nil {
+				return nil, errors.Wrapf(err, "invalid condition stored for field %s", f.Key)
+			}
+		}
+	}
+	return &EventForm{Fields: fields}, nil
+} //GetEventForm()
+
+type SetEventFormRequest struct {
+	EventForm
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+}
+
+//SetEventForm replaces the form of an event. Answers are stored by field key,
+//so answers given before remain linked to fields that keep the same key.
+func SetEventForm(eventID string, req SetEventFormRequest) error {
+	form := req.EventForm
+	if err := form.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid form")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM `event_form_fields` WHERE `event_id`=?", eventID); err != nil {
+		return errors.Wrapf(err, "failed to delete old form")
+	}
+	for _, f := range form.Fields {
+		f.EventID = eventID
+		f.OptionsJSON = ""
+		if len(f.Options) > 0 {
+			jsonOptions, _ := json.Marshal(f.Options)
+			f.OptionsJSON = string(jsonOptions)
+		}
+		f.ConditionJSON = ""
+		if f.Condition != nil {
+			jsonCondition, _ := json.Marshal(f.Condition)
+			f.ConditionJSON = string(jsonCondition)
+		}
+		if _, err := tx.NamedExec(
+			"INSERT INTO `event_form_fields` SET `event_id`=:event_id,`key`=:key,`label`=:label,`type`=:type,`required`=:required,`options`=:options,`condition`=:condition,`position`=:position",
+			f,
+		); err != nil {
+			return errors.Wrapf(err, "failed to add field %s", f.Key)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit form")
+	}
+	return nil
+} //SetEventForm()
+
+//ValidateAnswers checks the answers against the form and returns the value
+//to store for each field, e.g. "2022-06-24" for a date or "[\"veg\",\"halal\"]"
+//for a multi_select. Answers to fields not in the form are not allowed.
+//The answer to a file field is the id of a document, got with getDocument
+//to check that the entrant may use it and its type and size.
+func (form EventForm) ValidateAnswers(answers map[string]interface{}, getDocument func(id string) (*Document, error)) (map[string]string, error) {
+	values := map[string]string{}
+	fieldByKey := map[string]FormField{}
+	for _, f := range form.Fields {
+		fieldByKey[f.Key] = f
+	}
+	for key := range answers {
+		if _, ok := fieldByKey[key]; !ok {
+			return nil, errors.Errorc(http.StatusBadRequest, fmt.Sprintf("unknown field \"%s\"", key))
+		}
+	}
+	for _, f := range form.Fields {
+		if f.Condition != nil && !conditionMet(*f.Condition, values) {
+			if _, ok := answers[f.Key]; ok {
+				return nil, errors.Errorc(http.StatusBadRequest, fmt.Sprintf("%s does not apply", f.Label))
+			}
+			continue
+		}
+		answer, ok := answers[f.Key]
+		if !ok || answer == nil || answer == "" {
+			if f.Required {
+				return nil, errors.Errorc(http.StatusBadRequest, fmt.Sprintf("missing %s", f.Label))
+			}
+			continue
+		}
+		value, err := f.answerValue(answer)
+		if err != nil {
+			return nil, errors.Errorc(http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", f.Label, err))
+		}
+		if f.Type == FieldFile {
+			if err := f.checkDocument(value, getDocument); err != nil {
+				return nil, err
+			}
+		}
+		values[f.Key] = value
+	}
+	return values, nil
+} //EventForm.ValidateAnswers()
+
+//checkDocument checks the document answered to a file field
+func (f FormField) checkDocument(id string, getDocument func(id string) (*Document, error)) error {
+	d, err := getDocument(id)
+	if err != nil {
+		if errors.Code(err) > 0 {
+			return errors.Errorc(http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", f.Label, err))
+		}
+		return errors.Wrapf(err, "failed to get document for %s", f.Label)
+	}
+	if d.Size > MaxFileAnswerSize {
+		return errors.Errorc(http.StatusBadRequest, fmt.Sprintf("invalid %s: %d bytes is more than %d", f.Label, d.Size, MaxFileAnswerSize))
+	}
+	if len(f.Options) == 0 {
+		return nil
+	}
+	contentType := strings.ToLower(strings.TrimSpace(strings.SplitN(d.ContentType, ";", 2)[0]))
+	for _, allowed := range f.Options {
+		allowed = strings.ToLower(allowed)
+		if contentType == allowed || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*"))) {
+			return nil
+		}
+	}
+	return errors.Errorc(http.StatusBadRequest, fmt.Sprintf("invalid %s: %s is not %s", f.Label, d.ContentType, strings.Join(f.Options, "|")))
+} //FormField.checkDocument()
+
+func conditionMet(c FormCondition, values map[string]string) bool {
+	value, ok := values[c.Key]
+	if !ok {
+		return false
+	}
+	var selected []string
+	if err := json.Unmarshal([]byte(value), &selected); err != nil {
+		selected = []string{value} //not a multi_select
+	}
+	for _, s := range selected {
+		for _, v := range c.Values {
+			if s == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f FormField) answerValue(answer interface{}) (string, error) {
+	switch f.Type {
+	case FieldText, FieldFile:
+		s, ok := answer.(string)
+		if !ok {
+			return "", errors.Errorf("expecting a string")
+		}
+		s = strings.TrimSpace(s)
+		if len(s) > 1000 {
+			return "", errors.Errorf("too long")
+		}
+		return s, nil
+	case FieldNumber:
+		switch v := answer.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case string:
+			if _, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return "", errors.Errorf("\"%s\" is not a number", v)
+			}
+			return strings.TrimSpace(v), nil
+		}
+		return "", errors.Errorf("expecting a number")
+	case FieldDate:
+		s, ok := answer.(string)
+		if !ok {
+			return "", errors.Errorf("expecting a date string")
+		}
+		if _, err := time.Parse("2006-01-02", s); err != nil {
+			return "", errors.Errorf("\"%s\" is not a date, expecting for example 2022-06-24", s)
+		}
+		return s, nil
+	case FieldSelect:
+		s, ok := answer.(string)
+		if !ok || !f.isOption(s) {
+			return "", errors.Errorf("expecting one of %s", strings.Join(f.Options, "|"))
+		}
+		return s, nil
+	case FieldMultiSelect:
+		list, ok := answer.([]interface{})
+		if !ok {
+			return "", errors.Errorf("expecting a list of values")
+		}
+		selected := []string{}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok || !f.isOption(s) {
+				return "", errors.Errorf("expecting values from %s", strings.Join(f.Options, "|"))
+			}
+			selected = append(selected, s)
+		}
+		if len(selected) == 0 && f.Required {
+			return "", errors.Errorf("select at least one value")
+		}
+		jsonSelected, _ := json.Marshal(selected)
+		return string(jsonSelected), nil
+	}
+	return "", errors.Errorf("unknown field type %s", f.Type)
+} //FormField.answerValue()
+
+func (f FormField) isOption(s string) bool {
+	for _, o := range f.Options {
+		if o == s {
+			return true
+		}
+	}
+	return false
+}
+
+//EntryAnswer is the stored answer of an entry to a form field
+type EntryAnswer struct {
+	EntryID string `json:"entry_id" db:"entry_id"`
+	Key     string `json:"key" db:"key"`
+	Value   string `json:"value" db:"value"`
+}
+
+//ListEventAnswers returns all answers for entries into an event, ordered by
+//entry, to an organiser of the event
+func ListEventAnswers(eventID, byPersonID string) ([]EntryAnswer, error) {
+	if err := AuthoriseEventOrganiser(eventID, byPersonID); err != nil {
+		return nil, err
+	}
+	var answers []EntryAnswer
+	if err := NamedSelect(
+		&answers,
+		"SELECT a.`entry_id`,a.`key`,a.`value` FROM `entry_answers` AS a JOIN `entries` AS n ON a.`entry_id`=n.`id`"+
+			" WHERE n.`event_id`=:event_id ORDER BY a.`entry_id`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get answers")
+	}
+	return answers, nil
+}
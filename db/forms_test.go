@@ -0,0 +1,70 @@
+package db_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func TestValidateFileAnswers(t *testing.T) {
+	form := db.EventForm{Fields: []db.FormField{
+		{Key: "medical", Label: "Medical certificate", Type: db.FieldFile, Required: true, Options: []string{"application/pdf", "image/*"}},
+		{Key: "photo", Label: "Photo", Type: db.FieldFile},
+	}}
+	if err := form.Validate(); err != nil {
+		t.Fatalf("invalid form: %+v", err)
+	}
+	documents := map[string]db.Document{
+		"pdf":   {ID: "pdf", ContentType: "application/pdf", Size: 1000},
+		"jpeg":  {ID: "jpeg", ContentType: "image/jpeg", Size: 1000},
+		"html":  {ID: "html", ContentType: "text/html; charset=utf-8", Size: 1000},
+		"large": {ID: "large", ContentType: "application/pdf", Size: db.MaxFileAnswerSize + 1},
+	}
+	getDocument := func(id string) (*db.Document, error) {
+		if id == "other" {
+			return nil, errors.Errorc(http.StatusForbidden, "not your document")
+		}
+		d, ok := documents[id]
+		if !ok {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown document")
+		}
+		return &d, nil
+	}
+	tests := []struct {
+		answers map[string]interface{}
+		ok      bool
+	}{
+		{map[string]interface{}{"medical": "pdf"}, true},
+		{map[string]interface{}{"medical": "jpeg", "photo": "html"}, true}, //photo allows any type
+		{map[string]interface{}{"medical": "html"}, false},
+		{map[string]interface{}{"medical": "large"}, false},
+		{map[string]interface{}{"medical": "unknown"}, false},
+		{map[string]interface{}{"medical": "other"}, false},
+		{map[string]interface{}{"medical": 12}, false},
+	}
+	for _, test := range tests {
+		values, err := form.ValidateAnswers(test.answers, getDocument)
+		if test.ok {
+			if err != nil {
+				t.Fatalf("%+v rejected: %+v", test.answers, err)
+			}
+			if values["medical"] != test.answers["medical"] {
+				t.Fatalf("%+v stored as %+v", test.answers, values)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("%+v accepted", test.answers)
+		}
+		if errors.Code(err) != http.StatusBadRequest {
+			t.Fatalf("%+v: code %d instead of 400: %+v", test.answers, errors.Code(err), err)
+		}
+	}
+
+	form.Fields[0].Options = []string{"pdf"}
+	if err := form.Validate(); err == nil {
+		t.Fatalf("accepted invalid content type")
+	}
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/pdf"
+	"github.com/jmoiron/sqlx"
+)
+
+//BillTo is the club or company named on the invoice instead of the payer
+type BillTo struct {
+	Name      string `json:"name"`
+	Address   string `json:"address,omitempty"`
+	VATNumber string `json:"vat_number,omitempty"`
+}
+
+func (b BillTo) Validate() error {
+	if b.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	return nil
+}
+
+//Invoice is issued by the organisation running the event, or selling the
+//memberships, when an order is paid, so it is also the receipt. Invoice
+//numbers are sequential without gaps per organisation.
+type Invoice struct {
+	ID              string        `json:"id" db:"id"`
+	OrganisationID  string        `json:"organisation_id" db:"organisation_id"`
+	OrderID         string        `json:"order_id" db:"order_id"`
+	Number          string        `json:"number" db:"number"`
+	Issued          SqlTime       `json:"issued" db:"issued"`
+	BillToName      string        `json:"bill_to_name" db:"bill_to_name"`
+	BillToAddress   string        `json:"bill_to_address,omitempty" db:"bill_to_address"`
+	BillToVATNumber string        `json:"bill_to_vat_number,omitempty" db:"bill_to_vat_number"`
+	BillToEmail     string        `json:"bill_to_email,omitempty" db:"bill_to_email"`
+	Total           Amount        `json:"total" db:"-"`
+	TotalCents      int           `json:"-" db:"total_cents"`
+	VATPercent      int           `json:"vat_percent" db:"vat_percent"`
+	VAT             Amount        `json:"vat" db:"-" doc:"Included in the total"`
+	VATCents        int           `json:"-" db:"vat_cents"`
+	Seller          *Organisation `json:"seller,omitempty" db:"-"`
+	Lines           []OrderLine   `json:"lines,omitempty" db:"-"`
+	Paid            *SqlTime      `json:"paid,omitempty" db:"-"`
+}
+
+//IncludedVAT returns the VAT included in the amount, rounded to a cent
+func IncludedVAT(a Amount, percent int) Amount {
+	d := 100 + percent
+	c := a.Cents * percent
+	if c < 0 {
+		return Amount{Currency: a.Currency, Cents: -((-c*2 + d) / (2 * d))}
+	}
+	return Amount{Currency: a.Currency, Cents: (c*2 + d) / (2 * d)}
+}
+
+//issueInvoice issues the invoice for a paid order in the transaction that
+//confirms it, so an invoice number is only used when the payment is committed.
+//Free orders and events without an organisation are not invoiced.
+func issueInvoice(tx *sqlx.Tx, orderID string) error {
+	var order struct {
+		Order
+		OrganisationID *string `db:"organisation_id"`
+	}
+	if err := tx.Get(&order,
+		"SELECT o.`id`,o.`person_id`,o.`total_cents`,o.`bill_to_name`,o.`bill_to_address`,o.`bill_to_vat_number`,COALESCE(o.`organisation_id`,e.`organisation_id`) AS `organisation_id` FROM `orders` o LEFT JOIN `events` e ON e.`id`=o.`event_id` WHERE o.`id`=?",
+		orderID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get order")
+	}
+	if order.OrganisationID == nil || order.TotalCents == 0 {
+		return nil
+	}
+	var seller struct {
+		Organisation
+		NextInvoiceNr int `db:"next_invoice_nr"`
+	}
+	if err := tx.Get(&seller,
+		"SELECT `id`,`vat_number`,`vat_percent`,`invoice_prefix`,`next_invoice_nr` FROM `organisations` WHERE `id`=? FOR UPDATE",
+		*order.OrganisationID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to lock organisation")
+	}
+	var nrExisting int
+	if err := tx.Get(&nrExisting, "SELECT COUNT(*) FROM `invoices` WHERE `order_id`=?", orderID); err != nil {
+		return errors.Wrapf(err, "failed to check invoice")
+	}
+	if nrExisting > 0 {
+		return nil
+	}
+
+	inv := Invoice{
+		ID:              uuid.New().String(),
+		OrganisationID:  seller.ID,
+		OrderID:         orderID,
+		Number:          fmt.Sprintf("%s-%06d", seller.InvoicePrefix, seller.NextInvoiceNr),
+		Issued:          SqlTime(time.Now()),
+		BillToName:      order.BillToName,
+		BillToAddress:   order.BillToAddress,
+		BillToVATNumber: order.BillToVATNumber,
+		Total:           Amount{Currency: DefaultCurrency, Cents: order.TotalCents},
+		TotalCents:      order.TotalCents,
+	}
+	var payer Person
+	if err := tx.Get(&payer, "SELECT `first_name`,`last_name`,`email` FROM `persons` WHERE `id`=?", order.PersonID); err != nil {
+		return errors.Wrapf(err, "failed to get payer")
+	}
+	if inv.BillToName == "" {
+		inv.BillToName = payer.Name + " " + payer.Surname
+	}
+	if payer.Email != nil {
+		inv.BillToEmail = *payer.Email
+	}
+	if seller.VATNumber != "" {
+		inv.VATPercent = seller.VATPercent
+		inv.VAT = IncludedVAT(inv.Total, inv.VATPercent)
+		inv.VATCents = inv.VAT.Cents
+	}
+	if _, err := tx.NamedExec(
+		"INSERT INTO `invoices` SET `id`=:id,`organisation_id`=:organisation_id,`order_id`=:order_id,`number`=:number,`issued`=:issued,`bill_to_name`=:bill_to_name,`bill_to_address`=:bill_to_address,`bill_to_vat_number`=:bill_to_vat_number,`bill_to_email`=:bill_to_email,`total_cents`=:total_cents,`vat_percent`=:vat_percent,`vat_cents`=:vat_cents",
+		inv,
+	); err != nil {
+		return errors.Wrapf(err, "failed to add invoice")
+	}
+	if _, err := tx.Exec("UPDATE `organisations` SET `next_invoice_nr`=? WHERE `id`=?", seller.NextInvoiceNr+1, seller.ID); err != nil {
+		return errors.Wrapf(err, "failed to update invoice nr")
+	}
+	return nil
+} //issueInvoice()
+
+func GetOrderInvoice(orderID string) (*Invoice, error) {
+	var inv Invoice
+	if err := NamedGet(&inv,
+		"SELECT `id`,`organisation_id`,`order_id`,`number`,`issued`,`bill_to_name`,`bill_to_address`,`bill_to_vat_number`,`bill_to_email`,`total_cents`,`vat_percent`,`vat_cents` FROM `invoices` WHERE `order_id`=:order_id",
+		map[string]interface{}{
+			"order_id": orderID,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "order has no invoice")
+		}
+		return nil, errors.Wrapf(err, "failed to get invoice")
+	}
+	inv.Total = Amount{Currency: DefaultCurrency, Cents: inv.TotalCents}
+	inv.VAT = Amount{Currency: DefaultCurrency, Cents: inv.VATCents}
+	var err error
+	if inv.Seller, err = GetOrganisation(inv.OrganisationID); err != nil {
+		return nil, err
+	}
+	order, err := GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	inv.Lines = order.Lines
+	inv.Paid = order.Paid
+	return &inv, nil
+}
+
+//PDF renders the invoice on A4 pages
+func (inv Invoice) PDF() []byte {
+	const left, right = 50.0, 545.0
+	doc := pdf.New()
+	page := doc.AddPage()
+
+	title := "INVOICE"
+	if inv.VATPercent > 0 {
+		title = "TAX INVOICE"
+	}
+	page.Text(left, 70, pdf.HelveticaBold, 20, title)
+	y := 60.0
+	if inv.Seller != nil {
+		page.TextRight(right, y, pdf.HelveticaBold, 12, inv.Seller.Name)
+		for _, line := range addressLines(inv.Seller.Address) {
+			y += 13
+			page.TextRight(right, y, pdf.Helvetica, 9, line)
+		}
+		if inv.Seller.Email != "" {
+			y += 13
+			page.TextRight(right, y, pdf.Helvetica, 9, inv.Seller.Email)
+		}
+		if inv.Seller.VATNumber != "" {
+			y += 13
+			page.TextRight(right, y, pdf.Helvetica, 9, "VAT No: "+inv.Seller.VATNumber)
+		}
+	}
+
+	if y += 40; y < 110 {
+		y = 110
+	}
+	for _, kv := range [][2]string{
+		{"Invoice No", inv.Number},
+		{"Date", time.Time(inv.Issued).Format("2 January 2006")},
+		{"Order", inv.OrderID},
+	} {
+		page.Text(left, y, pdf.HelveticaBold, 9, kv[0])
+		page.Text(left+70, y, pdf.Helvetica, 9, kv[1])
+		y += 13
+	}
+
+	y += 15
+	page.Text(left, y, pdf.HelveticaBold, 10, "Bill To")
+	y += 14
+	page.Text(left, y, pdf.Helvetica, 10, inv.BillToName)
+	for _, line := range addressLines(inv.BillToAddress) {
+		y += 13
+		page.Text(left, y, pdf.Helvetica, 9, line)
+	}
+	if inv.BillToVATNumber != "" {
+		y += 13
+		page.Text(left, y, pdf.Helvetica, 9, "VAT No: "+inv.BillToVATNumber)
+	}
+	if inv.BillToEmail != "" {
+		y += 13
+		page.Text(left, y, pdf.Helvetica, 9, inv.BillToEmail)
+	}
+
+	header := func(y float64) {
+		page.Rect(left, y-13, right-left, 18, 0.9)
+		page.Text(left+5, y, pdf.HelveticaBold, 10, "Description")
+		page.TextRight(right-5, y, pdf.HelveticaBold, 10, "Amount")
+	}
+	y += 35
+	header(y)
+	for _, line := range inv.Lines {
+		y += 18
+		if y > invoicePageBottom {
+			page = doc.AddPage()
+			y = 60
+			header(y)
+			y += 18
+		}
+		page.Text(left+5, y, pdf.Helvetica, 10, line.Description)
+		page.TextRight(right-5, y, pdf.Helvetica, 10, line.Amount.String())
+	}
+	y += 8
+	page.Line(left, y, right, y, 0.5)
+	y += 16
+	totalLabel := "Total"
+	if inv.VATPercent > 0 {
+		totalLabel = "Total (incl. VAT)"
+	}
+	page.TextRight(right-100, y, pdf.HelveticaBold, 10, totalLabel)
+	page.TextRight(right-5, y, pdf.HelveticaBold, 10, inv.Total.String())
+	if inv.VATPercent > 0 {
+		y += 14
+		page.TextRight(right-100, y, pdf.Helvetica, 9, fmt.Sprintf("VAT included at %d%%", inv.VATPercent))
+		page.TextRight(right-5, y, pdf.Helvetica, 9, inv.VAT.String())
+	}
+	if inv.Paid != nil {
+		y += 30
+		page.Text(left, y, pdf.HelveticaBold, 12, "PAID "+time.Time(*inv.Paid).Format("2 January 2006")+" - thank you")
+	}
+	return doc.Bytes()
+} //Invoice.PDF()
+
+//invoicePageBottom is where the invoice continues on a new page
+const invoicePageBottom = 780.0
+
+func addressLines(address string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(strings.ReplaceAll(address, ",", "\n"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
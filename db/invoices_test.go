@@ -0,0 +1,48 @@
+package db_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestIncludedVAT(t *testing.T) {
+	for cents, vat := range map[int]int{
+		11500: 1500,
+		100:   13, //13.04
+		35000: 4565,
+		1:     0,
+		0:     0,
+		-230:  -30,
+	} {
+		if got := db.IncludedVAT(db.Amount{Cents: cents}, 15).Cents; got != vat {
+			t.Errorf("VAT in %d cents is %d instead of %d", cents, got, vat)
+		}
+	}
+}
+
+func TestInvoicePDF(t *testing.T) {
+	paid := db.SqlTime(time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC))
+	inv := db.Invoice{
+		Number:     "SVC-000042",
+		OrderID:    "order-1",
+		Issued:     paid,
+		BillToName: "Acme (Pty) Ltd",
+		Total:      db.Amount{Currency: db.DefaultCurrency, Cents: 35000},
+		VATPercent: 15,
+		VAT:        db.Amount{Currency: db.DefaultCurrency, Cents: 4565},
+		Seller:     &db.Organisation{Name: "Swartvlei Club", Address: "1 Lake Rd, Sedgefield", VATNumber: "4123456789"},
+		Paid:       &paid,
+	}
+	for i := 0; i < 60; i++ {
+		inv.Lines = append(inv.Lines, db.OrderLine{Description: "Entry", Amount: db.Amount{Currency: db.DefaultCurrency, Cents: 35000}})
+	}
+	data := inv.PDF()
+	for _, expected := range []string{"%PDF-", "(TAX INVOICE)", "(SVC-000042)", "(Acme \\(Pty\\) Ltd)", "(R45.65)", "/Count 2"} {
+		if !bytes.Contains(data, []byte(expected)) {
+			t.Errorf("invoice PDF does not contain %s", expected)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/cron"
+	"github.com/jmoiron/sqlx"
+)
+
+//Job is background work kept in the database, so that a restart neither
+//loses nor repeats it. Recurring jobs have a cron schedule in UTC and run
+//again at the next time it matches. One-off jobs run once at a time and are
+//retried a few times when they fail. An instance runs a due job while it
+//holds the lease, which is taken under a row lock so only one instance runs
+//each job.
+type Job struct {
+	ID         string   `json:"id" db:"id"`
+	Name       *string  `json:"name,omitempty" db:"name" doc:"Unique name of a recurring job"`
+	Kind       string   `json:"kind" db:"kind"`
+	Args       string   `json:"args,omitempty" db:"args" doc:"JSON arguments of the kind"`
+	Schedule   *string  `json:"schedule,omitempty" db:"schedule" doc:"Cron expression of recurring jobs"`
+	Status     string   `json:"status" db:"status"`
+	NextRun    SqlTime  `json:"next_run" db:"next_run"`
+	Attempts   int      `json:"attempts" db:"attempts"`
+	LastRun    *SqlTime `json:"last_run,omitempty" db:"last_run"`
+	LastError  string   `json:"last_error,omitempty" db:"last_error"`
+	LeaseOwner *string  `json:"-" db:"lease_owner"`
+	LeaseUntil *SqlTime `json:"-" db:"lease_until"`
+	Created    SqlTime  `json:"created" db:"created"`
+}
+
+const (
+	JobScheduled = "scheduled"
+	JobDone      = "done"   //one-off that succeeded
+	JobFailed    = "failed" //one-off that failed every attempt, or invalid schedule
+)
+
+const jobColumns = "`id`,`name`,`kind`,COALESCE(`args`,'') AS `args`,`schedule`,`status`,`next_run`,`attempts`,`last_run`,`last_error`,`lease_owner`,`lease_until`,`created`"
+
+const (
+	//jobLease is how long an instance may run a job before another instance
+	//may take it over, assuming the first one died
+	jobLease = 15 * time.Minute
+
+	//jobMaxAttempts of one-off jobs, retried after a minute per attempt
+	jobMaxAttempts = 5
+)
+
+//JobFunc does the work of a kind of job with its arguments and returns how
+//many things it did, e.g. the number of reminders sent. Jobs may run again
+//after an instance died, so they must not repeat work already done.
+type JobFunc func(args json.RawMessage) (int, error)
+
+//jobKinds are the kinds of jobs that can be scheduled
+var jobKinds = map[string]JobFunc{
+	"expire_orders":             func(json.RawMessage) (int, error) { return ExpireOrders() },
+	"volunteer_reminders":       func(json.RawMessage) (int, error) { return SendVolunteerReminders(24 * time.Hour) },
+	"entries_closing_reminders": func(json.RawMessage) (int, error) { return SendEntriesClosingReminders(48 * time.Hour) },
+	"event_reminders":           func(json.RawMessage) (int, error) { return SendEventReminders(3 * 24 * time.Hour) },
+	"purge_tokens":              func(json.RawMessage) (int, error) { return PurgeExpiredTokens() },
+	"deliver_announcement":      deliverAnnouncementJob,
+}
+
+//jobGiveUps clean up after a one-off job of the kind that failed every attempt
+var jobGiveUps = map[string]JobFunc{
+	"deliver_announcement": failAnnouncementJob,
+}
+
+//jobOwner identifies this instance in the leases it holds
+var jobOwner = uuid.New().String()
+
+//ScheduleJob adds a one-off job to run at the time, or as soon as possible.
+//Pass the transaction that makes the work, so the job exists only when the
+//work does.
+func ScheduleJob(q sqlx.Execer, kind string, args interface{}, at time.Time) (*Job, error) {
+	if _, ok := jobKinds[kind]; !ok {
+		return nil, errors.Errorf("unknown job kind \"%s\"", kind)
+	}
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode job args")
+	}
+	now := time.Now()
+	j := Job{
+		ID:      uuid.New().String(),
+		Kind:    kind,
+		Args:    string(argsJSON),
+		Status:  JobScheduled,
+		NextRun: SqlTime(at),
+		Created: SqlTime(now),
+	}
+	if _, err := q.Exec(
+		"INSERT INTO `jobs` SET `id`=?,`kind`=?,`args`=?,`status`=?,`next_run`=?,`created`=?",
+		j.ID, j.Kind, j.Args, j.Status, j.NextRun, j.Created,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to schedule job")
+	}
+	return &j, nil
+} //ScheduleJob()
+
+//RunNextJob runs the job that is due the longest and returns false when
+//none is due, so the caller can wait before checking again
+func RunNextJob() (bool, error) {
+	now := time.Now()
+	j, err := leaseJob(now)
+	if err != nil || j == nil {
+		return false, err
+	}
+	nr, runErr := runJob(*j)
+	if runErr != nil {
+		log.Errorf("job %s(%s) failed: %+v", j.Kind, j.ID, runErr)
+	} else if nr > 0 {
+		log.Infof("job %s(%s) done %d", j.Kind, j.ID, nr)
+	}
+	return true, finishJob(*j, runErr, time.Now())
+} //RunNextJob()
+
+//leaseJob takes the lease of the job that is due the longest. The row stays
+//locked only while taking the lease, and rows locked by other instances are
+//skipped rather than waited for.
+func leaseJob(now time.Time) (*Job, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	var j Job
+	if err := tx.Get(&j,
+		"SELECT "+jobColumns+" FROM `jobs` WHERE `status`=? AND `next_run`<=? AND (`lease_until` IS NULL OR `lease_until`<?)"+
+			" ORDER BY `next_run` LIMIT 1 FOR UPDATE SKIP LOCKED",
+		JobScheduled, SqlTime(now), SqlTime(now),
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get due job")
+	}
+	until := SqlTime(now.Add(jobLease))
+	if _, err := tx.Exec(
+		"UPDATE `jobs` SET `lease_owner`=?,`lease_until`=? WHERE `id`=?",
+		jobOwner, until, j.ID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to lease job")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit job lease")
+	}
+	j.LeaseOwner = &jobOwner
+	j.LeaseUntil = &until
+	return &j, nil
+} //leaseJob()
+
+//runJob runs the job, turning a panic into an error so the job is finished
+//and the worker survives
+func runJob(j Job) (nr int, err error) {
+	fnc, ok := jobKinds[j.Kind]
+	if !ok {
+		return 0, errors.Errorf("unknown job kind \"%s\"", j.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("panic: %v", r)
+		}
+	}()
+	return fnc(json.RawMessage(j.Args))
+}
+
+//finishJob releases the lease and sets when the job runs next, if it still
+//holds the lease
+func finishJob(j Job, runErr error, now time.Time) error {
+	j.LastRun = (*SqlTime)(&now)
+	j.LastError = ""
+	if runErr != nil {
+		j.LastError = runErr.Error()
+		if len(j.LastError) > 400 {
+			j.LastError = j.LastError[:400]
+		}
+	}
+	j.Reschedule(runErr, now)
+	if res, err := db.Exec(
+		"UPDATE `jobs` SET `status`=?,`next_run`=?,`attempts`=?,`last_run`=?,`last_error`=?,`lease_owner`=NULL,`lease_until`=NULL WHERE `id`=? AND `lease_owner`=?",
+		j.Status, j.NextRun, j.Attempts, j.LastRun, j.LastError, j.ID, jobOwner,
+	); err != nil {
+		return errors.Wrapf(err, "failed to finish job")
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return nil //lease was taken over
+	}
+	if giveUp, ok := jobGiveUps[j.Kind]; ok && j.GaveUp() {
+		if _, err := giveUp(json.RawMessage(j.Args)); err != nil {
+			return errors.Wrapf(err, "failed to give up job %s(%s)", j.Kind, j.ID)
+		}
+	}
+	return nil
+} //finishJob()
+
+//GaveUp is true when a one-off job failed every attempt and will not run again
+func (j Job) GaveUp() bool {
+	return j.Schedule == nil && j.Status == JobFailed
+}
+
+//Reschedule sets the status, attempts and next run after a run. Attempts
+//counts the failures in a row.
+func (j *Job) Reschedule(runErr error, now time.Time) {
+	if runErr == nil {
+		j.Attempts = 0
+	} else {
+		j.Attempts++
+	}
+	if j.Schedule != nil {
+		next := time.Time{}
+		if s, err := cron.Parse(*j.Schedule); err == nil {
+			next = s.Next(now.UTC())
+		}
+		if next.IsZero() {
+			j.Status = JobFailed
+			j.LastError = "invalid schedule \"" + *j.Schedule + "\""
+			return
+		}
+		j.NextRun = SqlTime(next)
+		return
+	}
+	switch {
+	case runErr == nil:
+		j.Status = JobDone
+	case j.Attempts >= jobMaxAttempts:
+		j.Status = JobFailed
+	default:
+		j.NextRun = SqlTime(now.Add(time.Duration(j.Attempts) * time.Minute))
+	}
+} //Job.Reschedule()
+
+//deliverAnnouncementJob delivers to the recipients still pending, so a job
+//that runs again does not repeat messages
+func deliverAnnouncementJob(args json.RawMessage) (int, error) {
+	var a struct {
+		AnnouncementID string `json:"announcement_id"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil || a.AnnouncementID == "" {
+		return 0, errors.Errorc(http.StatusBadRequest, "missing announcement_id")
+	}
+	return 0, DeliverAnnouncement(a.AnnouncementID)
+}
+
+//failAnnouncementJob marks the recipients that were never reached as failed
+func failAnnouncementJob(args json.RawMessage) (int, error) {
+	var a struct {
+		AnnouncementID string `json:"announcement_id"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil || a.AnnouncementID == "" {
+		return 0, errors.Errorc(http.StatusBadRequest, "missing announcement_id")
+	}
+	return 0, FailAnnouncementDelivery(a.AnnouncementID)
+}
@@ -0,0 +1,49 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestJobReschedule(t *testing.T) {
+	now := time.Date(2022, 6, 24, 10, 7, 30, 0, time.UTC)
+	failed := errors.New("failed")
+
+	every15 := "*/15 * * * *"
+	j := db.Job{Schedule: &every15, Status: db.JobScheduled}
+	j.Reschedule(failed, now)
+	if j.Status != db.JobScheduled || j.Attempts != 1 || time.Time(j.NextRun) != now.Add(7*time.Minute+30*time.Second) {
+		t.Fatalf("recurring after failure: %+v", j)
+	}
+	j.Reschedule(nil, now)
+	if j.Status != db.JobScheduled || j.Attempts != 0 {
+		t.Fatalf("recurring after success: %+v", j)
+	}
+
+	invalid := "every day"
+	j = db.Job{Schedule: &invalid, Status: db.JobScheduled}
+	j.Reschedule(nil, now)
+	if j.Status != db.JobFailed || j.LastError == "" {
+		t.Fatalf("invalid schedule: %+v", j)
+	}
+
+	j = db.Job{Status: db.JobScheduled}
+	for attempt := 1; attempt < 5; attempt++ {
+		j.Reschedule(failed, now)
+		if j.Status != db.JobScheduled || j.Attempts != attempt || time.Time(j.NextRun) != now.Add(time.Duration(attempt)*time.Minute) {
+			t.Fatalf("one-off attempt %d: %+v", attempt, j)
+		}
+	}
+	j.Reschedule(failed, now)
+	if j.Status != db.JobFailed {
+		t.Fatalf("one-off not failed after 5 attempts: %+v", j)
+	}
+	j = db.Job{Status: db.JobScheduled, Attempts: 2}
+	j.Reschedule(nil, now)
+	if j.Status != db.JobDone {
+		t.Fatalf("one-off not done: %+v", j)
+	}
+}
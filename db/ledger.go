@@ -0,0 +1,323 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//The ledger records every movement of money with double entry: each
+//transaction has entries that sum to zero, with debits positive and credits
+//negative. Rows are only ever inserted, corrections are new transactions.
+//
+//Accounts per event:
+//
+//processor:<name>  money held by the payment processor for us (asset)
+//bank              money in our bank account, e.g. from EFT (asset)
+//organiser         what we owe the organiser of the event (liability)
+//credit_notes      credit notes owed to participants (liability)
+//
+//Membership fees are not for an event and use the same accounts per
+//organisation, with organiser being what we owe the organisation.
+const (
+	AccountBank        = "bank"
+	AccountOrganiser   = "organiser"
+	AccountCreditNotes = "credit_notes"
+)
+
+//ProcessorAccount is the account for money held by a payment processor
+func ProcessorAccount(provider string) string {
+	if provider == ProviderEFT {
+		return AccountBank
+	}
+	return "processor:" + provider
+}
+
+const (
+	LedgerPayment    = "payment"
+	LedgerFee        = "fee"
+	LedgerRefund     = "refund"
+	LedgerCreditNote = "credit_note"
+	LedgerPayout     = "payout"
+)
+
+type LedgerTransaction struct {
+	ID             string        `json:"id" db:"id"`
+	EventID        string        `json:"event_id,omitempty" db:"event_id"`
+	OrganisationID string        `json:"organisation_id,omitempty" db:"organisation_id" doc:"Set instead of event_id for membership fees"`
+	Kind           string        `json:"kind" db:"kind"`
+	Reference      string        `json:"reference" db:"reference" doc:"Payment, refund or payout that caused it"`
+	Description    string        `json:"description" db:"description"`
+	Created        SqlTime       `json:"created" db:"created"`
+	Entries        []LedgerEntry `json:"entries" db:"-"`
+}
+
+type LedgerEntry struct {
+	TransactionID  string `json:"-" db:"transaction_id"`
+	Account        string `json:"account" db:"account"`
+	EventID        string `json:"-" db:"event_id"`
+	OrganisationID string `json:"-" db:"organisation_id"`
+	Amount         Amount `json:"amount" db:"-" doc:"Debit positive, credit negative"`
+	AmountCents    int    `json:"-" db:"amount_cents"`
+}
+
+//postLedger appends a transaction that moves amount from one account to
+//another, i.e. debits the first account and credits the second
+func postLedger(tx *sqlx.Tx, eventID, kind, reference, description string, amount Amount, debit, credit string) error {
+	if amount.Cents == 0 {
+		return nil
+	}
+	return postLedgerTransaction(tx, LedgerTransaction{
+		EventID:     eventID,
+		Kind:        kind,
+		Reference:   reference,
+		Description: description,
+		Entries: []LedgerEntry{
+			{Account: debit, AmountCents: amount.Cents},
+			{Account: credit, AmountCents: -amount.Cents},
+		},
+	})
+}
+
+//postOrderLedger posts to the ledger of the event of the order, or of the
+//organisation for orders without an event
+func postOrderLedger(tx *sqlx.Tx, order Order, kind, reference, description string, amount Amount, debit, credit string) error {
+	if order.EventID != "" {
+		return postLedger(tx, order.EventID, kind, reference, description, amount, debit, credit)
+	}
+	if amount.Cents == 0 {
+		return nil
+	}
+	return postLedgerTransaction(tx, LedgerTransaction{
+		OrganisationID: order.OrganisationID,
+		Kind:           kind,
+		Reference:      reference,
+		Description:    description,
+		Entries: []LedgerEntry{
+			{Account: debit, AmountCents: amount.Cents},
+			{Account: credit, AmountCents: -amount.Cents},
+		},
+	})
+}
+
+//Validate checks that the transaction has entries that sum to zero
+func (t LedgerTransaction) Validate() error {
+	if len(t.Entries) < 2 {
+		return errors.Errorf("ledger transaction needs at least two entries")
+	}
+	sum := 0
+	for _, e := range t.Entries {
+		sum += e.AmountCents
+	}
+	if sum != 0 {
+		return errors.Errorf("ledger transaction %s %s does not balance: %d cents", t.Kind, t.Reference, sum)
+	}
+	return nil
+}
+
+func postLedgerTransaction(tx *sqlx.Tx, t LedgerTransaction) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	t.ID = uuid.New().String()
+	t.Created = SqlTime(time.Now())
+	if _, err := tx.NamedExec(
+		"INSERT INTO `ledger_transactions` SET `id`=:id,`event_id`=NULLIF(:event_id,''),`organisation_id`=NULLIF(:organisation_id,''),`kind`=:kind,`reference`=:reference,`description`=:description,`created`=:created",
+		t,
+	); err != nil {
+		return errors.Wrapf(err, "failed to add ledger transaction")
+	}
+	for _, e := range t.Entries {
+		e.TransactionID = t.ID
+		e.EventID = t.EventID
+		e.OrganisationID = t.OrganisationID
+		if _, err := tx.NamedExec(
+			"INSERT INTO `ledger_entries` SET `transaction_id`=:transaction_id,`account`=:account,`event_id`=NULLIF(:event_id,''),`organisation_id`=NULLIF(:organisation_id,''),`amount_cents`=:amount_cents",
+			e,
+		); err != nil {
+			return errors.Wrapf(err, "failed to add ledger entry")
+		}
+	}
+	return nil
+} //postLedgerTransaction()
+
+//EventLedger answers how much was collected, refunded, paid to the processor
+//and paid out to the organiser for an event
+type EventLedger struct {
+	Balances []AccountBalance `json:"balances"`
+	Totals   []KindTotal      `json:"totals" doc:"Total per kind of transaction"`
+}
+
+type AccountBalance struct {
+	Account      string `json:"account" db:"account"`
+	Balance      Amount `json:"balance" db:"-"`
+	BalanceCents int    `json:"-" db:"balance_cents"`
+}
+
+type KindTotal struct {
+	Kind       string `json:"kind" db:"kind"`
+	Count      int    `json:"count" db:"count"`
+	Total      Amount `json:"total" db:"-"`
+	TotalCents int    `json:"-" db:"total_cents"`
+}
+
+func GetEventLedger(eventID string) (*EventLedger, error) {
+	l := EventLedger{Balances: []AccountBalance{}, Totals: []KindTotal{}}
+	if err := NamedSelect(&l.Balances,
+		"SELECT `account`,SUM(`amount_cents`) AS `balance_cents` FROM `ledger_entries` WHERE `event_id`=:event_id GROUP BY `account` ORDER BY `account`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get balances")
+	}
+	for i := range l.Balances {
+		l.Balances[i].Balance = Amount{Currency: DefaultCurrency, Cents: l.Balances[i].BalanceCents}
+	}
+	//the organiser account is credited for payments and debited for the rest,
+	//so its entries give the total of each kind
+	if err := NamedSelect(&l.Totals,
+		"SELECT t.`kind`,COUNT(*) AS `count`,ABS(SUM(e.`amount_cents`)) AS `total_cents` FROM `ledger_transactions` t JOIN `ledger_entries` e ON e.`transaction_id`=t.`id` AND e.`account`=:organiser WHERE t.`event_id`=:event_id GROUP BY t.`kind` ORDER BY t.`kind`",
+		map[string]interface{}{
+			"event_id":  eventID,
+			"organiser": AccountOrganiser,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get totals")
+	}
+	for i := range l.Totals {
+		l.Totals[i].Total = Amount{Currency: DefaultCurrency, Cents: l.Totals[i].TotalCents}
+	}
+	return &l, nil
+} //GetEventLedger()
+
+//LedgerStatementLine is an entry of an account with the balance after it
+type LedgerStatementLine struct {
+	TransactionID string  `json:"transaction_id" db:"transaction_id"`
+	Created       SqlTime `json:"created" db:"created"`
+	Kind          string  `json:"kind" db:"kind"`
+	Reference     string  `json:"reference" db:"reference"`
+	Description   string  `json:"description" db:"description"`
+	Amount        Amount  `json:"amount" db:"-"`
+	AmountCents   int     `json:"-" db:"amount_cents"`
+	Balance       Amount  `json:"balance" db:"-"`
+}
+
+func GetEventLedgerStatement(eventID, account string) ([]LedgerStatementLine, error) {
+	lines := []LedgerStatementLine{}
+	if err := NamedSelect(&lines,
+		"SELECT e.`transaction_id`,t.`created`,t.`kind`,t.`reference`,t.`description`,e.`amount_cents` FROM `ledger_entries` e JOIN `ledger_transactions` t ON t.`id`=e.`transaction_id` WHERE e.`event_id`=:event_id AND e.`account`=:account ORDER BY e.`seq`",
+		map[string]interface{}{
+			"event_id": eventID,
+			"account":  account,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get statement")
+	}
+	balance := Amount{Currency: DefaultCurrency}
+	for i := range lines {
+		lines[i].Amount = Amount{Currency: DefaultCurrency, Cents: lines[i].AmountCents}
+		balance = balance.Add(lines[i].Amount)
+		lines[i].Balance = balance
+	}
+	return lines, nil
+}
+
+type NewPayoutRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	Amount     Amount `json:"amount"`
+	From       string `json:"from" doc:"Account paid from, e.g. bank or processor:payfast"`
+	Reference  string `json:"reference" doc:"Bank reference of the payout"`
+}
+
+func (req NewPayoutRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.Amount.Cents <= 0 {
+		return errors.Errorf("invalid amount")
+	}
+	if req.From != AccountBank && !strings.HasPrefix(req.From, "processor:") {
+		return errors.Errorf("invalid from \"%s\", expecting bank or processor:<name>", req.From)
+	}
+	if req.Reference == "" {
+		return errors.Errorf("missing reference")
+	}
+	return nil
+}
+
+//AddPayout records money paid out to the organiser
+func AddPayout(eventID string, req NewPayoutRequest) error {
+	if err := req.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if ok, err := isEventOrganiser(tx, eventID, req.ByPersonID); err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorc(http.StatusForbidden, "only organisers can record payouts")
+	}
+	amount := Amount{Currency: DefaultCurrency, Cents: req.Amount.Cents}
+	if err := postLedger(tx, eventID, LedgerPayout, req.Reference, "payout to organiser", amount, AccountOrganiser, req.From); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit payout")
+	}
+	return nil
+}
+
+//LedgerCheck is what CheckLedger found in the ledger
+type LedgerCheck struct {
+	Unbalanced []UnbalancedTransaction
+	Orphans    int //entries without a transaction
+	TotalCents int //sum of all entries
+}
+
+//UnbalancedTransaction does not sum to zero or has less than two entries
+type UnbalancedTransaction struct {
+	ID       string `db:"id"`
+	Kind     string `db:"kind"`
+	SumCents int    `db:"sum_cents"`
+}
+
+//Problems describes each problem found, none when the ledger is correct
+func (c LedgerCheck) Problems() []string {
+	problems := []string{}
+	for _, t := range c.Unbalanced {
+		problems = append(problems, fmt.Sprintf("transaction %s (%s) sums to %d cents or has less than two entries", t.ID, t.Kind, t.SumCents))
+	}
+	if c.Orphans > 0 {
+		problems = append(problems, fmt.Sprintf("%d entries without a transaction", c.Orphans))
+	}
+	if c.TotalCents != 0 {
+		problems = append(problems, fmt.Sprintf("ledger sums to %d cents instead of zero", c.TotalCents))
+	}
+	return problems
+}
+
+//CheckLedger verifies that every transaction and so the whole ledger sums to
+//zero, and returns a description of each problem found
+func CheckLedger() ([]string, error) {
+	var c LedgerCheck
+	if err := db.Select(&c.Unbalanced,
+		"SELECT t.`id`,t.`kind`,COALESCE(SUM(e.`amount_cents`),0) AS `sum_cents` FROM `ledger_transactions` t LEFT JOIN `ledger_entries` e ON e.`transaction_id`=t.`id` GROUP BY t.`id`,t.`kind` HAVING `sum_cents`!=0 OR COUNT(e.`transaction_id`)<2",
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to check transactions")
+	}
+	if err := db.Get(&c.Orphans,
+		"SELECT COUNT(*) FROM `ledger_entries` e LEFT JOIN `ledger_transactions` t ON t.`id`=e.`transaction_id` WHERE t.`id` IS NULL",
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to check entries")
+	}
+	if err := db.Get(&c.TotalCents, "SELECT COALESCE(SUM(`amount_cents`),0) FROM `ledger_entries`"); err != nil {
+		return nil, errors.Wrapf(err, "failed to sum ledger")
+	}
+	return c.Problems(), nil
+} //CheckLedger()
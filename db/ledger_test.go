@@ -0,0 +1,54 @@
+package db_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestLedgerTransactionValidate(t *testing.T) {
+	balanced := db.LedgerTransaction{Kind: db.LedgerPayment, Reference: "p1", Entries: []db.LedgerEntry{
+		{Account: "processor:payfast", AmountCents: 25000},
+		{Account: db.AccountOrganiser, AmountCents: -24000},
+		{Account: "fees", AmountCents: -1000},
+	}}
+	if err := balanced.Validate(); err != nil {
+		t.Fatalf("balanced transaction rejected: %+v", err)
+	}
+	unbalanced := db.LedgerTransaction{Kind: db.LedgerPayment, Reference: "p2", Entries: []db.LedgerEntry{
+		{Account: "processor:payfast", AmountCents: 25000},
+		{Account: db.AccountOrganiser, AmountCents: -24000},
+	}}
+	if err := unbalanced.Validate(); err == nil || !strings.Contains(err.Error(), "does not balance: 1000 cents") {
+		t.Fatalf("unbalanced transaction: %v", err)
+	}
+	single := db.LedgerTransaction{Kind: db.LedgerPayment, Entries: []db.LedgerEntry{{Account: db.AccountBank}}}
+	if err := single.Validate(); err == nil {
+		t.Fatalf("accepted transaction with one entry")
+	}
+}
+
+func TestLedgerCheckProblems(t *testing.T) {
+	if problems := (db.LedgerCheck{}).Problems(); len(problems) != 0 {
+		t.Fatalf("correct ledger has problems: %+v", problems)
+	}
+	problems := db.LedgerCheck{
+		Unbalanced: []db.UnbalancedTransaction{{ID: "t1", Kind: db.LedgerRefund, SumCents: -500}},
+		Orphans:    2,
+		TotalCents: -500,
+	}.Problems()
+	expected := []string{
+		"transaction t1 (refund) sums to -500 cents",
+		"2 entries without a transaction",
+		"ledger sums to -500 cents instead of zero",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("got %+v instead of %+v", problems, expected)
+	}
+	for i := range expected {
+		if !strings.HasPrefix(problems[i], expected[i]) {
+			t.Fatalf("got %q instead of %q", problems[i], expected[i])
+		}
+	}
+}
@@ -1,7 +1,501 @@
 package db
 
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//Location is a venue that can be used by many events. Only the person who
+//added it can change it.
 type Location struct {
-	Name string  `json:"name"`
-	Lat  float64 `json:"lat"`
-	Lon  float64 `json:"lon"`
+	ID              string  `json:"id" db:"id"`
+	Name            string  `json:"name" db:"name"`
+	Street          string  `json:"street,omitempty" db:"street"`
+	Suburb          string  `json:"suburb,omitempty" db:"suburb"`
+	Town            string  `json:"town,omitempty" db:"town"`
+	Province        string  `json:"province,omitempty" db:"province"`
+	PostalCode      string  `json:"postal_code,omitempty" db:"postal_code"`
+	Country         string  `json:"country,omitempty" db:"country"`
+	Lat             float64 `json:"lat" db:"lat"`
+	Lon             float64 `json:"lon" db:"lon"`
+	Directions      string  `json:"directions,omitempty" db:"directions" doc:"How to get there or where to meet, e.g. \"Park at the clubhouse\""`
+	TimeZone        string  `json:"time_zone,omitempty" db:"time_zone" doc:"IANA time zone, default from the country when it has only one"`
+	AddedByPersonID *string `json:"added_by_person_id,omitempty" db:"added_by_person_id"`
+}
+
+const locationColumns = "`id`,`name`,`street`,`suburb`,`town`,`province`,`postal_code`,`country`,`lat`,`lon`,`directions`,`time_zone`,`added_by_person_id`"
+
+//earthRadiusKm is the mean radius used for haversine distances
+const earthRadiusKm = 6371.0
+
+//sameVenueKm is how close two locations with similar names must be to be
+//taken as the same venue
+const sameVenueKm = 0.2
+
+//DistanceKm is the great-circle distance between two points (haversine)
+func DistanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(math.Min(1, h)))
+}
+
+//BoundingBox contains all points within km of a point, so an index on lat
+//and lon can discard most rows before the exact distance is calculated
+type BoundingBox struct {
+	MinLat, MaxLat float64
+	MinLon, MaxLon float64 //MinLon > MaxLon when the box crosses the 180th meridian
+}
+
+func NewBoundingBox(lat, lon, km float64) BoundingBox {
+	dLat := km / earthRadiusKm * 180 / math.Pi
+	b := BoundingBox{MinLat: lat - dLat, MaxLat: lat + dLat, MinLon: -180, MaxLon: 180}
+	if b.MinLat <= -90 || b.MaxLat >= 90 {
+		//includes a pole so all longitudes
+		b.MinLat, b.MaxLat = math.Max(b.MinLat, -90), math.Min(b.MaxLat, 90)
+		return b
+	}
+	dLon := math.Asin(math.Min(1, math.Sin(km/earthRadiusKm)/math.Cos(lat*math.Pi/180))) * 180 / math.Pi
+	if dLon >= 180 {
+		return b
+	}
+	b.MinLon, b.MaxLon = lon-dLon, lon+dLon
+	if b.MinLon < -180 {
+		b.MinLon += 360
+	}
+	if b.MaxLon > 180 {
+		b.MaxLon -= 360
+	}
+	return b
+}
+
+func (b BoundingBox) Contains(lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon > b.MaxLon {
+		return lon >= b.MinLon || lon <= b.MaxLon
+	}
+	return lon >= b.MinLon && lon <= b.MaxLon
+}
+
+//where is the SQL condition for the box on lat and lon columns with the prefix
+func (b BoundingBox) where(prefix string) (string, map[string]interface{}) {
+	args := map[string]interface{}{
+		"min_lat": b.MinLat,
+		"max_lat": b.MaxLat,
+		"min_lon": b.MinLon,
+		"max_lon": b.MaxLon,
+	}
+	cond := prefix + "`lat` BETWEEN :min_lat AND :max_lat AND "
+	if b.MinLon > b.MaxLon {
+		return cond + "(" + prefix + "`lon`>=:min_lon OR " + prefix + "`lon`<=:max_lon)", args
+	}
+	return cond + prefix + "`lon` BETWEEN :min_lon AND :max_lon", args
+}
+
+//Address is the street address of the location on one line
+func (l Location) Address() string {
+	parts := []string{}
+	for _, p := range []string{l.Street, l.Suburb, l.Town} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+//SameVenue is true when the locations are within 200m of each other and their
+//names are the same apart from case, punctuation and common words, or one name
+//contains the other, e.g. "Swartvlei" and "Swartvlei Lake"
+func (l Location) SameVenue(other Location) bool {
+	if DistanceKm(l.Lat, l.Lon, other.Lat, other.Lon) > sameVenueKm {
+		return false
+	}
+	a, b := venueName(l.Name), venueName(other.Name)
+	if a == "" || b == "" {
+		return a == b
+	}
+	return a == b || strings.Contains(a, b) || strings.Contains(b, a)
+}
+
+//venueName normalises a name to compare venues
+func venueName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	s := ""
+	for _, w := range words {
+		switch w {
+		case "the", "die", "at", "by", "of", "and", "en":
+			continue
+		}
+		s += w + " "
+	}
+	return strings.TrimSpace(s)
+}
+
+type NewLocationRequest struct {
+	ByPersonID string  `json:"by_person_id" doc:"Person adding or changing the location"`
+	Name       string  `json:"name"`
+	Street     string  `json:"street,omitempty"`
+	Suburb     string  `json:"suburb,omitempty"`
+	Town       string  `json:"town,omitempty"`
+	Province   string  `json:"province,omitempty"`
+	PostalCode string  `json:"postal_code,omitempty"`
+	Country    string  `json:"country,omitempty"`
+	Lat        float64 `json:"lat"`
+	Lon        float64 `json:"lon"`
+	Directions string  `json:"directions,omitempty"`
+	TimeZone   string  `json:"time_zone,omitempty" doc:"IANA time zone, needed when the country has more than one"`
+}
+
+func (req NewLocationRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return errors.Errorf("missing name")
+	}
+	if req.Lat < -90 || req.Lat > 90 {
+		return errors.Errorf("lat must be -90..90")
+	}
+	if req.Lon < -180 || req.Lon > 180 {
+		return errors.Errorf("lon must be -180..180")
+	}
+	if req.Lat == 0 && req.Lon == 0 {
+		return errors.Errorf("missing lat and lon")
+	}
+	if req.TimeZone != "" {
+		if _, err := LoadTimeZone(req.TimeZone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (req NewLocationRequest) location() Location {
+	l := Location{
+		Name:       strings.TrimSpace(req.Name),
+		Street:     strings.TrimSpace(req.Street),
+		Suburb:     strings.TrimSpace(req.Suburb),
+		Town:       strings.TrimSpace(req.Town),
+		Province:   strings.TrimSpace(req.Province),
+		PostalCode: strings.TrimSpace(req.PostalCode),
+		Country:    strings.TrimSpace(req.Country),
+		Lat:        req.Lat,
+		Lon:        req.Lon,
+		Directions: strings.TrimSpace(req.Directions),
+		TimeZone:   req.TimeZone,
+	}
+	if l.TimeZone == "" {
+		l.TimeZone = TimeZoneForCountry(l.Country)
+	}
+	return l
+}
+
+//AddLocation adds a venue, or returns the existing one when the same venue
+//was added before so events share one location
+func AddLocation(req NewLocationRequest) (*Location, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	l := req.location()
+	nearby, err := ListLocationsNear(l.Lat, l.Lon, sameVenueKm)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nearby {
+		if n.SameVenue(l) {
+			return &n.Location, nil
+		}
+	}
+	l.ID = uuid.New().String()
+	l.AddedByPersonID = &req.ByPersonID
+	if _, err := db.NamedExec(
+		"INSERT INTO `locations` SET `id`=:id,`name`=:name,`street`=:street,`suburb`=:suburb,`town`=:town,`province`=:province,`postal_code`=:postal_code,`country`=:country,`lat`=:lat,`lon`=:lon,`directions`=:directions,`time_zone`=:time_zone,`added_by_person_id`=:added_by_person_id",
+		l,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add location")
+	}
+	return &l, nil
+} //AddLocation()
+
+func GetLocation(id string) (*Location, error) {
+	var l Location
+	if err := NamedGet(&l,
+		"SELECT "+locationColumns+" FROM `locations` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown location")
+		}
+		return nil, errors.Wrapf(err, "failed to get location")
+	}
+	return &l, nil
+}
+
+func ListLocations(filter string) ([]Location, error) {
+	locations := []Location{}
+	if err := NamedSelect(&locations,
+		"SELECT "+locationColumns+" FROM `locations` WHERE `name` LIKE :filter OR `town` LIKE :filter ORDER BY `name`",
+		map[string]interface{}{
+			"filter": "%" + filter + "%",
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list locations")
+	}
+	return locations, nil
+}
+
+//AuthoriseLocation returns the location when the person added it, and may
+//change it
+func AuthoriseLocation(id, personID string) (*Location, error) {
+	l, err := GetLocation(id)
+	if err != nil {
+		return nil, err
+	}
+	if personID == "" || l.AddedByPersonID == nil || *l.AddedByPersonID != personID {
+		return nil, errors.Errorc(http.StatusForbidden, "only the person who added the location can change it")
+	}
+	return l, nil
+}
+
+//authoriseLocationEvents fails when the person does not organise all the
+//events at the location, and locks those events until the transaction ends
+func authoriseLocationEvents(tx *sqlx.Tx, id, personID string) error {
+	var eventIDs []string
+	if err := tx.Select(&eventIDs, "SELECT `id` FROM `events` WHERE `location_id`=? FOR UPDATE", id); err != nil {
+		return errors.Wrapf(err, "failed to get events")
+	}
+	for _, eventID := range eventIDs {
+		if ok, err := isEventOrganiser(tx, eventID, personID); err != nil {
+			return err
+		} else if !ok {
+			return errors.Errorc(http.StatusForbidden, "location is used by events of other organisers")
+		}
+	}
+	return nil
+}
+
+//UpdateLocation changes a location. Only the person who added it can change
+//it, and only when organising all its events.
+func UpdateLocation(id string, req NewLocationRequest) (*Location, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if _, err := AuthoriseLocation(id, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if err := authoriseLocationEvents(tx, id, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	l := req.location()
+	l.ID = id
+	l.AddedByPersonID = &req.ByPersonID
+	result, err := tx.NamedExec(
+		"UPDATE `locations` SET `name`=:name,`street`=:street,`suburb`=:suburb,`town`=:town,`province`=:province,`postal_code`=:postal_code,`country`=:country,`lat`=:lat,`lon`=:lon,`directions`=:directions,`time_zone`=:time_zone WHERE `id`=:id",
+		l,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to update location")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit location")
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		//also 0 when nothing changed
+		return GetLocation(id)
+	}
+	return &l, nil
+}
+
+//DeleteLocation deletes a location that is not used by any event
+func DeleteLocation(id, byPersonID string) error {
+	if _, err := AuthoriseLocation(id, byPersonID); err != nil {
+		return err
+	}
+	var nrEvents int
+	if err := db.Get(&nrEvents, "SELECT COUNT(*) FROM `events` WHERE `location_id`=?", id); err != nil {
+		return errors.Wrapf(err, "failed to check events")
+	}
+	if nrEvents > 0 {
+		return errors.Errorc(http.StatusConflict, "location is used by events, merge it into another location instead")
+	}
+	result, err := db.Exec("DELETE FROM `locations` WHERE `id`=?", id)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete location")
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.Errorc(http.StatusNotFound, "unknown location")
+	}
+	return nil
+}
+
+type MergeLocationRequest struct {
+	ByPersonID     string `json:"by_person_id" doc:"Person who added this location and organises its events"`
+	IntoLocationID string `json:"into_location_id" doc:"Location that replaces this one"`
+}
+
+func (req MergeLocationRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.IntoLocationID == "" {
+		return errors.Errorf("missing into_location_id")
+	}
+	return nil
 }
+
+//MergeLocation moves the events of a duplicate location to another location
+//and deletes the duplicate. Only the person who added the duplicate can merge
+//it, and only when organising all its events.
+func MergeLocation(id string, req MergeLocationRequest) (*Location, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if req.IntoLocationID == id {
+		return nil, errors.Errorf("cannot merge location into itself")
+	}
+	if _, err := AuthoriseLocation(id, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	into, err := GetLocation(req.IntoLocationID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if err := authoriseLocationEvents(tx, id, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE `events` SET `location_id`=? WHERE `location_id`=?", into.ID, id); err != nil {
+		return nil, errors.Wrapf(err, "failed to move events")
+	}
+	result, err := tx.Exec("DELETE FROM `locations` WHERE `id`=?", id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to delete location")
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, errors.Errorc(http.StatusNotFound, "unknown location")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit merge")
+	}
+	return into, nil
+} //MergeLocation()
+
+type SetEventLocationRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	LocationID string `json:"location_id"`
+}
+
+func (req SetEventLocationRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.LocationID == "" {
+		return errors.Errorf("missing location_id")
+	}
+	return nil
+}
+
+func SetEventLocation(eventID string, req SetEventLocationRequest) error {
+	if err := req.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid request")
+	}
+	var nrEvents int
+	if err := db.Get(&nrEvents, "SELECT COUNT(*) FROM `events` WHERE `id`=?", eventID); err != nil {
+		return errors.Wrapf(err, "failed to get event")
+	}
+	if nrEvents == 0 {
+		return errors.Errorc(http.StatusNotFound, "unknown event")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return err
+	}
+	if _, err := GetLocation(req.LocationID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE `events` SET `location_id`=? WHERE `id`=?", req.LocationID, eventID); err != nil {
+		return errors.Wrapf(err, "failed to set event location")
+	}
+	return nil
+}
+
+//NearbyLocation is a location with its distance from the point searched from
+type NearbyLocation struct {
+	Location
+	DistanceKm float64 `json:"distance_km"`
+}
+
+//ListLocationsNear returns the locations within km of a point, nearest first
+func ListLocationsNear(lat, lon, km float64) ([]NearbyLocation, error) {
+	cond, args := NewBoundingBox(lat, lon, km).where("")
+	var locations []Location
+	if err := NamedSelect(&locations,
+		"SELECT "+locationColumns+" FROM `locations` WHERE "+cond,
+		args,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get locations")
+	}
+	nearby := []NearbyLocation{}
+	for _, l := range locations {
+		if d := DistanceKm(lat, lon, l.Lat, l.Lon); d <= km {
+			nearby = append(nearby, NearbyLocation{Location: l, DistanceKm: math.Round(d*100) / 100})
+		}
+	}
+	sort.SliceStable(nearby, func(i, j int) bool { return nearby[i].DistanceKm < nearby[j].DistanceKm })
+	return nearby, nil
+}
+
+//NearbyEvent is an upcoming event at a location within the distance searched
+type NearbyEvent struct {
+	EventSummary
+	LocationID   string  `json:"location_id" db:"location_id"`
+	LocationName string  `json:"location_name" db:"location_name"`
+	Lat          float64 `json:"-" db:"lat"`
+	Lon          float64 `json:"-" db:"lon"`
+	DistanceKm   float64 `json:"distance_km" db:"-"`
+}
+
+//ListEventsNear returns events from today at locations within km of a point,
+//nearest first
+func ListEventsNear(lat, lon, km float64) ([]NearbyEvent, error) {
+	cond, args := NewBoundingBox(lat, lon, km).where("l.")
+	args["today"] = time.Now().Format("2006-01-02")
+	var events []NearbyEvent
+	if err := NamedSelect(&events,
+		"SELECT e.`id`,e.`name`,e.`date`,l.`id` AS `location_id`,l.`name` AS `location_name`,l.`lat`,l.`lon` FROM `events` e JOIN `locations` l ON l.`id`=e.`location_id` WHERE e.`date`>=:today AND "+cond,
+		args,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get events")
+	}
+	nearby := []NearbyEvent{}
+	for _, e := range events {
+		if d := DistanceKm(lat, lon, e.Lat, e.Lon); d <= km {
+			e.DistanceKm = math.Round(d*100) / 100
+			nearby = append(nearby, e)
+		}
+	}
+	sort.SliceStable(nearby, func(i, j int) bool { return nearby[i].DistanceKm < nearby[j].DistanceKm })
+	return nearby, nil
+} //ListEventsNear()
@@ -0,0 +1,82 @@
+package db_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestDistanceKm(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		km                     float64
+	}{
+		{name: "same point", lat1: -33.92, lon1: 18.42, lat2: -33.92, lon2: 18.42, km: 0},
+		{name: "Cape Town to Johannesburg", lat1: -33.9249, lon1: 18.4241, lat2: -26.2041, lon2: 28.0473, km: 1261},
+		{name: "Wilderness to Sedgefield", lat1: -33.9946, lon1: 22.5799, lat2: -34.0180, lon2: 22.8010, km: 20.5},
+		{name: "across the 180th meridian", lat1: 0, lon1: 179.5, lat2: 0, lon2: -179.5, km: 111.2},
+	}
+	for _, test := range tests {
+		if km := db.DistanceKm(test.lat1, test.lon1, test.lat2, test.lon2); math.Abs(km-test.km) > test.km*0.01+0.01 {
+			t.Errorf("%s: %.2fkm expected %.2fkm", test.name, km, test.km)
+		}
+	}
+}
+
+func TestBoundingBox(t *testing.T) {
+	tests := []struct {
+		name         string
+		lat, lon, km float64
+	}{
+		{name: "Cape Town", lat: -33.92, lon: 18.42, km: 50},
+		{name: "near the 180th meridian", lat: -17.7, lon: 179.9, km: 100},
+		{name: "near the south pole", lat: -89.5, lon: 0, km: 100},
+	}
+	for _, test := range tests {
+		box := db.NewBoundingBox(test.lat, test.lon, test.km)
+		//every point on the circle must be inside the box
+		for bearing := 0.0; bearing < 360; bearing += 5 {
+			lat, lon := destination(test.lat, test.lon, test.km*0.999, bearing)
+			if !box.Contains(lat, lon) {
+				t.Errorf("%s: %+v does not contain %.4f,%.4f at %.0f degrees", test.name, box, lat, lon, bearing)
+			}
+		}
+		//and points well outside must not be
+		lat, lon := destination(test.lat, test.lon, test.km*1.5, 45)
+		if test.lat > -89 && box.Contains(lat, lon) {
+			t.Errorf("%s: %+v contains %.4f,%.4f", test.name, box, lat, lon)
+		}
+	}
+}
+
+//destination is the point km away from lat,lon in the direction of bearing
+func destination(lat, lon, km, bearing float64) (float64, float64) {
+	rad := math.Pi / 180
+	d := km / 6371.0
+	lat1, lon1, b := lat*rad, lon*rad, bearing*rad
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(b))
+	lon2 := lon1 + math.Atan2(math.Sin(b)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+	lon2 = math.Mod(lon2/rad+540, 360) - 180
+	return lat2 / rad, lon2
+}
+
+func TestSameVenue(t *testing.T) {
+	swartvlei := db.Location{Name: "Swartvlei", Lat: -33.9850, Lon: 22.7700}
+	tests := []struct {
+		other db.Location
+		same  bool
+	}{
+		{other: db.Location{Name: "swartvlei", Lat: -33.9851, Lon: 22.7701}, same: true},
+		{other: db.Location{Name: "The Swartvlei Lake", Lat: -33.9860, Lon: 22.7710}, same: true},
+		{other: db.Location{Name: "Swartvlei!", Lat: -33.9850, Lon: 22.7700}, same: true},
+		{other: db.Location{Name: "Swartvlei", Lat: -33.9950, Lon: 22.7700}, same: false},
+		{other: db.Location{Name: "Sedgefield Slow Town", Lat: -33.9851, Lon: 22.7701}, same: false},
+	}
+	for _, test := range tests {
+		if same := swartvlei.SameVenue(test.other); same != test.same {
+			t.Errorf("%+v: same=%v expected %v", test.other, same, test.same)
+		}
+	}
+}
@@ -0,0 +1,764 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//MembershipType is a kind of membership an organisation sells, e.g. "Senior"
+//or "Junior licence", with its fee and how long it is valid
+type MembershipType struct {
+	ID               string `json:"id" db:"id"`
+	OrganisationID   string `json:"organisation_id" db:"organisation_id"`
+	Name             string `json:"name" db:"name"`
+	Description      string `json:"description,omitempty" db:"description"`
+	ValidMonths      int    `json:"valid_months" db:"valid_months" doc:"e.g. 12 for an annual membership"`
+	SeasonStartMonth int    `json:"season_start_month,omitempty" db:"season_start_month" doc:"1..12 when all memberships run from the start of the season, e.g. 1 for calendar years, omit to run from the day it starts"`
+	Fee              Amount `json:"fee" db:"-"`
+	FeeCents         int    `json:"-" db:"fee_cents"`
+	Active           bool   `json:"active" db:"active" doc:"Only active types can be renewed"`
+}
+
+const membershipTypeColumns = "`id`,`organisation_id`,`name`,`description`,`valid_months`,`season_start_month`,`fee_cents`,`active`"
+
+func (t *MembershipType) Validate() error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	if t.ValidMonths < 1 || t.ValidMonths > 120 {
+		return errors.Errorf("valid_months=%d, expecting 1..120", t.ValidMonths)
+	}
+	if t.SeasonStartMonth < 0 || t.SeasonStartMonth > 12 {
+		return errors.Errorf("season_start_month=%d, expecting 1..12 or 0 for none", t.SeasonStartMonth)
+	}
+	if t.Fee.Cents < 0 {
+		return errors.Errorf("negative fee")
+	}
+	if t.Fee.Currency == nil {
+		t.Fee.Currency = DefaultCurrency
+	}
+	if t.Fee.Currency != DefaultCurrency {
+		return errors.Errorf("fee currency %s is not %s", t.Fee.Currency.Code, DefaultCurrency.Code)
+	}
+	t.FeeCents = t.Fee.Cents
+	return nil
+}
+
+//Period returns the first and last day (CCYY-MM-DD) of a membership starting
+//on the day. With a season it is the season that includes the day, or the
+//next season when the day falls after a season shorter than a year.
+func (t MembershipType) Period(day time.Time) (string, string) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	if t.SeasonStartMonth > 0 {
+		date := start
+		start = time.Date(date.Year(), time.Month(t.SeasonStartMonth), 1, 0, 0, 0, 0, time.UTC)
+		if start.After(date) {
+			start = start.AddDate(-1, 0, 0)
+		}
+		if start.AddDate(0, t.ValidMonths, -1).Before(date) {
+			start = start.AddDate(1, 0, 0)
+		}
+	}
+	return start.Format(dateLayout), start.AddDate(0, t.ValidMonths, -1).Format(dateLayout)
+}
+
+const dateLayout = "2006-01-02"
+
+//membershipToday is the current date where the organisations are
+func membershipToday() time.Time {
+	loc, err := LoadTimeZone(DefaultTimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return time.Now().In(loc)
+}
+
+type MembershipTypeRequest struct {
+	MembershipType
+	ByPersonID string `json:"by_person_id" doc:"Admin of the organisation"`
+}
+
+func (req *MembershipTypeRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	return req.MembershipType.Validate()
+}
+
+func AddMembershipType(organisationID string, req MembershipTypeRequest) (*MembershipType, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if err := authoriseOrganisation(db, organisationID, req.ByPersonID, OrganisationAdmin); err != nil {
+		return nil, err
+	}
+	t := req.MembershipType
+	t.ID = uuid.New().String()
+	t.OrganisationID = organisationID
+	if _, err := db.NamedExec(
+		"INSERT INTO `membership_types` SET `id`=:id,`organisation_id`=:organisation_id,`name`=:name,`description`=:description,`valid_months`=:valid_months,`season_start_month`=:season_start_month,`fee_cents`=:fee_cents,`active`=:active",
+		t,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorc(http.StatusConflict, "membership type \""+t.Name+"\" already exists")
+		}
+		return nil, errors.Wrapf(err, "failed to add membership type")
+	}
+	return &t, nil
+}
+
+//UpdateMembershipType changes the type for renewals from now on, existing
+//memberships keep their period
+func UpdateMembershipType(id string, req MembershipTypeRequest) (*MembershipType, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	old, err := GetMembershipType(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authoriseOrganisation(db, old.OrganisationID, req.ByPersonID, OrganisationAdmin); err != nil {
+		return nil, err
+	}
+	t := req.MembershipType
+	t.ID = old.ID
+	t.OrganisationID = old.OrganisationID
+	if _, err := db.NamedExec(
+		"UPDATE `membership_types` SET `name`=:name,`description`=:description,`valid_months`=:valid_months,`season_start_month`=:season_start_month,`fee_cents`=:fee_cents,`active`=:active WHERE `id`=:id",
+		t,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorc(http.StatusConflict, "membership type \""+t.Name+"\" already exists")
+		}
+		return nil, errors.Wrapf(err, "failed to update membership type")
+	}
+	return &t, nil
+}
+
+func GetMembershipType(id string) (*MembershipType, error) {
+	var t MembershipType
+	if err := NamedGet(&t,
+		"SELECT "+membershipTypeColumns+" FROM `membership_types` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown membership type")
+		}
+		return nil, errors.Wrapf(err, "failed to get membership type")
+	}
+	t.Fee = Amount{Currency: DefaultCurrency, Cents: t.FeeCents}
+	return &t, nil
+}
+
+func ListMembershipTypes(organisationID string) ([]MembershipType, error) {
+	types := []MembershipType{}
+	if err := NamedSelect(&types,
+		"SELECT "+membershipTypeColumns+" FROM `membership_types` WHERE `organisation_id`=:organisation_id ORDER BY `name`",
+		map[string]interface{}{
+			"organisation_id": organisationID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list membership types")
+	}
+	for i := range types {
+		types[i].Fee = Amount{Currency: DefaultCurrency, Cents: types[i].FeeCents}
+	}
+	return types, nil
+}
+
+//Membership makes a person a member of an organisation from the first to the
+//last day of its period. It is pending until the order paying for it is paid.
+type Membership struct {
+	ID               string  `json:"id" db:"id"`
+	OrganisationID   string  `json:"organisation_id" db:"organisation_id"`
+	OrganisationName string  `json:"organisation_name" db:"organisation_name"`
+	TypeID           string  `json:"type_id" db:"type_id"`
+	TypeName         string  `json:"type_name" db:"type_name"`
+	PersonID         string  `json:"person_id" db:"person_id"`
+	FirstName        string  `json:"first_name" db:"first_name"`
+	LastName         string  `json:"last_name" db:"last_name"`
+	Number           string  `json:"number,omitempty" db:"number" doc:"Membership or licence number, e.g. from the federation"`
+	Status           string  `json:"status" db:"status"`
+	ValidFrom        string  `json:"valid_from" db:"valid_from" doc:"First day CCYY-MM-DD"`
+	ValidUntil       string  `json:"valid_until" db:"valid_until" doc:"Last day CCYY-MM-DD"`
+	Source           string  `json:"source" db:"source"`
+	OrderID          *string `json:"order_id,omitempty" db:"order_id"`
+	Created          SqlTime `json:"created" db:"created"`
+}
+
+const (
+	MembershipPending = "pending" //awaiting payment
+	MembershipActive  = "active"
+)
+
+//Sources of memberships
+const (
+	MembershipPaid     = "payment"
+	MembershipImported = "import"
+)
+
+const membershipSelectSQL = "SELECT s.`id`,s.`organisation_id`,o.`name` AS `organisation_name`,s.`type_id`,t.`name` AS `type_name`,s.`person_id`,p.`first_name`,p.`last_name`," +
+	"s.`number`,s.`status`,s.`valid_from`,s.`valid_until`,s.`source`,s.`order_id`,s.`created`" +
+	" FROM `memberships` s JOIN `organisations` o ON o.`id`=s.`organisation_id` JOIN `membership_types` t ON t.`id`=s.`type_id` JOIN `persons` p ON p.`id`=s.`person_id`"
+
+type RenewMembershipRequest struct {
+	PersonID      string  `json:"person_id" doc:"Member"`
+	PayerPersonID string  `json:"payer_person_id,omitempty" doc:"Person paying, default is the member, e.g. a parent"`
+	Number        string  `json:"number,omitempty" doc:"Membership number to keep, default is the number of the previous membership"`
+	PayBy         string  `json:"pay_by,omitempty" doc:"online (default) or eft"`
+	BillTo        *BillTo `json:"bill_to,omitempty" doc:"Club or company to name on the invoice"`
+}
+
+func (req RenewMembershipRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	if req.PayBy != "" && req.PayBy != "online" && req.PayBy != ProviderEFT {
+		return errors.Errorf("invalid pay_by \"%s\", expecting online|eft", req.PayBy)
+	}
+	if req.BillTo != nil {
+		if err := req.BillTo.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid bill_to")
+		}
+	}
+	return nil
+}
+
+//RenewMembership creates a pending membership with an order to pay for it,
+//starting today or after the current membership ends. It becomes active when
+//the order is paid, immediately when nothing is due.
+func RenewMembership(typeID string, req RenewMembershipRequest, provider string) (*Order, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if req.PayerPersonID == "" {
+		req.PayerPersonID = req.PersonID
+	}
+	t, err := GetMembershipType(typeID)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Active {
+		return nil, errors.Errorc(http.StatusBadRequest, "membership type "+t.Name+" is no longer available")
+	}
+	org, err := GetOrganisation(t.OrganisationID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	var current []Membership
+	if err := tx.Select(&current,
+		"SELECT `id`,`status`,`number`,`valid_until`,`order_id` FROM `memberships` WHERE `organisation_id`=? AND `person_id`=? ORDER BY `valid_until` DESC FOR UPDATE",
+		t.OrganisationID, req.PersonID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get memberships")
+	}
+	now := time.Now()
+	from := membershipToday()
+	for _, m := range current {
+		if m.Status == MembershipPending {
+			return nil, errors.Errorc(http.StatusConflict, "renewal awaiting payment of order "+*m.OrderID)
+		}
+		if req.Number == "" {
+			req.Number = m.Number
+		}
+		if until, err := time.Parse(dateLayout, m.ValidUntil); err == nil && !until.Before(time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)) {
+			from = until.AddDate(0, 0, 1)
+		}
+	}
+	m := Membership{
+		ID:             uuid.New().String(),
+		OrganisationID: t.OrganisationID,
+		TypeID:         t.ID,
+		PersonID:       req.PersonID,
+		Number:         req.Number,
+		Status:         MembershipPending,
+		Source:         MembershipPaid,
+		Created:        SqlTime(now),
+	}
+	m.ValidFrom, m.ValidUntil = t.Period(from)
+
+	ttl := orderTTL
+	if provider == ProviderEFT {
+		ttl = eftOrderTTL
+	}
+	order := Order{
+		ID:             uuid.New().String(),
+		OrganisationID: t.OrganisationID,
+		PersonID:       req.PayerPersonID,
+		Status:         OrderPending,
+		Total:          t.Fee,
+		TotalCents:     t.FeeCents,
+		Provider:       provider,
+		Created:        SqlTime(now),
+		Expires:        SqlTime(now.Add(ttl)),
+	}
+	if req.BillTo != nil {
+		order.BillToName = req.BillTo.Name
+		order.BillToAddress = req.BillTo.Address
+		order.BillToVATNumber = req.BillTo.VATNumber
+	}
+	if order.TotalCents == 0 {
+		order.Status = OrderPaid
+		order.Paid = &order.Created
+		m.Status = MembershipActive
+	}
+	if err := insertOrder(tx, &order); err != nil {
+		return nil, err
+	}
+	m.OrderID = &order.ID
+	if _, err := tx.NamedExec(
+		"INSERT INTO `memberships` SET `id`=:id,`organisation_id`=:organisation_id,`type_id`=:type_id,`person_id`=:person_id,`number`=:number,`status`=:status,`valid_from`=:valid_from,`valid_until`=:valid_until,`source`=:source,`order_id`=:order_id,`created`=:created",
+		m,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1452 {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown person")
+		}
+		return nil, errors.Wrapf(err, "failed to add membership")
+	}
+	line := OrderLine{
+		OrderID:      order.ID,
+		MembershipID: &m.ID,
+		PersonID:     m.PersonID,
+		Description:  fmt.Sprintf("%s %s membership %s to %s", org.Name, t.Name, m.ValidFrom, m.ValidUntil),
+		Amount:       t.Fee,
+		AmountCents:  t.FeeCents,
+	}
+	if err := insertOrderLine(tx, line); err != nil {
+		return nil, err
+	}
+	order.Lines = []OrderLine{line}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit membership")
+	}
+	return &order, nil
+} //RenewMembership()
+
+//memberOn returns the active membership of the person valid on the date, or
+//nil when not a member
+func memberOn(q sqlx.Queryer, organisationID, personID, date string) (*Membership, error) {
+	var m Membership
+	if err := sqlx.Get(q, &m,
+		membershipSelectSQL+" WHERE s.`organisation_id`=? AND s.`person_id`=? AND s.`status`=? AND s.`valid_from`<=? AND s.`valid_until`>=? ORDER BY s.`valid_until` DESC LIMIT 1",
+		organisationID, personID, MembershipActive, date, date,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to check membership")
+	}
+	return &m, nil
+}
+
+//MembershipStatus tells if a person is a member of an organisation on a date
+type MembershipStatus struct {
+	PersonID       string      `json:"person_id"`
+	OrganisationID string      `json:"organisation_id"`
+	Date           string      `json:"date"`
+	Member         bool        `json:"member"`
+	Membership     *Membership `json:"membership,omitempty" doc:"Valid on the date"`
+}
+
+//GetMembershipStatus looks up the membership of the person on the date, or
+//today when date is "". Anybody may ask if the person is a member, only the
+//person and organisers of the organisation see the membership.
+func GetMembershipStatus(personID, organisationID, date, byPersonID string) (*MembershipStatus, error) {
+	if date == "" {
+		date = membershipToday().Format(dateLayout)
+	} else if _, err := time.Parse(dateLayout, date); err != nil {
+		return nil, errors.Errorc(http.StatusBadRequest, "invalid date \""+date+"\", expecting CCYY-MM-DD")
+	}
+	m, err := memberOn(db, organisationID, personID, date)
+	if err != nil {
+		return nil, err
+	}
+	status := &MembershipStatus{
+		PersonID:       personID,
+		OrganisationID: organisationID,
+		Date:           date,
+		Member:         m != nil,
+	}
+	if m != nil && byPersonID != "" {
+		if AuthorisePerson(personID, byPersonID) == nil || authoriseOrganisation(db, organisationID, byPersonID, OrganisationOrganiser) == nil {
+			status.Membership = m
+		}
+	}
+	return status, nil
+}
+
+//ListPersonMemberships returns all memberships of the person, latest first,
+//to that person
+func ListPersonMemberships(personID, byPersonID string) ([]Membership, error) {
+	if err := AuthorisePerson(personID, byPersonID); err != nil {
+		return nil, err
+	}
+	memberships := []Membership{}
+	if err := NamedSelect(&memberships,
+		membershipSelectSQL+" WHERE s.`person_id`=:person_id ORDER BY s.`valid_until` DESC",
+		map[string]interface{}{
+			"person_id": personID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list memberships")
+	}
+	return memberships, nil
+}
+
+//ListOrganisationMemberships returns the memberships valid on the date, or all
+//when date is "", to an organiser of the organisation
+func ListOrganisationMemberships(organisationID, byPersonID, date string) ([]Membership, error) {
+	if err := authoriseOrganisation(db, organisationID, byPersonID, OrganisationOrganiser); err != nil {
+		return nil, err
+	}
+	query := membershipSelectSQL + " WHERE s.`organisation_id`=:organisation_id"
+	if date != "" {
+		query += " AND s.`status`=:status AND s.`valid_from`<=:date AND s.`valid_until`>=:date"
+	}
+	memberships := []Membership{}
+	if err := NamedSelect(&memberships, query+" ORDER BY p.`last_name`,p.`first_name`,s.`valid_until` DESC",
+		map[string]interface{}{
+			"organisation_id": organisationID,
+			"status":          MembershipActive,
+			"date":            date,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list memberships")
+	}
+	return memberships, nil
+}
+
+//eventMembership returns whose membership counts for the event (its own
+//organisation unless set to e.g. a federation), if only members may enter and
+//the date on which entrants must be members
+func eventMembership(q sqlx.Queryer, eventID string) (organisationID string, membersOnly bool, date string, err error) {
+	var event struct {
+		OrganisationID string `db:"organisation_id"`
+		MembersOnly    bool   `db:"members_only"`
+		Date           string `db:"date"`
+	}
+	if err := sqlx.Get(q, &event,
+		"SELECT COALESCE(`membership_organisation_id`,`organisation_id`,'') AS `organisation_id`,`members_only`,`date` FROM `events` WHERE `id`=?",
+		eventID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, "", errors.Errorc(http.StatusNotFound, "unknown event")
+		}
+		return "", false, "", errors.Wrapf(err, "failed to get event membership")
+	}
+	return event.OrganisationID, event.MembersOnly, event.Date, nil
+}
+
+//checkMembership refuses entries from non-members into members-only events
+func checkMembership(q sqlx.Queryer, eventID, personID string) error {
+	organisationID, membersOnly, date, err := eventMembership(q, eventID)
+	if err != nil {
+		return err
+	}
+	if !membersOnly || organisationID == "" {
+		return nil
+	}
+	m, err := memberOn(q, organisationID, personID, date)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.Errorc(http.StatusForbidden, "only members may enter, membership must be valid on "+date)
+	}
+	return nil
+}
+
+type SetEventMembershipRequest struct {
+	ByPersonID     string `json:"by_person_id" doc:"Organiser of the event"`
+	MembersOnly    bool   `json:"members_only" doc:"Refuse entries from non-members"`
+	OrganisationID string `json:"organisation_id,omitempty" doc:"Whose members, e.g. a federation, default is the organisation of the event"`
+}
+
+func (req SetEventMembershipRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	return nil
+}
+
+//SetEventMembership sets whose members get member prices and whether only
+//they may enter
+func SetEventMembership(eventID string, req SetEventMembershipRequest) error {
+	if err := req.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid request")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return err
+	}
+	var organisationID *string
+	if req.OrganisationID != "" {
+		if _, err := GetOrganisation(req.OrganisationID); err != nil {
+			return err
+		}
+		organisationID = &req.OrganisationID
+	}
+	if req.MembersOnly && organisationID == nil {
+		event, err := GetEvent(eventID)
+		if err != nil {
+			return err
+		}
+		if event.OrganisationID == "" {
+			return errors.Errorc(http.StatusBadRequest, "event has no organisation, specify whose members may enter")
+		}
+	}
+	if _, err := db.Exec(
+		"UPDATE `events` SET `members_only`=?,`membership_organisation_id`=? WHERE `id`=?",
+		req.MembersOnly, organisationID, eventID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to set event membership")
+	}
+	return nil
+}
+
+//MembershipRow is a member in a membership list, e.g. from the federation
+type MembershipRow struct {
+	Row        int    `json:"row"`
+	Number     string `json:"number,omitempty"`
+	NatID      string `json:"nat_id,omitempty"`
+	Email      string `json:"email,omitempty"`
+	FirstName  string `json:"first_name,omitempty"`
+	LastName   string `json:"last_name,omitempty"`
+	Type       string `json:"type,omitempty"`
+	ValidFrom  string `json:"valid_from,omitempty"`
+	ValidUntil string `json:"valid_until,omitempty"`
+	Problem    string `json:"problem,omitempty" doc:"Why the row was not imported"`
+}
+
+//ParseMembershipCSV parses a membership list exported from a spreadsheet. It
+//looks for a header row with an ID number or email column, which identify the
+//members, and skips rows above it. Dates are returned as CCYY-MM-DD.
+func ParseMembershipCSV(r io.Reader) ([]MembershipRow, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read list")
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) //UTF-8 BOM from spreadsheets
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+	if first := bytes.IndexByte(data, '\n'); first > 0 && bytes.Count(data[:first], []byte(";")) > bytes.Count(data[:first], []byte(",")) {
+		cr.Comma = ';'
+	}
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid CSV")
+	}
+
+	var cols map[string]int
+	headerRow := -1
+	for i, record := range records {
+		cols = map[string]int{}
+		for c, name := range record {
+			name = strings.ToLower(strings.TrimSpace(name))
+			field := ""
+			switch {
+			case strings.Contains(name, "phone") || strings.Contains(name, "cell") || strings.Contains(name, "mobile") || strings.Contains(name, "gender"):
+			case strings.Contains(name, "type") || strings.Contains(name, "category") || strings.Contains(name, "class"):
+				field = "type"
+			case strings.Contains(name, "from") || strings.Contains(name, "start") || strings.Contains(name, "joined"):
+				field = "valid_from"
+			case strings.Contains(name, "until") || strings.Contains(name, "expir") || strings.Contains(name, "end") || name == "to" || name == "valid to":
+				field = "valid_until"
+			case strings.Contains(name, "mail"):
+				field = "email"
+			case name == "id" || strings.HasPrefix(name, "id ") || strings.Contains(name, "identity") || strings.Contains(name, "passport") || strings.Contains(name, "nat_id") || strings.Contains(name, "national"):
+				field = "nat_id"
+			case strings.Contains(name, "number") || strings.HasSuffix(name, " no") || strings.Contains(name, "licen") || strings.Contains(name, "member"):
+				field = "number"
+			case strings.Contains(name, "first") || strings.Contains(name, "given"):
+				field = "first_name"
+			case strings.Contains(name, "last") || strings.Contains(name, "surname") || strings.Contains(name, "family"):
+				field = "last_name"
+			}
+			if _, ok := cols[field]; field != "" && !ok {
+				cols[field] = c
+			}
+		}
+		_, natID := cols["nat_id"]
+		_, email := cols["email"]
+		if natID || email {
+			headerRow = i
+			break
+		}
+	}
+	if headerRow < 0 {
+		return nil, errors.Errorf("CSV has no header row with an ID number or email column")
+	}
+
+	col := func(record []string, field string) string {
+		c, ok := cols[field]
+		if !ok || c >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[c])
+	}
+	rows := []MembershipRow{}
+	for i, record := range records[headerRow+1:] {
+		row := MembershipRow{
+			Row:       headerRow + i + 2,
+			Number:    col(record, "number"),
+			NatID:     col(record, "nat_id"),
+			Email:     strings.ToLower(col(record, "email")),
+			FirstName: col(record, "first_name"),
+			LastName:  col(record, "last_name"),
+			Type:      col(record, "type"),
+		}
+		if row.NatID == "" && row.Email == "" {
+			continue //blank or summary lines
+		}
+		for _, d := range []struct {
+			field string
+			value *string
+		}{
+			{"valid_from", &row.ValidFrom},
+			{"valid_until", &row.ValidUntil},
+		} {
+			if s := col(record, d.field); s != "" {
+				t, err := parseStatementDate(s)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid row %d %s", row.Row, d.field)
+				}
+				*d.value = t.Format(dateLayout)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+} //ParseMembershipCSV()
+
+type ImportMembershipsRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Admin of the organisation"`
+	TypeID     string `json:"type_id,omitempty" doc:"Type of rows without a type column that matches a type name"`
+}
+
+func (req ImportMembershipsRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	return nil
+}
+
+//MembershipImport summarises the import of a membership list
+type MembershipImport struct {
+	Imported int             `json:"imported"`
+	Updated  int             `json:"updated" doc:"Imported before, number and last day updated"`
+	Problems []MembershipRow `json:"problems" doc:"Rows not imported"`
+}
+
+//ImportMemberships adds the memberships in a list, e.g. from a federation,
+//matching members by ID number and then by email. Rows without a registered
+//person are returned as problems, so the list can be imported again after
+//they registered. Importing a membership again updates it.
+func ImportMemberships(organisationID string, req ImportMembershipsRequest, rows []MembershipRow) (*MembershipImport, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if err := authoriseOrganisation(db, organisationID, req.ByPersonID, OrganisationAdmin); err != nil {
+		return nil, err
+	}
+	types, err := ListMembershipTypes(organisationID)
+	if err != nil {
+		return nil, err
+	}
+	typeByName := map[string]MembershipType{}
+	var defaultType *MembershipType
+	for i, t := range types {
+		typeByName[strings.ToLower(t.Name)] = t
+		if t.ID == req.TypeID {
+			defaultType = &types[i]
+		}
+	}
+	if req.TypeID != "" && defaultType == nil {
+		return nil, errors.Errorc(http.StatusBadRequest, "unknown type_id for this organisation")
+	}
+
+	result := MembershipImport{Problems: []MembershipRow{}}
+	problem := func(row MembershipRow, reason string) {
+		row.Problem = reason
+		result.Problems = append(result.Problems, row)
+	}
+	today := membershipToday()
+	for _, row := range rows {
+		t, ok := typeByName[strings.ToLower(row.Type)]
+		if !ok {
+			if defaultType == nil {
+				problem(row, "unknown membership type \""+row.Type+"\"")
+				continue
+			}
+			t = *defaultType
+		}
+		var personID string
+		err := db.Get(&personID, "SELECT `id` FROM `persons` WHERE `nat_id`=? AND `nat_id`!=''", row.NatID)
+		if err == sql.ErrNoRows && row.Email != "" {
+			err = db.Get(&personID, "SELECT `id` FROM `persons` WHERE `email`=?", row.Email)
+		}
+		if err == sql.ErrNoRows {
+			problem(row, "not registered")
+			continue
+		}
+		if err != nil {
+			return &result, errors.Wrapf(err, "failed to find person of row %d", row.Row)
+		}
+		m := Membership{
+			ID:             uuid.New().String(),
+			OrganisationID: organisationID,
+			TypeID:         t.ID,
+			PersonID:       personID,
+			Number:         row.Number,
+			Status:         MembershipActive,
+			ValidFrom:      row.ValidFrom,
+			ValidUntil:     row.ValidUntil,
+			Source:         MembershipImported,
+			Created:        SqlTime(time.Now()),
+		}
+		start := today
+		if m.ValidFrom != "" {
+			start, _ = time.Parse(dateLayout, m.ValidFrom)
+		}
+		from, until := t.Period(start)
+		if m.ValidFrom == "" {
+			m.ValidFrom = from
+		}
+		if m.ValidUntil == "" {
+			m.ValidUntil = until
+		}
+		if m.ValidUntil < m.ValidFrom {
+			problem(row, "ends before it starts")
+			continue
+		}
+		res, err := db.NamedExec(
+			"INSERT INTO `memberships` SET `id`=:id,`organisation_id`=:organisation_id,`type_id`=:type_id,`person_id`=:person_id,`number`=:number,`status`=:status,`valid_from`=:valid_from,`valid_until`=:valid_until,`source`=:source,`created`=:created"+
+				" ON DUPLICATE KEY UPDATE `type_id`=VALUES(`type_id`),`number`=VALUES(`number`),`status`=VALUES(`status`),`valid_until`=VALUES(`valid_until`)",
+			m,
+		)
+		if err != nil {
+			return &result, errors.Wrapf(err, "failed to import row %d", row.Row)
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			result.Imported++
+		} else {
+			result.Updated++
+		}
+	}
+	return &result, nil
+} //ImportMemberships()
@@ -0,0 +1,71 @@
+package db_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func TestMembershipPeriod(t *testing.T) {
+	for _, test := range []struct {
+		validMonths int
+		seasonStart int
+		day         string
+		from        string
+		until       string
+	}{
+		{12, 0, "2024-03-15", "2024-03-15", "2025-03-14"},
+		{12, 0, "2024-02-29", "2024-02-29", "2025-02-28"},
+		{12, 1, "2024-03-15", "2024-01-01", "2024-12-31"},
+		{12, 7, "2024-03-15", "2023-07-01", "2024-06-30"},
+		{12, 7, "2024-07-01", "2024-07-01", "2025-06-30"},
+		{6, 9, "2024-10-01", "2024-09-01", "2025-02-28"},
+		{6, 9, "2024-05-01", "2024-09-01", "2025-02-28"}, //after the previous season ended
+	} {
+		day, _ := time.Parse("2006-01-02", test.day)
+		mt := db.MembershipType{ValidMonths: test.validMonths, SeasonStartMonth: test.seasonStart}
+		from, until := mt.Period(day)
+		if from != test.from || until != test.until {
+			t.Fatalf("%d months from month %d on %s: %s..%s instead of %s..%s", test.validMonths, test.seasonStart, test.day, from, until, test.from, test.until)
+		}
+	}
+}
+
+func TestParseMembershipCSV(t *testing.T) {
+	rows, err := db.ParseMembershipCSV(strings.NewReader("\xef\xbb\xbf" +
+		"Athletics Federation;;;;;\n" +
+		"Licensed members 2024;;;;;\n" +
+		"Licence No;First Name;Surname;ID Number;Gender;Expiry Date\n" +
+		"ABC123;Jan;Smith;8001015009087;M;2024/12/31\n" +
+		";;;;;\n" +
+		"ABC124;Sue; Jones ;9002025008086;F;31 Dec 2024\n" +
+		"Total: 2;;;;;\n"))
+	if err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("%d rows instead of 2: %+v", len(rows), rows)
+	}
+	if rows[0].Row != 4 || rows[0].Number != "ABC123" || rows[0].NatID != "8001015009087" || rows[0].FirstName != "Jan" || rows[0].ValidUntil != "2024-12-31" {
+		t.Fatalf("wrong first row %+v", rows[0])
+	}
+	if rows[1].Row != 6 || rows[1].LastName != "Jones" || rows[1].ValidUntil != "2024-12-31" || rows[1].ValidFrom != "" {
+		t.Fatalf("wrong second row %+v", rows[1])
+	}
+
+	if _, err := db.ParseMembershipCSV(strings.NewReader("Name,Phone\nJan,0821234567\n")); err == nil {
+		t.Fatalf("parsed list without ID number or email")
+	}
+}
+
+func TestListPersonMembershipsNeedsPerson(t *testing.T) {
+	for _, byPersonID := range []string{"", "p2"} {
+		if _, err := db.ListPersonMemberships("p1", byPersonID); errors.Code(err) != http.StatusForbidden {
+			t.Fatalf("by %q: code %d instead of 403: %+v", byPersonID, errors.Code(err), err)
+		}
+	}
+}
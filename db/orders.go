@@ -0,0 +1,591 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/email"
+	"github.com/jansemmelink/events/payment"
+	"github.com/jmoiron/sqlx"
+)
+
+//Order pays for one or more entries into an event, the fee of an entry
+//transfer, or for memberships of an organisation. The entries or memberships
+//stay pending until a verified payment for the full amount is received, and
+//are removed when the order expires unpaid.
+type Order struct {
+	ID              string      `json:"id" db:"id"`
+	EventID         string      `json:"event_id,omitempty" db:"event_id"`
+	OrganisationID  string      `json:"organisation_id,omitempty" db:"organisation_id" doc:"Set instead of event_id for memberships"`
+	PersonID        string      `json:"person_id" db:"person_id" doc:"Person paying for the order"`
+	Status          string      `json:"status" db:"status"`
+	Total           Amount      `json:"total" db:"-"`
+	TotalCents      int         `json:"-" db:"total_cents"`
+	Credit          Amount      `json:"credit" db:"-" doc:"Paid with credit notes of the payer"`
+	CreditCents     int         `json:"-" db:"credit_cents"`
+	Provider        string      `json:"provider" db:"provider"`
+	Reference       string      `json:"reference" db:"reference" doc:"Payment reference to use when paying by EFT"`
+	BillToName      string      `json:"bill_to_name,omitempty" db:"bill_to_name"`
+	BillToAddress   string      `json:"bill_to_address,omitempty" db:"bill_to_address"`
+	BillToVATNumber string      `json:"bill_to_vat_number,omitempty" db:"bill_to_vat_number"`
+	Created         SqlTime     `json:"created" db:"created"`
+	Expires         SqlTime     `json:"expires" db:"expires"`
+	Paid            *SqlTime    `json:"paid,omitempty" db:"paid"`
+	Lines           []OrderLine `json:"lines,omitempty" db:"-"`
+	Refunds         []Refund    `json:"refunds,omitempty" db:"-"`
+	Refunded        Amount      `json:"refunded" db:"-" doc:"Total of completed refunds"`
+}
+
+//OrderLine is a line item from the pricing quote
+type OrderLine struct {
+	OrderID      string  `json:"-" db:"order_id"`
+	Line         int     `json:"line" db:"line"`
+	EntryID      string  `json:"entry_id,omitempty" db:"entry_id"`
+	MembershipID *string `json:"membership_id,omitempty" db:"membership_id"`
+	TransferID   *string `json:"transfer_id,omitempty" db:"transfer_id" doc:"Set for entry transfer fees"`
+	PersonID     string  `json:"person_id" db:"person_id"`
+	Description  string  `json:"description" db:"description"`
+	Amount       Amount  `json:"amount" db:"-"`
+	AmountCents  int     `json:"-" db:"amount_cents"`
+	PromoCodeID  *string `json:"promo_code_id,omitempty" db:"promo_code_id"`
+}
+
+//DueCents is what is left to pay after the credit notes
+func (o Order) DueCents() int {
+	return o.TotalCents - o.CreditCents
+}
+
+const (
+	OrderPending  = "pending"
+	OrderPaid     = "paid"
+	OrderExpired  = "expired"
+	OrderRefunded = "refunded" //all refunded, partial refunds leave the order paid
+)
+
+//orderTTL is how long the payer has to pay before the entries are released,
+//which is longer for EFT because bank transfers take days to clear
+const (
+	orderTTL    = time.Hour
+	eftOrderTTL = 3 * 24 * time.Hour
+)
+
+type CheckoutRequest struct {
+	PersonID  string            `json:"person_id" doc:"Person paying for the entries"`
+	Entries   []NewEntryRequest `json:"entries"`
+	Codes     []string          `json:"codes,omitempty" doc:"Promo codes"`
+	PayBy     string            `json:"pay_by,omitempty" doc:"online (default) or eft"`
+	BillTo    *BillTo           `json:"bill_to,omitempty" doc:"Club or company to name on the invoice"`
+	UseCredit bool              `json:"use_credit,omitempty" doc:"Pay with open credit notes of the payer first"`
+}
+
+func (req CheckoutRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	if len(req.Entries) == 0 {
+		return errors.Errorf("missing entries")
+	}
+	if req.PayBy != "" && req.PayBy != "online" && req.PayBy != ProviderEFT {
+		return errors.Errorf("invalid pay_by \"%s\", expecting online|eft", req.PayBy)
+	}
+	if req.BillTo != nil {
+		if err := req.BillTo.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid bill_to")
+		}
+	}
+	for i, e := range req.Entries {
+		if err := e.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid entries[%d]", i)
+		}
+	}
+	return nil
+}
+
+//Checkout creates pending entries with an order to pay for them. With
+//use_credit the open credit notes of the payer pay first. When nothing is
+//due, the order is paid and the entries confirmed immediately.
+func Checkout(eventID string, req CheckoutRequest, provider string) (*Order, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	pricing, err := GetEventPricing(eventID)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, len(req.Entries))
+	values := make([]map[string]string, len(req.Entries))
+	items := make([]QuoteRequestItem, len(req.Entries))
+	for i, e := range req.Entries {
+		if entries[i], values[i], err = prepareEntry(eventID, e); err != nil {
+			return nil, errors.Wrapf(err, "invalid entries[%d]", i)
+		}
+		items[i] = QuoteRequestItem{PersonID: e.PersonID}
+		if entries[i].CategoryID != nil {
+			items[i].CategoryID = *entries[i].CategoryID
+		}
+	}
+	basket, personIDs, err := newBasket(eventID, items)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	codes, err := getPromoCodes(tx, eventID, req.Codes, personIDs)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ttl := orderTTL
+	if provider == ProviderEFT {
+		if err := checkEFTEvent(tx, eventID); err != nil {
+			return nil, err
+		}
+		ttl = eftOrderTTL
+	}
+	quote, err := pricing.Calculate(basket, now, codes...)
+	if err != nil {
+		return nil, err
+	}
+	order := Order{
+		ID:         uuid.New().String(),
+		EventID:    eventID,
+		PersonID:   req.PersonID,
+		Status:     OrderPending,
+		Total:      quote.Total,
+		TotalCents: quote.Total.Cents,
+		Provider:   provider,
+		Created:    SqlTime(now),
+		Expires:    SqlTime(now.Add(ttl)),
+	}
+	if req.BillTo != nil {
+		order.BillToName = req.BillTo.Name
+		order.BillToAddress = req.BillTo.Address
+		order.BillToVATNumber = req.BillTo.VATNumber
+	}
+	var credits []CreditNoteRedemption
+	if req.UseCredit {
+		if credits, err = spendPersonCreditNotes(tx, &order); err != nil {
+			return nil, err
+		}
+	}
+	if order.DueCents() == 0 {
+		order.Status = OrderPaid
+		order.Paid = &order.Created
+	}
+	if err := insertOrder(tx, &order); err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if order.Status == OrderPaid {
+			entry.Status = EntryStatusConfirmed
+		}
+		if err := insertEntry(tx, *entry, values[i]); err != nil {
+			return nil, errors.Wrapf(err, "failed to add entries[%d]", i)
+		}
+	}
+	for i, line := range quote.Lines {
+		ol := OrderLine{
+			OrderID:     order.ID,
+			Line:        i,
+			EntryID:     entries[line.Item].ID,
+			PersonID:    line.PersonID,
+			Description: line.Description,
+			Amount:      line.Amount,
+			AmountCents: line.Amount.Cents,
+		}
+		if line.PromoCodeID != "" {
+			ol.PromoCodeID = &line.PromoCodeID
+		}
+		if err := insertOrderLine(tx, ol); err != nil {
+			return nil, err
+		}
+		order.Lines = append(order.Lines, ol)
+	}
+	if err := RedeemPromoCodes(tx, eventID, order.ID, req.Codes, *quote); err != nil {
+		return nil, err
+	}
+	if err := redeemCreditNotes(tx, order, credits); err != nil {
+		return nil, err
+	}
+	paidWithCredit := order.Status == OrderPaid && order.CreditCents > 0
+	if paidWithCredit {
+		if err := issueInvoice(tx, order.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit order")
+	}
+	for _, entry := range entries {
+		notifyCrew(*entry)
+	}
+	if paidWithCredit {
+		if err := sendOrderConfirmation(order.ID); err != nil {
+			log.Errorf("failed to send confirmation of order %s: %+v", order.ID, err)
+		}
+	}
+	return &order, nil
+} //Checkout()
+
+//insertOrder adds the order with a new payment reference
+func insertOrder(tx *sqlx.Tx, order *Order) error {
+	for attempt := 0; ; attempt++ {
+		order.Reference = NewPaymentReference()
+		_, err := tx.NamedExec(
+			"INSERT INTO `orders` SET `id`=:id,`event_id`=NULLIF(:event_id,''),`organisation_id`=NULLIF(:organisation_id,''),`person_id`=:person_id,`status`=:status,`total_cents`=:total_cents,`credit_cents`=:credit_cents,`provider`=:provider,`reference`=:reference,`bill_to_name`=:bill_to_name,`bill_to_address`=:bill_to_address,`bill_to_vat_number`=:bill_to_vat_number,`created`=:created,`expires`=:expires,`paid`=:paid",
+			order,
+		)
+		if err == nil {
+			return nil
+		}
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 && attempt < 5 {
+			continue //reference already used, try another
+		}
+		return errors.Wrapf(err, "failed to add order")
+	}
+}
+
+func insertOrderLine(tx *sqlx.Tx, ol OrderLine) error {
+	if _, err := tx.NamedExec(
+		"INSERT INTO `order_lines` SET `order_id`=:order_id,`line`=:line,`entry_id`=:entry_id,`membership_id`=:membership_id,`transfer_id`=:transfer_id,`person_id`=:person_id,`description`=:description,`amount_cents`=:amount_cents,`promo_code_id`=:promo_code_id",
+		ol,
+	); err != nil {
+		return errors.Wrapf(err, "failed to add order line")
+	}
+	return nil
+}
+
+func GetOrder(id string) (*Order, error) {
+	var order Order
+	if err := NamedGet(&order,
+		"SELECT `id`,COALESCE(`event_id`,'') AS `event_id`,COALESCE(`organisation_id`,'') AS `organisation_id`,`person_id`,`status`,`total_cents`,`credit_cents`,`provider`,`reference`,`bill_to_name`,`bill_to_address`,`bill_to_vat_number`,`created`,`expires`,`paid` FROM `orders` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown order")
+		}
+		return nil, errors.Wrapf(err, "failed to get order")
+	}
+	order.Total = Amount{Currency: DefaultCurrency, Cents: order.TotalCents}
+	order.Credit = Amount{Currency: DefaultCurrency, Cents: order.CreditCents}
+	if err := NamedSelect(
+		&order.Lines,
+		"SELECT `order_id`,`line`,`entry_id`,`membership_id`,`transfer_id`,`person_id`,`description`,`amount_cents`,`promo_code_id` FROM `order_lines` WHERE `order_id`=:id ORDER BY `line`",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get order lines")
+	}
+	for i := range order.Lines {
+		order.Lines[i].Amount = Amount{Currency: DefaultCurrency, Cents: order.Lines[i].AmountCents}
+	}
+	if err := NamedSelect(
+		&order.Refunds,
+		"SELECT "+refundColumns+" FROM `refunds` WHERE `order_id`=:id ORDER BY `requested`",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get order refunds")
+	}
+	order.Refunded = Amount{Currency: DefaultCurrency}
+	for i, r := range order.Refunds {
+		order.Refunds[i].Amount = Amount{Currency: DefaultCurrency, Cents: r.AmountCents}
+		if r.Status == RefundCompleted {
+			order.Refunded.Cents += r.AmountCents
+		}
+	}
+	return &order, nil
+} //GetOrder()
+
+//AuthoriseOrder returns the order to the person paying for it, to an
+//organiser of its event or for memberships to an admin of the organisation
+func AuthoriseOrder(id, personID string) (*Order, error) {
+	order, err := GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if personID != "" && order.PersonID == personID {
+		return order, nil
+	}
+	if order.EventID == "" {
+		if err := authoriseOrganisation(db, order.OrganisationID, personID, OrganisationAdmin); err != nil {
+			return nil, errors.Errorc(http.StatusForbidden, "not your order")
+		}
+		return order, nil
+	}
+	if ok, err := IsEventOrganiser(order.EventID, personID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "not your order")
+	}
+	return order, nil
+}
+
+//Payment is a payment notification received from a provider
+type Payment struct {
+	ID          string  `json:"id" db:"id"`
+	OrderID     string  `json:"order_id" db:"order_id"`
+	Provider    string  `json:"provider" db:"provider"`
+	ProviderRef string  `json:"provider_ref" db:"provider_ref"`
+	AmountCents int     `json:"amount_cents" db:"amount_cents"`
+	Status      string  `json:"status" db:"status"`
+	Note        string  `json:"note" db:"note" doc:"Why the payment did not confirm the order"`
+	Received    SqlTime `json:"received" db:"received"`
+	Payload     string  `json:"-" db:"payload"`
+}
+
+//ProcessPayment records a verified payment notification and confirms the
+//order when paid in full. A notification received again (providers retry until
+//they get a success response) is ignored, so this can safely be called again.
+func ProcessPayment(provider string, n payment.Notification) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	p := Payment{
+		ID:          uuid.New().String(),
+		OrderID:     n.OrderID,
+		Provider:    provider,
+		ProviderRef: n.ProviderRef,
+		AmountCents: n.AmountCents,
+		Status:      n.Status,
+		Received:    SqlTime(time.Now()),
+		Payload:     n.Payload,
+	}
+	var order Order
+	if err := tx.Get(&order,
+		"SELECT `id`,COALESCE(`event_id`,'') AS `event_id`,COALESCE(`organisation_id`,'') AS `organisation_id`,`person_id`,`status`,`total_cents`,`credit_cents`,`provider`,`reference`,`created`,`expires`,`paid` FROM `orders` WHERE `id`=? FOR UPDATE",
+		n.OrderID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.Errorc(http.StatusNotFound, "unknown order")
+		}
+		return errors.Wrapf(err, "failed to get order")
+	}
+
+	confirm := false
+	switch {
+	case n.Status != payment.StatusComplete:
+		p.Note = "not completed"
+	case order.Status != OrderPending:
+		p.Note = "order is " + order.Status
+	case n.AmountCents != order.DueCents():
+		p.Note = fmt.Sprintf("amount %d cents != amount due %d cents", n.AmountCents, order.DueCents())
+	default:
+		confirm = true
+	}
+	if _, err := tx.NamedExec(
+		"INSERT INTO `payments` SET `id`=:id,`order_id`=:order_id,`provider`=:provider,`provider_ref`=:provider_ref,`amount_cents`=:amount_cents,`status`=:status,`note`=:note,`received`=:received,`payload`=:payload",
+		p,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			log.Debugf("ignore repeated %s payment notification %s", provider, n.ProviderRef)
+			return nil
+		}
+		return errors.Wrapf(err, "failed to add payment")
+	}
+	if n.Status == payment.StatusComplete {
+		//money was received for the event even if it cannot confirm the order
+		received := Amount{Currency: DefaultCurrency, Cents: n.AmountCents}
+		if err := postOrderLedger(tx, order, LedgerPayment, p.ID, "payment for order "+order.ID, received, ProcessorAccount(provider), AccountOrganiser); err != nil {
+			return err
+		}
+		fee := Amount{Currency: DefaultCurrency, Cents: n.FeeCents}
+		if err := postOrderLedger(tx, order, LedgerFee, p.ID, provider+" fee for order "+order.ID, fee, AccountOrganiser, ProcessorAccount(provider)); err != nil {
+			return err
+		}
+	}
+	if p.Note != "" && n.Status == payment.StatusComplete {
+		//money received but not applied to the order
+		log.Errorf("payment %s for order %s needs manual review: %s", p.ID, order.ID, p.Note)
+	}
+	if confirm {
+		if err := confirmOrder(tx, order.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit payment")
+	}
+	if confirm {
+		if err := sendOrderConfirmation(order.ID); err != nil {
+			log.Errorf("failed to send confirmation of order %s: %+v", order.ID, err)
+		}
+	}
+	return nil
+} //ProcessPayment()
+
+//confirmOrder marks the locked order paid and confirms its entries, activates
+//its memberships or completes its entry transfers
+func confirmOrder(tx *sqlx.Tx, orderID string) error {
+	if _, err := tx.Exec(
+		"UPDATE `orders` SET `status`=?,`paid`=? WHERE `id`=?",
+		OrderPaid, SqlTime(time.Now()), orderID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to update order")
+	}
+	if _, err := tx.Exec(
+		"UPDATE `entries` SET `status`=? WHERE `status`=? AND `id` IN (SELECT `entry_id` FROM `order_lines` WHERE `order_id`=?)",
+		EntryStatusConfirmed, EntryStatusPending, orderID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to confirm entries")
+	}
+	if _, err := tx.Exec(
+		"UPDATE `memberships` SET `status`=? WHERE `status`=? AND `order_id`=?",
+		MembershipActive, MembershipPending, orderID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to activate memberships")
+	}
+	if err := completeOrderTransfers(tx, orderID); err != nil {
+		return err
+	}
+	return issueInvoice(tx, orderID)
+}
+
+func sendOrderConfirmation(orderID string) error {
+	order, err := GetOrder(orderID)
+	if err != nil {
+		return err
+	}
+	payer, err := GetPerson(map[string]string{"id": order.PersonID})
+	if err != nil || payer == nil {
+		return errors.Errorf("payer not found")
+	}
+	if payer.Email == nil {
+		return nil //cannot email
+	}
+	subject, title, confirmed := "Entry Confirmation: ", "", "entries are confirmed"
+	if order.EventID != "" {
+		var event EventSummary
+		if err := NamedGet(&event,
+			"SELECT `id`,`name`,`date` FROM `events` WHERE `id`=:id",
+			map[string]interface{}{
+				"id": order.EventID,
+			}); err != nil {
+			return errors.Wrapf(err, "failed to get event")
+		}
+		title = event.Name
+	} else {
+		org, err := GetOrganisation(order.OrganisationID)
+		if err != nil {
+			return err
+		}
+		subject, title, confirmed = "Membership Confirmation: ", org.Name, "memberships are active"
+	}
+	msg := email.Message{
+		From:        email.Email{Addr: "no-reply@events.net", Name: "Events"},
+		To:          []email.Email{{Addr: *payer.Email, Name: payer.Name + " " + payer.Surname}},
+		Subject:     subject + title,
+		ContentType: "text/html",
+	}
+	msg.Content = "<H1>" + html.EscapeString(title) + "</H1>"
+	msg.Content += "<P>Thank you, your payment was received and the following " + confirmed + ":</P>"
+	msg.Content += "<TABLE>"
+	for _, line := range order.Lines {
+		msg.Content += "<TR><TD>" + html.EscapeString(line.Description) + "</TD><TD>" + line.Amount.String() + "</TD></TR>"
+	}
+	msg.Content += "<TR><TD><B>Total</B></TD><TD><B>" + order.Total.String() + "</B></TD></TR>"
+	msg.Content += "</TABLE>"
+	if inv, err := GetOrderInvoice(orderID); err != nil {
+		log.Debugf("no invoice for order %s: %+v", orderID, err)
+	} else {
+		msg.Content += "<P>Your invoice " + inv.Number + " is attached.</P>"
+		msg.Attachments = append(msg.Attachments, email.Attachment{
+			Filename:    "invoice-" + inv.Number + ".pdf",
+			ContentType: "application/pdf",
+			Data:        inv.PDF(),
+		})
+	}
+	return email.Send(msg)
+} //sendOrderConfirmation()
+
+//ExpireOrders releases the entries, memberships, transfers, promo codes and
+//credit notes of orders that were not paid in time, and returns the nr of
+//orders expired
+func ExpireOrders() (int, error) {
+	var ids []string
+	if err := NamedSelect(
+		&ids,
+		"SELECT `id` FROM `orders` WHERE `status`=:status AND `expires`<:now",
+		map[string]interface{}{
+			"status": OrderPending,
+			"now":    SqlTime(time.Now()),
+		}); err != nil {
+		return 0, errors.Wrapf(err, "failed to get expired orders")
+	}
+	nrExpired := 0
+	for _, id := range ids {
+		expired, err := expireOrder(id)
+		if err != nil {
+			return nrExpired, errors.Wrapf(err, "failed to expire order %s", id)
+		}
+		if expired {
+			nrExpired++
+		}
+	}
+	return nrExpired, nil
+} //ExpireOrders()
+
+func expireOrder(id string) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	var status string
+	if err := tx.Get(&status, "SELECT `status` FROM `orders` WHERE `id`=? FOR UPDATE", id); err != nil {
+		return false, errors.Wrapf(err, "failed to lock order")
+	}
+	if status != OrderPending {
+		return false, nil //paid while we were busy
+	}
+	if _, err := tx.Exec("UPDATE `orders` SET `status`=? WHERE `id`=?", OrderExpired, id); err != nil {
+		return false, errors.Wrapf(err, "failed to update order")
+	}
+	pendingEntries := "SELECT `id` FROM `entries` WHERE `status`='" + EntryStatusPending + "' AND `id` IN (SELECT `entry_id` FROM `order_lines` WHERE `order_id`=?)"
+	var entryIDs []string
+	if err := tx.Select(&entryIDs, pendingEntries, id); err != nil {
+		return false, errors.Wrapf(err, "failed to get entries")
+	}
+	for _, entryID := range entryIDs {
+		if _, err := tx.Exec("DELETE FROM `entry_answers` WHERE `entry_id`=?", entryID); err != nil {
+			return false, errors.Wrapf(err, "failed to delete answers")
+		}
+		if _, err := tx.Exec("DELETE FROM `entry_members` WHERE `entry_id`=?", entryID); err != nil {
+			return false, errors.Wrapf(err, "failed to delete crew")
+		}
+		if _, err := tx.Exec("DELETE FROM `entries` WHERE `id`=?", entryID); err != nil {
+			return false, errors.Wrapf(err, "failed to delete entry")
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM `promo_redemptions` WHERE `order_id`=?", id); err != nil {
+		return false, errors.Wrapf(err, "failed to release promo codes")
+	}
+	if err := releaseCreditNotes(tx, id); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM `memberships` WHERE `status`=? AND `order_id`=?", MembershipPending, id); err != nil {
+		return false, errors.Wrapf(err, "failed to delete memberships")
+	}
+	if _, err := tx.Exec("UPDATE `entry_transfers` SET `status`=? WHERE `status`=? AND `order_id`=?", TransferExpired, TransferAccepted, id); err != nil {
+		return false, errors.Wrapf(err, "failed to expire transfers")
+	}
+	if err := tx.Commit(); err != nil {
+		return false, errors.Wrapf(err, "failed to commit")
+	}
+	return true, nil
+} //expireOrder()
@@ -0,0 +1,481 @@
+package db
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//Organisation is the body (club, federation or company) that runs events and
+//issues the invoices for their entries. Its organisers and admins are
+//organisers of all its events.
+type Organisation struct {
+	ID             string  `json:"id" db:"id"`
+	Name           string  `json:"name" db:"name"`
+	Address        string  `json:"address,omitempty" db:"address"`
+	Email          string  `json:"email,omitempty" db:"email"`
+	Phone          string  `json:"phone,omitempty" db:"phone"`
+	Website        string  `json:"website,omitempty" db:"website"`
+	LogoDocumentID *string `json:"logo_document_id,omitempty" db:"logo_document_id" doc:"Image shown on events and invoices"`
+	BrandColour    string  `json:"brand_colour,omitempty" db:"brand_colour" doc:"e.g. #1a5fb4"`
+	VATNumber      string  `json:"vat_number,omitempty" db:"vat_number" doc:"When registered for VAT, invoices are tax invoices"`
+	VATPercent     int     `json:"vat_percent" db:"vat_percent" doc:"Included in entry fees, default 15"`
+	InvoicePrefix  string  `json:"invoice_prefix" db:"invoice_prefix" doc:"Prefix of invoice numbers, e.g. SVC"`
+}
+
+const organisationColumns = "`id`,`name`,`address`,`email`,`phone`,`website`,`logo_document_id`,`brand_colour`,`vat_number`,`vat_percent`,`invoice_prefix`"
+
+//Roles of members in an organisation, from least to most access
+const (
+	OrganisationMember    = "member"    //belongs to the club, no access to events
+	OrganisationOrganiser = "organiser" //organiser of all events of the organisation
+	OrganisationAdmin     = "admin"     //organiser who also manages the organisation and its members
+)
+
+var brandColourRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+//OrganisationProfile is the contact details and branding of an organisation
+type OrganisationProfile struct {
+	Name           string  `json:"name"`
+	Address        string  `json:"address,omitempty"`
+	Email          string  `json:"email,omitempty"`
+	Phone          string  `json:"phone,omitempty"`
+	Website        string  `json:"website,omitempty"`
+	LogoDocumentID *string `json:"logo_document_id,omitempty"`
+	BrandColour    string  `json:"brand_colour,omitempty"`
+	VATNumber      string  `json:"vat_number,omitempty"`
+	VATPercent     *int    `json:"vat_percent,omitempty"`
+}
+
+func (p OrganisationProfile) Validate() error {
+	if p.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	if p.Email != "" && !emailRegex.MatchString(p.Email) {
+		return errors.Errorf("invalid email")
+	}
+	if p.BrandColour != "" && !brandColourRegex.MatchString(p.BrandColour) {
+		return errors.Errorf("invalid brand_colour \"%s\", expecting #RRGGBB", p.BrandColour)
+	}
+	if p.VATPercent != nil && (*p.VATPercent < 0 || *p.VATPercent > 100) {
+		return errors.Errorf("vat_percent must be 0..100")
+	}
+	return nil
+}
+
+//apply sets the profile on the organisation, checking that a new logo is an
+//image owned by the person
+func (p OrganisationProfile) apply(o *Organisation, byPersonID string) error {
+	if p.LogoDocumentID != nil && *p.LogoDocumentID != "" {
+		logo, err := GetDocument(*p.LogoDocumentID)
+		if o.LogoDocumentID == nil || *o.LogoDocumentID != *p.LogoDocumentID {
+			logo, err = AuthoriseDocument(*p.LogoDocumentID, byPersonID)
+		}
+		if err != nil {
+			return err
+		}
+		switch logo.ContentType {
+		case "image/png", "image/jpeg", "image/gif", "image/webp":
+		default:
+			return errors.Errorc(http.StatusBadRequest, "logo is "+logo.ContentType+", expecting an image")
+		}
+		o.LogoDocumentID = &logo.ID
+	} else {
+		o.LogoDocumentID = nil
+	}
+	o.Name = p.Name
+	o.Address = p.Address
+	o.Email = p.Email
+	o.Phone = p.Phone
+	o.Website = p.Website
+	o.BrandColour = p.BrandColour
+	o.VATNumber = p.VATNumber
+	if p.VATPercent != nil {
+		o.VATPercent = *p.VATPercent
+	}
+	return nil
+}
+
+type NewOrganisationRequest struct {
+	OrganisationProfile
+	ByPersonID    string `json:"by_person_id" doc:"Becomes the first admin"`
+	InvoicePrefix string `json:"invoice_prefix"`
+}
+
+func (req NewOrganisationRequest) Validate() error {
+	if err := req.OrganisationProfile.Validate(); err != nil {
+		return err
+	}
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.InvoicePrefix == "" {
+		return errors.Errorf("missing invoice_prefix")
+	}
+	return nil
+}
+
+//AddOrganisation adds an organisation with the person making it as admin
+func AddOrganisation(req NewOrganisationRequest) (*Organisation, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	o := Organisation{
+		ID:            uuid.New().String(),
+		VATPercent:    15,
+		InvoicePrefix: req.InvoicePrefix,
+	}
+	if err := req.OrganisationProfile.apply(&o, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.NamedExec(
+		"INSERT INTO `organisations` SET `id`=:id,`name`=:name,`address`=:address,`email`=:email,`phone`=:phone,`website`=:website,`logo_document_id`=:logo_document_id,`brand_colour`=:brand_colour,`vat_number`=:vat_number,`vat_percent`=:vat_percent,`invoice_prefix`=:invoice_prefix",
+		o,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorc(http.StatusConflict, "organisation \""+o.Name+"\" already exists")
+		}
+		return nil, errors.Wrapf(err, "failed to add organisation")
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO `organisation_members` SET `organisation_id`=?,`person_id`=?,`role`=?",
+		o.ID, req.ByPersonID, OrganisationAdmin,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add admin")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit organisation")
+	}
+	return &o, nil
+} //AddOrganisation()
+
+func GetOrganisation(id string) (*Organisation, error) {
+	var o Organisation
+	if err := NamedGet(&o,
+		"SELECT "+organisationColumns+" FROM `organisations` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown organisation")
+		}
+		return nil, errors.Wrapf(err, "failed to get organisation")
+	}
+	return &o, nil
+}
+
+type UpdateOrganisationRequest struct {
+	OrganisationProfile
+	ByPersonID string `json:"by_person_id" doc:"Admin of the organisation"`
+}
+
+func (req UpdateOrganisationRequest) Validate() error {
+	if err := req.OrganisationProfile.Validate(); err != nil {
+		return err
+	}
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	return nil
+}
+
+//UpdateOrganisation changes the contact details and branding. The invoice
+//prefix cannot change, as it is part of the numbers of issued invoices.
+func UpdateOrganisation(id string, req UpdateOrganisationRequest) (*Organisation, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if err := authoriseOrganisation(db, id, req.ByPersonID, OrganisationAdmin); err != nil {
+		return nil, err
+	}
+	o, err := GetOrganisation(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.OrganisationProfile.apply(o, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	if _, err := db.NamedExec(
+		"UPDATE `organisations` SET `name`=:name,`address`=:address,`email`=:email,`phone`=:phone,`website`=:website,`logo_document_id`=:logo_document_id,`brand_colour`=:brand_colour,`vat_number`=:vat_number,`vat_percent`=:vat_percent WHERE `id`=:id",
+		o,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorc(http.StatusConflict, "organisation \""+o.Name+"\" already exists")
+		}
+		return nil, errors.Wrapf(err, "failed to update organisation")
+	}
+	return o, nil
+} //UpdateOrganisation()
+
+//organisationRole returns the role of the person in the organisation, or ""
+//when not a member
+func organisationRole(q sqlx.Queryer, organisationID, personID string) (string, error) {
+	var role string
+	if err := sqlx.Get(q, &role,
+		"SELECT `role` FROM `organisation_members` WHERE `organisation_id`=? AND `person_id`=?",
+		organisationID, personID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "failed to get organisation role")
+	}
+	return role, nil
+}
+
+//roleAtLeast checks if the role gives at least the access of the minimum role
+func roleAtLeast(role, minimum string) bool {
+	rank := map[string]int{OrganisationMember: 1, OrganisationOrganiser: 2, OrganisationAdmin: 3}
+	return rank[role] > 0 && rank[role] >= rank[minimum]
+}
+
+//authoriseOrganisation fails when the person does not have at least the
+//minimum role in the organisation
+func authoriseOrganisation(q sqlx.Queryer, organisationID, personID, minimum string) error {
+	role, err := organisationRole(q, organisationID, personID)
+	if err != nil {
+		return err
+	}
+	if !roleAtLeast(role, minimum) {
+		return errors.Errorc(http.StatusForbidden, "only organisation "+minimum+"s can do this")
+	}
+	return nil
+}
+
+//OrganisationMembership is a person in an organisation
+type OrganisationMembership struct {
+	OrganisationID   string `json:"organisation_id" db:"organisation_id"`
+	OrganisationName string `json:"organisation_name" db:"organisation_name"`
+	PersonID         string `json:"person_id" db:"person_id"`
+	FirstName        string `json:"first_name" db:"first_name"`
+	LastName         string `json:"last_name" db:"last_name"`
+	Role             string `json:"role" db:"role"`
+}
+
+const membershipSelect = "SELECT m.`organisation_id`,o.`name` AS `organisation_name`,m.`person_id`,p.`first_name`,p.`last_name`,m.`role`" +
+	" FROM `organisation_members` m JOIN `organisations` o ON o.`id`=m.`organisation_id` JOIN `persons` p ON p.`id`=m.`person_id`"
+
+type SetOrganisationMemberRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Admin of the organisation"`
+	PersonID   string `json:"person_id"`
+	Role       string `json:"role" doc:"member, organiser or admin"`
+}
+
+func (req SetOrganisationMemberRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	if !roleAtLeast(req.Role, OrganisationMember) {
+		return errors.Errorf("invalid role \"%s\", expecting member|organiser|admin", req.Role)
+	}
+	return nil
+}
+
+//SetOrganisationMember adds a member or changes the role of a member. The
+//last admin cannot be demoted.
+func SetOrganisationMember(organisationID string, req SetOrganisationMemberRequest) (*OrganisationMembership, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if err := authoriseOrganisation(tx, organisationID, req.ByPersonID, OrganisationAdmin); err != nil {
+		return nil, err
+	}
+	if req.Role != OrganisationAdmin {
+		if err := keepAnAdmin(tx, organisationID, req.PersonID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO `organisation_members` SET `organisation_id`=?,`person_id`=?,`role`=? ON DUPLICATE KEY UPDATE `role`=VALUES(`role`)",
+		organisationID, req.PersonID, req.Role,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1452 {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown person")
+		}
+		return nil, errors.Wrapf(err, "failed to set member")
+	}
+	var m OrganisationMembership
+	if err := tx.Get(&m,
+		membershipSelect+" WHERE m.`organisation_id`=? AND m.`person_id`=?",
+		organisationID, req.PersonID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get member")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit member")
+	}
+	return &m, nil
+} //SetOrganisationMember()
+
+//keepAnAdmin fails when the person is the last admin, locking the admins
+//so two admins cannot demote each other at the same time
+func keepAnAdmin(tx *sqlx.Tx, organisationID, personID string) error {
+	var admins []string
+	if err := tx.Select(&admins,
+		"SELECT `person_id` FROM `organisation_members` WHERE `organisation_id`=? AND `role`=? FOR UPDATE",
+		organisationID, OrganisationAdmin,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get admins")
+	}
+	if len(admins) == 1 && admins[0] == personID {
+		return errors.Errorc(http.StatusConflict, "organisation needs an admin, add another admin first")
+	}
+	return nil
+}
+
+//RemoveOrganisationMember removes a member, by an admin or by the member
+//leaving. The last admin cannot be removed.
+func RemoveOrganisationMember(organisationID, personID, byPersonID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if personID != byPersonID {
+		if err := authoriseOrganisation(tx, organisationID, byPersonID, OrganisationAdmin); err != nil {
+			return err
+		}
+	}
+	if err := keepAnAdmin(tx, organisationID, personID); err != nil {
+		return err
+	}
+	result, err := tx.Exec(
+		"DELETE FROM `organisation_members` WHERE `organisation_id`=? AND `person_id`=?",
+		organisationID, personID,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove member")
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.Errorc(http.StatusNotFound, "not a member")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit member")
+	}
+	return nil
+} //RemoveOrganisationMember()
+
+//ListOrganisationMembers returns the members to a member of the organisation
+func ListOrganisationMembers(organisationID, byPersonID string) ([]OrganisationMembership, error) {
+	if err := authoriseOrganisation(db, organisationID, byPersonID, OrganisationMember); err != nil {
+		return nil, err
+	}
+	members := []OrganisationMembership{}
+	if err := NamedSelect(&members,
+		membershipSelect+" WHERE m.`organisation_id`=:organisation_id ORDER BY p.`last_name`,p.`first_name`",
+		map[string]interface{}{
+			"organisation_id": organisationID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list members")
+	}
+	return members, nil
+}
+
+//ListPersonOrganisations returns the organisations the person belongs to,
+//only to the person
+func ListPersonOrganisations(personID, byPersonID string) ([]OrganisationMembership, error) {
+	if err := AuthorisePerson(personID, byPersonID); err != nil {
+		return nil, err
+	}
+	memberships := []OrganisationMembership{}
+	if err := NamedSelect(&memberships,
+		membershipSelect+" WHERE m.`person_id`=:person_id ORDER BY o.`name`",
+		map[string]interface{}{
+			"person_id": personID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list organisations")
+	}
+	return memberships, nil
+}
+
+//ListOrganisationEvents returns the events owned by the organisation
+func ListOrganisationEvents(organisationID string) ([]EventSummary, error) {
+	events := []EventSummary{}
+	if err := NamedSelect(&events,
+		"SELECT `id`,`name`,`date` FROM `events` WHERE `organisation_id`=:organisation_id ORDER BY `date` DESC",
+		map[string]interface{}{
+			"organisation_id": organisationID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list events")
+	}
+	return events, nil
+}
+
+type SetEventOrganisationRequest struct {
+	ByPersonID     string `json:"by_person_id" doc:"Organiser of the event and admin of the organisation"`
+	OrganisationID string `json:"organisation_id"`
+}
+
+func (req SetEventOrganisationRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.OrganisationID == "" {
+		return errors.Errorf("missing organisation_id")
+	}
+	return nil
+}
+
+//SetEventOrganisation makes the organisation the owner of the event, by a
+//person who organises the event and is an admin of the organisation
+func SetEventOrganisation(eventID string, req SetEventOrganisationRequest) error {
+	if err := req.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid request")
+	}
+	if _, err := GetOrganisation(req.OrganisationID); err != nil {
+		return err
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return err
+	}
+	if err := authoriseOrganisation(db, req.OrganisationID, req.ByPersonID, OrganisationAdmin); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE `events` SET `organisation_id`=? WHERE `id`=?", req.OrganisationID, eventID); err != nil {
+		return errors.Wrapf(err, "failed to set event organisation")
+	}
+	return nil
+}
+
+//EventOrganiserSummary is an organiser of an event, appointed to the event or
+//inherited from the organisation that owns it
+type EventOrganiserSummary struct {
+	PersonID  string `json:"person_id" db:"person_id"`
+	FirstName string `json:"first_name" db:"first_name"`
+	LastName  string `json:"last_name" db:"last_name"`
+	Role      string `json:"role" db:"role"`
+	Inherited bool   `json:"inherited" db:"inherited"`
+}
+
+func ListEventOrganisers(eventID string) ([]EventOrganiserSummary, error) {
+	organisers := []EventOrganiserSummary{}
+	if err := NamedSelect(&organisers,
+		"SELECT o.`person_id`,p.`first_name`,p.`last_name`,o.`role`,FALSE AS `inherited` FROM `event_organisers` o JOIN `persons` p ON p.`id`=o.`person_id` WHERE o.`event_id`=:event_id"+
+			" UNION SELECT m.`person_id`,p.`first_name`,p.`last_name`,m.`role`,TRUE AS `inherited` FROM `events` e JOIN `organisation_members` m ON m.`organisation_id`=e.`organisation_id` JOIN `persons` p ON p.`id`=m.`person_id`"+
+			" WHERE e.`id`=:event_id AND m.`role` IN ('"+OrganisationOrganiser+"','"+OrganisationAdmin+"')"+
+			" ORDER BY `inherited`,`last_name`,`first_name`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list organisers")
+	}
+	return organisers, nil
+}
@@ -0,0 +1,27 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestOrganisationProfile(t *testing.T) {
+	pct := func(i int) *int { return &i }
+	for name, tc := range map[string]struct {
+		profile db.OrganisationProfile
+		ok      bool
+	}{
+		"minimal":    {db.OrganisationProfile{Name: "Stellenbosch Cycling Club"}, true},
+		"branded":    {db.OrganisationProfile{Name: "SCC", Email: "info@scc.co.za", BrandColour: "#1a5FB4", VATPercent: pct(0)}, true},
+		"no name":    {db.OrganisationProfile{Email: "info@scc.co.za"}, false},
+		"bad email":  {db.OrganisationProfile{Name: "SCC", Email: "info"}, false},
+		"short hex":  {db.OrganisationProfile{Name: "SCC", BrandColour: "#fff"}, false},
+		"named":      {db.OrganisationProfile{Name: "SCC", BrandColour: "blue"}, false},
+		"vat > 100%": {db.OrganisationProfile{Name: "SCC", VATPercent: pct(101)}, false},
+	} {
+		if err := tc.profile.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: Validate()=%v, expected ok=%v", name, err, tc.ok)
+		}
+	}
+}
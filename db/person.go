@@ -32,7 +32,7 @@ type Person struct {
 //as they are the unique identifiers on a person record
 func GetPerson(identifier map[string]string) (*Person, error) {
 	if len(identifier) != 1 {
-		return nil, errors.Errorf("invalid identifier %+v requiring id,nat_it,phone or email")
+		return nil, errors.Errorf("invalid identifier %+v requiring id,nat_it,phone or email", identifier)
 	}
 	var n string
 	for n = range identifier { //empty for just to get the map key
@@ -43,7 +43,7 @@ func GetPerson(identifier map[string]string) (*Person, error) {
 	case "phone":
 	case "email":
 	default:
-		return nil, errors.Errorf("invalid identifier %+v requiring id,nat_it,phone or email")
+		return nil, errors.Errorf("invalid identifier %+v requiring id,nat_it,phone or email", identifier)
 	}
 	var p Person
 	if err := NamedGet(&p,
@@ -394,3 +394,15 @@ func HashPassword(natID, pw string) string {
 	h.Write([]byte(s))
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
+
+//AuthorisePerson fails when the person asking is not the person, used to keep
+//the details of a person to that person
+func AuthorisePerson(personID, byPersonID string) error {
+	if byPersonID == "" {
+		return errors.Errorc(http.StatusForbidden, "missing by_person_id")
+	}
+	if byPersonID != personID {
+		return errors.Errorc(http.StatusForbidden, "only the person can do this")
+	}
+	return nil
+}
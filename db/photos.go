@@ -0,0 +1,531 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/photo"
+)
+
+//Photo is an image in the gallery of an event. The original is stored as a
+//document, the web and thumbnail versions are added by ProcessNextPhoto().
+type Photo struct {
+	ID                 string   `json:"id" db:"id"`
+	EventID            string   `json:"event_id" db:"event_id"`
+	DocumentID         string   `json:"document_id" db:"document_id"`
+	WebDocumentID      *string  `json:"web_document_id,omitempty" db:"web_document_id"`
+	ThumbDocumentID    *string  `json:"thumb_document_id,omitempty" db:"thumb_document_id"`
+	Width              int      `json:"width" db:"width"`
+	Height             int      `json:"height" db:"height"`
+	Caption            string   `json:"caption" db:"caption"`
+	Status             string   `json:"status" db:"status"`
+	Moderation         string   `json:"moderation" db:"moderation"`
+	Uploaded           SqlTime  `json:"uploaded" db:"uploaded"`
+	UploadedByPersonID string   `json:"uploaded_by_person_id" db:"uploaded_by_person_id"`
+	Claimed            *SqlTime `json:"-" db:"claimed"`
+	Error              string   `json:"error,omitempty" db:"error"`
+	Bibs               []string `json:"bibs" db:"-"`
+}
+
+const photoColumns = "`id`,`event_id`,`document_id`,`web_document_id`,`thumb_document_id`,`width`,`height`,`caption`,`status`,`moderation`,`uploaded`,`uploaded_by_person_id`,`claimed`,`error`"
+
+//Processing status of a photo
+const (
+	PhotoUploaded   = "uploaded"
+	PhotoProcessing = "processing"
+	PhotoReady      = "ready"
+	PhotoFailed     = "failed"
+)
+
+//Moderation of a photo, only approved photos are shown to everyone
+const (
+	PhotoPending  = "pending"
+	PhotoApproved = "approved"
+	PhotoRejected = "rejected"
+)
+
+//photoDocumentPrefix names the documents of photos, which are not listed
+//with other documents
+const photoDocumentPrefix = "photos/"
+
+//MaxPhotoSize limits uploaded photos
+const MaxPhotoSize = 25 << 20
+
+//photoClaimTTL is how long a photo may be processing before another worker
+//claims it, e.g. after a restart
+const photoClaimTTL = 10 * time.Minute
+
+var bibRegex = regexp.MustCompile(`^[A-Z0-9-]{1,20}$`)
+
+//normaliseBib returns the bib in upper case or fails when it is not 1..20
+//letters, digits or dashes
+func normaliseBib(bib string) (string, error) {
+	bib = strings.ToUpper(strings.TrimSpace(bib))
+	if !bibRegex.MatchString(bib) {
+		return "", errors.Errorf("invalid bib \"%s\", expecting 1..20 letters, digits or dashes", bib)
+	}
+	return bib, nil
+}
+
+type UploadPhotoRequest struct {
+	ByPersonID string `json:"by_person_id"`
+	Caption    string `json:"caption,omitempty"`
+	Filename   string `json:"filename,omitempty"`
+}
+
+func (req UploadPhotoRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if len(req.Caption) > 200 {
+		return errors.Errorf("caption longer than 200")
+	}
+	return nil
+}
+
+//UploadPhoto checks that the content is an image, stores it and adds it to
+//the gallery to be processed. Photos of organisers are approved, others must
+//be approved by an organiser.
+func UploadPhoto(eventID string, req UploadPhotoRequest, r io.Reader) (*Photo, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if _, err := GetEvent(eventID); err != nil {
+		return nil, err
+	}
+	role, err := EventRole(eventID, req.ByPersonID)
+	if err != nil {
+		return nil, err
+	}
+
+	//the image header is at the start, but a jpeg may have large metadata
+	//segments before it
+	head := make([]byte, 256<<10)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to read photo")
+	}
+	head = head[:n]
+	config, _, err := photo.Check(bytes.NewReader(head))
+	if err != nil {
+		return nil, errors.Errorc(http.StatusBadRequest, err.Error())
+	}
+
+	p := Photo{
+		ID:                 uuid.New().String(),
+		EventID:            eventID,
+		Width:              config.Width,
+		Height:             config.Height,
+		Caption:            req.Caption,
+		Status:             PhotoUploaded,
+		Moderation:         PhotoPending,
+		Uploaded:           SqlTime(time.Now()),
+		UploadedByPersonID: req.ByPersonID,
+		Bibs:               []string{},
+	}
+	if role == EventRoleOrganiser {
+		p.Moderation = PhotoApproved
+	}
+	doc, err := uploadDocument(
+		UploadDocumentRequest{
+			Name:       photoDocumentPrefix + p.ID,
+			ByPersonID: req.ByPersonID,
+			Filename:   req.Filename,
+		},
+		io.MultiReader(bytes.NewReader(head), r),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.DocumentID = doc.ID
+	if _, err := db.NamedExec(
+		"INSERT INTO `photos` SET `id`=:id,`event_id`=:event_id,`document_id`=:document_id,`width`=:width,`height`=:height,`caption`=:caption,`status`=:status,`moderation`=:moderation,`uploaded`=:uploaded,`uploaded_by_person_id`=:uploaded_by_person_id,`error`=''",
+		p,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add photo")
+	}
+	return &p, nil
+} //UploadPhoto()
+
+//ProcessNextPhoto claims an uploaded photo and makes its web and thumbnail
+//versions. It returns false when there was nothing to process. A photo that
+//cannot be processed is marked failed.
+func ProcessNextPhoto() (bool, error) {
+	p, err := claimPhoto(time.Now())
+	if err != nil || p == nil {
+		return false, err
+	}
+	if err := processPhoto(p); err != nil {
+		log.Errorf("failed to process photo %s: %+v", p.ID, err)
+		reason := err.Error()
+		if len(reason) > 200 {
+			reason = reason[:200]
+		}
+		if _, err := db.Exec(
+			"UPDATE `photos` SET `status`=?,`error`=? WHERE `id`=? AND `status`=?",
+			PhotoFailed, reason, p.ID, PhotoProcessing,
+		); err != nil {
+			return true, errors.Wrapf(err, "failed to update photo")
+		}
+	}
+	return true, nil
+}
+
+//claimPhoto marks the oldest uploaded photo as processing, or a photo that
+//was processing for too long. Another worker may claim the same photo first,
+//then the next one is tried.
+func claimPhoto(now time.Time) (*Photo, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		var p Photo
+		if err := db.Get(&p,
+			"SELECT "+photoColumns+" FROM `photos` WHERE `status`=? OR (`status`=? AND `claimed`<?) ORDER BY `uploaded` LIMIT 1",
+			PhotoUploaded, PhotoProcessing, SqlTime(now.Add(-photoClaimTTL)),
+		); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+			return nil, errors.Wrapf(err, "failed to get photo to process")
+		}
+		result, err := db.Exec(
+			"UPDATE `photos` SET `status`=?,`claimed`=? WHERE `id`=? AND `status`=? AND `claimed`<=>?",
+			PhotoProcessing, SqlTime(now), p.ID, p.Status, p.Claimed,
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to claim photo")
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return &p, nil
+		}
+	}
+	return nil, nil
+} //claimPhoto()
+
+func processPhoto(p *Photo) error {
+	_, content, err := OpenDocument(p.DocumentID)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(content, MaxPhotoSize+1))
+	content.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read photo")
+	}
+	img, orientation, err := photo.Decode(data)
+	if err != nil {
+		return err
+	}
+	web := photo.Orient(photo.Scale(img, photo.WebSize), orientation)
+	thumb := photo.Scale(web, photo.ThumbSize)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if orientation >= 5 {
+		width, height = height, width
+	}
+
+	versions := []struct {
+		name string
+		img  image.Image
+		id   **string
+	}{
+		{"web", web, &p.WebDocumentID},
+		{"thumb", thumb, &p.ThumbDocumentID},
+	}
+	for _, v := range versions {
+		data, err := photo.EncodeJPEG(v.img)
+		if err != nil {
+			return err
+		}
+		doc, err := uploadDocument(
+			UploadDocumentRequest{
+				Name:       photoDocumentPrefix + p.ID + "/" + v.name,
+				ByPersonID: p.UploadedByPersonID,
+				Filename:   v.name + ".jpg",
+			},
+			bytes.NewReader(data),
+		)
+		if err != nil {
+			return errors.Wrapf(err, "failed to store %s version", v.name)
+		}
+		*v.id = &doc.ID
+	}
+	if _, err := db.Exec(
+		"UPDATE `photos` SET `status`=?,`web_document_id`=?,`thumb_document_id`=?,`width`=?,`height`=?,`error`='' WHERE `id`=? AND `status`=?",
+		PhotoReady, p.WebDocumentID, p.ThumbDocumentID, width, height, p.ID, PhotoProcessing,
+	); err != nil {
+		return errors.Wrapf(err, "failed to update photo")
+	}
+	return nil
+} //processPhoto()
+
+func GetPhoto(id string) (*Photo, error) {
+	var p Photo
+	if err := NamedGet(&p,
+		"SELECT "+photoColumns+" FROM `photos` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown photo")
+		}
+		return nil, errors.Wrapf(err, "failed to get photo")
+	}
+	p.Bibs = []string{}
+	if err := db.Select(&p.Bibs, "SELECT `bib` FROM `photo_tags` WHERE `photo_id`=? ORDER BY `bib`", id); err != nil {
+		return nil, errors.Wrapf(err, "failed to get photo tags")
+	}
+	return &p, nil
+}
+
+type PhotoFilter struct {
+	PersonID   string `doc:"Viewer, organisers see all photos, others approved photos and their own uploads"`
+	Bib        string `doc:"Only photos tagged with the bib"`
+	EntrantID  string `doc:"Only photos tagged with the bib of the person's entry"`
+	Moderation string `doc:"Only photos with this moderation, for organisers"`
+}
+
+//ListEventPhotos returns the photos in the gallery of the event that the
+//viewer may see, latest first
+func ListEventPhotos(eventID string, filter PhotoFilter) ([]Photo, error) {
+	role, err := EventRole(eventID, filter.PersonID)
+	if err != nil {
+		return nil, err
+	}
+	args := map[string]interface{}{
+		"event_id":  eventID,
+		"person_id": filter.PersonID,
+		"ready":     PhotoReady,
+		"approved":  PhotoApproved,
+	}
+	where := "`event_id`=:event_id"
+	if role == EventRoleOrganiser {
+		if filter.Moderation != "" {
+			where += " AND `moderation`=:moderation"
+			args["moderation"] = filter.Moderation
+		}
+	} else if filter.PersonID != "" {
+		where += " AND (`status`=:ready AND `moderation`=:approved OR `uploaded_by_person_id`=:person_id)"
+	} else {
+		where += " AND `status`=:ready AND `moderation`=:approved"
+	}
+	if filter.EntrantID != "" {
+		var bib *string
+		if err := db.Get(&bib,
+			"SELECT `bib` FROM `entries` WHERE `event_id`=? AND (`person_id`=? OR `id` IN (SELECT `entry_id` FROM `entry_members` WHERE `person_id`=?)) ORDER BY `status`='"+EntryStatusWithdrawn+"' LIMIT 1",
+			eventID, filter.EntrantID, filter.EntrantID,
+		); err != nil && err != sql.ErrNoRows {
+			return nil, errors.Wrapf(err, "failed to get bib")
+		}
+		if bib == nil {
+			return []Photo{}, nil //no bib to find photos with
+		}
+		filter.Bib = *bib
+	}
+	if filter.Bib != "" {
+		bib, err := normaliseBib(filter.Bib)
+		if err != nil {
+			return nil, errors.Errorc(http.StatusBadRequest, err.Error())
+		}
+		where += " AND `id` IN (SELECT `photo_id` FROM `photo_tags` WHERE `bib`=:bib)"
+		args["bib"] = bib
+	}
+
+	photos := []Photo{}
+	if err := NamedSelect(&photos,
+		"SELECT "+photoColumns+" FROM `photos` WHERE "+where+" ORDER BY `uploaded` DESC",
+		args,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to list photos")
+	}
+	var tags []struct {
+		PhotoID string `db:"photo_id"`
+		Bib     string `db:"bib"`
+	}
+	if err := db.Select(&tags,
+		"SELECT t.`photo_id`,t.`bib` FROM `photo_tags` t JOIN `photos` p ON p.`id`=t.`photo_id` WHERE p.`event_id`=? ORDER BY t.`bib`",
+		eventID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get photo tags")
+	}
+	bibs := map[string][]string{}
+	for _, t := range tags {
+		bibs[t.PhotoID] = append(bibs[t.PhotoID], t.Bib)
+	}
+	for i := range photos {
+		if photos[i].Bibs = bibs[photos[i].ID]; photos[i].Bibs == nil {
+			photos[i].Bibs = []string{}
+		}
+	}
+	return photos, nil
+} //ListEventPhotos()
+
+//AuthorisePhoto returns the photo when the person may see it
+func AuthorisePhoto(photoID, personID string) (*Photo, error) {
+	p, err := GetPhoto(photoID)
+	if err != nil {
+		return nil, err
+	}
+	if p.Status == PhotoReady && p.Moderation == PhotoApproved {
+		return p, nil
+	}
+	if personID != "" && personID == p.UploadedByPersonID {
+		return p, nil
+	}
+	if ok, err := IsEventOrganiser(p.EventID, personID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "photo not approved")
+	}
+	return p, nil
+}
+
+//VersionDocumentID returns the document of the original, web or thumb
+//version of the photo
+func (p Photo) VersionDocumentID(version string) (string, error) {
+	var id *string
+	switch version {
+	case "original":
+		return p.DocumentID, nil
+	case "web":
+		id = p.WebDocumentID
+	case "thumb":
+		id = p.ThumbDocumentID
+	default:
+		return "", errors.Errorc(http.StatusNotFound, "unknown version \""+version+"\", expecting original|web|thumb")
+	}
+	if id == nil {
+		return "", errors.Errorc(http.StatusNotFound, "photo is "+p.Status)
+	}
+	return *id, nil
+}
+
+//authorisePhotoChange checks that the person is an organiser or uploaded the
+//photo
+func authorisePhotoChange(p *Photo, personID string) error {
+	if personID != "" && personID == p.UploadedByPersonID {
+		return nil
+	}
+	if ok, err := IsEventOrganiser(p.EventID, personID); err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorc(http.StatusForbidden, "only organisers and the uploader can change a photo")
+	}
+	return nil
+}
+
+type TagPhotoRequest struct {
+	ByPersonID string   `json:"by_person_id"`
+	Bibs       []string `json:"bibs" doc:"Replaces the tags of the photo"`
+}
+
+func (req *TagPhotoRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	for i, bib := range req.Bibs {
+		var err error
+		if req.Bibs[i], err = normaliseBib(bib); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//TagPhoto sets the bib numbers of the entrants in the photo
+func TagPhoto(photoID string, req TagPhotoRequest) (*Photo, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	p, err := GetPhoto(photoID)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorisePhotoChange(p, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM `photo_tags` WHERE `photo_id`=?", photoID); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete tags")
+	}
+	for _, bib := range req.Bibs {
+		if _, err := tx.Exec("INSERT INTO `photo_tags` SET `photo_id`=?,`bib`=?", photoID, bib); err != nil {
+			if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+				continue //listed twice
+			}
+			return nil, errors.Wrapf(err, "failed to tag photo")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit tags")
+	}
+	return GetPhoto(photoID)
+} //TagPhoto()
+
+type ModeratePhotoRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	Moderation string `json:"moderation" doc:"approved or rejected"`
+}
+
+func (req ModeratePhotoRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.Moderation != PhotoApproved && req.Moderation != PhotoRejected {
+		return errors.Errorf("invalid moderation \"%s\", expecting approved|rejected", req.Moderation)
+	}
+	return nil
+}
+
+//ModeratePhoto approves a photo to be shown to everyone, or rejects it
+func ModeratePhoto(photoID string, req ModeratePhotoRequest) (*Photo, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	p, err := GetPhoto(photoID)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := IsEventOrganiser(p.EventID, req.ByPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can moderate photos")
+	}
+	if _, err := db.Exec("UPDATE `photos` SET `moderation`=? WHERE `id`=?", req.Moderation, photoID); err != nil {
+		return nil, errors.Wrapf(err, "failed to moderate photo")
+	}
+	p.Moderation = req.Moderation
+	return p, nil
+}
+
+//RemovePhoto deletes the photo with all its versions
+func RemovePhoto(photoID, byPersonID string) error {
+	p, err := GetPhoto(photoID)
+	if err != nil {
+		return err
+	}
+	if err := authorisePhotoChange(p, byPersonID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM `photos` WHERE `id`=?", photoID); err != nil {
+		return errors.Wrapf(err, "failed to delete photo")
+	}
+	for _, id := range []*string{&p.DocumentID, p.WebDocumentID, p.ThumbDocumentID} {
+		if id != nil {
+			if err := deleteDocument(*id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
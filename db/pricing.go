@@ -0,0 +1,374 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
+
+//PriceRule sets the entry fee for entries that match it. When more than one
+//rule matches an entry, the most specific one applies: a rule for the category
+//beats a rule for all categories, a rule for members or non-members beats a
+//rule for anybody, and a rule with dates (early bird or late entry) beats one
+//without dates. Rules that are equally specific apply in the order listed.
+type PriceRule struct {
+	ID          string   `json:"id" db:"id"`
+	EventID     string   `json:"-" db:"event_id"`
+	Description string   `json:"description" db:"description" doc:"Shown on the line item, e.g. \"Early bird\""`
+	CategoryID  *string  `json:"category_id,omitempty" db:"category_id" doc:"Omit for all categories"`
+	Member      *bool    `json:"member,omitempty" db:"member" doc:"Omit for members and non-members"`
+	ValidFrom   *SqlTime `json:"valid_from,omitempty" db:"valid_from" doc:"Entries from this time"`
+	ValidUntil  *SqlTime `json:"valid_until,omitempty" db:"valid_until" doc:"Entries before this time"`
+	Fee         Amount   `json:"fee" db:"-"`
+	FeeCents    int      `json:"-" db:"fee_cents"`
+	Position    int      `json:"-" db:"position"`
+}
+
+func (rule PriceRule) matches(item BasketItem, at time.Time) bool {
+	if rule.CategoryID != nil && *rule.CategoryID != item.CategoryID {
+		return false
+	}
+	if rule.Member != nil && *rule.Member != item.Member {
+		return false
+	}
+	if rule.ValidFrom != nil && at.Before(time.Time(*rule.ValidFrom)) {
+		return false
+	}
+	if rule.ValidUntil != nil && !at.Before(time.Time(*rule.ValidUntil)) {
+		return false
+	}
+	return true
+}
+
+func (rule PriceRule) specificity() int {
+	s := 0
+	if rule.CategoryID != nil {
+		s += 4
+	}
+	if rule.Member != nil {
+		s += 2
+	}
+	if rule.ValidFrom != nil || rule.ValidUntil != nil {
+		s += 1
+	}
+	return s
+}
+
+//FamilyDiscount gives a percentage off the entry fee of each family member
+//entered in the same basket, from the MinEntries'th entry onwards, applied to
+//the cheapest entries first.
+type FamilyDiscount struct {
+	MinEntries int `json:"min_entries" db:"min_entries" doc:"e.g. 3 for discount on the 3rd and further family members"`
+	PercentOff int `json:"percent_off" db:"percent_off"`
+}
+
+//EventPricing is everything needed to calculate entry fees for an event
+type EventPricing struct {
+	Currency       *Currency       `json:"-"`
+	Rules          []PriceRule     `json:"rules"`
+	FamilyDiscount *FamilyDiscount `json:"family_discount,omitempty"`
+}
+
+func (p *EventPricing) Validate() error {
+	if p.Currency == nil {
+		p.Currency = DefaultCurrency
+	}
+	//normalise a copy, the caller may share the rules
+	p.Rules = append([]PriceRule(nil), p.Rules...)
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		r.Description = strings.TrimSpace(r.Description)
+		if r.Description == "" {
+			return errors.Errorf("rule[%d] missing description", i)
+		}
+		if r.Fee.Currency == nil {
+			r.Fee.Currency = p.Currency
+		}
+		if r.Fee.Currency != p.Currency {
+			return errors.Errorf("rule[%d] fee currency %s is not the event currency %s", i, r.Fee.Currency.Code, p.Currency.Code)
+		}
+		if r.Fee.Cents < 0 {
+			return errors.Errorf("rule[%d] negative fee", i)
+		}
+		if r.ValidFrom != nil && r.ValidUntil != nil && !time.Time(*r.ValidUntil).After(time.Time(*r.ValidFrom)) {
+			return errors.Errorf("rule[%d] valid_until is not after valid_from", i)
+		}
+		r.FeeCents = r.Fee.Cents
+		r.Position = i
+	}
+	if p.FamilyDiscount != nil {
+		if p.FamilyDiscount.MinEntries < 2 {
+			return errors.Errorf("family discount min_entries=%d, expecting 2 or more", p.FamilyDiscount.MinEntries)
+		}
+		if p.FamilyDiscount.PercentOff < 1 || p.FamilyDiscount.PercentOff > 100 {
+			return errors.Errorf("family discount percent_off=%d, expecting 1..100", p.FamilyDiscount.PercentOff)
+		}
+	}
+	return nil
+} //EventPricing.Validate()
+
+//BasketItem is one entry to be priced
+type BasketItem struct {
+	PersonID   string `json:"person_id"`
+	CategoryID string `json:"category_id"`
+	Member     bool   `json:"member"`
+	FamilyID   string `json:"family_id,omitempty" doc:"Entries with the same family id qualify for the family discount"`
+}
+
+//QuoteLine is a line item in the price breakdown. Discounts are negative.
+type QuoteLine struct {
+	Item        int    `json:"item" doc:"Index of the basket item"`
+	PersonID    string `json:"person_id"`
+	Description string `json:"description"`
+	Amount      Amount `json:"amount"`
+	PromoCodeID string `json:"promo_code_id,omitempty"`
+}
+
+type Quote struct {
+	Lines []QuoteLine `json:"lines"`
+	Total Amount      `json:"total"`
+}
+
+//Calculate prices the basket of entries made at the specified time,
+//applying the promo codes after the entry fees and family discounts
+func (p EventPricing) Calculate(basket []BasketItem, at time.Time, codes ...PromoCode) (*Quote, error) {
+	if err := p.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid pricing")
+	}
+	quote := Quote{
+		Lines: []QuoteLine{},
+		Total: Amount{Currency: p.Currency},
+	}
+	fees := make([]Amount, len(basket))
+	for i, item := range basket {
+		var rule *PriceRule
+		for ri := range p.Rules {
+			r := &p.Rules[ri]
+			if !r.matches(item, at) {
+				continue
+			}
+			if rule == nil || r.specificity() > rule.specificity() {
+				rule = r
+			}
+		}
+		if rule == nil {
+			return nil, errors.Errorc(http.StatusBadRequest, fmt.Sprintf("no entry fee for item[%d] in category %s", i, item.CategoryID))
+		}
+		fees[i] = rule.Fee
+		quote.Lines = append(quote.Lines, QuoteLine{
+			Item:        i,
+			PersonID:    item.PersonID,
+			Description: rule.Description,
+			Amount:      rule.Fee,
+		})
+	}
+
+	if p.FamilyDiscount != nil {
+		itemsByFamily := map[string][]int{}
+		families := []string{}
+		for i, item := range basket {
+			if item.FamilyID == "" {
+				continue
+			}
+			if _, ok := itemsByFamily[item.FamilyID]; !ok {
+				families = append(families, item.FamilyID)
+			}
+			itemsByFamily[item.FamilyID] = append(itemsByFamily[item.FamilyID], i)
+		}
+		for _, familyID := range families {
+			items := itemsByFamily[familyID]
+			nrDiscounted := len(items) - p.FamilyDiscount.MinEntries + 1
+			if nrDiscounted < 1 {
+				continue
+			}
+			//discount the cheapest entries, keeping basket order for equal fees
+			sort.SliceStable(items, func(a, b int) bool { return fees[items[a]].Cents < fees[items[b]].Cents })
+			for _, i := range items[0:nrDiscounted] {
+				discount := fees[i].Percent(p.FamilyDiscount.PercentOff)
+				if discount.Cents == 0 {
+					continue
+				}
+				quote.Lines = append(quote.Lines, QuoteLine{
+					Item:        i,
+					PersonID:    basket[i].PersonID,
+					Description: fmt.Sprintf("Family discount %d%%", p.FamilyDiscount.PercentOff),
+					Amount:      discount.Neg(),
+				})
+			}
+		}
+	}
+
+	if err := p.applyPromoCodes(&quote, basket, at, codes); err != nil {
+		return nil, err
+	}
+
+	for _, line := range quote.Lines {
+		quote.Total = quote.Total.Add(line.Amount)
+	}
+	return &quote, nil
+} //EventPricing.Calculate()
+
+func GetEventPricing(eventID string) (*EventPricing, error) {
+	p := EventPricing{
+		Currency: DefaultCurrency,
+	}
+	if err := NamedSelect(
+		&p.Rules,
+		"SELECT `id`,`event_id`,`description`,`category_id`,`member`,`valid_from`,`valid_until`,`fee_cents`,`position` FROM `event_prices` WHERE `event_id`=:event_id ORDER BY `position`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get event prices")
+	}
+	for i := range p.Rules {
+		p.Rules[i].Fee = Amount{Currency: p.Currency, Cents: p.Rules[i].FeeCents}
+	}
+	var discounts []FamilyDiscount
+	if err := NamedSelect(
+		&discounts,
+		"SELECT `min_entries`,`percent_off` FROM `event_family_discounts` WHERE `event_id`=:event_id",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get family discount")
+	}
+	if len(discounts) > 0 {
+		p.FamilyDiscount = &discounts[0]
+	}
+	return &p, nil
+} //GetEventPricing()
+
+type SetEventPricingRequest struct {
+	EventPricing
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+}
+
+//SetEventPricing replaces all price rules and the family discount of an event
+func SetEventPricing(eventID string, req SetEventPricingRequest) error {
+	p := req.EventPricing
+	if err := p.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid pricing")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM `event_prices` WHERE `event_id`=?", eventID); err != nil {
+		return errors.Wrapf(err, "failed to delete old prices")
+	}
+	if _, err := tx.Exec("DELETE FROM `event_family_discounts` WHERE `event_id`=?", eventID); err != nil {
+		return errors.Wrapf(err, "failed to delete old family discount")
+	}
+	for _, r := range p.Rules {
+		r.ID = uuid.New().String()
+		r.EventID = eventID
+		if _, err := tx.NamedExec(
+			"INSERT INTO `event_prices` SET `id`=:id,`event_id`=:event_id,`description`=:description,`category_id`=:category_id,`member`=:member,`valid_from`=:valid_from,`valid_until`=:valid_until,`fee_cents`=:fee_cents,`position`=:position",
+			r,
+		); err != nil {
+			return errors.Wrapf(err, "failed to add price %s", r.Description)
+		}
+	}
+	if p.FamilyDiscount != nil {
+		if _, err := tx.Exec(
+			"INSERT INTO `event_family_discounts` SET `event_id`=?,`min_entries`=?,`percent_off`=?",
+			eventID, p.FamilyDiscount.MinEntries, p.FamilyDiscount.PercentOff,
+		); err != nil {
+			return errors.Wrapf(err, "failed to add family discount")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit pricing")
+	}
+	return nil
+} //SetEventPricing()
+
+type QuoteRequest struct {
+	Items []QuoteRequestItem `json:"items"`
+	Codes []string           `json:"codes,omitempty" doc:"Promo codes"`
+}
+
+type QuoteRequestItem struct {
+	PersonID   string `json:"person_id"`
+	CategoryID string `json:"category_id"`
+}
+
+func (req QuoteRequest) Validate() error {
+	if len(req.Items) == 0 {
+		return errors.Errorf("missing items")
+	}
+	for i, item := range req.Items {
+		if item.PersonID == "" {
+			return errors.Errorf("item[%d] missing person_id", i)
+		}
+	}
+	return nil
+}
+
+//QuoteEntries prices entries for the listed persons as if entered now,
+//looking up their families for the family discount
+func QuoteEntries(eventID string, req QuoteRequest) (*Quote, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	pricing, err := GetEventPricing(eventID)
+	if err != nil {
+		return nil, err
+	}
+	basket, personIDs, err := newBasket(eventID, req.Items)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := getPromoCodes(db, eventID, req.Codes, personIDs)
+	if err != nil {
+		return nil, err
+	}
+	return pricing.Calculate(basket, time.Now(), codes...)
+} //QuoteEntries()
+
+//newBasket makes the basket items, looking up the family of each person and
+//if the person is a member on the day of the event
+func newBasket(eventID string, items []QuoteRequestItem) ([]BasketItem, []string, error) {
+	organisationID, _, date, err := eventMembership(db, eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	basket := make([]BasketItem, len(items))
+	personIDs := make([]string, len(items))
+	for i, item := range items {
+		personIDs[i] = item.PersonID
+		basket[i] = BasketItem{
+			PersonID:   item.PersonID,
+			CategoryID: item.CategoryID,
+		}
+		var familyIDs []string
+		if err := NamedSelect(
+			&familyIDs,
+			"SELECT `family_id` FROM `family_person` WHERE `person_id`=:person_id",
+			map[string]interface{}{
+				"person_id": item.PersonID,
+			}); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to get family")
+		}
+		if len(familyIDs) > 0 {
+			basket[i].FamilyID = familyIDs[0]
+		}
+		if organisationID != "" {
+			m, err := memberOn(db, organisationID, item.PersonID, date)
+			if err != nil {
+				return nil, nil, err
+			}
+			basket[i].Member = m != nil
+		}
+	}
+	return basket, personIDs, nil
+} //newBasket()
@@ -0,0 +1,282 @@
+package db_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func TestPricing(t *testing.T) {
+	rand := func(cents int) db.Amount {
+		return db.Amount{Currency: db.DefaultCurrency, Cents: cents}
+	}
+	str := func(s string) *string { return &s }
+	yes := true
+	no := false
+	earlyBirdEnd := db.SqlTime(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	lateEntryStart := db.SqlTime(time.Date(2022, 6, 20, 0, 0, 0, 0, time.UTC))
+	early := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+	normal := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	late := time.Date(2022, 6, 21, 12, 0, 0, 0, time.UTC)
+
+	pricing := db.EventPricing{
+		Rules: []db.PriceRule{
+			{Description: "Entry", Fee: rand(25000)},
+			{Description: "Early bird", ValidUntil: &earlyBirdEnd, Fee: rand(20000)},
+			{Description: "Late entry", ValidFrom: &lateEntryStart, Fee: rand(30000)},
+			{Description: "Junior", CategoryID: str("junior"), Fee: rand(10050)},
+			{Description: "Member", Member: &yes, Fee: rand(22500)},
+			{Description: "Non-member day licence", Member: &no, CategoryID: str("elite"), Fee: rand(35000)},
+		},
+		FamilyDiscount: &db.FamilyDiscount{MinEntries: 3, PercentOff: 25},
+	}
+
+	type expectedLine struct {
+		item        int
+		description string
+		cents       int
+	}
+	tests := []struct {
+		name   string
+		at     time.Time
+		basket []db.BasketItem
+		lines  []expectedLine
+		total  int
+	}{
+		{
+			name:   "normal entry",
+			at:     normal,
+			basket: []db.BasketItem{{PersonID: "a", CategoryID: "open"}},
+			lines:  []expectedLine{{0, "Entry", 25000}},
+			total:  25000,
+		},
+		{
+			name:   "early bird",
+			at:     early,
+			basket: []db.BasketItem{{PersonID: "a", CategoryID: "open"}},
+			lines:  []expectedLine{{0, "Early bird", 20000}},
+			total:  20000,
+		},
+		{
+			name:   "early bird ends at deadline",
+			at:     time.Time(earlyBirdEnd),
+			basket: []db.BasketItem{{PersonID: "a", CategoryID: "open"}},
+			lines:  []expectedLine{{0, "Entry", 25000}},
+			total:  25000,
+		},
+		{
+			name:   "late entry",
+			at:     late,
+			basket: []db.BasketItem{{PersonID: "a", CategoryID: "open"}},
+			lines:  []expectedLine{{0, "Late entry", 30000}},
+			total:  30000,
+		},
+		{
+			name:   "category beats dates",
+			at:     late,
+			basket: []db.BasketItem{{PersonID: "a", CategoryID: "junior"}},
+			lines:  []expectedLine{{0, "Junior", 10050}},
+			total:  10050,
+		},
+		{
+			name:   "member beats dates",
+			at:     early,
+			basket: []db.BasketItem{{PersonID: "a", CategoryID: "open", Member: true}},
+			lines:  []expectedLine{{0, "Member", 22500}},
+			total:  22500,
+		},
+		{
+			name: "category and membership",
+			at:   normal,
+			basket: []db.BasketItem{
+				{PersonID: "a", CategoryID: "elite", Member: false},
+				{PersonID: "b", CategoryID: "elite", Member: true},
+			},
+			lines: []expectedLine{{0, "Non-member day licence", 35000}, {1, "Member", 22500}},
+			total: 57500,
+		},
+		{
+			name: "family too small for discount",
+			at:   normal,
+			basket: []db.BasketItem{
+				{PersonID: "a", CategoryID: "open", FamilyID: "f1"},
+				{PersonID: "b", CategoryID: "open", FamilyID: "f1"},
+			},
+			lines: []expectedLine{{0, "Entry", 25000}, {1, "Entry", 25000}},
+			total: 50000,
+		},
+		{
+			name: "family discount on cheapest entries",
+			at:   normal,
+			basket: []db.BasketItem{
+				{PersonID: "a", CategoryID: "open", FamilyID: "f1"},
+				{PersonID: "b", CategoryID: "junior", FamilyID: "f1"},
+				{PersonID: "c", CategoryID: "open", FamilyID: "f1"},
+				{PersonID: "d", CategoryID: "open", FamilyID: "f2"},
+				{PersonID: "e", CategoryID: "junior", FamilyID: "f1"},
+			},
+			lines: []expectedLine{
+				{0, "Entry", 25000},
+				{1, "Junior", 10050},
+				{2, "Entry", 25000},
+				{3, "Entry", 25000},
+				{4, "Junior", 10050},
+				{1, "Family discount 25%", -2513}, //25% of 100.50 = 25.125 rounds to 25.13
+				{4, "Family discount 25%", -2513},
+			},
+			total: 90074,
+		},
+	}
+
+	for _, test := range tests {
+		quote, err := pricing.Calculate(test.basket, test.at)
+		if err != nil {
+			t.Fatalf("%s: failed: %+v", test.name, err)
+		}
+		if len(quote.Lines) != len(test.lines) {
+			t.Fatalf("%s: got %d lines, expected %d: %+v", test.name, len(quote.Lines), len(test.lines), quote.Lines)
+		}
+		for i, expected := range test.lines {
+			line := quote.Lines[i]
+			if line.Item != expected.item || line.Description != expected.description || line.Amount.Cents != expected.cents {
+				t.Errorf("%s: line[%d] = {%d,%s,%d}, expected %+v", test.name, i, line.Item, line.Description, line.Amount.Cents, expected)
+			}
+			if line.Amount.Currency != db.DefaultCurrency {
+				t.Errorf("%s: line[%d] currency %+v", test.name, i, line.Amount.Currency)
+			}
+		}
+		if quote.Total.Cents != test.total {
+			t.Errorf("%s: total %d, expected %d", test.name, quote.Total.Cents, test.total)
+		}
+	}
+}
+
+func TestPricingWithoutMatchingRule(t *testing.T) {
+	str := func(s string) *string { return &s }
+	pricing := db.EventPricing{
+		Rules: []db.PriceRule{
+			{Description: "Junior", CategoryID: str("junior"), Fee: db.Amount{Cents: 10000}},
+		},
+	}
+	if _, err := pricing.Calculate([]db.BasketItem{{PersonID: "a", CategoryID: "open"}}, time.Now()); err == nil {
+		t.Fatalf("priced entry without matching rule")
+	}
+}
+
+func TestPricingValidateCopiesRules(t *testing.T) {
+	rules := []db.PriceRule{{Description: " Entry ", Fee: db.Amount{Cents: 10000}}}
+	pricing := db.EventPricing{Rules: rules}
+	if err := pricing.Validate(); err != nil {
+		t.Fatalf("invalid pricing: %+v", err)
+	}
+	if pricing.Rules[0].Description != "Entry" || pricing.Rules[0].FeeCents != 10000 {
+		t.Fatalf("rule not normalised: %+v", pricing.Rules[0])
+	}
+	if rules[0].Description != " Entry " || rules[0].FeeCents != 0 || rules[0].Fee.Currency != nil {
+		t.Fatalf("changed the rules of the caller: %+v", rules[0])
+	}
+}
+
+func TestSetEventPricingNeedsOrganiser(t *testing.T) {
+	req := db.SetEventPricingRequest{
+		EventPricing: db.EventPricing{Rules: []db.PriceRule{{Description: "Entry", Fee: db.Amount{Cents: 10000}}}},
+	}
+	if err := db.SetEventPricing("e1", req); errors.Code(err) != http.StatusForbidden {
+		t.Fatalf("code %d instead of 403: %+v", errors.Code(err), err)
+	}
+}
+
+func TestAmountPercent(t *testing.T) {
+	tests := []struct {
+		cents   int
+		percent int
+		result  int
+	}{
+		{10000, 20, 2000},
+		{10050, 25, 2513},
+		{10049, 25, 2512},
+		{1, 50, 1},
+		{1, 49, 0},
+		{-10050, 25, -2513},
+		{0, 25, 0},
+	}
+	for _, test := range tests {
+		if r := (db.Amount{Cents: test.cents}).Percent(test.percent); r.Cents != test.result {
+			t.Errorf("%d%% of %d = %d, expected %d", test.percent, test.cents, r.Cents, test.result)
+		}
+	}
+}
+
+func TestPromoCodes(t *testing.T) {
+	rand := func(cents int) db.Amount {
+		return db.Amount{Currency: db.DefaultCurrency, Cents: cents}
+	}
+	str := func(s string) *string { return &s }
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	expired := db.SqlTime(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	pricing := db.EventPricing{
+		Rules: []db.PriceRule{
+			{Description: "Entry", Fee: rand(25000)},
+			{Description: "Junior", CategoryID: str("junior"), Fee: rand(4000)},
+		},
+		FamilyDiscount: &db.FamilyDiscount{MinEntries: 2, PercentOff: 10},
+	}
+	free := db.PromoCode{ID: "1", Code: "FREE", Kind: db.PromoFree}
+	pct := db.PromoCode{ID: "2", Code: "PCT20", Kind: db.PromoPercent, PercentOff: 20, Stackable: true}
+	fixed := db.PromoCode{ID: "3", Code: "R50JUNIOR", Kind: db.PromoFixed, AmountOff: rand(5000), CategoryID: str("junior"), Stackable: true}
+	old := db.PromoCode{ID: "4", Code: "OLD", Kind: db.PromoFree, ValidUntil: &expired}
+	onceEach := db.PromoCode{ID: "5", Code: "ONCE", Kind: db.PromoPercent, PercentOff: 50, MaxPerPerson: 1, RedeemedBy: map[string]int{"a": 1}}
+	lastOne := db.PromoCode{ID: "6", Code: "LAST", Kind: db.PromoPercent, PercentOff: 50, MaxRedemptions: 10, Redeemed: 9}
+
+	tests := []struct {
+		name   string
+		basket []db.BasketItem
+		codes  []db.PromoCode
+		total  int
+		fail   bool
+	}{
+		{name: "no code", basket: []db.BasketItem{{PersonID: "a"}}, total: 25000},
+		{name: "free entry", basket: []db.BasketItem{{PersonID: "a"}}, codes: []db.PromoCode{free}, total: 0},
+		{name: "percent off", basket: []db.BasketItem{{PersonID: "a"}}, codes: []db.PromoCode{pct}, total: 20000},
+		{name: "fixed off limited to fee", basket: []db.BasketItem{{PersonID: "a", CategoryID: "junior"}}, codes: []db.PromoCode{fixed}, total: 0},
+		{name: "code for other category", basket: []db.BasketItem{{PersonID: "a"}}, codes: []db.PromoCode{fixed}, fail: true},
+		{
+			name:   "after family discount",
+			basket: []db.BasketItem{{PersonID: "a", FamilyID: "f"}, {PersonID: "b", FamilyID: "f"}},
+			codes:  []db.PromoCode{pct},
+			total:  25000 + 22500 - 5000 - 4500,
+		},
+		{
+			name:   "stacked codes",
+			basket: []db.BasketItem{{PersonID: "a"}, {PersonID: "b", CategoryID: "junior"}},
+			codes:  []db.PromoCode{pct, fixed},
+			total:  20000 + 0,
+		},
+		{name: "same code twice", basket: []db.BasketItem{{PersonID: "a"}}, codes: []db.PromoCode{pct, pct}, fail: true},
+		{name: "not stackable", basket: []db.BasketItem{{PersonID: "a"}}, codes: []db.PromoCode{free, pct}, fail: true},
+		{name: "expired", basket: []db.BasketItem{{PersonID: "a"}}, codes: []db.PromoCode{old}, fail: true},
+		{name: "per person limit", basket: []db.BasketItem{{PersonID: "a"}}, codes: []db.PromoCode{onceEach}, fail: true},
+		{name: "per person other person", basket: []db.BasketItem{{PersonID: "b"}}, codes: []db.PromoCode{onceEach}, total: 12500},
+		{name: "last redemption", basket: []db.BasketItem{{PersonID: "a"}}, codes: []db.PromoCode{lastOne}, total: 12500},
+		{name: "over max redemptions", basket: []db.BasketItem{{PersonID: "a"}, {PersonID: "b"}}, codes: []db.PromoCode{lastOne}, fail: true},
+	}
+	for _, test := range tests {
+		quote, err := pricing.Calculate(test.basket, now, test.codes...)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: did not fail: %+v", test.name, quote.Lines)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed: %+v", test.name, err)
+			continue
+		}
+		if quote.Total.Cents != test.total {
+			t.Errorf("%s: total %d, expected %d: %+v", test.name, quote.Total.Cents, test.total, quote.Lines)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//PromoCode is a discount handed out by sponsors and clubs, e.g. free entry,
+//20% off or R50 off for entries in one category
+type PromoCode struct {
+	ID             string   `json:"id" db:"id"`
+	EventID        string   `json:"event_id" db:"event_id"`
+	Code           string   `json:"code" db:"code"`
+	Description    string   `json:"description" db:"description"`
+	Kind           string   `json:"kind" db:"kind" doc:"free|percent|fixed"`
+	PercentOff     int      `json:"percent_off,omitempty" db:"percent_off"`
+	AmountOff      Amount   `json:"amount_off,omitempty" db:"-"`
+	AmountOffCents int      `json:"-" db:"amount_off_cents"`
+	CategoryID     *string  `json:"category_id,omitempty" db:"category_id" doc:"Omit for all categories"`
+	ValidFrom      *SqlTime `json:"valid_from,omitempty" db:"valid_from"`
+	ValidUntil     *SqlTime `json:"valid_until,omitempty" db:"valid_until"`
+	MaxRedemptions int      `json:"max_redemptions" db:"max_redemptions" doc:"0 for unlimited"`
+	MaxPerPerson   int      `json:"max_per_person" db:"max_per_person" doc:"0 for unlimited"`
+	Stackable      bool     `json:"stackable" db:"stackable" doc:"Can be used with other codes"`
+
+	//redemptions so far, loaded with the code to check the limits
+	Redeemed   int            `json:"redeemed" db:"redeemed"`
+	RedeemedBy map[string]int `json:"-" db:"-"`
+}
+
+const (
+	PromoFree    = "free"
+	PromoPercent = "percent"
+	PromoFixed   = "fixed"
+)
+
+var promoCodeRegex = regexp.MustCompile(`^[A-Z0-9-]{4,40}$`)
+
+func (c *PromoCode) Validate() error {
+	c.Code = strings.ToUpper(strings.TrimSpace(c.Code))
+	if !promoCodeRegex.MatchString(c.Code) {
+		return errors.Errorf("invalid code \"%s\", expecting 4..40 letters, digits or dashes", c.Code)
+	}
+	c.Description = strings.TrimSpace(c.Description)
+	switch c.Kind {
+	case PromoFree:
+	case PromoPercent:
+		if c.PercentOff < 1 || c.PercentOff > 100 {
+			return errors.Errorf("invalid percent_off=%d, expecting 1..100", c.PercentOff)
+		}
+	case PromoFixed:
+		if c.AmountOff.Currency == nil {
+			c.AmountOff.Currency = DefaultCurrency
+		}
+		if c.AmountOff.Cents < 1 {
+			return errors.Errorf("invalid amount_off %s", c.AmountOff)
+		}
+	default:
+		return errors.Errorf("invalid kind \"%s\", expecting free|percent|fixed", c.Kind)
+	}
+	if c.ValidFrom != nil && c.ValidUntil != nil && !time.Time(*c.ValidUntil).After(time.Time(*c.ValidFrom)) {
+		return errors.Errorf("valid_until is not after valid_from")
+	}
+	if c.MaxRedemptions < 0 {
+		return errors.Errorf("negative max_redemptions")
+	}
+	if c.MaxPerPerson < 0 {
+		return errors.Errorf("negative max_per_person")
+	}
+	c.AmountOffCents = c.AmountOff.Cents
+	return nil
+} //PromoCode.Validate()
+
+//discount returns the discount on an item that still costs net
+func (c PromoCode) discount(net Amount) Amount {
+	var d Amount
+	switch c.Kind {
+	case PromoFree:
+		d = net
+	case PromoPercent:
+		d = net.Percent(c.PercentOff)
+	case PromoFixed:
+		d = c.AmountOff
+		if d.Cents > net.Cents {
+			d.Cents = net.Cents
+		}
+	}
+	return d
+}
+
+func (c PromoCode) appliesTo(item BasketItem) bool {
+	return c.CategoryID == nil || *c.CategoryID == item.CategoryID
+}
+
+func (c PromoCode) validAt(at time.Time) bool {
+	if c.ValidFrom != nil && at.Before(time.Time(*c.ValidFrom)) {
+		return false
+	}
+	if c.ValidUntil != nil && !at.Before(time.Time(*c.ValidUntil)) {
+		return false
+	}
+	return true
+}
+
+//checkLimits fails when the code is used for the nr of entries per person
+//on top of the redemptions already made
+func (c PromoCode) checkLimits(usesByPerson map[string]int) error {
+	total := c.Redeemed
+	for personID, nr := range usesByPerson {
+		total += nr
+		if c.MaxPerPerson > 0 && c.RedeemedBy[personID]+nr > c.MaxPerPerson {
+			return errors.Errorc(http.StatusConflict, fmt.Sprintf("code %s can only be used %d times per person", c.Code, c.MaxPerPerson))
+		}
+	}
+	if c.MaxRedemptions > 0 && total > c.MaxRedemptions {
+		return errors.Errorc(http.StatusConflict, fmt.Sprintf("code %s has been fully redeemed", c.Code))
+	}
+	return nil
+}
+
+//applyPromoCodes adds discount lines to the quote for every item that each
+//code applies to, after the entry fees and family discounts
+func (p EventPricing) applyPromoCodes(quote *Quote, basket []BasketItem, at time.Time, codes []PromoCode) error {
+	if len(codes) == 0 {
+		return nil
+	}
+	if len(codes) > 1 {
+		used := map[string]bool{}
+		for _, c := range codes {
+			if used[c.ID] {
+				return errors.Errorc(http.StatusBadRequest, fmt.Sprintf("code %s is used more than once", c.Code))
+			}
+			used[c.ID] = true
+			if !c.Stackable {
+				return errors.Errorc(http.StatusBadRequest, fmt.Sprintf("code %s cannot be used with other codes", c.Code))
+			}
+		}
+	}
+	net := make([]Amount, len(basket))
+	for i := range net {
+		net[i] = Amount{Currency: p.Currency}
+	}
+	for _, line := range quote.Lines {
+		net[line.Item] = net[line.Item].Add(line.Amount)
+	}
+	for _, c := range codes {
+		if !c.validAt(at) {
+			return errors.Errorc(http.StatusBadRequest, fmt.Sprintf("code %s is not valid now", c.Code))
+		}
+		if c.Kind == PromoFixed && c.AmountOff.Currency != p.Currency {
+			return errors.Errorf("code %s currency %s is not the event currency", c.Code, c.AmountOff.Currency.Code)
+		}
+		usesByPerson := map[string]int{}
+		for i, item := range basket {
+			if !c.appliesTo(item) {
+				continue
+			}
+			d := c.discount(net[i])
+			if d.Cents <= 0 {
+				continue
+			}
+			net[i] = net[i].Sub(d)
+			usesByPerson[item.PersonID]++
+			description := c.Description
+			if description == "" {
+				description = "Promo code " + c.Code
+			}
+			quote.Lines = append(quote.Lines, QuoteLine{
+				Item:        i,
+				PersonID:    item.PersonID,
+				Description: description,
+				Amount:      d.Neg(),
+				PromoCodeID: c.ID,
+			})
+		}
+		if len(usesByPerson) == 0 {
+			return errors.Errorc(http.StatusBadRequest, fmt.Sprintf("code %s does not apply to any of the entries", c.Code))
+		}
+		if err := c.checkLimits(usesByPerson); err != nil {
+			return err
+		}
+	}
+	return nil
+} //EventPricing.applyPromoCodes()
+
+const selectPromoCodeSQL = "SELECT c.`id`,c.`event_id`,c.`code`,c.`description`,c.`kind`,c.`percent_off`,c.`amount_off_cents`,c.`category_id`," +
+	"c.`valid_from`,c.`valid_until`,c.`max_redemptions`,c.`max_per_person`,c.`stackable`," +
+	"(SELECT COUNT(*) FROM `promo_redemptions` AS r WHERE r.`promo_code_id`=c.`id`) AS redeemed" +
+	" FROM `promo_codes` AS c"
+
+type NewPromoCodeRequest struct {
+	PromoCode
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+}
+
+func AddPromoCode(eventID string, req NewPromoCodeRequest) (*PromoCode, error) {
+	c := req.PromoCode
+	if err := c.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid promo code")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	c.ID = uuid.New().String()
+	c.EventID = eventID
+	c.Redeemed = 0
+	if c.CategoryID != nil {
+		var nr int
+		if err := NamedGet(&nr,
+			"SELECT COUNT(*) FROM `event_categories` WHERE `id`=:id AND `event_id`=:event_id",
+			map[string]interface{}{"id": *c.CategoryID, "event_id": eventID},
+		); err != nil || nr != 1 {
+			return nil, errors.Errorc(http.StatusBadRequest, "unknown category_id")
+		}
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO `promo_codes` SET `id`=:id,`event_id`=:event_id,`code`=:code,`description`=:description,`kind`=:kind,`percent_off`=:percent_off,`amount_off_cents`=:amount_off_cents,`category_id`=:category_id,"+
+			"`valid_from`=:valid_from,`valid_until`=:valid_until,`max_redemptions`=:max_redemptions,`max_per_person`=:max_per_person,`stackable`=:stackable",
+		c,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorc(http.StatusConflict, fmt.Sprintf("code %s already exists", c.Code))
+		}
+		return nil, errors.Wrapf(err, "failed to add promo code")
+	}
+	return &c, nil
+} //AddPromoCode()
+
+func ListPromoCodes(eventID string) ([]PromoCode, error) {
+	var codes []PromoCode
+	if err := NamedSelect(
+		&codes,
+		selectPromoCodeSQL+" WHERE c.`event_id`=:event_id ORDER BY c.`code`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get promo codes")
+	}
+	for i := range codes {
+		codes[i].AmountOff = Amount{Currency: DefaultCurrency, Cents: codes[i].AmountOffCents}
+	}
+	return codes, nil
+}
+
+//getPromoCodes loads the codes for an event with the redemptions so far, by
+//all and by each of the persons. Pass a transaction to lock the codes until
+//the redemptions are added, so concurrent checkouts cannot exceed the limits.
+//A code can only be used once.
+func getPromoCodes(q sqlx.Queryer, eventID string, codes []string, personIDs []string) ([]PromoCode, error) {
+	list := []PromoCode{}
+	used := map[string]bool{}
+	for _, code := range codes {
+		if used[strings.ToUpper(strings.TrimSpace(code))] {
+			return nil, errors.Errorc(http.StatusBadRequest, fmt.Sprintf("code %s is used more than once", code))
+		}
+		used[strings.ToUpper(strings.TrimSpace(code))] = true
+		query := selectPromoCodeSQL + " WHERE c.`event_id`=? AND c.`code`=?"
+		if _, ok := q.(*sqlx.Tx); ok {
+			query += " FOR UPDATE"
+		}
+		var c PromoCode
+		if err := sqlx.Get(q, &c, query, eventID, strings.ToUpper(strings.TrimSpace(code))); err != nil {
+			return nil, errors.Errorc(http.StatusBadRequest, fmt.Sprintf("unknown code %s", code))
+		}
+		c.AmountOff = Amount{Currency: DefaultCurrency, Cents: c.AmountOffCents}
+		c.RedeemedBy = map[string]int{}
+		for _, personID := range personIDs {
+			var nr int
+			if err := sqlx.Get(q, &nr,
+				"SELECT COUNT(*) FROM `promo_redemptions` WHERE `promo_code_id`=? AND `person_id`=?",
+				c.ID, personID,
+			); err != nil {
+				return nil, errors.Wrapf(err, "failed to count redemptions")
+			}
+			c.RedeemedBy[personID] = nr
+		}
+		list = append(list, c)
+	}
+	return list, nil
+} //getPromoCodes()
+
+//RedeemPromoCodes records the use of every code in the quote for the order
+//being checked out, in the transaction that creates the order. The codes are
+//locked and the limits checked again, so they hold under concurrent checkout.
+func RedeemPromoCodes(tx *sqlx.Tx, eventID string, orderID string, codes []string, quote Quote) error {
+	if len(codes) == 0 {
+		return nil
+	}
+	personIDs := []string{}
+	for _, line := range quote.Lines {
+		personIDs = append(personIDs, line.PersonID)
+	}
+	locked, err := getPromoCodes(tx, eventID, codes, personIDs)
+	if err != nil {
+		return err
+	}
+	for _, c := range locked {
+		usesByPerson := map[string]int{}
+		for _, line := range quote.Lines {
+			if line.PromoCodeID == c.ID {
+				usesByPerson[line.PersonID]++
+			}
+		}
+		if err := c.checkLimits(usesByPerson); err != nil {
+			return err
+		}
+		for _, line := range quote.Lines {
+			if line.PromoCodeID != c.ID {
+				continue
+			}
+			if _, err := tx.Exec(
+				"INSERT INTO `promo_redemptions` SET `id`=?,`promo_code_id`=?,`order_id`=?,`person_id`=?,`discount_cents`=?,`redeemed`=?",
+				uuid.New().String(), c.ID, orderID, line.PersonID, -line.Amount.Cents, SqlTime(time.Now()),
+			); err != nil {
+				return errors.Wrapf(err, "failed to redeem code %s", c.Code)
+			}
+		}
+	}
+	return nil
+} //RedeemPromoCodes()
@@ -0,0 +1,874 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/payment"
+	"github.com/jmoiron/sqlx"
+)
+
+//RefundPolicy defines how much of the entry fee is refunded when a
+//participant withdraws or the event is cancelled
+type RefundPolicy struct {
+	Rules            []RefundRule `json:"rules" doc:"Percentage refunded by days before the event, none when no rule applies"`
+	AdminFee         Amount       `json:"admin_fee" doc:"Deducted from each refund when withdrawing"`
+	AdminFeeCents    int          `json:"-" db:"admin_fee_cents"`
+	Method           string       `json:"method" db:"method" doc:"cash, credit (credit note) or choice of the participant"`
+	CancelledPercent int          `json:"cancelled_percent" db:"cancelled_percent" doc:"Refunded without admin fee when the event is cancelled"`
+}
+
+//RefundRule applies when withdrawing at least DaysBefore days before the event
+type RefundRule struct {
+	DaysBefore int `json:"days_before" db:"days_before"`
+	Percent    int `json:"percent" db:"percent"`
+}
+
+const (
+	RefundCash   = "cash"
+	RefundCredit = "credit"
+	RefundChoice = "choice"
+)
+
+func (p *RefundPolicy) Validate() error {
+	switch p.Method {
+	case RefundCash, RefundCredit, RefundChoice:
+	default:
+		return errors.Errorf("invalid method \"%s\", expecting cash|credit|choice", p.Method)
+	}
+	if p.AdminFee.Cents < 0 {
+		return errors.Errorf("negative admin_fee")
+	}
+	if p.AdminFee.Currency == nil {
+		p.AdminFee.Currency = DefaultCurrency
+	}
+	p.AdminFeeCents = p.AdminFee.Cents
+	if p.CancelledPercent < 0 || p.CancelledPercent > 100 {
+		return errors.Errorf("cancelled_percent must be 0..100")
+	}
+	days := map[int]bool{}
+	for i, r := range p.Rules {
+		if r.DaysBefore < 0 {
+			return errors.Errorf("rule[%d] negative days_before", i)
+		}
+		if r.Percent < 0 || r.Percent > 100 {
+			return errors.Errorf("rule[%d] percent must be 0..100", i)
+		}
+		if days[r.DaysBefore] {
+			return errors.Errorf("rule[%d] duplicate days_before %d", i, r.DaysBefore)
+		}
+		days[r.DaysBefore] = true
+	}
+	sort.Slice(p.Rules, func(i, j int) bool { return p.Rules[i].DaysBefore > p.Rules[j].DaysBefore })
+	return nil
+}
+
+//Calculate returns the refund on the amount paid for an entry, when
+//withdrawing the specified nr of days before the event, or when cancelled
+func (p RefundPolicy) Calculate(paid Amount, daysBefore int, cancelled bool) Amount {
+	if cancelled {
+		return paid.Percent(p.CancelledPercent)
+	}
+	percent := 0
+	for _, r := range p.Rules {
+		if daysBefore >= r.DaysBefore && r.DaysBefore >= 0 {
+			percent = r.Percent
+			break
+		}
+	}
+	refund := paid.Percent(percent)
+	if percent > 0 {
+		refund = refund.Sub(p.AdminFee)
+	}
+	if refund.Cents < 0 {
+		refund.Cents = 0
+	}
+	return refund
+}
+
+//GetEventRefundPolicy returns the event policy, which by default refunds
+//nothing on withdrawal and everything when the event is cancelled
+func GetEventRefundPolicy(eventID string) (*RefundPolicy, error) {
+	return getEventRefundPolicy(db, eventID)
+}
+
+func getEventRefundPolicy(q sqlx.Queryer, eventID string) (*RefundPolicy, error) {
+	p := RefundPolicy{Rules: []RefundRule{}, Method: RefundCash, CancelledPercent: 100}
+	if err := sqlx.Get(q, &p,
+		"SELECT `admin_fee_cents`,`method`,`cancelled_percent` FROM `event_refund_policies` WHERE `event_id`=?",
+		eventID,
+	); err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "failed to get refund policy")
+	}
+	p.AdminFee = Amount{Currency: DefaultCurrency, Cents: p.AdminFeeCents}
+	if err := sqlx.Select(q, &p.Rules,
+		"SELECT `days_before`,`percent` FROM `event_refund_rules` WHERE `event_id`=? ORDER BY `days_before` DESC",
+		eventID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get refund rules")
+	}
+	return &p, nil
+}
+
+type SetRefundPolicyRequest struct {
+	RefundPolicy
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+}
+
+func SetEventRefundPolicy(eventID string, req SetRefundPolicyRequest) error {
+	p := req.RefundPolicy
+	if err := p.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid refund policy")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(
+		"REPLACE INTO `event_refund_policies` SET `event_id`=?,`admin_fee_cents`=?,`method`=?,`cancelled_percent`=?",
+		eventID, p.AdminFeeCents, p.Method, p.CancelledPercent,
+	); err != nil {
+		return errors.Wrapf(err, "failed to set refund policy")
+	}
+	if _, err := tx.Exec("DELETE FROM `event_refund_rules` WHERE `event_id`=?", eventID); err != nil {
+		return errors.Wrapf(err, "failed to delete old refund rules")
+	}
+	for _, r := range p.Rules {
+		if _, err := tx.Exec(
+			"INSERT INTO `event_refund_rules` SET `event_id`=?,`days_before`=?,`percent`=?",
+			eventID, r.DaysBefore, r.Percent,
+		); err != nil {
+			return errors.Wrapf(err, "failed to add refund rule")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit refund policy")
+	}
+	return nil
+} //SetEventRefundPolicy()
+
+//Refund pays back (part of) what was paid for one entry of an order, in cash
+//through the payment provider or as a credit note
+type Refund struct {
+	ID          string   `json:"id" db:"id"`
+	EventID     string   `json:"event_id" db:"event_id"`
+	OrderID     string   `json:"order_id" db:"order_id"`
+	EntryID     string   `json:"entry_id" db:"entry_id"`
+	PersonID    string   `json:"person_id" db:"person_id" doc:"Requested by"`
+	Reason      string   `json:"reason" db:"reason"`
+	Method      string   `json:"method" db:"method"`
+	Amount      Amount   `json:"amount" db:"-"`
+	AmountCents int      `json:"-" db:"amount_cents"`
+	Status      string   `json:"status" db:"status"`
+	Note        string   `json:"note,omitempty" db:"note"`
+	Requested   SqlTime  `json:"requested" db:"requested"`
+	DecidedBy   *string  `json:"decided_by,omitempty" db:"decided_by"`
+	Decided     *SqlTime `json:"decided,omitempty" db:"decided"`
+	RefundRef   *string  `json:"refund_ref,omitempty" db:"refund_ref" doc:"Provider or bank reference of the cash refund"`
+	Completed   *SqlTime `json:"completed,omitempty" db:"completed"`
+}
+
+const (
+	RefundReasonWithdrawn = "withdrawn"
+	RefundReasonCancelled = "event_cancelled"
+
+	RefundRequested = "requested"
+	RefundApproved  = "approved" //cash refund still to be paid
+	RefundRejected  = "rejected"
+	RefundCompleted = "completed"
+	RefundFailed    = "failed" //provider refused, can be completed by hand
+)
+
+const refundColumns = "`id`,`event_id`,`order_id`,`entry_id`,`person_id`,`reason`,`method`,`amount_cents`,`status`,`note`,`requested`,`decided_by`,`decided`,`refund_ref`,`completed`"
+
+type NewRefundRequest struct {
+	PersonID string `json:"person_id" doc:"Entrant or the person who paid"`
+	Method   string `json:"method,omitempty" doc:"cash or credit when the policy lets the participant choose"`
+	Note     string `json:"note,omitempty"`
+}
+
+func (req NewRefundRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	if req.Method != "" && req.Method != RefundCash && req.Method != RefundCredit {
+		return errors.Errorf("invalid method \"%s\", expecting cash|credit", req.Method)
+	}
+	return nil
+}
+
+//RequestRefund is used when a participant withdraws. The amount is
+//calculated from the event policy and the organisers must approve it.
+func RequestRefund(entryID string, req NewRefundRequest) (*Refund, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	var entry Entry
+	if err := tx.Get(&entry,
+		"SELECT `id`,`event_id`,`person_id`,`status` FROM `entries` WHERE `id`=? FOR UPDATE",
+		entryID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown entry")
+		}
+		return nil, errors.Wrapf(err, "failed to get entry")
+	}
+	if entry.Status != EntryStatusConfirmed {
+		return nil, errors.Errorc(http.StatusConflict, "entry is "+entry.Status)
+	}
+	order, paid, err := entryPayment(tx, entryID)
+	if err != nil {
+		return nil, err
+	}
+	if req.PersonID != entry.PersonID && req.PersonID != order.PersonID {
+		return nil, errors.Errorc(http.StatusForbidden, "only the entrant or payer can request a refund")
+	}
+	var nrOpen int
+	if err := tx.Get(&nrOpen,
+		"SELECT COUNT(*) FROM `refunds` WHERE `entry_id`=? AND `status` IN (?,?,?)",
+		entryID, RefundRequested, RefundApproved, RefundCompleted,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to check refunds")
+	}
+	if nrOpen > 0 {
+		return nil, errors.Errorc(http.StatusConflict, "refund already requested")
+	}
+	var nrTransfers int
+	if err := tx.Get(&nrTransfers,
+		"SELECT COUNT(*) FROM `entry_transfers` WHERE `entry_id`=? AND `status` IN (?,?)",
+		entryID, TransferOffered, TransferAccepted,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to check transfers")
+	}
+	if nrTransfers > 0 {
+		return nil, errors.Errorc(http.StatusConflict, "a transfer of the entry is open, cancel it first")
+	}
+
+	policy, err := getEventRefundPolicy(tx, entry.EventID)
+	if err != nil {
+		return nil, err
+	}
+	daysBefore, cancelled, err := eventDaysBefore(tx, entry.EventID)
+	if err != nil {
+		return nil, err
+	}
+	method := policy.Method
+	if method == RefundChoice {
+		if method = req.Method; method == "" {
+			return nil, errors.Errorf("missing method, choose cash or credit")
+		}
+	}
+	if order.CreditCents > 0 {
+		method = RefundCredit //paid (partly) with credit, which is not returned in cash
+	}
+	amount := policy.Calculate(paid, daysBefore, cancelled)
+	reason := RefundReasonWithdrawn
+	if cancelled {
+		reason = RefundReasonCancelled
+	}
+	refund := Refund{
+		ID:          uuid.New().String(),
+		EventID:     entry.EventID,
+		OrderID:     order.ID,
+		EntryID:     entryID,
+		PersonID:    req.PersonID,
+		Reason:      reason,
+		Method:      method,
+		Amount:      amount,
+		AmountCents: amount.Cents,
+		Status:      RefundRequested,
+		Note:        req.Note,
+		Requested:   SqlTime(time.Now()),
+	}
+	if err := insertRefund(tx, refund); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit refund")
+	}
+	return &refund, nil
+} //RequestRefund()
+
+func insertRefund(tx *sqlx.Tx, r Refund) error {
+	if _, err := tx.NamedExec(
+		"INSERT INTO `refunds` SET `id`=:id,`event_id`=:event_id,`order_id`=:order_id,`entry_id`=:entry_id,`person_id`=:person_id,`reason`=:reason,`method`=:method,`amount_cents`=:amount_cents,`status`=:status,`note`=:note,`requested`=:requested,`decided_by`=:decided_by,`decided`=:decided",
+		r,
+	); err != nil {
+		return errors.Wrapf(err, "failed to add refund")
+	}
+	return nil
+}
+
+//entryPayment returns the paid order of the entry and what was paid for the
+//entry, which is the sum of its order lines after discounts
+func entryPayment(q sqlx.Queryer, entryID string) (*Order, Amount, error) {
+	var order Order
+	if err := sqlx.Get(q, &order,
+		"SELECT o.`id`,o.`event_id`,o.`person_id`,o.`status`,o.`total_cents`,o.`credit_cents`,o.`provider` FROM `orders` o WHERE o.`id`=(SELECT `order_id` FROM `order_lines` WHERE `entry_id`=? LIMIT 1)",
+		entryID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, Amount{}, errors.Errorc(http.StatusConflict, "entry was not paid")
+		}
+		return nil, Amount{}, errors.Wrapf(err, "failed to get order")
+	}
+	if order.Status != OrderPaid && order.Status != OrderRefunded {
+		return nil, Amount{}, errors.Errorc(http.StatusConflict, "order is "+order.Status)
+	}
+	var cents int
+	if err := sqlx.Get(q, &cents,
+		"SELECT COALESCE(SUM(`amount_cents`),0) FROM `order_lines` WHERE `order_id`=? AND `entry_id`=?",
+		order.ID, entryID,
+	); err != nil {
+		return nil, Amount{}, errors.Wrapf(err, "failed to get amount paid")
+	}
+	return &order, Amount{Currency: DefaultCurrency, Cents: cents}, nil
+}
+
+//eventDaysBefore returns the nr of days from today until the event, and if
+//the event was cancelled
+func eventDaysBefore(q sqlx.Queryer, eventID string) (int, bool, error) {
+	var event struct {
+		Date      string   `db:"date"`
+		Cancelled *SqlTime `db:"cancelled"`
+	}
+	if err := sqlx.Get(q, &event, "SELECT `date`,`cancelled` FROM `events` WHERE `id`=?", eventID); err != nil {
+		return 0, false, errors.Wrapf(err, "failed to get event")
+	}
+	date, err := time.Parse("2006-01-02", event.Date)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "invalid event date %s", event.Date)
+	}
+	//today where the event takes place
+	loc, err := eventTimeZone(q, eventID)
+	if err != nil {
+		return 0, false, err
+	}
+	today, _ := time.Parse("2006-01-02", time.Now().In(loc).Format("2006-01-02"))
+	return int(date.Sub(today).Hours() / 24), event.Cancelled != nil, nil
+}
+
+func ListRefunds(eventID string, status string) ([]Refund, error) {
+	query := "SELECT " + refundColumns + " FROM `refunds` WHERE `event_id`=:event_id"
+	if status != "" {
+		query += " AND `status`=:status"
+	}
+	refunds := []Refund{}
+	if err := NamedSelect(&refunds, query+" ORDER BY `requested`",
+		map[string]interface{}{
+			"event_id": eventID,
+			"status":   status,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list refunds")
+	}
+	for i := range refunds {
+		refunds[i].Amount = Amount{Currency: DefaultCurrency, Cents: refunds[i].AmountCents}
+	}
+	return refunds, nil
+}
+
+func GetRefund(id string) (*Refund, error) {
+	return getRefund(db, id, false)
+}
+
+func getRefund(q sqlx.Queryer, id string, forUpdate bool) (*Refund, error) {
+	query := "SELECT " + refundColumns + " FROM `refunds` WHERE `id`=?"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var r Refund
+	if err := sqlx.Get(q, &r, query, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown refund")
+		}
+		return nil, errors.Wrapf(err, "failed to get refund")
+	}
+	r.Amount = Amount{Currency: DefaultCurrency, Cents: r.AmountCents}
+	return &r, nil
+}
+
+type DecideRefundRequest struct {
+	ByPersonID string  `json:"by_person_id" doc:"Organiser of the event"`
+	Approve    bool    `json:"approve"`
+	Amount     *Amount `json:"amount,omitempty" doc:"Approve a different amount than calculated from the policy"`
+	Note       string  `json:"note,omitempty"`
+}
+
+func (req DecideRefundRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.Amount != nil && req.Amount.Cents < 0 {
+		return errors.Errorf("negative amount")
+	}
+	if !req.Approve && req.Note == "" {
+		return errors.Errorf("missing note to explain rejection")
+	}
+	return nil
+}
+
+//DecideRefund approves or rejects a requested refund. On approval the entry
+//is withdrawn and a credit note refund is completed. A cash refund stays
+//approved until paid through the provider (see CompleteRefund).
+func DecideRefund(id string, req DecideRefundRequest) (*Refund, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	refund, err := getRefund(tx, id, true)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := isEventOrganiser(tx, refund.EventID, req.ByPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can decide on refunds")
+	}
+	if refund.Status != RefundRequested {
+		return nil, errors.Errorc(http.StatusConflict, "refund is "+refund.Status)
+	}
+	now := SqlTime(time.Now())
+	refund.DecidedBy = &req.ByPersonID
+	refund.Decided = &now
+	if req.Note != "" {
+		refund.Note = req.Note
+	}
+	if !req.Approve {
+		refund.Status = RefundRejected
+	} else {
+		if req.Amount != nil {
+			refund.Amount = Amount{Currency: DefaultCurrency, Cents: req.Amount.Cents}
+			refund.AmountCents = req.Amount.Cents
+		}
+		if err := approveRefund(tx, refund); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE `refunds` SET `amount_cents`=:amount_cents,`status`=:status,`note`=:note,`decided_by`=:decided_by,`decided`=:decided,`completed`=:completed WHERE `id`=:id",
+		refund,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update refund")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit refund")
+	}
+	return refund, nil
+} //DecideRefund()
+
+//approveRefund checks that the entry was not refunded more than was paid
+//for it, withdraws the entry and issues the credit note
+func approveRefund(tx *sqlx.Tx, refund *Refund) error {
+	var order Order
+	if err := tx.Get(&order,
+		"SELECT `id`,`event_id`,`person_id`,`status`,`total_cents`,`provider` FROM `orders` WHERE `id`=? FOR UPDATE",
+		refund.OrderID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get order")
+	}
+	_, paid, err := entryPayment(tx, refund.EntryID)
+	if err != nil {
+		return err
+	}
+	var refundedCents int
+	if err := tx.Get(&refundedCents,
+		"SELECT COALESCE(SUM(`amount_cents`),0) FROM `refunds` WHERE `entry_id`=? AND `id`!=? AND `status` IN (?,?)",
+		refund.EntryID, refund.ID, RefundApproved, RefundCompleted,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get refunded amount")
+	}
+	if refundedCents+refund.AmountCents > paid.Cents {
+		remaining := Amount{Currency: DefaultCurrency, Cents: paid.Cents - refundedCents}
+		return errors.Errorc(http.StatusConflict, fmt.Sprintf("refund %s is more than the %s not yet refunded for the entry", refund.Amount, remaining))
+	}
+	if refund.Reason == RefundReasonWithdrawn {
+		if _, err := tx.Exec(
+			"UPDATE `entries` SET `status`=? WHERE `id`=?",
+			EntryStatusWithdrawn, refund.EntryID,
+		); err != nil {
+			return errors.Wrapf(err, "failed to withdraw entry")
+		}
+		if _, err := tx.Exec(
+			"UPDATE `entry_members` SET `status`=? WHERE `entry_id`=?",
+			TeamMemberWithdrawn, refund.EntryID,
+		); err != nil {
+			return errors.Wrapf(err, "failed to withdraw crew")
+		}
+	}
+	refund.Status = RefundApproved
+	if refund.Method == RefundCredit || refund.AmountCents == 0 {
+		if refund.AmountCents > 0 {
+			if _, err := tx.Exec(
+				"INSERT INTO `credit_notes` SET `id`=?,`person_id`=?,`refund_id`=?,`amount_cents`=?,`balance_cents`=?,`issued`=?",
+				uuid.New().String(), order.PersonID, refund.ID, refund.AmountCents, refund.AmountCents, SqlTime(time.Now()),
+			); err != nil {
+				return errors.Wrapf(err, "failed to add credit note")
+			}
+		}
+		return completeRefund(tx, refund, order, AccountCreditNotes)
+	}
+	return nil
+} //approveRefund()
+
+//completeRefund marks the refund paid and the order refunded once all was refunded
+func completeRefund(tx *sqlx.Tx, refund *Refund, order Order, paidFrom string) error {
+	kind := LedgerRefund
+	if paidFrom == AccountCreditNotes {
+		kind = LedgerCreditNote
+	}
+	if err := postLedger(tx, refund.EventID, kind, refund.ID, refund.Reason+" refund for order "+order.ID, refund.Amount, AccountOrganiser, paidFrom); err != nil {
+		return err
+	}
+	now := SqlTime(time.Now())
+	refund.Status = RefundCompleted
+	refund.Completed = &now
+	var refundedCents int
+	if err := tx.Get(&refundedCents,
+		"SELECT COALESCE(SUM(`amount_cents`),0) FROM `refunds` WHERE `order_id`=? AND `id`!=? AND `status`=?",
+		order.ID, refund.ID, RefundCompleted,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get refunded amount")
+	}
+	if order.TotalCents > 0 && refundedCents+refund.AmountCents >= order.TotalCents {
+		if _, err := tx.Exec("UPDATE `orders` SET `status`=? WHERE `id`=?", OrderRefunded, order.ID); err != nil {
+			return errors.Wrapf(err, "failed to update order")
+		}
+	}
+	return nil
+}
+
+//RefundPayment returns the provider and its reference of the payment that
+//must be refunded in cash
+func RefundPayment(refundID string) (provider string, paymentRef string, err error) {
+	var p Payment
+	if err := NamedGet(&p,
+		"SELECT p.`provider`,p.`provider_ref` FROM `payments` p JOIN `refunds` r ON r.`order_id`=p.`order_id` WHERE r.`id`=:id AND p.`status`=:complete AND p.`note`='' LIMIT 1",
+		map[string]interface{}{
+			"id":       refundID,
+			"complete": payment.StatusComplete,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			//not paid through a provider, e.g. EFT
+			var order Order
+			if err := NamedGet(&order,
+				"SELECT o.`provider` FROM `orders` o JOIN `refunds` r ON r.`order_id`=o.`id` WHERE r.`id`=:id",
+				map[string]interface{}{
+					"id": refundID,
+				}); err != nil {
+				return "", "", errors.Wrapf(err, "failed to get order")
+			}
+			return order.Provider, "", nil
+		}
+		return "", "", errors.Wrapf(err, "failed to get payment")
+	}
+	return p.Provider, p.ProviderRef, nil
+}
+
+//CompleteRefund records the result of paying an approved cash refund, which
+//is done through the provider, or by hand for EFT or after the provider failed
+func CompleteRefund(id string, refundRef string, refundErr error) (*Refund, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	refund, err := getRefund(tx, id, true)
+	if err != nil {
+		return nil, err
+	}
+	if refund.Status != RefundApproved && refund.Status != RefundFailed {
+		return nil, errors.Errorc(http.StatusConflict, "refund is "+refund.Status)
+	}
+	if refundErr != nil {
+		refund.Status = RefundFailed
+		refund.Note = fmt.Sprintf("%.200s", fmt.Sprintf("refund failed: %s", refundErr))
+	} else {
+		var order Order
+		if err := tx.Get(&order,
+			"SELECT `id`,`event_id`,`status`,`total_cents`,`provider` FROM `orders` WHERE `id`=? FOR UPDATE",
+			refund.OrderID,
+		); err != nil {
+			return nil, errors.Wrapf(err, "failed to get order")
+		}
+		refund.RefundRef = &refundRef
+		//paid by hand from the bank when not paid through the provider
+		paidFrom := ProcessorAccount(order.Provider)
+		if refund.Status == RefundFailed {
+			paidFrom = AccountBank
+		}
+		if err := completeRefund(tx, refund, order, paidFrom); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE `refunds` SET `status`=:status,`note`=:note,`refund_ref`=:refund_ref,`completed`=:completed WHERE `id`=:id",
+		refund,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update refund")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit refund")
+	}
+	return refund, nil
+} //CompleteRefund()
+
+type CancelEventRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	Note       string `json:"note,omitempty" doc:"Reason for cancelling, kept on each refund"`
+}
+
+func (req CancelEventRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	return nil
+}
+
+//CancelEvent marks the event cancelled and approves a refund according to
+//the policy for every paid entry that was not refunded yet. Cash refunds are
+//returned to be paid through the provider.
+func CancelEvent(eventID string, req CancelEventRequest) ([]Refund, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if ok, err := isEventOrganiser(tx, eventID, req.ByPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can cancel the event")
+	}
+	now := SqlTime(time.Now())
+	if _, err := tx.Exec("UPDATE `events` SET `cancelled`=? WHERE `id`=? AND `cancelled` IS NULL", now, eventID); err != nil {
+		return nil, errors.Wrapf(err, "failed to cancel event")
+	}
+	policy, err := getEventRefundPolicy(tx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	method := policy.Method
+	if method == RefundChoice {
+		method = RefundCash
+	}
+	var entryIDs []string
+	if err := tx.Select(&entryIDs,
+		"SELECT `id` FROM `entries` WHERE `event_id`=? AND `status`=? AND `id` IN (SELECT `entry_id` FROM `order_lines`) AND `id` NOT IN (SELECT `entry_id` FROM `refunds` WHERE `status` IN (?,?,?)) FOR UPDATE",
+		eventID, EntryStatusConfirmed, RefundRequested, RefundApproved, RefundCompleted,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get entries")
+	}
+	refunds := []Refund{}
+	for _, entryID := range entryIDs {
+		order, paid, err := entryPayment(tx, entryID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "entry %s", entryID)
+		}
+		amount := policy.Calculate(paid, 0, true)
+		refundMethod := method
+		if order.CreditCents > 0 {
+			refundMethod = RefundCredit //paid (partly) with credit, which is not returned in cash
+		}
+		refund := Refund{
+			ID:          uuid.New().String(),
+			EventID:     eventID,
+			OrderID:     order.ID,
+			EntryID:     entryID,
+			PersonID:    req.ByPersonID,
+			Reason:      RefundReasonCancelled,
+			Method:      refundMethod,
+			Amount:      amount,
+			AmountCents: amount.Cents,
+			Status:      RefundRequested,
+			Note:        req.Note,
+			Requested:   now,
+			DecidedBy:   &req.ByPersonID,
+			Decided:     &now,
+		}
+		if err := insertRefund(tx, refund); err != nil {
+			return nil, err
+		}
+		if err := approveRefund(tx, &refund); err != nil {
+			return nil, err
+		}
+		if _, err := tx.NamedExec(
+			"UPDATE `refunds` SET `status`=:status,`completed`=:completed WHERE `id`=:id",
+			refund,
+		); err != nil {
+			return nil, errors.Wrapf(err, "failed to update refund")
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit cancellation")
+	}
+	return refunds, nil
+} //CancelEvent()
+
+//CreditNote records a refund owed to the payer as credit instead of cash,
+//with the balance still owed, which the payer can spend at checkout.
+type CreditNote struct {
+	ID           string  `json:"id" db:"id"`
+	PersonID     string  `json:"person_id" db:"person_id"`
+	RefundID     string  `json:"refund_id" db:"refund_id"`
+	Amount       Amount  `json:"amount" db:"-"`
+	AmountCents  int     `json:"-" db:"amount_cents"`
+	Balance      Amount  `json:"balance" db:"-"`
+	BalanceCents int     `json:"-" db:"balance_cents"`
+	Issued       SqlTime `json:"issued" db:"issued"`
+}
+
+func ListPersonCreditNotes(personID, byPersonID string) ([]CreditNote, error) {
+	if err := AuthorisePerson(personID, byPersonID); err != nil {
+		return nil, err
+	}
+	notes := []CreditNote{}
+	if err := NamedSelect(&notes,
+		"SELECT `id`,`person_id`,`refund_id`,`amount_cents`,`balance_cents`,`issued` FROM `credit_notes` WHERE `person_id`=:person_id ORDER BY `issued`",
+		map[string]interface{}{
+			"person_id": personID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list credit notes")
+	}
+	for i := range notes {
+		notes[i].Amount = Amount{Currency: DefaultCurrency, Cents: notes[i].AmountCents}
+		notes[i].Balance = Amount{Currency: DefaultCurrency, Cents: notes[i].BalanceCents}
+	}
+	return notes, nil
+}
+
+//CreditNoteRedemption is what was paid with a credit note on an order
+type CreditNoteRedemption struct {
+	CreditNoteID string  `json:"credit_note_id" db:"credit_note_id"`
+	OrderID      string  `json:"order_id" db:"order_id"`
+	AmountCents  int     `json:"amount_cents" db:"amount_cents"`
+	Redeemed     SqlTime `json:"redeemed" db:"redeemed"`
+}
+
+//SpendCreditNotes pays up to amount from the balances of the notes in the
+//order given, and returns what is paid with each note
+func SpendCreditNotes(notes []CreditNote, amount Amount) []CreditNoteRedemption {
+	credits := []CreditNoteRedemption{}
+	remaining := amount.Cents
+	for _, n := range notes {
+		if remaining <= 0 {
+			break
+		}
+		if n.BalanceCents <= 0 {
+			continue
+		}
+		cents := n.BalanceCents
+		if cents > remaining {
+			cents = remaining
+		}
+		credits = append(credits, CreditNoteRedemption{CreditNoteID: n.ID, AmountCents: cents})
+		remaining -= cents
+	}
+	return credits
+}
+
+//spendPersonCreditNotes locks the open credit notes of the payer and spends
+//them on the order total, oldest first, setting the credit of the order
+func spendPersonCreditNotes(tx *sqlx.Tx, order *Order) ([]CreditNoteRedemption, error) {
+	notes := []CreditNote{}
+	if err := tx.Select(&notes,
+		"SELECT `id`,`balance_cents` FROM `credit_notes` WHERE `person_id`=? AND `balance_cents`>0 ORDER BY `issued` FOR UPDATE",
+		order.PersonID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get credit notes")
+	}
+	credits := SpendCreditNotes(notes, Amount{Currency: DefaultCurrency, Cents: order.TotalCents})
+	order.CreditCents = 0
+	for _, c := range credits {
+		order.CreditCents += c.AmountCents
+	}
+	order.Credit = Amount{Currency: DefaultCurrency, Cents: order.CreditCents}
+	return credits, nil
+}
+
+//redeemCreditNotes takes the credits of the new order from the balances of
+//the credit notes, moving them from what is owed to the payer to the organiser
+func redeemCreditNotes(tx *sqlx.Tx, order Order, credits []CreditNoteRedemption) error {
+	for _, c := range credits {
+		c.OrderID = order.ID
+		c.Redeemed = order.Created
+		if _, err := tx.Exec(
+			"UPDATE `credit_notes` SET `balance_cents`=`balance_cents`-? WHERE `id`=?",
+			c.AmountCents, c.CreditNoteID,
+		); err != nil {
+			return errors.Wrapf(err, "failed to update credit note")
+		}
+		if _, err := tx.NamedExec(
+			"INSERT INTO `credit_note_redemptions` SET `credit_note_id`=:credit_note_id,`order_id`=:order_id,`amount_cents`=:amount_cents,`redeemed`=:redeemed",
+			c,
+		); err != nil {
+			return errors.Wrapf(err, "failed to redeem credit note")
+		}
+		credit := Amount{Currency: DefaultCurrency, Cents: c.AmountCents}
+		if err := postOrderLedger(tx, order, LedgerCreditNote, c.CreditNoteID, "credit note for order "+order.ID, credit, AccountCreditNotes, AccountOrganiser); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//releaseCreditNotes returns the credit of an expired order to the credit notes
+func releaseCreditNotes(tx *sqlx.Tx, orderID string) error {
+	credits := []CreditNoteRedemption{}
+	if err := tx.Select(&credits,
+		"SELECT `credit_note_id`,`order_id`,`amount_cents`,`redeemed` FROM `credit_note_redemptions` WHERE `order_id`=?",
+		orderID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get credit note redemptions")
+	}
+	if len(credits) == 0 {
+		return nil
+	}
+	var order Order
+	if err := tx.Get(&order,
+		"SELECT `id`,COALESCE(`event_id`,'') AS `event_id`,COALESCE(`organisation_id`,'') AS `organisation_id` FROM `orders` WHERE `id`=?",
+		orderID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get order")
+	}
+	for _, c := range credits {
+		if _, err := tx.Exec(
+			"UPDATE `credit_notes` SET `balance_cents`=`balance_cents`+? WHERE `id`=?",
+			c.AmountCents, c.CreditNoteID,
+		); err != nil {
+			return errors.Wrapf(err, "failed to update credit note")
+		}
+		credit := Amount{Currency: DefaultCurrency, Cents: c.AmountCents}
+		if err := postOrderLedger(tx, order, LedgerCreditNote, c.CreditNoteID, "credit note released by expired order "+orderID, credit, AccountOrganiser, AccountCreditNotes); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM `credit_note_redemptions` WHERE `order_id`=?", orderID); err != nil {
+		return errors.Wrapf(err, "failed to delete credit note redemptions")
+	}
+	return nil
+} //releaseCreditNotes()
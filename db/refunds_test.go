@@ -0,0 +1,92 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestRefundPolicy(t *testing.T) {
+	policy := db.RefundPolicy{
+		Rules: []db.RefundRule{
+			{DaysBefore: 7, Percent: 50},
+			{DaysBefore: 30, Percent: 100},
+		},
+		AdminFee:         db.Amount{Cents: 2500},
+		Method:           db.RefundCash,
+		CancelledPercent: 90,
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("invalid policy: %+v", err)
+	}
+	paid := db.Amount{Currency: db.DefaultCurrency, Cents: 35000}
+	tests := []struct {
+		name       string
+		paid       db.Amount
+		daysBefore int
+		cancelled  bool
+		expected   int
+	}{
+		{name: "early", paid: paid, daysBefore: 60, expected: 35000 - 2500},
+		{name: "on 30 days", paid: paid, daysBefore: 30, expected: 35000 - 2500},
+		{name: "between", paid: paid, daysBefore: 29, expected: 17500 - 2500},
+		{name: "on 7 days", paid: paid, daysBefore: 7, expected: 17500 - 2500},
+		{name: "late", paid: paid, daysBefore: 6, expected: 0},
+		{name: "after event", paid: paid, daysBefore: -1, expected: 0},
+		{name: "fee more than refund", paid: db.Amount{Currency: db.DefaultCurrency, Cents: 4000}, daysBefore: 10, expected: 0},
+		{name: "cancelled", paid: paid, daysBefore: 2, cancelled: true, expected: 31500},
+		{name: "free entry", paid: db.Amount{Currency: db.DefaultCurrency}, daysBefore: 60, expected: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			refund := policy.Calculate(test.paid, test.daysBefore, test.cancelled)
+			if refund.Cents != test.expected {
+				t.Fatalf("refund %d cents instead of %d", refund.Cents, test.expected)
+			}
+		})
+	}
+}
+
+func TestRefundPolicyValidate(t *testing.T) {
+	for name, p := range map[string]db.RefundPolicy{
+		"method":    {Method: "cheque"},
+		"percent":   {Method: db.RefundCash, Rules: []db.RefundRule{{DaysBefore: 1, Percent: 101}}},
+		"duplicate": {Method: db.RefundCash, Rules: []db.RefundRule{{DaysBefore: 1, Percent: 10}, {DaysBefore: 1, Percent: 20}}},
+		"fee":       {Method: db.RefundCredit, AdminFee: db.Amount{Cents: -1}},
+		"cancelled": {Method: db.RefundChoice, CancelledPercent: 120},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Fatalf("invalid %s accepted", name)
+		}
+	}
+}
+
+func TestSpendCreditNotes(t *testing.T) {
+	notes := []db.CreditNote{
+		{ID: "old", BalanceCents: 5000},
+		{ID: "spent", BalanceCents: 0},
+		{ID: "new", BalanceCents: 8000},
+	}
+	rand := func(cents int) db.Amount { return db.Amount{Currency: db.DefaultCurrency, Cents: cents} }
+	tests := []struct {
+		name     string
+		amount   db.Amount
+		expected map[string]int
+	}{
+		{name: "one note", amount: rand(3000), expected: map[string]int{"old": 3000}},
+		{name: "oldest first", amount: rand(9000), expected: map[string]int{"old": 5000, "new": 4000}},
+		{name: "not enough credit", amount: rand(20000), expected: map[string]int{"old": 5000, "new": 8000}},
+		{name: "nothing due", amount: rand(0), expected: map[string]int{}},
+	}
+	for _, test := range tests {
+		credits := db.SpendCreditNotes(notes, test.amount)
+		if len(credits) != len(test.expected) {
+			t.Fatalf("%s: spent %+v, expected %+v", test.name, credits, test.expected)
+		}
+		for _, c := range credits {
+			if c.AmountCents != test.expected[c.CreditNoteID] {
+				t.Fatalf("%s: spent %d from %s, expected %d", test.name, c.AmountCents, c.CreditNoteID, test.expected[c.CreditNoteID])
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"fmt"
+	"html"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/email"
+)
+
+//kinds of reminders, sent once per event and person
+const (
+	ReminderEntriesClosing = "entries_closing"
+	ReminderEvent          = "event"
+)
+
+//reminderRecipient is a person to remind about an event
+type reminderRecipient struct {
+	PersonID  string  `db:"person_id"`
+	FirstName string  `db:"first_name"`
+	LastName  string  `db:"last_name"`
+	Email     string  `db:"email"`
+	Reason    string  `db:"reason"`
+	TeamName  *string `db:"team_name"`
+}
+
+//notRemindedSQL excludes persons p already reminded about the event
+const notRemindedSQL = " AND p.`email` IS NOT NULL AND NOT EXISTS (SELECT 1 FROM `event_reminders` r WHERE r.`kind`=:kind AND r.`event_id`=:event_id AND r.`person_id`=p.`id`)"
+
+//SendEntriesClosingReminders reminds entrants who have not paid and crew
+//members who have not confirmed their places, when entries of the event
+//close within the period
+func SendEntriesClosingReminders(period time.Duration) (int, error) {
+	now := time.Now()
+	var eventIDs []string
+	if err := NamedSelect(&eventIDs,
+		"SELECT `id` FROM `events` WHERE `cancelled` IS NULL AND `entries_close`>:now AND `entries_close`<=:until",
+		map[string]interface{}{
+			"now":   SqlTime(now),
+			"until": SqlTime(now.Add(period)),
+		}); err != nil {
+		return 0, errors.Wrapf(err, "failed to get events closing entries")
+	}
+	nrSent := 0
+	for _, eventID := range eventIDs {
+		event, err := GetEvent(eventID)
+		if err != nil {
+			return nrSent, err
+		}
+		if event.EntriesClose == nil {
+			continue //changed since
+		}
+		var recipients []reminderRecipient
+		if err := NamedSelect(&recipients,
+			"SELECT p.`id` AS `person_id`,p.`first_name`,p.`last_name`,p.`email`,'payment' AS `reason`,n.`team_name`"+
+				" FROM `entries` n JOIN `persons` p ON p.`id`=n.`person_id`"+
+				" WHERE n.`event_id`=:event_id AND n.`status`='"+EntryStatusPending+"'"+notRemindedSQL+
+				" UNION ALL"+
+				" SELECT p.`id` AS `person_id`,p.`first_name`,p.`last_name`,p.`email`,'crew' AS `reason`,n.`team_name`"+
+				" FROM `entry_members` m JOIN `entries` n ON n.`id`=m.`entry_id` JOIN `persons` p ON p.`id`=m.`person_id`"+
+				" WHERE m.`event_id`=:event_id AND m.`status`='"+TeamMemberInvited+"' AND n.`status`<>'"+EntryStatusWithdrawn+"'"+notRemindedSQL,
+			map[string]interface{}{
+				"kind":     ReminderEntriesClosing,
+				"event_id": eventID,
+			}); err != nil {
+			return nrSent, errors.Wrapf(err, "failed to get persons to remind")
+		}
+		closes := time.Time(*event.EntriesClose).Format("Monday 2 January 2006 at 15:04")
+		for _, r := range recipients {
+			msg := email.Message{
+				From:        email.Email{Addr: "no-reply@events.net", Name: "Events"},
+				To:          []email.Email{{Addr: r.Email, Name: r.FirstName + " " + r.LastName}},
+				Subject:     "Entries Closing: " + event.Name,
+				ContentType: "text/html",
+			}
+			msg.Content = "<H1>" + html.EscapeString(event.Name) + "</H1>"
+			msg.Content += "<P>Entries close on " + closes + ".</P>"
+			if r.Reason == "crew" && r.TeamName != nil {
+				msg.Content += "<P>Please confirm your place in the crew " + html.EscapeString(*r.TeamName) + " before then.</P>"
+			} else {
+				msg.Content += "<P>Your entry is not paid yet. Please complete the payment before then to keep your place.</P>"
+			}
+			if sent, err := sendReminder(msg, ReminderEntriesClosing, eventID, r.PersonID); err != nil {
+				return nrSent, err
+			} else if sent {
+				nrSent++
+			}
+		}
+	}
+	return nrSent, nil
+} //SendEntriesClosingReminders()
+
+//SendEventReminders reminds confirmed entrants and crew members of events
+//that start within the period, with the start time and location
+func SendEventReminders(period time.Duration) (int, error) {
+	now := time.Now()
+	until := now.Add(period)
+	//dates are local, so take a day extra on both sides and check the start
+	var eventIDs []string
+	if err := NamedSelect(&eventIDs,
+		"SELECT `id` FROM `events` WHERE `cancelled` IS NULL AND `date`>=:from AND `date`<=:to",
+		map[string]interface{}{
+			"from": now.AddDate(0, 0, -1).Format("2006-01-02"),
+			"to":   until.AddDate(0, 0, 1).Format("2006-01-02"),
+		}); err != nil {
+		return 0, errors.Wrapf(err, "failed to get events to remind")
+	}
+	nrSent := 0
+	for _, eventID := range eventIDs {
+		event, err := GetEvent(eventID)
+		if err != nil {
+			return nrSent, err
+		}
+		start, err := event.Start()
+		if err != nil {
+			return nrSent, err
+		}
+		if !start.After(now) || start.After(until) {
+			continue
+		}
+		var recipients []reminderRecipient
+		if err := NamedSelect(&recipients,
+			"SELECT p.`id` AS `person_id`,p.`first_name`,p.`last_name`,p.`email`,'' AS `reason`,n.`team_name`"+
+				" FROM `entries` n LEFT JOIN `entry_members` m ON m.`entry_id`=n.`id` AND m.`status`='"+TeamMemberConfirmed+"'"+
+				" JOIN `persons` p ON p.`id`=COALESCE(m.`person_id`,n.`person_id`)"+
+				" WHERE n.`event_id`=:event_id AND n.`status`='"+EntryStatusConfirmed+"'"+notRemindedSQL,
+			map[string]interface{}{
+				"kind":     ReminderEvent,
+				"event_id": eventID,
+			}); err != nil {
+			return nrSent, errors.Wrapf(err, "failed to get entrants to remind")
+		}
+		if len(recipients) == 0 {
+			continue
+		}
+		when := start.Format("Monday 2 January 2006")
+		if event.StartTime != nil {
+			when = start.Format("Monday 2 January 2006 at 15:04")
+		}
+		where := ""
+		if event.LocationID != "" {
+			l, err := GetLocation(event.LocationID)
+			if err != nil {
+				return nrSent, err
+			}
+			where = "<P>Location: " + html.EscapeString(l.Name)
+			if address := l.Address(); address != "" {
+				where += ", " + html.EscapeString(address)
+			}
+			where += "</P>"
+			if l.Directions != "" {
+				where += "<P>" + html.EscapeString(l.Directions) + "</P>"
+			}
+		}
+		for _, r := range recipients {
+			msg := email.Message{
+				From:        email.Email{Addr: "no-reply@events.net", Name: "Events"},
+				To:          []email.Email{{Addr: r.Email, Name: r.FirstName + " " + r.LastName}},
+				Subject:     "Event Reminder: " + event.Name,
+				ContentType: "text/html",
+			}
+			msg.Content = "<H1>" + html.EscapeString(event.Name) + "</H1>"
+			msg.Content += fmt.Sprintf("<P>Hi %s, see you on %s.</P>", html.EscapeString(r.FirstName), when)
+			if r.TeamName != nil {
+				msg.Content += "<P>Crew: " + html.EscapeString(*r.TeamName) + "</P>"
+			}
+			msg.Content += where
+			if sent, err := sendReminder(msg, ReminderEvent, eventID, r.PersonID); err != nil {
+				return nrSent, err
+			} else if sent {
+				nrSent++
+			}
+		}
+	}
+	return nrSent, nil
+} //SendEventReminders()
+
+//sendReminder sends the message and records that the person was reminded,
+//or leaves it for the next run when sending failed
+func sendReminder(msg email.Message, kind, eventID, personID string) (bool, error) {
+	if err := email.Send(msg); err != nil {
+		log.Errorf("failed to send %s reminder to %s: %+v", kind, msg.To[0].Addr, err)
+		return false, nil
+	}
+	if _, err := db.Exec(
+		"INSERT IGNORE INTO `event_reminders` SET `kind`=?,`event_id`=?,`person_id`=?,`sent`=?",
+		kind, eventID, personID, SqlTime(time.Now()),
+	); err != nil {
+		return true, errors.Wrapf(err, "failed to mark reminder sent")
+	}
+	return true, nil
+}
+
+//PurgeExpiredTokens removes the temporary passwords (tpw) that expired, so
+//an old activation or reset link cannot be used
+func PurgeExpiredTokens() (int, error) {
+	result, err := db.Exec(
+		"UPDATE `persons` SET `tpw`=NULL,`tpx`=NULL WHERE `tpw` IS NOT NULL AND `tpx`<?",
+		SqlTime(time.Now()),
+	)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to purge expired tokens")
+	}
+	nr, _ := result.RowsAffected()
+	return int(nr), nil
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//EntryResult is the result of an entry. For team entries it is the result of
+//the crew, with the members listed.
+type EntryResult struct {
+	EntryID            string       `json:"entry_id" db:"entry_id"`
+	EventID            string       `json:"event_id" db:"event_id"`
+	Status             string       `json:"status" db:"status"`
+	Elapsed            string       `json:"elapsed,omitempty" db:"-" doc:"h:mm:ss with optional fraction, for finishers"`
+	ElapsedMs          *int64       `json:"-" db:"elapsed_ms"`
+	Position           int          `json:"position,omitempty" db:"-" doc:"Overall position of finishers"`
+	CategoryPosition   int          `json:"category_position,omitempty" db:"-"`
+	Recorded           SqlTime      `json:"recorded" db:"recorded"`
+	RecordedByPersonID string       `json:"-" db:"recorded_by_person_id"`
+	Bib                *string      `json:"bib,omitempty" db:"bib"`
+	PersonID           string       `json:"person_id" db:"person_id" doc:"Entrant or captain"`
+	FirstName          string       `json:"first_name" db:"first_name"`
+	LastName           string       `json:"last_name" db:"last_name"`
+	TeamName           *string      `json:"team_name,omitempty" db:"team_name"`
+	CategoryID         *string      `json:"category_id,omitempty" db:"category_id"`
+	CategoryName       *string      `json:"category_name,omitempty" db:"category_name"`
+	Members            []TeamMember `json:"members,omitempty" db:"-"`
+}
+
+const (
+	ResultFinished     = "finished"
+	ResultDidNotFinish = "dnf"
+	ResultDidNotStart  = "dns"
+	ResultDisqualified = "dsq"
+)
+
+//resultOrder lists finishers first, then the others in this order
+var resultOrder = map[string]int{
+	ResultFinished:     0,
+	ResultDidNotFinish: 1,
+	ResultDisqualified: 2,
+	ResultDidNotStart:  3,
+}
+
+//ParseElapsed parses a time like "1:02:03", "45:12" or "1:02:03.45"
+func ParseElapsed(s string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, errors.Errorf("invalid time \"%s\", expecting h:mm:ss or mm:ss", s)
+	}
+	last := parts[len(parts)-1]
+	seconds, err := strconv.ParseFloat(last, 64)
+	if err != nil || strings.Trim(last, "0123456789.") != "" || seconds >= 60 {
+		return 0, errors.Errorf("invalid seconds in \"%s\"", s)
+	}
+	d := time.Duration(seconds*1000+0.5) * time.Millisecond
+	for i, unit := range []time.Duration{time.Minute, time.Hour} {
+		p := len(parts) - 2 - i
+		if p < 0 {
+			break
+		}
+		n, err := strconv.Atoi(parts[p])
+		if err != nil || n < 0 || (unit == time.Minute && len(parts) == 3 && n >= 60) {
+			return 0, errors.Errorf("invalid time \"%s\"", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+//FormatElapsed formats a time as h:mm:ss with a fraction only when needed
+func FormatElapsed(d time.Duration) string {
+	ms := d.Milliseconds()
+	s := fmt.Sprintf("%d:%02d:%02d", ms/3600000, ms/60000%60, ms/1000%60)
+	if ms%1000 != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%03d", ms%1000), "0")
+	}
+	return s
+}
+
+type SetEntryResultRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	Status     string `json:"status" doc:"finished|dnf|dns|dsq"`
+	Elapsed    string `json:"elapsed,omitempty" doc:"Time of finishers, e.g. 1:02:03.4"`
+	elapsed    time.Duration
+}
+
+func (req *SetEntryResultRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if _, ok := resultOrder[req.Status]; !ok {
+		return errors.Errorf("invalid status \"%s\", expecting finished|dnf|dns|dsq", req.Status)
+	}
+	if req.Status != ResultFinished {
+		if req.Elapsed != "" {
+			return errors.Errorf("only finishers have a time")
+		}
+		return nil
+	}
+	var err error
+	if req.elapsed, err = ParseElapsed(req.Elapsed); err != nil {
+		return err
+	}
+	if req.elapsed <= 0 {
+		return errors.Errorf("missing time")
+	}
+	return nil
+}
+
+//SetEntryResult records or corrects the result of a confirmed entry, which is
+//the result of the whole crew for a team entry
+func SetEntryResult(entryID string, req SetEntryResultRequest) (*EntryResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	var entry Entry
+	if err := db.Get(&entry, "SELECT `id`,`event_id`,`person_id`,`status` FROM `entries` WHERE `id`=?", entryID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown entry")
+		}
+		return nil, errors.Wrapf(err, "failed to get entry")
+	}
+	if ok, err := IsEventOrganiser(entry.EventID, req.ByPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can record results")
+	}
+	if entry.Status != EntryStatusConfirmed {
+		return nil, errors.Errorc(http.StatusBadRequest, "entry is "+entry.Status)
+	}
+	r := EntryResult{
+		EntryID:            entry.ID,
+		EventID:            entry.EventID,
+		Status:             req.Status,
+		Recorded:           SqlTime(time.Now()),
+		RecordedByPersonID: req.ByPersonID,
+	}
+	if req.Status == ResultFinished {
+		ms := req.elapsed.Milliseconds()
+		r.ElapsedMs = &ms
+		r.Elapsed = FormatElapsed(req.elapsed)
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO `entry_results` SET `entry_id`=:entry_id,`event_id`=:event_id,`status`=:status,`elapsed_ms`=:elapsed_ms,`recorded`=:recorded,`recorded_by_person_id`=:recorded_by_person_id"+
+			" ON DUPLICATE KEY UPDATE `status`=:status,`elapsed_ms`=:elapsed_ms,`recorded`=:recorded,`recorded_by_person_id`=:recorded_by_person_id",
+		r,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to record result")
+	}
+	return &r, nil
+} //SetEntryResult()
+
+//ListEventResults lists the results of the event ranked overall and in each
+//category, with the crews of team entries
+func ListEventResults(eventID string) ([]EntryResult, error) {
+	results := []EntryResult{}
+	if err := db.Select(&results,
+		"SELECT r.`entry_id`,r.`event_id`,r.`status`,r.`elapsed_ms`,r.`recorded`,r.`recorded_by_person_id`,n.`bib`,n.`person_id`,p.`first_name`,p.`last_name`,n.`team_name`,n.`category_id`,c.`name` AS `category_name`"+
+			" FROM `entry_results` r JOIN `entries` n ON n.`id`=r.`entry_id` JOIN `persons` p ON p.`id`=n.`person_id`"+
+			" LEFT JOIN `event_categories` c ON c.`id`=n.`category_id`"+
+			" WHERE r.`event_id`=?",
+		eventID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to list results")
+	}
+	var members []TeamMember
+	if err := db.Select(&members,
+		teamMemberSelectSQL+" WHERE m.`event_id`=? AND m.`entry_id` IN (SELECT `entry_id` FROM `entry_results`) ORDER BY m.`position`",
+		eventID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get crews")
+	}
+	crews := map[string][]TeamMember{}
+	for _, m := range members {
+		crews[m.EntryID] = append(crews[m.EntryID], m)
+	}
+	RankResults(results)
+	for i := range results {
+		results[i].Members = crews[results[i].EntryID]
+	}
+	return results, nil
+} //ListEventResults()
+
+//RankResults sorts finishers by time followed by the others, and sets the
+//positions of the finishers overall and in their categories. Finishers with
+//the same time share a position.
+func RankResults(results []EntryResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Status != b.Status {
+			return resultOrder[a.Status] < resultOrder[b.Status]
+		}
+		if a.ElapsedMs != nil && b.ElapsedMs != nil && *a.ElapsedMs != *b.ElapsedMs {
+			return *a.ElapsedMs < *b.ElapsedMs
+		}
+		return a.LastName+a.FirstName < b.LastName+b.FirstName
+	})
+	overall := ranking{}
+	categories := map[string]*ranking{}
+	for i := range results {
+		r := &results[i]
+		if r.Status != ResultFinished || r.ElapsedMs == nil {
+			continue
+		}
+		r.Elapsed = FormatElapsed(time.Duration(*r.ElapsedMs) * time.Millisecond)
+		r.Position = overall.next(*r.ElapsedMs)
+		if r.CategoryID != nil {
+			if categories[*r.CategoryID] == nil {
+				categories[*r.CategoryID] = &ranking{}
+			}
+			r.CategoryPosition = categories[*r.CategoryID].next(*r.ElapsedMs)
+		}
+	}
+}
+
+//ranking gives positions to times in increasing order
+type ranking struct {
+	count    int
+	position int
+	last     int64
+}
+
+func (r *ranking) next(ms int64) int {
+	r.count++
+	if r.count == 1 || ms != r.last {
+		r.position = r.count
+	}
+	r.last = ms
+	return r.position
+}
@@ -2,52 +2,74 @@ package db
 
 import (
 	"database/sql/driver"
-	"fmt"
 	"strings"
 	"time"
 
 	"github.com/go-msvc/errors"
 )
 
+//SqlTime is an instant stored in DATETIME columns as UTC, because DATETIME
+//has no zone. In JSON it is RFC 3339 with the offset of its location, e.g.
+//the time zone of an event.
 type SqlTime time.Time
 
+const sqlTimeLayout = "2006-01-02 15:04:05"
+
 func (t *SqlTime) Scan(value interface{}) error {
-	if byteArray, ok := value.([]uint8); ok {
-		strValue := string(byteArray)
-		timeValue, err := time.Parse("2006-01-02 15:04:05", strValue)
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []uint8:
+		return t.Scan(string(v))
+	case string:
+		timeValue, err := time.ParseInLocation(sqlTimeLayout, v, time.UTC)
 		if err != nil {
 			return err
 		}
 		*t = SqlTime(timeValue)
 		return nil
-	}
-	if value == nil {
+	case time.Time:
+		*t = SqlTime(v.UTC())
 		return nil
 	}
-	return errors.Errorf("%T is not []uint8", value)
+	return errors.Errorf("cannot scan %T into time", value)
 }
 
-// func (t SqlTime) Value() interface{} {
-// 	return []uint8(time.Time(t).Format("2006-01-02 15:04:05"))
-// }
-
 func (t SqlTime) Value() (driver.Value, error) {
-	return time.Time(t).Format("2006-01-02 15:04:05"), nil
+	return time.Time(t).UTC().Format(sqlTimeLayout), nil
+}
+
+//In returns the same instant in the location, e.g. to show the offset of an
+//event's time zone
+func (t SqlTime) In(loc *time.Location) SqlTime {
+	return SqlTime(time.Time(t).In(loc))
 }
 
 func (t SqlTime) String() string {
-	return time.Time(t).Format("2006-01-02 15:04:05")
+	return time.Time(t).Format(time.RFC3339)
 }
 
+//UnmarshalJSON accepts RFC 3339, or "2006-01-02 15:04:05" without an offset
+//as sent before times had zones, which is taken as the local time of the
+//server as it was stored then
 func (t *SqlTime) UnmarshalJSON(v []byte) error {
 	s := string(v)
 	if len(s) < 2 || !strings.HasPrefix(s, "\"") || !strings.HasSuffix(s, "\"") {
-		return errors.Errorf("invalid time string %s (expects quoted \"2006-01-02 15:04:05\")", s)
+		return errors.Errorf("invalid time string %s (expects quoted RFC 3339)", s)
+	}
+	s = s[1 : len(s)-1]
+	if timeValue, err := time.Parse(time.RFC3339, s); err == nil {
+		*t = SqlTime(timeValue)
+		return nil
+	}
+	timeValue, err := time.ParseInLocation(sqlTimeLayout, s, time.Local)
+	if err != nil {
+		return errors.Errorf("invalid time \"%s\" (expects RFC 3339, e.g. \"2006-01-02T15:04:05+02:00\")", s)
 	}
-	return t.Scan(v[1 : len(v)-1])
+	*t = SqlTime(timeValue)
+	return nil
 }
 
 func (t SqlTime) MarshalJSON() ([]byte, error) {
-	s := fmt.Sprintf("\"%s\"", time.Time(t).Format("2006-01-02 15:04:05"))
-	return []byte(s), nil
+	return []byte("\"" + time.Time(t).Format(time.RFC3339) + "\""), nil
 }
@@ -0,0 +1,52 @@
+package db_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestSqlTime(t *testing.T) {
+	johannesburg, _ := time.LoadLocation("Africa/Johannesburg")
+	local := time.Date(2024, 6, 24, 7, 30, 0, 0, johannesburg)
+
+	//stored in UTC whatever the location
+	v, err := db.SqlTime(local).Value()
+	if err != nil || v != "2024-06-24 05:30:00" {
+		t.Fatalf("Value()=%v,%v, expected UTC", v, err)
+	}
+	var scanned db.SqlTime
+	if err := scanned.Scan([]byte("2024-06-24 05:30:00")); err != nil {
+		t.Fatalf("scan failed: %+v", err)
+	}
+	if !time.Time(scanned).Equal(local) {
+		t.Fatalf("scanned %v, expected %v", time.Time(scanned), local)
+	}
+
+	//JSON in the offset of the location
+	jsonValue, _ := json.Marshal(db.SqlTime(local))
+	if string(jsonValue) != `"2024-06-24T07:30:00+02:00"` {
+		t.Errorf("JSON %s, expected offset +02:00", jsonValue)
+	}
+	jsonValue, _ = json.Marshal(scanned)
+	if string(jsonValue) != `"2024-06-24T05:30:00Z"` {
+		t.Errorf("JSON %s, expected UTC", jsonValue)
+	}
+	var parsed db.SqlTime
+	if err := json.Unmarshal([]byte(`"2024-06-24T07:30:00+02:00"`), &parsed); err != nil || !time.Time(parsed).Equal(local) {
+		t.Errorf("parsed %v,%+v, expected %v", time.Time(parsed), err, local)
+	}
+
+	//legacy times without offset are local time of the server
+	if err := json.Unmarshal([]byte(`"2024-06-24 07:30:00"`), &parsed); err != nil {
+		t.Fatalf("legacy time failed: %+v", err)
+	}
+	if exp := time.Date(2024, 6, 24, 7, 30, 0, 0, time.Local); !time.Time(parsed).Equal(exp) {
+		t.Errorf("legacy parsed %v, expected %v", time.Time(parsed), exp)
+	}
+	if err := json.Unmarshal([]byte(`"24 June 2024"`), &parsed); err == nil {
+		t.Errorf("invalid time parsed")
+	}
+}
@@ -0,0 +1,298 @@
+package db
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//EventStats is the dashboard of an event and its sub-events for organisers.
+//Series have labels and values of the same length, ready to chart.
+type EventStats struct {
+	EventID         string       `json:"event_id"`
+	Entries         int          `json:"entries" doc:"Entries that are not withdrawn"`
+	Confirmed       int          `json:"confirmed"`
+	Pending         int          `json:"pending"`
+	Withdrawn       int          `json:"withdrawn"`
+	CheckedIn       int          `json:"checked_in" doc:"Confirmed entries that arrived on the day"`
+	Waitlist        int          `json:"waitlist" doc:"People waiting for a place"`
+	Participants    int          `json:"participants" doc:"Entrants and crew members of entries that are not withdrawn"`
+	EntriesPerDay   StatsSeries  `json:"entries_per_day" doc:"New entries per day in the time zone of the event"`
+	EntriesOverTime StatsSeries  `json:"entries_over_time" doc:"Total entries at the end of each day"`
+	ByEvent         StatsSeries  `json:"by_event" doc:"Entries in the event and each sub-event"`
+	ByCategory      StatsSeries  `json:"by_category"`
+	ByGender        StatsSeries  `json:"by_gender" doc:"Participants by gender"`
+	ByAge           StatsSeries  `json:"by_age" doc:"Participants by age on the day in groups of 10 years"`
+	Revenue         RevenueStats `json:"revenue"`
+	RevenuePerDay   StatsSeries  `json:"revenue_per_day" doc:"Payments collected per day in major units"`
+	Generated       SqlTime      `json:"generated"`
+}
+
+//StatsSeries is a named series of values with a label for each
+type StatsSeries struct {
+	Name   string    `json:"name"`
+	Labels []string  `json:"labels"`
+	Values []float64 `json:"values"`
+}
+
+func newStatsSeries(name string) StatsSeries {
+	return StatsSeries{Name: name, Labels: []string{}, Values: []float64{}}
+}
+
+func (s *StatsSeries) add(label string, value float64) {
+	s.Labels = append(s.Labels, label)
+	s.Values = append(s.Values, value)
+}
+
+//RevenueStats is the money of the orders of the event
+type RevenueStats struct {
+	Collected   Amount `json:"collected" doc:"Paid orders, before refunds"`
+	Refunded    Amount `json:"refunded" doc:"Completed refunds"`
+	Net         Amount `json:"net" doc:"Collected less refunded"`
+	Outstanding Amount `json:"outstanding" doc:"Pending orders that have not yet expired"`
+}
+
+//statsEventsSQL selects the event and its sub-events as e
+const statsEventsSQL = " (e.`id`=:event_id OR e.`parent_event_id`=:event_id)"
+
+//GetEventStats counts the entries and money of the event with its
+//sub-events using SQL aggregates, so large events are not loaded. Days are
+//counted in the time zone of the event.
+func GetEventStats(eventID, byPersonID string) (*EventStats, error) {
+	if err := AuthoriseEventOrganiser(eventID, byPersonID); err != nil {
+		return nil, err
+	}
+	loc, err := eventTimeZone(db, eventID)
+	if err != nil {
+		return nil, err
+	}
+	stats := EventStats{
+		EventID:         eventID,
+		EntriesPerDay:   newStatsSeries("entries per day"),
+		EntriesOverTime: newStatsSeries("entries"),
+		ByEvent:         newStatsSeries("entries by event"),
+		ByCategory:      newStatsSeries("entries by category"),
+		ByGender:        newStatsSeries("participants by gender"),
+		ByAge:           newStatsSeries("participants by age"),
+		RevenuePerDay:   newStatsSeries("revenue per day"),
+		Generated:       SqlTime(time.Now().In(loc)),
+	}
+	arg := map[string]interface{}{"event_id": eventID}
+
+	var statuses []statsCount
+	if err := NamedSelect(&statuses,
+		"SELECT n.`status` AS `label`,COUNT(*) AS `count` FROM `entries` n JOIN `events` e ON e.`id`=n.`event_id`"+
+			" WHERE"+statsEventsSQL+" GROUP BY n.`status`",
+		arg,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to count entries")
+	}
+	for _, s := range statuses {
+		switch s.Label {
+		case EntryStatusConfirmed:
+			stats.Confirmed = s.Count
+		case EntryStatusPending:
+			stats.Pending = s.Count
+		case EntryStatusWithdrawn:
+			stats.Withdrawn = s.Count
+		}
+	}
+	stats.Entries = stats.Confirmed + stats.Pending
+
+	if err := NamedGet(&stats.CheckedIn,
+		"SELECT COUNT(*) FROM `entries` n JOIN `events` e ON e.`id`=n.`event_id`"+
+			" WHERE"+statsEventsSQL+" AND n.`status`='"+EntryStatusConfirmed+"' AND n.`checked_in` IS NOT NULL",
+		arg,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to count check-ins")
+	}
+	if err := NamedGet(&stats.Waitlist,
+		"SELECT COUNT(*) FROM `event_waitlist` w JOIN `events` e ON e.`id`=w.`event_id` WHERE"+statsEventsSQL,
+		arg,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to count waitlist")
+	}
+
+	//entries are counted per hour in UTC, then per day in the event's zone
+	var hours []HourCount
+	if err := NamedSelect(&hours,
+		"SELECT DATE_FORMAT(n.`created`,'%Y-%m-%d %H') AS `hour`,COUNT(*) AS `count` FROM `entries` n JOIN `events` e ON e.`id`=n.`event_id`"+
+			" WHERE"+statsEventsSQL+" AND n.`status`<>'"+EntryStatusWithdrawn+"' GROUP BY `hour` ORDER BY `hour`",
+		arg,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to count entries per day")
+	}
+	perDay, err := DailyCounts(hours, loc)
+	if err != nil {
+		return nil, err
+	}
+	total := 0.0
+	for _, d := range perDay {
+		stats.EntriesPerDay.add(d.Day, float64(d.Count))
+		total += float64(d.Count)
+		stats.EntriesOverTime.add(d.Day, total)
+	}
+
+	var events []statsCount
+	if err := NamedSelect(&events,
+		"SELECT e.`name` AS `label`,COUNT(n.`id`) AS `count` FROM `events` e"+
+			" LEFT JOIN `entries` n ON n.`event_id`=e.`id` AND n.`status`<>'"+EntryStatusWithdrawn+"'"+
+			" WHERE"+statsEventsSQL+" GROUP BY e.`id`,e.`name` ORDER BY e.`id`<>:event_id,e.`date`,e.`name`",
+		arg,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to count entries by event")
+	}
+	for _, c := range events {
+		stats.ByEvent.add(c.Label, float64(c.Count))
+	}
+
+	var categories []statsCount
+	if err := NamedSelect(&categories,
+		"SELECT COALESCE(c.`name`,'') AS `label`,COUNT(*) AS `count` FROM `entries` n JOIN `events` e ON e.`id`=n.`event_id`"+
+			" LEFT JOIN `event_categories` c ON c.`id`=n.`category_id`"+
+			" WHERE"+statsEventsSQL+" AND n.`status`<>'"+EntryStatusWithdrawn+"' GROUP BY n.`category_id`,c.`name` ORDER BY c.`name`",
+		arg,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to count entries by category")
+	}
+	for _, c := range categories {
+		if c.Label == "" {
+			c.Label = "none"
+		}
+		stats.ByCategory.add(c.Label, float64(c.Count))
+	}
+
+	//participants are the crew of team entries, else the entrant
+	var participants []struct {
+		Gender  string `db:"gender"`
+		AgeBand int    `db:"age_band"`
+		Count   int    `db:"count"`
+	}
+	if err := NamedSelect(&participants,
+		"SELECT p.`gender`,FLOOR(TIMESTAMPDIFF(YEAR,p.`dob`,e.`date`)/10) AS `age_band`,COUNT(*) AS `count` FROM `entries` n JOIN `events` e ON e.`id`=n.`event_id`"+
+			" LEFT JOIN `entry_members` m ON m.`entry_id`=n.`id` AND m.`status`<>'"+TeamMemberDeclined+"'"+
+			" JOIN `persons` p ON p.`id`=COALESCE(m.`person_id`,n.`person_id`)"+
+			" WHERE"+statsEventsSQL+" AND n.`status`<>'"+EntryStatusWithdrawn+"' GROUP BY p.`gender`,`age_band`",
+		arg,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to count participants")
+	}
+	genders := map[string]int{}
+	ages := map[int]int{}
+	minBand, maxBand := -1, -1
+	for _, p := range participants {
+		stats.Participants += p.Count
+		genders[p.Gender] += p.Count
+		ages[p.AgeBand] += p.Count
+		if minBand < 0 || p.AgeBand < minBand {
+			minBand = p.AgeBand
+		}
+		if p.AgeBand > maxBand {
+			maxBand = p.AgeBand
+		}
+	}
+	for _, g := range []string{"M", "F"} {
+		stats.ByGender.add(g, float64(genders[g]))
+		delete(genders, g)
+	}
+	if len(genders) > 0 {
+		other := 0
+		for _, count := range genders {
+			other += count
+		}
+		stats.ByGender.add("other", float64(other))
+	}
+	for band := minBand; band >= 0 && band <= maxBand; band++ {
+		stats.ByAge.add(strconv.Itoa(band*10)+"-"+strconv.Itoa(band*10+9), float64(ages[band]))
+	}
+
+	if err := stats.getRevenue(arg, loc); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+} //GetEventStats()
+
+func (stats *EventStats) getRevenue(arg map[string]interface{}, loc *time.Location) error {
+	var revenue struct {
+		CollectedCents   int `db:"collected_cents"`
+		OutstandingCents int `db:"outstanding_cents"`
+		RefundedCents    int `db:"refunded_cents"`
+	}
+	if err := NamedGet(&revenue,
+		"SELECT"+
+			" (SELECT COALESCE(SUM(o.`total_cents`),0) FROM `orders` o JOIN `events` e ON e.`id`=o.`event_id` WHERE"+statsEventsSQL+" AND o.`status` IN ('"+OrderPaid+"','"+OrderRefunded+"')) AS `collected_cents`,"+
+			" (SELECT COALESCE(SUM(o.`total_cents`),0) FROM `orders` o JOIN `events` e ON e.`id`=o.`event_id` WHERE"+statsEventsSQL+" AND o.`status`='"+OrderPending+"' AND o.`expires`>UTC_TIMESTAMP()) AS `outstanding_cents`,"+
+			" (SELECT COALESCE(SUM(r.`amount_cents`),0) FROM `refunds` r JOIN `events` e ON e.`id`=r.`event_id` WHERE"+statsEventsSQL+" AND r.`status`='"+RefundCompleted+"') AS `refunded_cents`",
+		arg,
+	); err != nil {
+		return errors.Wrapf(err, "failed to sum revenue")
+	}
+	stats.Revenue = RevenueStats{
+		Collected:   Amount{Currency: DefaultCurrency, Cents: revenue.CollectedCents},
+		Refunded:    Amount{Currency: DefaultCurrency, Cents: revenue.RefundedCents},
+		Net:         Amount{Currency: DefaultCurrency, Cents: revenue.CollectedCents - revenue.RefundedCents},
+		Outstanding: Amount{Currency: DefaultCurrency, Cents: revenue.OutstandingCents},
+	}
+
+	var hours []HourCount
+	if err := NamedSelect(&hours,
+		"SELECT DATE_FORMAT(o.`paid`,'%Y-%m-%d %H') AS `hour`,SUM(o.`total_cents`) AS `count` FROM `orders` o JOIN `events` e ON e.`id`=o.`event_id`"+
+			" WHERE"+statsEventsSQL+" AND o.`status` IN ('"+OrderPaid+"','"+OrderRefunded+"') AND o.`paid` IS NOT NULL GROUP BY `hour` ORDER BY `hour`",
+		arg,
+	); err != nil {
+		return errors.Wrapf(err, "failed to sum revenue per day")
+	}
+	perDay, err := DailyCounts(hours, loc)
+	if err != nil {
+		return err
+	}
+	for _, d := range perDay {
+		stats.RevenuePerDay.add(d.Day, Amount{Currency: DefaultCurrency, Cents: d.Count}.Number())
+	}
+	return nil
+} //EventStats.getRevenue()
+
+//statsCount is a count by label
+type statsCount struct {
+	Label string `db:"label"`
+	Count int    `db:"count"`
+}
+
+//HourCount is a count, or sum of cents, in an hour "2006-01-02 15" UTC
+type HourCount struct {
+	Hour  string `db:"hour"`
+	Count int    `db:"count"`
+}
+
+//DayCount is a count, or sum of cents, on a day "2006-01-02"
+type DayCount struct {
+	Day   string
+	Count int
+}
+
+//DailyCounts adds up the hours, which must be in order, into days in the
+//location, including the days without any in between
+func DailyCounts(hours []HourCount, loc *time.Location) ([]DayCount, error) {
+	days := []DayCount{}
+	for _, h := range hours {
+		t, err := time.ParseInLocation("2006-01-02 15", h.Hour, time.UTC)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid hour \"%s\"", h.Hour)
+		}
+		day := t.In(loc).Format("2006-01-02")
+		for len(days) > 0 {
+			last, _ := time.Parse("2006-01-02", days[len(days)-1].Day)
+			next := last.AddDate(0, 0, 1).Format("2006-01-02")
+			if next > day {
+				break
+			}
+			days = append(days, DayCount{Day: next})
+		}
+		if len(days) == 0 {
+			days = append(days, DayCount{Day: day})
+		}
+		days[len(days)-1].Count += h.Count
+	}
+	return days, nil
+} //DailyCounts()
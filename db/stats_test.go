@@ -0,0 +1,39 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestDailyCounts(t *testing.T) {
+	loc, _ := time.LoadLocation("Africa/Johannesburg")
+	days, err := db.DailyCounts([]db.HourCount{
+		{Hour: "2022-05-01 08", Count: 2},
+		{Hour: "2022-05-01 22", Count: 1}, //00:00 on 2 May in Johannesburg
+		{Hour: "2022-05-02 10", Count: 3},
+		{Hour: "2022-05-05 12", Count: 4},
+	}, loc)
+	if err != nil {
+		t.Fatalf("failed: %+v", err)
+	}
+	expected := []db.DayCount{
+		{Day: "2022-05-01", Count: 2},
+		{Day: "2022-05-02", Count: 4},
+		{Day: "2022-05-03"},
+		{Day: "2022-05-04"},
+		{Day: "2022-05-05", Count: 4},
+	}
+	if len(days) != len(expected) {
+		t.Fatalf("got %+v instead of %+v", days, expected)
+	}
+	for i := range days {
+		if days[i] != expected[i] {
+			t.Fatalf("got %+v instead of %+v", days, expected)
+		}
+	}
+	if _, err := db.DailyCounts([]db.HourCount{{Hour: "2022-05-01"}}, loc); err == nil {
+		t.Fatalf("accepted invalid hour")
+	}
+}
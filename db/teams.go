@@ -0,0 +1,520 @@
+package db
+
+import (
+	"database/sql"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jansemmelink/events/email"
+	"github.com/jmoiron/sqlx"
+)
+
+//TeamMember is a person in the crew of a team entry, e.g. a paddler in a K2
+//or a runner in a relay. Members other than the captain confirm their place.
+type TeamMember struct {
+	EntryID   string   `json:"-" db:"entry_id"`
+	EventID   string   `json:"-" db:"event_id"`
+	PersonID  string   `json:"person_id" db:"person_id"`
+	FirstName string   `json:"first_name" db:"first_name"`
+	LastName  string   `json:"last_name" db:"last_name"`
+	Position  int      `json:"position" db:"position" doc:"Seat or leg, 1 is the captain"`
+	Captain   bool     `json:"captain,omitempty" db:"captain"`
+	Status    string   `json:"status" db:"status"`
+	Responded *SqlTime `json:"responded,omitempty" db:"responded"`
+}
+
+const (
+	TeamMemberInvited   = "invited"
+	TeamMemberConfirmed = "confirmed"
+	TeamMemberDeclined  = "declined"
+	TeamMemberWithdrawn = "withdrawn" //the entry was withdrawn
+)
+
+//crew is the captain (first) and other members of a new entry, or just the
+//entrant for an individual entry
+type crew struct {
+	persons []crewPerson
+}
+
+type crewPerson struct {
+	ID        string `db:"id"`
+	FirstName string `db:"first_name"`
+	LastName  string `db:"last_name"`
+	Gender    string `db:"gender"`
+	Dob       string `db:"dob"`
+	age       int
+}
+
+//newCrew looks up the persons with their ages on the event date and checks
+//that none of them entered the event already
+func newCrew(q sqlx.Queryer, eventID string, personIDs []string) (*crew, error) {
+	c, err := getCrew(q, eventID, personIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotEntered(q, eventID, c.persons); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//getCrew looks up the persons with their ages on the event date
+func getCrew(q sqlx.Queryer, eventID string, personIDs []string) (*crew, error) {
+	var date string
+	if err := sqlx.Get(q, &date, "SELECT `date` FROM `events` WHERE `id`=?", eventID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown event")
+		}
+		return nil, errors.Wrapf(err, "failed to get event date")
+	}
+	day, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid event date \"%s\"", date)
+	}
+	query, args, err := sqlx.In(
+		"SELECT `id`,`first_name`,`last_name`,`gender`,`dob` FROM `persons` WHERE `id` IN (?)",
+		personIDs,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to prepare query")
+	}
+	var persons []crewPerson
+	if err := sqlx.Select(q, &persons, db.Rebind(query), args...); err != nil {
+		return nil, errors.Wrapf(err, "failed to get persons")
+	}
+	byID := map[string]crewPerson{}
+	for _, p := range persons {
+		if p.age, err = AgeOn(p.Dob, day); err != nil {
+			return nil, errors.Wrapf(err, "person %s", p.ID)
+		}
+		byID[p.ID] = p
+	}
+	c := crew{}
+	for _, id := range personIDs {
+		p, ok := byID[id]
+		if !ok {
+			return nil, errors.Errorc(http.StatusBadRequest, "unknown person "+id+", every member must register first")
+		}
+		c.persons = append(c.persons, p)
+	}
+	return &c, nil
+} //getCrew()
+
+//checkNotEntered fails when one of the persons already entered the event on
+//their own or in a crew. Withdrawn entries and declined places do not count,
+//so those persons can enter again.
+func checkNotEntered(q sqlx.Queryer, eventID string, persons []crewPerson) error {
+	personIDs := make([]string, len(persons))
+	byID := map[string]crewPerson{}
+	for i, p := range persons {
+		personIDs[i] = p.ID
+		byID[p.ID] = p
+	}
+	query, args, err := sqlx.In(
+		"SELECT `person_id` FROM `entries` WHERE `event_id`=? AND `person_id` IN (?) AND `status`<>'"+EntryStatusWithdrawn+"'"+
+			" UNION SELECT `person_id` FROM `entry_members` WHERE `event_id`=? AND `person_id` IN (?) AND `status` NOT IN ('"+TeamMemberDeclined+"','"+TeamMemberWithdrawn+"')",
+		eventID, personIDs, eventID, personIDs,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to prepare query")
+	}
+	var entered []string
+	if err := sqlx.Select(q, &entered, db.Rebind(query), args...); err != nil {
+		return errors.Wrapf(err, "failed to check entries")
+	}
+	if len(entered) > 0 {
+		p := byID[entered[0]]
+		return errors.Errorc(http.StatusConflict, p.FirstName+" "+p.LastName+" already entered")
+	}
+	return nil
+} //checkNotEntered()
+
+//category checks that the crew fits the selected category, or derives the
+//category when only one fits
+func (c crew) category(categories []EventCategory, categoryID string) (*string, error) {
+	genders := make([]string, len(c.persons))
+	ages := make([]int, len(c.persons))
+	for i, p := range c.persons {
+		genders[i], ages[i] = p.Gender, p.age
+	}
+	if categoryID != "" {
+		for _, cat := range categories {
+			if cat.ID == categoryID {
+				if !cat.Accepts(genders, ages) {
+					return nil, errors.Errorc(http.StatusBadRequest, "entrants do not fit category "+cat.Name)
+				}
+				return &cat.ID, nil
+			}
+		}
+		return nil, errors.Errorc(http.StatusBadRequest, "unknown category_id")
+	}
+	matches := MatchingCategories(categories, genders, ages)
+	switch len(matches) {
+	case 0:
+		return nil, errors.Errorc(http.StatusBadRequest, "no category for these entrants")
+	case 1:
+		return &matches[0].ID, nil
+	}
+	names := make([]string, len(matches))
+	for i, m := range matches {
+		names[i] = m.Name
+	}
+	return nil, errors.Errorc(http.StatusBadRequest, "missing category_id, choose one of "+strings.Join(names, ", "))
+} //crew.category()
+
+//team makes the entry a team entry of the crew, named after the surnames of
+//the crew unless named
+func (c crew) team(entry *Entry, name string) {
+	now := SqlTime(time.Now())
+	name = strings.TrimSpace(name)
+	surnames := make([]string, len(c.persons))
+	members := make([]TeamMember, len(c.persons))
+	for i, p := range c.persons {
+		surnames[i] = p.LastName
+		members[i] = TeamMember{
+			EntryID:   entry.ID,
+			EventID:   entry.EventID,
+			PersonID:  p.ID,
+			FirstName: p.FirstName,
+			LastName:  p.LastName,
+			Position:  i + 1,
+			Status:    TeamMemberInvited,
+		}
+	}
+	members[0].Captain = true
+	members[0].Status = TeamMemberConfirmed
+	members[0].Responded = &now
+	if name == "" {
+		name = strings.Join(surnames, "/")
+	}
+	entry.TeamName = &name
+	entry.Members = members
+}
+
+//notifyCrew invites the members of a new team entry to confirm their places
+func notifyCrew(entry Entry) {
+	if len(entry.Members) == 0 {
+		return
+	}
+	var eventName string
+	if err := db.Get(&eventName, "SELECT `name` FROM `events` WHERE `id`=?", entry.EventID); err != nil {
+		log.Errorf("failed to get event %s: %+v", entry.EventID, err)
+		return
+	}
+	for _, m := range entry.Members[1:] {
+		inviteCrewMember(eventName, *entry.TeamName, entry.Members[0], m)
+	}
+} //notifyCrew()
+
+//inviteCrewMember asks the member to confirm the place in the crew
+func inviteCrewMember(eventName, teamName string, captain TeamMember, m TeamMember) {
+	var address *string
+	if err := db.Get(&address, "SELECT `email` FROM `persons` WHERE `id`=?", m.PersonID); err != nil {
+		log.Errorf("failed to get email of %s: %+v", m.PersonID, err)
+		return
+	}
+	if address == nil {
+		return //cannot email, will see the invite when logged in
+	}
+	msg := email.Message{
+		From:        email.Email{Addr: "no-reply@events.net", Name: "Events"},
+		To:          []email.Email{{Addr: *address, Name: m.FirstName + " " + m.LastName}},
+		Subject:     "Crew Invitation: " + eventName,
+		ContentType: "text/html",
+	}
+	msg.Content = "<H1>" + html.EscapeString(eventName) + "</H1>"
+	msg.Content += "<P>" + html.EscapeString(captain.FirstName+" "+captain.LastName) + " entered you in the crew " + html.EscapeString(teamName) + ".</P>"
+	msg.Content += "<P>Please log in to confirm your place.</P>"
+	if err := email.Send(msg); err != nil {
+		log.Errorf("failed to send crew invitation of entry %s to %s: %+v", m.EntryID, *address, err)
+	}
+} //inviteCrewMember()
+
+//Team is a team entry with its crew
+type Team struct {
+	EntryID      string       `json:"entry_id" db:"id"`
+	EventID      string       `json:"event_id" db:"event_id"`
+	EventName    string       `json:"event_name" db:"event_name"`
+	CategoryID   *string      `json:"category_id,omitempty" db:"category_id"`
+	CategoryName *string      `json:"category_name,omitempty" db:"category_name"`
+	Name         string       `json:"name" db:"team_name"`
+	Status       string       `json:"status" db:"status" doc:"Entry status"`
+	Bib          *string      `json:"bib,omitempty" db:"bib"`
+	Members      []TeamMember `json:"members" db:"-"`
+	Complete     bool         `json:"complete" db:"-" doc:"All members confirmed their places"`
+}
+
+const teamSelectSQL = "SELECT n.`id`,n.`event_id`,e.`name` AS `event_name`,n.`category_id`,c.`name` AS `category_name`,n.`team_name`,n.`status`,n.`bib`" +
+	" FROM `entries` n JOIN `events` e ON e.`id`=n.`event_id` LEFT JOIN `event_categories` c ON c.`id`=n.`category_id`"
+
+const teamMemberSelectSQL = "SELECT m.`entry_id`,m.`event_id`,m.`person_id`,p.`first_name`,p.`last_name`,m.`position`,m.`captain`,m.`status`,m.`responded`" +
+	" FROM `entry_members` m JOIN `persons` p ON p.`id`=m.`person_id`"
+
+//GetEntryTeam returns the crew of a team entry to its members and the
+//organisers of the event
+func GetEntryTeam(entryID, byPersonID string) (*Team, error) {
+	var t Team
+	if err := db.Get(&t, teamSelectSQL+" WHERE n.`id`=? AND n.`team_name` IS NOT NULL", entryID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown team entry")
+		}
+		return nil, errors.Wrapf(err, "failed to get team")
+	}
+	if err := t.getMembers(); err != nil {
+		return nil, err
+	}
+	for _, m := range t.Members {
+		if m.PersonID == byPersonID {
+			return &t, nil
+		}
+	}
+	if err := AuthoriseEventOrganiser(t.EventID, byPersonID); err != nil {
+		return nil, err
+	}
+	return &t, nil
+} //GetEntryTeam()
+
+func (t *Team) getMembers() error {
+	if err := db.Select(&t.Members, teamMemberSelectSQL+" WHERE m.`entry_id`=? ORDER BY m.`position`", t.EntryID); err != nil {
+		return errors.Wrapf(err, "failed to get crew")
+	}
+	t.Complete = true
+	for _, m := range t.Members {
+		t.Complete = t.Complete && m.Status == TeamMemberConfirmed
+	}
+	return nil
+}
+
+type RespondTeamPlaceRequest struct {
+	PersonID string `json:"person_id" doc:"Invited member"`
+	Accept   bool   `json:"accept" doc:"false to decline"`
+}
+
+func (req RespondTeamPlaceRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	return nil
+}
+
+//RespondTeamPlace confirms or declines a place in a crew. Confirming checks
+//the waivers and membership of the member, as entering does for the captain.
+//The captain is told when a member declines, to find a substitute.
+func RespondTeamPlace(entryID string, req RespondTeamPlaceRequest) (*TeamMember, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	var m TeamMember
+	if err := tx.Get(&m,
+		teamMemberSelectSQL+" WHERE m.`entry_id`=? AND m.`person_id`=? FOR UPDATE",
+		entryID, req.PersonID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "not in this crew")
+		}
+		return nil, errors.Wrapf(err, "failed to get crew member")
+	}
+	if m.Captain {
+		return nil, errors.Errorc(http.StatusBadRequest, "the captain cannot decline, withdraw the entry instead")
+	}
+	m.Status = TeamMemberDeclined
+	if req.Accept {
+		if err := checkWaiversAccepted(tx, m.EventID, m.PersonID); err != nil {
+			return nil, err
+		}
+		if err := checkMembership(tx, m.EventID, m.PersonID); err != nil {
+			return nil, err
+		}
+		m.Status = TeamMemberConfirmed
+	}
+	now := SqlTime(time.Now())
+	m.Responded = &now
+	if _, err := tx.NamedExec(
+		"UPDATE `entry_members` SET `status`=:status,`responded`=:responded WHERE `entry_id`=:entry_id AND `person_id`=:person_id",
+		m,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update crew member")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit response")
+	}
+	if m.Status == TeamMemberDeclined {
+		notifyCaptain(m)
+	}
+	return &m, nil
+} //RespondTeamPlace()
+
+//notifyCaptain tells the captain that a member declined
+func notifyCaptain(m TeamMember) {
+	var captain struct {
+		FirstName string  `db:"first_name"`
+		LastName  string  `db:"last_name"`
+		Email     *string `db:"email"`
+		TeamName  string  `db:"team_name"`
+		EventName string  `db:"event_name"`
+	}
+	if err := db.Get(&captain,
+		"SELECT p.`first_name`,p.`last_name`,p.`email`,n.`team_name`,e.`name` AS `event_name`"+
+			" FROM `entry_members` m JOIN `persons` p ON p.`id`=m.`person_id` JOIN `entries` n ON n.`id`=m.`entry_id` JOIN `events` e ON e.`id`=n.`event_id`"+
+			" WHERE m.`entry_id`=? AND m.`captain`",
+		m.EntryID,
+	); err != nil {
+		log.Errorf("failed to get captain of entry %s: %+v", m.EntryID, err)
+		return
+	}
+	if captain.Email == nil {
+		return
+	}
+	msg := email.Message{
+		From:        email.Email{Addr: "no-reply@events.net", Name: "Events"},
+		To:          []email.Email{{Addr: *captain.Email, Name: captain.FirstName + " " + captain.LastName}},
+		Subject:     "Crew Place Declined: " + captain.EventName,
+		ContentType: "text/html",
+	}
+	msg.Content = "<H1>" + html.EscapeString(captain.EventName) + "</H1>"
+	msg.Content += "<P>" + html.EscapeString(m.FirstName+" "+m.LastName) + " declined the place in " + html.EscapeString(captain.TeamName) + ".</P>"
+	if err := email.Send(msg); err != nil {
+		log.Errorf("failed to tell captain of entry %s: %+v", m.EntryID, err)
+	}
+} //notifyCaptain()
+
+type SubstituteTeamMemberRequest struct {
+	ByPersonID  string `json:"by_person_id" doc:"Captain of the crew"`
+	PersonID    string `json:"person_id" doc:"Member to replace, e.g. who declined"`
+	NewPersonID string `json:"new_person_id" doc:"Member taking the place, who is invited to confirm"`
+}
+
+func (req SubstituteTeamMemberRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	if req.NewPersonID == "" {
+		return errors.Errorf("missing new_person_id")
+	}
+	return nil
+}
+
+//SubstituteTeamMember lets the captain give the place of a member to another
+//person, who is invited to confirm it. The crew must still fit the category.
+func SubstituteTeamMember(entryID string, req SubstituteTeamMemberRequest) (*Team, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	var entry Entry
+	if err := tx.Get(&entry,
+		"SELECT `id`,`event_id`,`category_id`,`person_id`,`status`,`team_name` FROM `entries` WHERE `id`=? AND `team_name` IS NOT NULL FOR UPDATE",
+		entryID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown team entry")
+		}
+		return nil, errors.Wrapf(err, "failed to get entry")
+	}
+	if entry.PersonID != req.ByPersonID {
+		return nil, errors.Errorc(http.StatusForbidden, "only the captain can substitute members")
+	}
+	if entry.Status == EntryStatusWithdrawn {
+		return nil, errors.Errorc(http.StatusConflict, "entry was withdrawn")
+	}
+	var members []TeamMember
+	if err := tx.Select(&members, teamMemberSelectSQL+" WHERE m.`entry_id`=? ORDER BY m.`position`", entryID); err != nil {
+		return nil, errors.Wrapf(err, "failed to get crew")
+	}
+	personIDs := make([]string, len(members))
+	var replaced *TeamMember
+	for i, m := range members {
+		personIDs[i] = m.PersonID
+		if m.PersonID == req.NewPersonID {
+			return nil, errors.Errorc(http.StatusConflict, "already in this crew")
+		}
+		if m.PersonID == req.PersonID {
+			personIDs[i] = req.NewPersonID
+			replaced = &members[i]
+		}
+	}
+	if replaced == nil {
+		return nil, errors.Errorc(http.StatusNotFound, "not in this crew")
+	}
+	if replaced.Captain {
+		return nil, errors.Errorc(http.StatusBadRequest, "the captain cannot be substituted, transfer the entry instead")
+	}
+	c, err := getCrew(tx, entry.EventID, personIDs)
+	if err != nil {
+		return nil, err
+	}
+	newMember := TeamMember{EntryID: entryID, EventID: entry.EventID, PersonID: req.NewPersonID, Position: replaced.Position, Status: TeamMemberInvited}
+	for _, p := range c.persons {
+		if p.ID == req.NewPersonID {
+			if err := checkNotEntered(tx, entry.EventID, []crewPerson{p}); err != nil {
+				return nil, err
+			}
+			newMember.FirstName, newMember.LastName = p.FirstName, p.LastName
+		}
+	}
+	if entry.CategoryID != nil {
+		categories, err := ListEventCategories(entry.EventID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.category(categories, *entry.CategoryID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(
+		"UPDATE `entry_members` SET `person_id`=?,`status`=?,`responded`=NULL WHERE `entry_id`=? AND `person_id`=?",
+		req.NewPersonID, TeamMemberInvited, entryID, req.PersonID,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return nil, errors.Errorc(http.StatusConflict, newMember.FirstName+" "+newMember.LastName+" already in a crew")
+		}
+		return nil, errors.Wrapf(err, "failed to substitute crew member")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit substitute")
+	}
+	var eventName string
+	if err := db.Get(&eventName, "SELECT `name` FROM `events` WHERE `id`=?", entry.EventID); err != nil {
+		log.Errorf("failed to get event %s: %+v", entry.EventID, err)
+	} else {
+		inviteCrewMember(eventName, *entry.TeamName, members[0], newMember)
+	}
+	return GetEntryTeam(entryID, req.ByPersonID)
+} //SubstituteTeamMember()
+
+//ListPersonTeams lists the teams the person is in, including those the person
+//was invited to and must still respond to
+func ListPersonTeams(personID, byPersonID string) ([]Team, error) {
+	if err := AuthorisePerson(personID, byPersonID); err != nil {
+		return nil, err
+	}
+	teams := []Team{}
+	if err := db.Select(&teams,
+		teamSelectSQL+" WHERE n.`id` IN (SELECT `entry_id` FROM `entry_members` WHERE `person_id`=?) ORDER BY e.`date` DESC",
+		personID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to list teams")
+	}
+	for i := range teams {
+		if err := teams[i].getMembers(); err != nil {
+			return nil, err
+		}
+	}
+	return teams, nil
+} //ListPersonTeams()
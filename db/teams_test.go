@@ -0,0 +1,96 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestCategoryAccepts(t *testing.T) {
+	k2Mixed := db.EventCategory{Name: "K2 Mixed", TeamSize: 2, Gender: db.CategoryGenderMixed}
+	k2Men := db.EventCategory{Name: "K2 Men", TeamSize: 2, Gender: "M"}
+	k2Veteran := db.EventCategory{Name: "K2 Veteran", TeamSize: 2, MinAge: 80}
+	relay := db.EventCategory{Name: "Relay U/60", TeamSize: 4, MaxAge: 60}
+	junior := db.EventCategory{Name: "Junior", MaxAge: 17}
+	categories := []db.EventCategory{k2Mixed, k2Men, k2Veteran, relay, junior}
+	for _, test := range []struct {
+		genders []string
+		ages    []int
+		matches []string
+	}{
+		{[]string{"M", "F"}, []int{30, 28}, []string{"K2 Mixed"}},
+		{[]string{"M", "F"}, []int{45, 40}, []string{"K2 Mixed", "K2 Veteran"}},
+		{[]string{"M", "M"}, []int{20, 21}, []string{"K2 Men"}},
+		{[]string{"F", "F"}, []int{20, 21}, []string{}},
+		{[]string{"F", "M", "F", "M"}, []int{15, 15, 15, 15}, []string{"Relay U/60"}},
+		{[]string{"F", "M", "F", "M"}, []int{15, 15, 15, 16}, []string{}},
+		{[]string{"F"}, []int{17}, []string{"Junior"}},
+		{[]string{"M"}, []int{18}, []string{}},
+	} {
+		matches := db.MatchingCategories(categories, test.genders, test.ages)
+		names := []string{}
+		for _, m := range matches {
+			names = append(names, m.Name)
+		}
+		if len(names) != len(test.matches) {
+			t.Fatalf("%v %v matched %v instead of %v", test.genders, test.ages, names, test.matches)
+		}
+		for i := range names {
+			if names[i] != test.matches[i] {
+				t.Fatalf("%v %v matched %v instead of %v", test.genders, test.ages, names, test.matches)
+			}
+		}
+	}
+}
+
+func TestElapsed(t *testing.T) {
+	for _, test := range []struct {
+		in  string
+		out string
+	}{
+		{"1:02:03", "1:02:03"},
+		{"45:12", "0:45:12"},
+		{"1:02:03.40", "1:02:03.4"},
+		{"125:00.5", "2:05:00.5"},
+	} {
+		d, err := db.ParseElapsed(test.in)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %+v", test.in, err)
+		}
+		if s := db.FormatElapsed(d); s != test.out {
+			t.Fatalf("%s formatted as %s instead of %s", test.in, s, test.out)
+		}
+	}
+	for _, invalid := range []string{"", "12", "1:60:00", "1:02:60", "1:-2:03", "1:02:NaN", "a:02:03"} {
+		if _, err := db.ParseElapsed(invalid); err == nil {
+			t.Fatalf("parsed invalid time \"%s\"", invalid)
+		}
+	}
+}
+
+func TestRankResults(t *testing.T) {
+	ms := func(v int64) *int64 { return &v }
+	k2, k1 := "k2", "k1"
+	results := []db.EntryResult{
+		{EntryID: "a", Status: db.ResultDidNotStart, LastName: "A"},
+		{EntryID: "b", Status: db.ResultFinished, ElapsedMs: ms(3000), CategoryID: &k2},
+		{EntryID: "c", Status: db.ResultFinished, ElapsedMs: ms(1000), CategoryID: &k1},
+		{EntryID: "d", Status: db.ResultDidNotFinish},
+		{EntryID: "e", Status: db.ResultFinished, ElapsedMs: ms(3000), CategoryID: &k2},
+		{EntryID: "f", Status: db.ResultFinished, ElapsedMs: ms(4000), CategoryID: &k2},
+	}
+	db.RankResults(results)
+	expected := []struct {
+		id       string
+		position int
+		category int
+	}{
+		{"c", 1, 1}, {"b", 2, 1}, {"e", 2, 1}, {"f", 4, 3}, {"d", 0, 0}, {"a", 0, 0},
+	}
+	for i, e := range expected {
+		r := results[i]
+		if r.EntryID != e.id || r.Position != e.position || r.CategoryPosition != e.category {
+			t.Fatalf("results[%d] = %s %d/%d instead of %s %d/%d", i, r.EntryID, r.Position, r.CategoryPosition, e.id, e.position, e.category)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	//zone data in the binary, so zones load on hosts without zoneinfo
+	_ "time/tzdata"
+
+	"github.com/go-msvc/errors"
+	"github.com/jmoiron/sqlx"
+)
+
+//DefaultTimeZone is used for events without a time zone when their location
+//does not give one, from env EVENTS_TIME_ZONE
+var DefaultTimeZone = strDefault(os.Getenv("EVENTS_TIME_ZONE"), "Africa/Johannesburg")
+
+//countryTimeZones are the zones of countries that have only one, by ISO 3166
+//code and English name. Venues in other countries need a time zone.
+var countryTimeZones = map[string]string{}
+
+func init() {
+	for _, c := range []struct{ code, name, zone string }{
+		{"ZA", "South Africa", "Africa/Johannesburg"},
+		{"NA", "Namibia", "Africa/Windhoek"},
+		{"BW", "Botswana", "Africa/Gaborone"},
+		{"ZW", "Zimbabwe", "Africa/Harare"},
+		{"MZ", "Mozambique", "Africa/Maputo"},
+		{"LS", "Lesotho", "Africa/Maseru"},
+		{"SZ", "Eswatini", "Africa/Mbabane"},
+		{"ZM", "Zambia", "Africa/Lusaka"},
+		{"MW", "Malawi", "Africa/Blantyre"},
+		{"KE", "Kenya", "Africa/Nairobi"},
+		{"TZ", "Tanzania", "Africa/Dar_es_Salaam"},
+		{"UG", "Uganda", "Africa/Kampala"},
+		{"MU", "Mauritius", "Indian/Mauritius"},
+		{"NG", "Nigeria", "Africa/Lagos"},
+		{"EG", "Egypt", "Africa/Cairo"},
+		{"MA", "Morocco", "Africa/Casablanca"},
+		{"GB", "United Kingdom", "Europe/London"},
+		{"IE", "Ireland", "Europe/Dublin"},
+		{"FR", "France", "Europe/Paris"},
+		{"DE", "Germany", "Europe/Berlin"},
+		{"NL", "Netherlands", "Europe/Amsterdam"},
+		{"BE", "Belgium", "Europe/Brussels"},
+		{"CH", "Switzerland", "Europe/Zurich"},
+		{"AT", "Austria", "Europe/Vienna"},
+		{"IT", "Italy", "Europe/Rome"},
+		{"SE", "Sweden", "Europe/Stockholm"},
+		{"NO", "Norway", "Europe/Oslo"},
+		{"DK", "Denmark", "Europe/Copenhagen"},
+		{"FI", "Finland", "Europe/Helsinki"},
+		{"PL", "Poland", "Europe/Warsaw"},
+		{"CZ", "Czechia", "Europe/Prague"},
+		{"HU", "Hungary", "Europe/Budapest"},
+		{"GR", "Greece", "Europe/Athens"},
+		{"TR", "Turkey", "Europe/Istanbul"},
+		{"IL", "Israel", "Asia/Jerusalem"},
+		{"AE", "United Arab Emirates", "Asia/Dubai"},
+		{"IN", "India", "Asia/Kolkata"},
+		{"SG", "Singapore", "Asia/Singapore"},
+		{"HK", "Hong Kong", "Asia/Hong_Kong"},
+		{"CN", "China", "Asia/Shanghai"},
+		{"JP", "Japan", "Asia/Tokyo"},
+		{"NZ", "New Zealand", "Pacific/Auckland"},
+	} {
+		countryTimeZones[strings.ToLower(c.code)] = c.zone
+		countryTimeZones[strings.ToLower(c.name)] = c.zone
+	}
+}
+
+//TimeZoneForCountry returns the zone of a country with only one zone, or ""
+func TimeZoneForCountry(country string) string {
+	return countryTimeZones[strings.ToLower(strings.TrimSpace(country))]
+}
+
+//LoadTimeZone loads an IANA time zone, e.g. "Europe/London"
+func LoadTimeZone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, errors.Errorc(http.StatusBadRequest, "missing time zone")
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Errorc(http.StatusBadRequest, "unknown time zone \""+name+"\"")
+	}
+	return loc, nil
+}
+
+//localTimeLayouts are accepted for times without an offset, which are taken
+//as the wall clock in the time zone of the event
+var localTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+//ParseEventTime parses RFC 3339 with an offset, or a wall clock time in the
+//zone. A wall clock time skipped when clocks move forward is refused, and a
+//time repeated when clocks move back is taken as the first of the two.
+func ParseEventTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.In(loc), nil
+	}
+	for _, layout := range localTimeLayouts {
+		wall, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		//the instant is the wall clock less the offset in effect at that
+		//time, try the offsets around it to find gaps and overlaps
+		var first *time.Time
+		for _, probe := range []time.Duration{-24 * time.Hour, 0, 24 * time.Hour} {
+			_, offset := wall.Add(probe).In(loc).Zone()
+			t := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+			if t.Format(layout) == wall.Format(layout) && (first == nil || t.Before(*first)) {
+				first = &t
+			}
+		}
+		if first == nil {
+			return time.Time{}, errors.Errorc(http.StatusBadRequest, s+" does not exist in "+loc.String()+" because clocks move forward")
+		}
+		return *first, nil
+	}
+	return time.Time{}, errors.Errorc(http.StatusBadRequest, "invalid time \""+s+"\", expecting RFC 3339 or CCYY-MM-DD HH:MM[:SS]")
+}
+
+//eventTimeZone returns the zone of the event, from the event, or else its
+//location, or else the default
+func eventTimeZone(q sqlx.Queryer, eventID string) (*time.Location, error) {
+	var zones struct {
+		Event    string `db:"event"`
+		Location string `db:"location"`
+		Country  string `db:"country"`
+	}
+	if err := sqlx.Get(q, &zones,
+		"SELECT COALESCE(e.`time_zone`,'') AS `event`,COALESCE(l.`time_zone`,'') AS `location`,COALESCE(l.`country`,'') AS `country`"+
+			" FROM `events` e LEFT JOIN `locations` l ON l.`id`=e.`location_id` WHERE e.`id`=?",
+		eventID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get event time zone")
+	}
+	for _, name := range []string{zones.Event, zones.Location, TimeZoneForCountry(zones.Country), DefaultTimeZone} {
+		if name != "" {
+			return LoadTimeZone(name)
+		}
+	}
+	return time.UTC, nil
+}
@@ -0,0 +1,73 @@
+package db_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func TestParseEventTime(t *testing.T) {
+	london, err := db.LoadTimeZone("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		s   string
+		utc string
+	}{
+		{"2024-06-01 09:00", "2024-06-01T08:00:00Z"},              //summer time
+		{"2024-01-15T09:00:00", "2024-01-15T09:00:00Z"},           //winter time
+		{"2024-03-31 00:59:59", "2024-03-31T00:59:59Z"},           //before clocks move forward
+		{"2024-03-31 02:00", "2024-03-31T01:00:00Z"},              //after clocks moved forward
+		{"2024-10-27 01:30", "2024-10-27T00:30:00Z"},              //repeated hour, first of two
+		{"2024-10-27T01:30:00Z", "2024-10-27T01:30:00Z"},          //second of two by offset
+		{"2024-06-01T09:00:00+02:00", "2024-06-01T07:00:00Z"},     //other offset
+		{"2024-06-01T09:00:00.5+01:00", "2024-06-01T08:00:00.5Z"}, //fractions
+	} {
+		got, err := db.ParseEventTime(tc.s, london)
+		if err != nil {
+			t.Errorf("%s failed: %+v", tc.s, err)
+			continue
+		}
+		if utc := got.UTC().Format(time.RFC3339Nano); utc != tc.utc {
+			t.Errorf("%s gave %s, expected %s", tc.s, utc, tc.utc)
+		}
+		if got.Location() != london {
+			t.Errorf("%s not in event time zone", tc.s)
+		}
+	}
+
+	//skipped when clocks move forward
+	if _, err := db.ParseEventTime("2024-03-31 01:30", london); errors.Code(err) != http.StatusBadRequest {
+		t.Errorf("time in DST gap gave %+v, expected 400", err)
+	}
+	if _, err := db.ParseEventTime("tomorrow at nine", london); errors.Code(err) != http.StatusBadRequest {
+		t.Errorf("invalid time gave %+v, expected 400", err)
+	}
+
+	//southern hemisphere moves forward in spring of October
+	auckland, _ := db.LoadTimeZone("Pacific/Auckland")
+	if _, err := db.ParseEventTime("2024-09-29 02:30", auckland); err == nil {
+		t.Errorf("time in Auckland DST gap did not fail")
+	}
+}
+
+func TestTimeZoneForCountry(t *testing.T) {
+	for country, exp := range map[string]string{
+		"ZA":           "Africa/Johannesburg",
+		"south africa": "Africa/Johannesburg",
+		" Namibia ":    "Africa/Windhoek",
+		"US":           "", //more than one zone
+		"":             "",
+	} {
+		if got := db.TimeZoneForCountry(country); got != exp {
+			t.Errorf("TimeZoneForCountry(%q)=%q, expected %q", country, got, exp)
+		}
+	}
+	if _, err := db.LoadTimeZone("Mars/Olympus_Mons"); errors.Code(err) != http.StatusBadRequest {
+		t.Errorf("unknown zone gave %+v, expected 400", err)
+	}
+}
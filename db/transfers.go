@@ -0,0 +1,734 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"net/http"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/email"
+	"github.com/jmoiron/sqlx"
+)
+
+//TransferPolicy lets participants pass their entries, or their places in a
+//crew, to someone else until the deadline. The person taking over pays the
+//fee.
+type TransferPolicy struct {
+	Allowed  bool     `json:"allowed" db:"allowed"`
+	Deadline *SqlTime `json:"deadline,omitempty" db:"deadline" doc:"Last moment to complete a transfer, default is the day before the event"`
+	Fee      Amount   `json:"fee" db:"-"`
+	FeeCents int      `json:"-" db:"fee_cents"`
+}
+
+func (p *TransferPolicy) Validate() error {
+	if p.Fee.Cents < 0 {
+		return errors.Errorf("negative fee")
+	}
+	if p.Fee.Currency == nil {
+		p.Fee.Currency = DefaultCurrency
+	}
+	if p.Fee.Currency != DefaultCurrency {
+		return errors.Errorf("fee currency %s is not %s", p.Fee.Currency.Code, DefaultCurrency.Code)
+	}
+	p.FeeCents = p.Fee.Cents
+	return nil
+}
+
+//Check fails when transfers are not allowed now, daysBefore the event
+func (p TransferPolicy) Check(now time.Time, daysBefore int, cancelled bool) error {
+	if !p.Allowed {
+		return errors.Errorc(http.StatusForbidden, "event does not allow transfers")
+	}
+	if cancelled {
+		return errors.Errorc(http.StatusConflict, "event was cancelled")
+	}
+	if p.Deadline != nil {
+		if now.After(time.Time(*p.Deadline)) {
+			return errors.Errorc(http.StatusForbidden, "transfers closed at "+p.Deadline.String())
+		}
+	} else if daysBefore < 1 {
+		return errors.Errorc(http.StatusForbidden, "transfers closed the day before the event")
+	}
+	return nil
+}
+
+//GetEventTransferPolicy returns the event policy, which by default does not
+//allow transfers
+func GetEventTransferPolicy(eventID string) (*TransferPolicy, error) {
+	return getEventTransferPolicy(db, eventID)
+}
+
+func getEventTransferPolicy(q sqlx.Queryer, eventID string) (*TransferPolicy, error) {
+	p := TransferPolicy{}
+	if err := sqlx.Get(q, &p,
+		"SELECT `allowed`,`deadline`,`fee_cents` FROM `event_transfer_policies` WHERE `event_id`=?",
+		eventID,
+	); err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "failed to get transfer policy")
+	}
+	p.Fee = Amount{Currency: DefaultCurrency, Cents: p.FeeCents}
+	return &p, nil
+}
+
+type SetTransferPolicyRequest struct {
+	TransferPolicy
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+}
+
+func SetEventTransferPolicy(eventID string, req SetTransferPolicyRequest) error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("invalid transfer policy: missing by_person_id")
+	}
+	if err := req.TransferPolicy.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid transfer policy")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return err
+	}
+	if _, err := db.Exec(
+		"REPLACE INTO `event_transfer_policies` SET `event_id`=?,`allowed`=?,`deadline`=?,`fee_cents`=?",
+		eventID, req.Allowed, req.Deadline, req.FeeCents,
+	); err != nil {
+		return errors.Wrapf(err, "failed to set transfer policy")
+	}
+	return nil
+}
+
+//EntryTransfer passes an entry, or a place in a crew, from one person to
+//another. Transfers are never deleted, so they are the audit trail of who
+//held each entry.
+type EntryTransfer struct {
+	ID            string   `json:"id" db:"id"`
+	EventID       string   `json:"event_id" db:"event_id"`
+	EntryID       string   `json:"entry_id" db:"entry_id"`
+	FromPersonID  string   `json:"from_person_id" db:"from_person_id"`
+	FromFirstName string   `json:"from_first_name" db:"from_first_name"`
+	FromLastName  string   `json:"from_last_name" db:"from_last_name"`
+	ToPersonID    string   `json:"to_person_id" db:"to_person_id"`
+	ToFirstName   string   `json:"to_first_name" db:"to_first_name"`
+	ToLastName    string   `json:"to_last_name" db:"to_last_name"`
+	Status        string   `json:"status" db:"status"`
+	Note          string   `json:"note,omitempty" db:"note"`
+	Fee           Amount   `json:"fee" db:"-"`
+	FeeCents      int      `json:"-" db:"fee_cents"`
+	OrderID       *string  `json:"order_id,omitempty" db:"order_id" doc:"Order to pay the fee"`
+	Answers       string   `json:"-" db:"answers" doc:"JSON answers to the event form of the new entrant"`
+	Problem       string   `json:"problem,omitempty" db:"problem" doc:"Why the transfer failed after the fee was paid"`
+	Requested     SqlTime  `json:"requested" db:"requested"`
+	Responded     *SqlTime `json:"responded,omitempty" db:"responded"`
+	Completed     *SqlTime `json:"completed,omitempty" db:"completed"`
+}
+
+const (
+	TransferOffered   = "offered"
+	TransferAccepted  = "accepted" //waiting for the fee to be paid
+	TransferCompleted = "completed"
+	TransferDeclined  = "declined"
+	TransferCancelled = "cancelled"
+	TransferExpired   = "expired" //fee not paid in time
+	TransferFailed    = "failed"  //fee paid but the transfer was no longer possible
+)
+
+//CheckAccept fails when the person cannot accept the transfer, e.g. because
+//it was offered to someone else or the fee was not paid in time
+func (t EntryTransfer) CheckAccept(personID string) error {
+	if t.ToPersonID != personID {
+		return errors.Errorc(http.StatusForbidden, "transfer was not offered to you")
+	}
+	if t.Status != TransferOffered {
+		return errors.Errorc(http.StatusConflict, "transfer is "+t.Status)
+	}
+	return nil
+}
+
+//Fail marks a transfer failed after the fee was paid, with the problem for
+//the organisers who refund the fee
+func (t *EntryTransfer) Fail(problem error) {
+	t.Status = TransferFailed
+	t.Problem = problem.Error()
+	if len(t.Problem) > 400 {
+		t.Problem = t.Problem[:400]
+	}
+}
+
+const transferSelectSQL = "SELECT t.`id`,t.`event_id`,t.`entry_id`,t.`from_person_id`,f.`first_name` AS `from_first_name`,f.`last_name` AS `from_last_name`," +
+	"t.`to_person_id`,p.`first_name` AS `to_first_name`,p.`last_name` AS `to_last_name`,t.`status`,t.`note`,t.`fee_cents`,t.`order_id`,t.`answers`,t.`problem`,t.`requested`,t.`responded`,t.`completed`" +
+	" FROM `entry_transfers` t JOIN `persons` f ON f.`id`=t.`from_person_id` JOIN `persons` p ON p.`id`=t.`to_person_id`"
+
+type OfferTransferRequest struct {
+	PersonID   string `json:"person_id" doc:"Entrant, or member of the crew giving up the place"`
+	ToPersonID string `json:"to_person_id" doc:"Registered person taking over"`
+	Note       string `json:"note,omitempty"`
+}
+
+func (req OfferTransferRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	if req.ToPersonID == "" {
+		return errors.Errorf("missing to_person_id")
+	}
+	if req.ToPersonID == req.PersonID {
+		return errors.Errorf("cannot transfer to yourself")
+	}
+	return nil
+}
+
+//OfferTransfer offers the entry, or the place of the person in the crew, to
+//another person who must accept it before the transfer deadline
+func OfferTransfer(entryID string, req OfferTransferRequest) (*EntryTransfer, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	entry, err := getTransferEntry(tx, entryID)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := checkTransfer(tx, *entry, req.PersonID, req.ToPersonID)
+	if err != nil {
+		return nil, err
+	}
+	var nrOpen int
+	if err := tx.Get(&nrOpen,
+		"SELECT COUNT(*) FROM `entry_transfers` WHERE `entry_id`=? AND `from_person_id`=? AND `status` IN (?,?)",
+		entryID, req.PersonID, TransferOffered, TransferAccepted,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to check transfers")
+	}
+	if nrOpen > 0 {
+		return nil, errors.Errorc(http.StatusConflict, "transfer already offered, cancel it first")
+	}
+	t := EntryTransfer{
+		ID:           uuid.New().String(),
+		EventID:      entry.EventID,
+		EntryID:      entry.ID,
+		FromPersonID: req.PersonID,
+		ToPersonID:   req.ToPersonID,
+		Status:       TransferOffered,
+		Note:         req.Note,
+		Fee:          policy.Fee,
+		FeeCents:     policy.FeeCents,
+		Requested:    SqlTime(time.Now()),
+	}
+	if _, err := tx.NamedExec(
+		"INSERT INTO `entry_transfers` SET `id`=:id,`event_id`=:event_id,`entry_id`=:entry_id,`from_person_id`=:from_person_id,`to_person_id`=:to_person_id,`status`=:status,`note`=:note,`fee_cents`=:fee_cents,`answers`=:answers,`problem`=:problem,`requested`=:requested",
+		t,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add transfer")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit transfer")
+	}
+	transfer, err := GetTransfer(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	notifyTransfer(*transfer, transfer.ToPersonID, "Entry Transfer Offered: ",
+		transfer.FromFirstName+" "+transfer.FromLastName+" offered you their place. Please log in to accept it.")
+	return transfer, nil
+} //OfferTransfer()
+
+func getTransferEntry(q sqlx.Queryer, entryID string) (*Entry, error) {
+	var entry Entry
+	if err := sqlx.Get(q, &entry,
+		"SELECT `id`,`event_id`,`category_id`,`person_id`,`status`,`team_name` FROM `entries` WHERE `id`=?",
+		entryID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown entry")
+		}
+		return nil, errors.Wrapf(err, "failed to get entry")
+	}
+	if entry.Status != EntryStatusConfirmed {
+		return nil, errors.Errorc(http.StatusConflict, "entry is "+entry.Status)
+	}
+	return &entry, nil
+}
+
+//checkTransfer checks that the transfer is allowed now, that the person may
+//give up the entry or place and that the new crew still fits the category.
+//Entries with an open refund cannot be transferred. It returns the event
+//policy.
+func checkTransfer(q sqlx.Queryer, entry Entry, fromPersonID, toPersonID string) (*TransferPolicy, error) {
+	policy, err := getEventTransferPolicy(q, entry.EventID)
+	if err != nil {
+		return nil, err
+	}
+	var nrRefunds int
+	if err := sqlx.Get(q, &nrRefunds,
+		"SELECT COUNT(*) FROM `refunds` WHERE `entry_id`=? AND `status` IN (?,?)",
+		entry.ID, RefundRequested, RefundApproved,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to check refunds")
+	}
+	if nrRefunds > 0 {
+		return nil, errors.Errorc(http.StatusConflict, "a refund of the entry is open")
+	}
+	daysBefore, cancelled, err := eventDaysBefore(q, entry.EventID)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.Check(time.Now(), daysBefore, cancelled); err != nil {
+		return nil, err
+	}
+	personIDs := []string{toPersonID}
+	if entry.TeamName != nil {
+		var members []string
+		if err := sqlx.Select(q, &members,
+			"SELECT `person_id` FROM `entry_members` WHERE `entry_id`=? ORDER BY `position`",
+			entry.ID,
+		); err != nil {
+			return nil, errors.Wrapf(err, "failed to get crew")
+		}
+		found := false
+		for i, id := range members {
+			if id == fromPersonID {
+				members[i], found = toPersonID, true
+			}
+		}
+		if !found {
+			return nil, errors.Errorc(http.StatusForbidden, "not in this crew")
+		}
+		personIDs = members
+	} else if entry.PersonID != fromPersonID {
+		return nil, errors.Errorc(http.StatusForbidden, "only the entrant can transfer the entry")
+	}
+	c, err := getCrew(q, entry.EventID, personIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range c.persons {
+		if p.ID == toPersonID {
+			if err := checkNotEntered(q, entry.EventID, []crewPerson{p}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if entry.CategoryID != nil {
+		categories, err := ListEventCategories(entry.EventID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.category(categories, *entry.CategoryID); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+} //checkTransfer()
+
+func GetTransfer(id string) (*EntryTransfer, error) {
+	return getTransfer(db, id, false)
+}
+
+func getTransfer(q sqlx.Queryer, id string, forUpdate bool) (*EntryTransfer, error) {
+	query := transferSelectSQL + " WHERE t.`id`=?"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var t EntryTransfer
+	if err := sqlx.Get(q, &t, query, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown transfer")
+		}
+		return nil, errors.Wrapf(err, "failed to get transfer")
+	}
+	t.Fee = Amount{Currency: DefaultCurrency, Cents: t.FeeCents}
+	return &t, nil
+}
+
+type AcceptTransferRequest struct {
+	PersonID string                 `json:"person_id" doc:"Person the transfer was offered to"`
+	Answers  map[string]interface{} `json:"answers,omitempty" doc:"Answers to the event form when taking over the entry (not a crew place)"`
+	PayBy    string                 `json:"pay_by,omitempty" doc:"online (default) or eft to pay the fee"`
+	BillTo   *BillTo                `json:"bill_to,omitempty" doc:"Club or company to name on the invoice"`
+}
+
+func (req AcceptTransferRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	if req.PayBy != "" && req.PayBy != "online" && req.PayBy != ProviderEFT {
+		return errors.Errorf("invalid pay_by \"%s\", expecting online|eft", req.PayBy)
+	}
+	if req.BillTo != nil {
+		if err := req.BillTo.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid bill_to")
+		}
+	}
+	return nil
+}
+
+//AcceptTransfer checks again that the transfer is allowed and that the new
+//person accepted the waivers and may enter members-only events. Without a fee
+//the transfer completes immediately, else it completes when the returned
+//order is paid.
+func AcceptTransfer(id string, req AcceptTransferRequest, provider string) (*EntryTransfer, *Order, error) {
+	if err := req.Validate(); err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	t, err := getTransfer(tx, id, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := t.CheckAccept(req.PersonID); err != nil {
+		return nil, nil, err
+	}
+	entry, err := getTransferEntry(tx, t.EntryID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := checkTransfer(tx, *entry, t.FromPersonID, t.ToPersonID); err != nil {
+		return nil, nil, err
+	}
+	if err := checkWaiversAccepted(tx, t.EventID, t.ToPersonID); err != nil {
+		return nil, nil, err
+	}
+	if err := checkMembership(tx, t.EventID, t.ToPersonID); err != nil {
+		return nil, nil, err
+	}
+	if entry.PersonID == t.FromPersonID {
+		//taking over the entry, not only a place in the crew
+		form, err := GetEventForm(t.EventID)
+		if err != nil {
+			return nil, nil, err
+		}
+		values, err := form.ValidateAnswers(req.Answers, func(id string) (*Document, error) {
+			return AuthoriseDocument(id, req.PersonID)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		answers, _ := json.Marshal(values)
+		t.Answers = string(answers)
+	}
+	now := SqlTime(time.Now())
+	t.Responded = &now
+	t.Status = TransferAccepted
+
+	var order *Order
+	if t.FeeCents > 0 {
+		ttl := orderTTL
+		if provider == ProviderEFT {
+			if err := checkEFTEvent(tx, t.EventID); err != nil {
+				return nil, nil, err
+			}
+			ttl = eftOrderTTL
+		}
+		order = &Order{
+			ID:         uuid.New().String(),
+			EventID:    t.EventID,
+			PersonID:   t.ToPersonID,
+			Status:     OrderPending,
+			Total:      t.Fee,
+			TotalCents: t.FeeCents,
+			Provider:   provider,
+			Created:    now,
+			Expires:    SqlTime(time.Time(now).Add(ttl)),
+		}
+		if req.BillTo != nil {
+			order.BillToName = req.BillTo.Name
+			order.BillToAddress = req.BillTo.Address
+			order.BillToVATNumber = req.BillTo.VATNumber
+		}
+		if err := insertOrder(tx, order); err != nil {
+			return nil, nil, err
+		}
+		ol := OrderLine{
+			OrderID:     order.ID,
+			TransferID:  &t.ID,
+			PersonID:    t.ToPersonID,
+			Description: "Transfer from " + t.FromFirstName + " " + t.FromLastName + " to " + t.ToFirstName + " " + t.ToLastName,
+			Amount:      t.Fee,
+			AmountCents: t.FeeCents,
+		}
+		if err := insertOrderLine(tx, ol); err != nil {
+			return nil, nil, err
+		}
+		order.Lines = []OrderLine{ol}
+		t.OrderID = &order.ID
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE `entry_transfers` SET `status`=:status,`answers`=:answers,`order_id`=:order_id,`responded`=:responded WHERE `id`=:id",
+		t,
+	); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to update transfer")
+	}
+	if order == nil {
+		if err := completeTransfer(tx, t); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to commit transfer")
+	}
+	if t.Status == TransferCompleted {
+		notifyTransfer(*t, t.FromPersonID, "Entry Transferred: ", t.ToFirstName+" "+t.ToLastName+" took over your place.")
+	}
+	return t, order, nil
+} //AcceptTransfer()
+
+//completeTransfer gives the entry or crew place to the new person
+func completeTransfer(tx *sqlx.Tx, t *EntryTransfer) error {
+	c, err := getCrew(tx, t.EventID, []string{t.ToPersonID})
+	if err != nil {
+		return err
+	}
+	if err := checkNotEntered(tx, t.EventID, c.persons); err != nil {
+		return err
+	}
+	now := SqlTime(time.Now())
+	if _, err := tx.Exec(
+		"DELETE FROM `entry_members` WHERE `entry_id`=? AND `person_id`=? AND `status`=?",
+		t.EntryID, t.ToPersonID, TeamMemberDeclined,
+	); err != nil {
+		return errors.Wrapf(err, "failed to remove declined place")
+	}
+	if _, err := tx.Exec(
+		"UPDATE `entry_members` SET `person_id`=?,`status`=?,`responded`=? WHERE `entry_id`=? AND `person_id`=?",
+		t.ToPersonID, TeamMemberConfirmed, now, t.EntryID, t.FromPersonID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to transfer crew place")
+	}
+	result, err := tx.Exec(
+		"UPDATE `entries` SET `person_id`=? WHERE `id`=? AND `person_id`=?",
+		t.ToPersonID, t.EntryID, t.FromPersonID,
+	)
+	if err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return errors.Errorc(http.StatusConflict, t.ToFirstName+" "+t.ToLastName+" already entered")
+		}
+		return errors.Wrapf(err, "failed to transfer entry")
+	}
+	if n, _ := result.RowsAffected(); n > 0 && t.Answers != "" {
+		values := map[string]string{}
+		if err := json.Unmarshal([]byte(t.Answers), &values); err != nil {
+			return errors.Wrapf(err, "invalid answers of transfer %s", t.ID)
+		}
+		if _, err := tx.Exec("DELETE FROM `entry_answers` WHERE `entry_id`=?", t.EntryID); err != nil {
+			return errors.Wrapf(err, "failed to delete answers")
+		}
+		for key, value := range values {
+			if _, err := tx.Exec(
+				"INSERT INTO `entry_answers` SET `entry_id`=?,`key`=?,`value`=?",
+				t.EntryID, key, value,
+			); err != nil {
+				return errors.Wrapf(err, "failed to add answer %s", key)
+			}
+		}
+	}
+	t.Status = TransferCompleted
+	t.Completed = &now
+	if _, err := tx.Exec(
+		"UPDATE `entry_transfers` SET `status`=?,`completed`=? WHERE `id`=?",
+		t.Status, t.Completed, t.ID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to complete transfer")
+	}
+	return nil
+} //completeTransfer()
+
+//completeOrderTransfers completes the transfers paid with the order. The
+//transfer is checked again, as it was accepted before paying. When it is no
+//longer possible, e.g. the deadline passed or the new person entered in the
+//meantime, it fails with the reason so the organisers can refund the fee.
+func completeOrderTransfers(tx *sqlx.Tx, orderID string) error {
+	var ids []string
+	if err := tx.Select(&ids,
+		"SELECT `id` FROM `entry_transfers` WHERE `order_id`=? AND `status`=?",
+		orderID, TransferAccepted,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get transfers")
+	}
+	for _, id := range ids {
+		t, err := getTransfer(tx, id, true)
+		if err != nil {
+			return err
+		}
+		entry, err := getTransferEntry(tx, t.EntryID)
+		if err == nil {
+			_, err = checkTransfer(tx, *entry, t.FromPersonID, t.ToPersonID)
+		}
+		if err == nil {
+			err = completeTransfer(tx, t)
+		}
+		if err != nil {
+			if errors.Code(err) <= 0 {
+				return err
+			}
+			log.Errorf("transfer %s failed after payment: %+v", id, err)
+			t.Fail(err)
+			if _, err := tx.Exec(
+				"UPDATE `entry_transfers` SET `status`=?,`problem`=? WHERE `id`=?",
+				t.Status, t.Problem, id,
+			); err != nil {
+				return errors.Wrapf(err, "failed to update transfer")
+			}
+		}
+	}
+	return nil
+}
+
+type EndTransferRequest struct {
+	PersonID string `json:"person_id" doc:"Person offering to cancel, or the person it was offered to to decline"`
+}
+
+func (req EndTransferRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	return nil
+}
+
+//EndTransfer cancels or declines a transfer that was not accepted yet
+func EndTransfer(id string, req EndTransferRequest) (*EntryTransfer, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	t, err := getTransfer(tx, id, true)
+	if err != nil {
+		return nil, err
+	}
+	if t.Status != TransferOffered {
+		return nil, errors.Errorc(http.StatusConflict, "transfer is "+t.Status)
+	}
+	switch req.PersonID {
+	case t.FromPersonID:
+		t.Status = TransferCancelled
+	case t.ToPersonID:
+		t.Status = TransferDeclined
+	default:
+		return nil, errors.Errorc(http.StatusForbidden, "not your transfer")
+	}
+	now := SqlTime(time.Now())
+	t.Responded = &now
+	if _, err := tx.Exec(
+		"UPDATE `entry_transfers` SET `status`=?,`responded`=? WHERE `id`=?",
+		t.Status, t.Responded, t.ID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update transfer")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit transfer")
+	}
+	if t.Status == TransferDeclined {
+		notifyTransfer(*t, t.FromPersonID, "Entry Transfer Declined: ", t.ToFirstName+" "+t.ToLastName+" declined your place.")
+	}
+	return t, nil
+} //EndTransfer()
+
+//ListEntryTransfers lists all transfers of the entry, to organisers, the
+//entrant and the persons involved
+func ListEntryTransfers(entryID, byPersonID string) ([]EntryTransfer, error) {
+	transfers := []EntryTransfer{}
+	if err := db.Select(&transfers, transferSelectSQL+" WHERE t.`entry_id`=? ORDER BY t.`requested`", entryID); err != nil {
+		return nil, errors.Wrapf(err, "failed to list transfers")
+	}
+	involved := false
+	for i, t := range transfers {
+		transfers[i].Fee = Amount{Currency: DefaultCurrency, Cents: t.FeeCents}
+		involved = involved || t.FromPersonID == byPersonID || t.ToPersonID == byPersonID
+	}
+	if !involved {
+		var entry Entry
+		if err := db.Get(&entry, "SELECT `id`,`event_id`,`person_id`,`status` FROM `entries` WHERE `id`=?", entryID); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, errors.Errorc(http.StatusNotFound, "unknown entry")
+			}
+			return nil, errors.Wrapf(err, "failed to get entry")
+		}
+		if entry.PersonID != byPersonID {
+			if err := AuthoriseEventOrganiser(entry.EventID, byPersonID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return transfers, nil
+}
+
+//ListEventTransfers lists the transfers in the event, optionally only those
+//with the status
+func ListEventTransfers(eventID, status string) ([]EntryTransfer, error) {
+	query := transferSelectSQL + " WHERE t.`event_id`=?"
+	args := []interface{}{eventID}
+	if status != "" {
+		query += " AND t.`status`=?"
+		args = append(args, status)
+	}
+	transfers := []EntryTransfer{}
+	if err := db.Select(&transfers, query+" ORDER BY t.`requested`", args...); err != nil {
+		return nil, errors.Wrapf(err, "failed to list transfers")
+	}
+	for i := range transfers {
+		transfers[i].Fee = Amount{Currency: DefaultCurrency, Cents: transfers[i].FeeCents}
+	}
+	return transfers, nil
+}
+
+//ListPersonTransfers lists the transfers the person offered or was offered,
+//only to the same person
+func ListPersonTransfers(personID, byPersonID string) ([]EntryTransfer, error) {
+	if err := AuthorisePerson(personID, byPersonID); err != nil {
+		return nil, err
+	}
+	transfers := []EntryTransfer{}
+	if err := db.Select(&transfers,
+		transferSelectSQL+" WHERE t.`from_person_id`=? OR t.`to_person_id`=? ORDER BY t.`requested` DESC",
+		personID, personID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to list transfers")
+	}
+	for i := range transfers {
+		transfers[i].Fee = Amount{Currency: DefaultCurrency, Cents: transfers[i].FeeCents}
+	}
+	return transfers, nil
+}
+
+//notifyTransfer emails one of the persons in a transfer, text is plain text
+func notifyTransfer(t EntryTransfer, personID, subject, text string) {
+	var to struct {
+		FirstName string  `db:"first_name"`
+		LastName  string  `db:"last_name"`
+		Email     *string `db:"email"`
+		EventName string  `db:"event_name"`
+	}
+	if err := db.Get(&to,
+		"SELECT p.`first_name`,p.`last_name`,p.`email`,e.`name` AS `event_name` FROM `persons` p JOIN `events` e ON e.`id`=? WHERE p.`id`=?",
+		t.EventID, personID,
+	); err != nil {
+		log.Errorf("failed to get person %s to notify of transfer %s: %+v", personID, t.ID, err)
+		return
+	}
+	if to.Email == nil {
+		return
+	}
+	msg := email.Message{
+		From:        email.Email{Addr: "no-reply@events.net", Name: "Events"},
+		To:          []email.Email{{Addr: *to.Email, Name: to.FirstName + " " + to.LastName}},
+		Subject:     subject + to.EventName,
+		ContentType: "text/html",
+	}
+	msg.Content = "<H1>" + html.EscapeString(to.EventName) + "</H1>"
+	msg.Content += "<P>" + html.EscapeString(text) + "</P>"
+	if err := email.Send(msg); err != nil {
+		log.Errorf("failed to notify %s of transfer %s: %+v", *to.Email, t.ID, err)
+	}
+}
@@ -0,0 +1,81 @@
+package db_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func TestTransferPolicyCheck(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	before := db.SqlTime(now.Add(-time.Minute))
+	after := db.SqlTime(now.Add(time.Minute))
+	for i, test := range []struct {
+		policy     db.TransferPolicy
+		daysBefore int
+		cancelled  bool
+		code       int
+	}{
+		{db.TransferPolicy{}, 10, false, http.StatusForbidden},
+		{db.TransferPolicy{Allowed: true}, 10, false, 0},
+		{db.TransferPolicy{Allowed: true}, 1, false, 0},
+		{db.TransferPolicy{Allowed: true}, 0, false, http.StatusForbidden},
+		{db.TransferPolicy{Allowed: true}, 10, true, http.StatusConflict},
+		{db.TransferPolicy{Allowed: true, Deadline: &after}, 0, false, 0},
+		{db.TransferPolicy{Allowed: true, Deadline: &before}, 10, false, http.StatusForbidden},
+	} {
+		err := test.policy.Check(now, test.daysBefore, test.cancelled)
+		if test.code == 0 {
+			if err != nil {
+				t.Fatalf("test[%d] failed: %+v", i, err)
+			}
+			continue
+		}
+		if err == nil || errors.Code(err) != test.code {
+			t.Fatalf("test[%d] gave %+v instead of %d", i, err, test.code)
+		}
+	}
+}
+
+func TestTransferAccept(t *testing.T) {
+	offered := db.EntryTransfer{ID: "t1", FromPersonID: "a", ToPersonID: "b", Status: db.TransferOffered}
+	if err := offered.CheckAccept("b"); err != nil {
+		t.Fatalf("cannot accept offered transfer: %+v", err)
+	}
+	if err := offered.CheckAccept("c"); errors.Code(err) != http.StatusForbidden {
+		t.Fatalf("accepted transfer offered to someone else: %+v", err)
+	}
+	//once accepted the fee must be paid, when the fee order expires the
+	//transfer must be offered again
+	for _, status := range []string{db.TransferAccepted, db.TransferExpired, db.TransferCancelled, db.TransferCompleted} {
+		transfer := offered
+		transfer.Status = status
+		if err := transfer.CheckAccept("b"); errors.Code(err) != http.StatusConflict {
+			t.Fatalf("accepted %s transfer: %+v", status, err)
+		}
+	}
+}
+
+func TestTransferCompleteAfterDeadline(t *testing.T) {
+	//the fee was paid after the deadline
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	deadline := db.SqlTime(now.Add(-time.Minute))
+	policy := db.TransferPolicy{Allowed: true, Deadline: &deadline}
+	err := policy.Check(now, 10, false)
+	if errors.Code(err) != http.StatusForbidden {
+		t.Fatalf("completed after deadline: %+v", err)
+	}
+	transfer := db.EntryTransfer{ID: "t1", Status: db.TransferAccepted}
+	transfer.Fail(err)
+	if transfer.Status != db.TransferFailed || transfer.Problem != err.Error() {
+		t.Fatalf("wrong failure: %+v", transfer)
+	}
+
+	transfer.Fail(errors.Errorf("%0500d", 1))
+	if len(transfer.Problem) != 400 {
+		t.Fatalf("problem of %d characters", len(transfer.Problem))
+	}
+}
@@ -0,0 +1,455 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jansemmelink/events/email"
+	"github.com/jmoiron/sqlx"
+)
+
+//VolunteerRole is a helper function defined by the organisers of an event,
+//e.g. "Marshal", "Water Point" or "Registration Desk"
+type VolunteerRole struct {
+	ID          string `json:"id" db:"id"`
+	EventID     string `json:"event_id" db:"event_id"`
+	Name        string `json:"name" db:"name"`
+	Description string `json:"description" db:"description"`
+}
+
+//VolunteerShift is a time slot for a role that needs a number of helpers
+type VolunteerShift struct {
+	ID        string  `json:"id" db:"id"`
+	EventID   string  `json:"event_id" db:"event_id"`
+	RoleID    string  `json:"role_id" db:"role_id"`
+	RoleName  string  `json:"role_name" db:"role_name"`
+	Location  string  `json:"location" db:"location" doc:"Where to report for the shift, e.g. \"Water point at 5km\""`
+	StartTime SqlTime `json:"start_time" db:"start_time"`
+	EndTime   SqlTime `json:"end_time" db:"end_time"`
+	Headcount int     `json:"headcount" db:"headcount" doc:"Nr of helpers needed for this shift"`
+	SignedUp  int     `json:"signed_up" db:"signed_up" doc:"Nr of helpers currently signed up"`
+}
+
+//CanSignUp fails when the shift already started or is full
+func (s VolunteerShift) CanSignUp(now time.Time) error {
+	if err := s.CanDrop(now); err != nil {
+		return err
+	}
+	if s.SignedUp >= s.Headcount {
+		return errors.Errorc(http.StatusConflict, "shift is full")
+	}
+	return nil
+}
+
+//CanDrop fails when the shift already started, so the hours of helpers who
+//were on it stay on their profiles
+func (s VolunteerShift) CanDrop(now time.Time) error {
+	if !time.Time(s.StartTime).After(now) {
+		return errors.Errorc(http.StatusConflict, "shift already started")
+	}
+	return nil
+}
+
+type NewVolunteerRoleRequest struct {
+	ByPersonID  string `json:"by_person_id" doc:"Organiser of the event"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func (req *NewVolunteerRoleRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	return nil
+}
+
+func AddVolunteerRole(eventID string, req NewVolunteerRoleRequest) (*VolunteerRole, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if err := AuthoriseEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	role := VolunteerRole{
+		ID:          uuid.New().String(),
+		EventID:     eventID,
+		Name:        req.Name,
+		Description: req.Description,
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO `volunteer_roles` SET `id`=:id,`event_id`=:event_id,`name`=:name,`description`=:description",
+		role,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add volunteer role")
+	}
+	return &role, nil
+}
+
+func ListVolunteerRoles(eventID string) ([]VolunteerRole, error) {
+	var roles []VolunteerRole
+	if err := NamedSelect(
+		&roles,
+		"SELECT `id`,`event_id`,`name`,`description` FROM `volunteer_roles` WHERE `event_id`=:event_id ORDER BY `name`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get volunteer roles")
+	}
+	return roles, nil
+}
+
+type NewVolunteerShiftRequest struct {
+	ByPersonID string  `json:"by_person_id" doc:"Organiser of the event"`
+	RoleID     string  `json:"role_id"`
+	Location   string  `json:"location"`
+	StartTime  SqlTime `json:"start_time"`
+	EndTime    SqlTime `json:"end_time"`
+	Headcount  int     `json:"headcount"`
+}
+
+func (req *NewVolunteerShiftRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.RoleID == "" {
+		return errors.Errorf("missing role_id")
+	}
+	req.Location = strings.TrimSpace(req.Location)
+	if time.Time(req.StartTime).IsZero() {
+		return errors.Errorf("missing start_time")
+	}
+	if !time.Time(req.EndTime).After(time.Time(req.StartTime)) {
+		return errors.Errorf("end_time %s is not after start_time %s", req.EndTime, req.StartTime)
+	}
+	if req.Headcount < 1 {
+		return errors.Errorf("invalid headcount %d, expecting 1 or more", req.Headcount)
+	}
+	return nil
+}
+
+func AddVolunteerShift(req NewVolunteerShiftRequest) (*VolunteerShift, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	var role VolunteerRole
+	if err := NamedGet(&role,
+		"SELECT `id`,`event_id`,`name`,`description` FROM `volunteer_roles` WHERE `id`=:id",
+		map[string]interface{}{
+			"id": req.RoleID,
+		}); err != nil {
+		return nil, errors.Errorc(http.StatusNotFound, "unknown volunteer role")
+	}
+	if err := AuthoriseEventOrganiser(role.EventID, req.ByPersonID); err != nil {
+		return nil, err
+	}
+	shift := VolunteerShift{
+		ID:        uuid.New().String(),
+		EventID:   role.EventID,
+		RoleID:    role.ID,
+		RoleName:  role.Name,
+		Location:  req.Location,
+		StartTime: req.StartTime,
+		EndTime:   req.EndTime,
+		Headcount: req.Headcount,
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO `volunteer_shifts` SET `id`=:id,`event_id`=:event_id,`role_id`=:role_id,`location`=:location,`start_time`=:start_time,`end_time`=:end_time,`headcount`=:headcount",
+		shift,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add volunteer shift")
+	}
+	return &shift, nil
+}
+
+const selectVolunteerShiftSQL = "SELECT s.`id`,s.`event_id`,s.`role_id`,r.`name` AS role_name,s.`location`,s.`start_time`,s.`end_time`,s.`headcount`," +
+	"(SELECT COUNT(*) FROM `volunteer_signups` AS v WHERE v.`shift_id`=s.`id`) AS signed_up" +
+	" FROM `volunteer_shifts` AS s JOIN `volunteer_roles` AS r ON s.`role_id`=r.`id`"
+
+//ListVolunteerShifts returns all shifts of an event with the nr of helpers
+//signed up for each, so the organisers can see where more are needed
+func ListVolunteerShifts(eventID string) ([]VolunteerShift, error) {
+	var shifts []VolunteerShift
+	if err := NamedSelect(
+		&shifts,
+		selectVolunteerShiftSQL+" WHERE s.`event_id`=:event_id ORDER BY s.`start_time`,r.`name`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get volunteer shifts")
+	}
+	return shifts, nil
+}
+
+type VolunteerSignupRequest struct {
+	PersonID string `json:"person_id"`
+}
+
+func (req VolunteerSignupRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorc(http.StatusBadRequest, "missing person_id")
+	}
+	return nil
+}
+
+//VolunteerSignup adds the person to the shift if it is not yet full
+func VolunteerSignup(shiftID string, req VolunteerSignupRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if err := signupInTx(tx, shiftID, req.PersonID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit signup")
+	}
+	return nil
+}
+
+//VolunteerDrop removes the person from the shift before it starts
+func VolunteerDrop(shiftID string, req VolunteerSignupRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if err := dropInTx(tx, shiftID, req.PersonID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit drop")
+	}
+	return nil
+}
+
+type VolunteerSwapRequest struct {
+	PersonID  string `json:"person_id"`
+	ToShiftID string `json:"to_shift_id" doc:"Shift that the person wants to do instead"`
+}
+
+func (req VolunteerSwapRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorc(http.StatusBadRequest, "missing person_id")
+	}
+	if req.ToShiftID == "" {
+		return errors.Errorc(http.StatusBadRequest, "missing to_shift_id")
+	}
+	return nil
+}
+
+//VolunteerSwap moves the person from one shift to another in one transaction
+//so the person does not lose the current shift when the other one is full
+func VolunteerSwap(fromShiftID string, req VolunteerSwapRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	if req.ToShiftID == fromShiftID {
+		return errors.Errorc(http.StatusBadRequest, "cannot swap to the same shift")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if err := dropInTx(tx, fromShiftID, req.PersonID); err != nil {
+		return err
+	}
+	if err := signupInTx(tx, req.ToShiftID, req.PersonID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to commit swap")
+	}
+	return nil
+} //VolunteerSwap()
+
+//lockShiftInTx locks the shift row so concurrent signups cannot exceed the
+//headcount
+func lockShiftInTx(tx *sqlx.Tx, shiftID string) (*VolunteerShift, error) {
+	var shift VolunteerShift
+	if err := tx.Get(&shift,
+		"SELECT `id`,`start_time`,`headcount`,(SELECT COUNT(*) FROM `volunteer_signups` WHERE `shift_id`=?) AS signed_up FROM `volunteer_shifts` WHERE `id`=? FOR UPDATE",
+		shiftID, shiftID,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown shift")
+		}
+		return nil, errors.Wrapf(err, "failed to get shift")
+	}
+	return &shift, nil
+}
+
+//dropInTx removes the person from the shift unless it already started
+func dropInTx(tx *sqlx.Tx, shiftID, personID string) error {
+	shift, err := lockShiftInTx(tx, shiftID)
+	if err != nil {
+		return err
+	}
+	if err := shift.CanDrop(time.Now()); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM `volunteer_signups` WHERE `shift_id`=? AND `person_id`=?", shiftID, personID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to drop shift")
+	}
+	if nr, _ := result.RowsAffected(); nr < 1 {
+		return errors.Errorc(http.StatusNotFound, "not signed up for this shift")
+	}
+	return nil
+} //dropInTx()
+
+//signupInTx adds the person to the shift unless it already started or is full
+func signupInTx(tx *sqlx.Tx, shiftID, personID string) error {
+	shift, err := lockShiftInTx(tx, shiftID)
+	if err != nil {
+		return err
+	}
+	if err := shift.CanSignUp(time.Now()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO `volunteer_signups` SET `id`=?,`shift_id`=?,`person_id`=?,`signed_up`=?",
+		uuid.New().String(), shiftID, personID, SqlTime(time.Now()),
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return errors.Errorc(http.StatusConflict, "already signed up for this shift")
+		}
+		return errors.Wrapf(err, "failed to sign up")
+	}
+	return nil
+} //signupInTx()
+
+type VolunteerShiftSummary struct {
+	ShiftID   string  `json:"shift_id" db:"shift_id"`
+	EventID   string  `json:"event_id" db:"event_id"`
+	EventName string  `json:"event_name" db:"event_name"`
+	RoleName  string  `json:"role_name" db:"role_name"`
+	Location  string  `json:"location" db:"location"`
+	StartTime SqlTime `json:"start_time" db:"start_time"`
+	EndTime   SqlTime `json:"end_time" db:"end_time"`
+}
+
+type PersonVolunteering struct {
+	PersonID string                  `json:"person_id"`
+	Hours    float64                 `json:"hours" doc:"Total hours of completed shifts"`
+	Done     []VolunteerShiftSummary `json:"done"`
+	Upcoming []VolunteerShiftSummary `json:"upcoming"`
+}
+
+//GetPersonVolunteering lists the shifts of a person for the person profile
+//with the total hours of all shifts already completed
+func GetPersonVolunteering(personID string) (*PersonVolunteering, error) {
+	var shifts []VolunteerShiftSummary
+	if err := NamedSelect(
+		&shifts,
+		"SELECT s.`id` AS shift_id,s.`event_id`,e.`name` AS event_name,r.`name` AS role_name,s.`location`,s.`start_time`,s.`end_time`"+
+			" FROM `volunteer_signups` AS v"+
+			" JOIN `volunteer_shifts` AS s ON v.`shift_id`=s.`id`"+
+			" JOIN `volunteer_roles` AS r ON s.`role_id`=r.`id`"+
+			" JOIN `events` AS e ON s.`event_id`=e.`id`"+
+			" WHERE v.`person_id`=:person_id ORDER BY s.`start_time`",
+		map[string]interface{}{
+			"person_id": personID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get volunteer shifts")
+	}
+	pv := PersonVolunteering{
+		PersonID: personID,
+		Done:     []VolunteerShiftSummary{},
+		Upcoming: []VolunteerShiftSummary{},
+	}
+	now := time.Now()
+	for _, s := range shifts {
+		if time.Time(s.EndTime).Before(now) {
+			pv.Done = append(pv.Done, s)
+			pv.Hours += time.Time(s.EndTime).Sub(time.Time(s.StartTime)).Hours()
+		} else {
+			pv.Upcoming = append(pv.Upcoming, s)
+		}
+	}
+	return &pv, nil
+} //GetPersonVolunteering()
+
+//SendVolunteerReminders emails every helper with a shift starting within the
+//next period who has not yet been reminded, and returns the nr of reminders sent
+func SendVolunteerReminders(period time.Duration) (int, error) {
+	type reminder struct {
+		SignupID  string  `db:"signup_id"`
+		FirstName string  `db:"first_name"`
+		LastName  string  `db:"last_name"`
+		Email     string  `db:"email"`
+		EventName string  `db:"event_name"`
+		RoleName  string  `db:"role_name"`
+		Location  string  `db:"location"`
+		StartTime SqlTime `db:"start_time"`
+		EndTime   SqlTime `db:"end_time"`
+	}
+	var reminders []reminder
+	if err := NamedSelect(
+		&reminders,
+		"SELECT v.`id` AS signup_id,p.`first_name`,p.`last_name`,p.`email`,e.`name` AS event_name,r.`name` AS role_name,s.`location`,s.`start_time`,s.`end_time`"+
+			" FROM `volunteer_signups` AS v"+
+			" JOIN `volunteer_shifts` AS s ON v.`shift_id`=s.`id`"+
+			" JOIN `volunteer_roles` AS r ON s.`role_id`=r.`id`"+
+			" JOIN `events` AS e ON s.`event_id`=e.`id`"+
+			" JOIN `persons` AS p ON v.`person_id`=p.`id`"+
+			" WHERE v.`reminded` IS NULL AND p.`email` IS NOT NULL AND s.`start_time`>:now AND s.`start_time`<=:until",
+		map[string]interface{}{
+			"now":   SqlTime(time.Now()),
+			"until": SqlTime(time.Now().Add(period)),
+		}); err != nil {
+		return 0, errors.Wrapf(err, "failed to get shifts to remind")
+	}
+
+	nrSent := 0
+	for _, r := range reminders {
+		msg := email.Message{
+			From:        email.Email{Addr: "no-reply@events.net", Name: "Events"},
+			To:          []email.Email{{Addr: r.Email, Name: r.FirstName + " " + r.LastName}},
+			Subject:     "Volunteer Shift Reminder: " + r.EventName,
+			ContentType: "text/html",
+		}
+		msg.Content = "<H1>" + html.EscapeString(r.EventName) + "</H1>"
+		msg.Content += fmt.Sprintf("<P>Thank you for helping as %s.</P>", html.EscapeString(r.RoleName))
+		msg.Content += fmt.Sprintf("<P>Your shift is from %s to %s.</P>", r.StartTime, r.EndTime)
+		if r.Location != "" {
+			msg.Content += "<P>Please report at: " + html.EscapeString(r.Location) + "</P>"
+		}
+		if err := email.Send(msg); err != nil {
+			log.Errorf("failed to send volunteer reminder to %s: %+v", r.Email, err)
+			continue //try again on the next run
+		}
+		if _, err := db.NamedExec(
+			"UPDATE `volunteer_signups` SET `reminded`=:now WHERE `id`=:id",
+			map[string]interface{}{
+				"id":  r.SignupID,
+				"now": SqlTime(time.Now()),
+			}); err != nil {
+			return nrSent, errors.Wrapf(err, "failed to mark reminder sent")
+		}
+		nrSent++
+	}
+	return nrSent, nil
+} //SendVolunteerReminders()
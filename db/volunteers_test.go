@@ -0,0 +1,81 @@
+package db_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func TestVolunteerShiftSignup(t *testing.T) {
+	now := time.Date(2022, 6, 25, 6, 0, 0, 0, time.UTC)
+	tests := []struct {
+		start    time.Time
+		signedUp int
+		code     int
+	}{
+		{now.Add(time.Hour), 0, 0},
+		{now.Add(time.Hour), 2, 0},
+		{now.Add(time.Hour), 3, http.StatusConflict}, //full
+		{now.Add(time.Hour), 4, http.StatusConflict}, //headcount reduced
+		{now, 0, http.StatusConflict},                //starting now
+		{now.Add(-time.Minute), 0, http.StatusConflict},
+	}
+	for _, test := range tests {
+		shift := db.VolunteerShift{StartTime: db.SqlTime(test.start), Headcount: 3, SignedUp: test.signedUp}
+		if err := shift.CanSignUp(now); errors.Code(err) != test.code {
+			t.Errorf("start %s with %d/3: code %d instead of %d: %+v", test.start.Sub(now), test.signedUp, errors.Code(err), test.code, err)
+		}
+	}
+}
+
+func TestVolunteerShiftDrop(t *testing.T) {
+	now := time.Date(2022, 6, 25, 6, 0, 0, 0, time.UTC)
+	shift := db.VolunteerShift{StartTime: db.SqlTime(now.Add(time.Minute)), Headcount: 3, SignedUp: 3}
+	if err := shift.CanDrop(now); err != nil {
+		t.Fatalf("cannot drop full shift before it starts: %+v", err)
+	}
+	if err := shift.CanDrop(now.Add(time.Minute)); errors.Code(err) != http.StatusConflict {
+		t.Fatalf("dropped shift that started: %+v", err)
+	}
+}
+
+func TestVolunteerSwap(t *testing.T) {
+	tests := []struct {
+		req  db.VolunteerSwapRequest
+		code int
+	}{
+		{db.VolunteerSwapRequest{ToShiftID: "s2"}, http.StatusBadRequest},
+		{db.VolunteerSwapRequest{PersonID: "p1"}, http.StatusBadRequest},
+		{db.VolunteerSwapRequest{PersonID: "p1", ToShiftID: "s1"}, http.StatusBadRequest}, //same shift
+	}
+	for _, test := range tests {
+		if err := db.VolunteerSwap("s1", test.req); errors.Code(err) != test.code {
+			t.Errorf("%+v: code %d instead of %d: %+v", test.req, errors.Code(err), test.code, err)
+		}
+	}
+	if err := (db.VolunteerSignupRequest{}).Validate(); errors.Code(err) != http.StatusBadRequest {
+		t.Errorf("drop without person_id: %+v", err)
+	}
+}
+
+func TestNewVolunteerShiftRequest(t *testing.T) {
+	start := db.SqlTime(time.Date(2022, 6, 25, 6, 0, 0, 0, time.UTC))
+	end := db.SqlTime(time.Date(2022, 6, 25, 9, 0, 0, 0, time.UTC))
+	tests := []struct {
+		req   db.NewVolunteerShiftRequest
+		valid bool
+	}{
+		{db.NewVolunteerShiftRequest{ByPersonID: "p1", RoleID: "r1", StartTime: start, EndTime: end, Headcount: 4}, true},
+		{db.NewVolunteerShiftRequest{ByPersonID: "p1", RoleID: "r1", StartTime: start, EndTime: end, Headcount: 0}, false},
+		{db.NewVolunteerShiftRequest{ByPersonID: "p1", RoleID: "r1", StartTime: end, EndTime: start, Headcount: 4}, false},
+		{db.NewVolunteerShiftRequest{ByPersonID: "p1", RoleID: "r1", StartTime: start, EndTime: start, Headcount: 4}, false},
+	}
+	for i, test := range tests {
+		if err := test.req.Validate(); (err == nil) != test.valid {
+			t.Errorf("test %d: valid=%v: %+v", i, err == nil, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+)
+
+//WaitlistEntry is a person waiting for a place in an event, e.g. after
+//entries closed or when the event is full. Entering the event removes the
+//person from the waitlist.
+type WaitlistEntry struct {
+	EventID   string  `json:"event_id" db:"event_id"`
+	PersonID  string  `json:"person_id" db:"person_id"`
+	FirstName string  `json:"first_name" db:"first_name"`
+	LastName  string  `json:"last_name" db:"last_name"`
+	Added     SqlTime `json:"added" db:"added"`
+}
+
+type WaitlistRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"The person or family member"`
+	PersonID   string `json:"person_id"`
+}
+
+func (req WaitlistRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	return nil
+}
+
+//JoinWaitlist adds a person who did not enter to the waitlist of the event
+func JoinWaitlist(eventID string, req WaitlistRequest) error {
+	if err := req.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid request")
+	}
+	if err := AuthorisePerson(req.PersonID, req.ByPersonID); err != nil {
+		return err
+	}
+	c, err := getCrew(db, eventID, []string{req.PersonID})
+	if err != nil {
+		return err
+	}
+	if err := checkNotEntered(db, eventID, c.persons); err != nil {
+		return err
+	}
+	if _, err := db.Exec(
+		"INSERT INTO `event_waitlist` SET `event_id`=?,`person_id`=?,`added`=?",
+		eventID, req.PersonID, SqlTime(time.Now()),
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			return errors.Errorc(http.StatusConflict, "already on the waitlist")
+		}
+		return errors.Wrapf(err, "failed to join waitlist")
+	}
+	return nil
+}
+
+//LeaveWaitlist removes the person from the waitlist of the event
+func LeaveWaitlist(eventID string, req WaitlistRequest) error {
+	if err := req.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid request")
+	}
+	if err := AuthorisePerson(req.PersonID, req.ByPersonID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM `event_waitlist` WHERE `event_id`=? AND `person_id`=?", eventID, req.PersonID); err != nil {
+		return errors.Wrapf(err, "failed to leave waitlist")
+	}
+	return nil
+}
+
+//ListWaitlist returns the waitlist of the event to its organisers, first
+//come first
+func ListWaitlist(eventID, byPersonID string) ([]WaitlistEntry, error) {
+	if err := AuthoriseEventOrganiser(eventID, byPersonID); err != nil {
+		return nil, err
+	}
+	list := []WaitlistEntry{}
+	if err := db.Select(&list,
+		"SELECT w.`event_id`,w.`person_id`,p.`first_name`,p.`last_name`,w.`added` FROM `event_waitlist` w JOIN `persons` p ON p.`id`=w.`person_id` WHERE w.`event_id`=? ORDER BY w.`added`",
+		eventID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to list waitlist")
+	}
+	return list, nil
+}
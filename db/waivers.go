@@ -0,0 +1,341 @@
+package db
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//Waiver is a document revision, e.g. an indemnity, that entrants must accept
+//before they can enter the event
+type Waiver struct {
+	ID                string  `json:"id" db:"id"`
+	EventID           string  `json:"event_id" db:"event_id"`
+	DocumentID        string  `json:"document_id" db:"document_id"`
+	DocumentName      string  `json:"document_name" db:"document_name"`
+	Revision          int     `json:"revision" db:"revision"`
+	Title             string  `json:"title" db:"title"`
+	Created           SqlTime `json:"created" db:"created"`
+	CreatedByPersonID string  `json:"created_by_person_id" db:"created_by_person_id"`
+}
+
+const waiverColumns = "w.`id`,w.`event_id`,w.`document_id`,d.`name` AS `document_name`,d.`revision`,w.`title`,w.`created`,w.`created_by_person_id`"
+
+//AgeOfMajority is the age from which a person accepts waivers for themselves.
+//Younger persons need a guardian to accept on their behalf.
+const AgeOfMajority = 18
+
+type SetEventWaiverRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	DocumentID string `json:"document_id" doc:"Revision to accept, replaces a required revision of the same document"`
+	Title      string `json:"title" doc:"Shown to entrants, default is the document name"`
+}
+
+func (req SetEventWaiverRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.DocumentID == "" {
+		return errors.Errorf("missing document_id")
+	}
+	return nil
+}
+
+//SetEventWaiver requires entrants to accept the document revision. Requiring
+//a new revision of the same document means it must be accepted again for new
+//entries, acceptances of older revisions are kept.
+func SetEventWaiver(eventID string, req SetEventWaiverRequest) (*Waiver, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if ok, err := IsEventOrganiser(eventID, req.ByPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can set waivers")
+	}
+	doc, err := AuthoriseDocument(req.DocumentID, req.ByPersonID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Title == "" {
+		req.Title = doc.Name
+	}
+	if _, err := db.Exec(
+		"INSERT INTO `event_waivers` SET `id`=?,`event_id`=?,`document_id`=?,`document_name`=?,`title`=?,`created`=?,`created_by_person_id`=?"+
+			" ON DUPLICATE KEY UPDATE `document_id`=VALUES(`document_id`),`title`=VALUES(`title`),`created`=VALUES(`created`),`created_by_person_id`=VALUES(`created_by_person_id`)",
+		uuid.New().String(), eventID, doc.ID, doc.Name, req.Title, SqlTime(time.Now()), req.ByPersonID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to set waiver")
+	}
+	var w Waiver
+	if err := db.Get(&w,
+		"SELECT "+waiverColumns+" FROM `event_waivers` w JOIN `documents` d ON d.`id`=w.`document_id` WHERE w.`event_id`=? AND w.`document_name`=?",
+		eventID, doc.Name,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get waiver")
+	}
+	return &w, nil
+} //SetEventWaiver()
+
+//RemoveEventWaiver stops requiring the waiver for new entries
+func RemoveEventWaiver(waiverID, byPersonID string) error {
+	w, err := GetWaiver(waiverID)
+	if err != nil {
+		return err
+	}
+	if ok, err := IsEventOrganiser(w.EventID, byPersonID); err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorc(http.StatusForbidden, "only organisers can remove waivers")
+	}
+	if _, err := db.Exec("DELETE FROM `event_waivers` WHERE `id`=?", waiverID); err != nil {
+		return errors.Wrapf(err, "failed to remove waiver")
+	}
+	return nil
+}
+
+func GetWaiver(id string) (*Waiver, error) {
+	var w Waiver
+	if err := NamedGet(&w,
+		"SELECT "+waiverColumns+" FROM `event_waivers` w JOIN `documents` d ON d.`id`=w.`document_id` WHERE w.`id`=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorc(http.StatusNotFound, "unknown waiver")
+		}
+		return nil, errors.Wrapf(err, "failed to get waiver")
+	}
+	return &w, nil
+}
+
+//ListEventWaivers returns the waivers entrants must accept
+func ListEventWaivers(eventID string) ([]Waiver, error) {
+	waivers := []Waiver{}
+	if err := NamedSelect(&waivers,
+		"SELECT "+waiverColumns+" FROM `event_waivers` w JOIN `documents` d ON d.`id`=w.`document_id` WHERE w.`event_id`=:event_id ORDER BY w.`title`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list waivers")
+	}
+	return waivers, nil
+}
+
+//WaiverAcceptance records that a document revision was accepted for a person,
+//by the person or by a guardian for a minor
+type WaiverAcceptance struct {
+	ID                 string  `json:"id" db:"id"`
+	EventID            string  `json:"event_id" db:"event_id"`
+	DocumentID         string  `json:"document_id" db:"document_id"`
+	PersonID           string  `json:"person_id" db:"person_id"`
+	AcceptedByPersonID string  `json:"accepted_by_person_id" db:"accepted_by_person_id"`
+	Capacity           string  `json:"capacity" db:"capacity"`
+	Accepted           SqlTime `json:"accepted" db:"accepted"`
+	IP                 string  `json:"ip" db:"ip"`
+}
+
+//Capacity in which a waiver was accepted
+const (
+	AcceptedAsSelf     = "self"
+	AcceptedAsGuardian = "guardian"
+)
+
+const waiverAcceptanceColumns = "`id`,`event_id`,`document_id`,`person_id`,`accepted_by_person_id`,`capacity`,`accepted`,`ip`"
+
+type AcceptWaiverRequest struct {
+	PersonID   string `json:"person_id" doc:"Entrant"`
+	ByPersonID string `json:"by_person_id" doc:"Person accepting, the entrant or a guardian when the entrant is a minor"`
+	DocumentID string `json:"document_id" doc:"Revision that was shown, to detect that it changed"`
+	IP         string `json:"-"`
+}
+
+func (req AcceptWaiverRequest) Validate() error {
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.DocumentID == "" {
+		return errors.Errorf("missing document_id")
+	}
+	return nil
+}
+
+//AcceptWaiver records acceptance of the revision the waiver requires. Adults
+//accept for themselves, minors need an adult in their family to accept on
+//their behalf. Accepting again returns the first acceptance.
+func AcceptWaiver(waiverID string, req AcceptWaiverRequest) (*WaiverAcceptance, error) {
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	w, err := GetWaiver(waiverID)
+	if err != nil {
+		return nil, err
+	}
+	if w.DocumentID != req.DocumentID {
+		return nil, errors.Errorc(http.StatusConflict, "waiver changed, accept revision "+w.DocumentID)
+	}
+	now := time.Now()
+	capacity, err := acceptanceCapacity(req.PersonID, req.ByPersonID, now)
+	if err != nil {
+		return nil, err
+	}
+	a := WaiverAcceptance{
+		ID:                 uuid.New().String(),
+		EventID:            w.EventID,
+		DocumentID:         w.DocumentID,
+		PersonID:           req.PersonID,
+		AcceptedByPersonID: req.ByPersonID,
+		Capacity:           capacity,
+		Accepted:           SqlTime(now),
+		IP:                 req.IP,
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO `waiver_acceptances` SET `id`=:id,`event_id`=:event_id,`document_id`=:document_id,`person_id`=:person_id,`accepted_by_person_id`=:accepted_by_person_id,`capacity`=:capacity,`accepted`=:accepted,`ip`=:ip",
+		a,
+	); err != nil {
+		if sqlError, ok := err.(*mysql.MySQLError); ok && sqlError.Number == 1062 {
+			if err := db.Get(&a,
+				"SELECT "+waiverAcceptanceColumns+" FROM `waiver_acceptances` WHERE `event_id`=? AND `document_id`=? AND `person_id`=?",
+				w.EventID, w.DocumentID, req.PersonID,
+			); err != nil {
+				return nil, errors.Wrapf(err, "failed to get acceptance")
+			}
+			return &a, nil
+		}
+		return nil, errors.Wrapf(err, "failed to accept waiver")
+	}
+	return &a, nil
+} //AcceptWaiver()
+
+//acceptanceCapacity checks that the person accepting may accept for the
+//entrant and returns in which capacity
+func acceptanceCapacity(personID, byPersonID string, now time.Time) (string, error) {
+	var persons []struct {
+		ID  string `db:"id"`
+		Dob string `db:"dob"`
+	}
+	if err := db.Select(&persons,
+		"SELECT `id`,`dob` FROM `persons` WHERE `id` IN (?,?)",
+		personID, byPersonID,
+	); err != nil {
+		return "", errors.Wrapf(err, "failed to get persons")
+	}
+	minor := map[string]bool{}
+	for _, p := range persons {
+		age, err := AgeOn(p.Dob, now)
+		if err != nil {
+			return "", errors.Wrapf(err, "person %s", p.ID)
+		}
+		minor[p.ID] = age < AgeOfMajority
+	}
+	entrantMinor, ok := minor[personID]
+	if !ok {
+		return "", errors.Errorc(http.StatusNotFound, "unknown person")
+	}
+	byMinor, ok := minor[byPersonID]
+	if !ok {
+		return "", errors.Errorc(http.StatusNotFound, "unknown by_person")
+	}
+	if personID == byPersonID {
+		if entrantMinor {
+			return "", errors.Errorc(http.StatusForbidden, "a minor needs a guardian to accept")
+		}
+		return AcceptedAsSelf, nil
+	}
+	if !entrantMinor {
+		return "", errors.Errorc(http.StatusForbidden, "adults must accept for themselves")
+	}
+	if byMinor {
+		return "", errors.Errorc(http.StatusForbidden, "a guardian must be an adult")
+	}
+	var n int
+	if err := db.Get(&n,
+		"SELECT COUNT(*) FROM `family_person` a JOIN `family_person` b ON a.`family_id`=b.`family_id` WHERE a.`person_id`=? AND b.`person_id`=?",
+		personID, byPersonID,
+	); err != nil {
+		return "", errors.Wrapf(err, "failed to check family")
+	}
+	if n == 0 {
+		return "", errors.Errorc(http.StatusForbidden, "a guardian must be in the same family")
+	}
+	return AcceptedAsGuardian, nil
+} //acceptanceCapacity()
+
+//AgeOn returns the age in whole years on the date of t of someone born on
+//dob (CCYY-MM-DD)
+func AgeOn(dob string, t time.Time) (int, error) {
+	born, err := time.Parse("2006-01-02", dob)
+	if err != nil {
+		return 0, errors.Errorf("invalid dob \"%s\", expecting CCYY-MM-DD", dob)
+	}
+	age := t.Year() - born.Year()
+	if t.Month() < born.Month() || (t.Month() == born.Month() && t.Day() < born.Day()) {
+		age--
+	}
+	return age, nil
+}
+
+//checkWaiversAccepted fails when the person did not accept the revision of
+//each waiver the event requires
+func checkWaiversAccepted(q sqlx.Queryer, eventID, personID string) error {
+	var missing []string
+	if err := sqlx.Select(q, &missing,
+		"SELECT w.`title` FROM `event_waivers` w LEFT JOIN `waiver_acceptances` a ON a.`event_id`=w.`event_id` AND a.`document_id`=w.`document_id` AND a.`person_id`=?"+
+			" WHERE w.`event_id`=? AND a.`id` IS NULL ORDER BY w.`title`",
+		personID, eventID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to check waivers")
+	}
+	if len(missing) > 0 {
+		return errors.Errorc(http.StatusForbidden, "waiver \""+missing[0]+"\" not accepted")
+	}
+	return nil
+}
+
+//WaiverAcceptanceRecord is an acceptance with names for the signed records
+//of an event
+type WaiverAcceptanceRecord struct {
+	WaiverAcceptance
+	DocumentName   string  `json:"document_name" db:"document_name"`
+	Revision       int     `json:"revision" db:"revision"`
+	FirstName      string  `json:"first_name" db:"first_name"`
+	LastName       string  `json:"last_name" db:"last_name"`
+	Dob            string  `json:"dob" db:"dob"`
+	AcceptedByName string  `json:"accepted_by_name" db:"accepted_by_name"`
+	EntryStatus    *string `json:"entry_status,omitempty" db:"entry_status"`
+}
+
+//ListWaiverAcceptances returns all acceptances for the event, including those
+//of revisions no longer required, for organisers to keep as signed records
+func ListWaiverAcceptances(eventID, byPersonID string) ([]WaiverAcceptanceRecord, error) {
+	if ok, err := IsEventOrganiser(eventID, byPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can list acceptances")
+	}
+	records := []WaiverAcceptanceRecord{}
+	if err := NamedSelect(&records,
+		"SELECT a.`id`,a.`event_id`,a.`document_id`,a.`person_id`,a.`accepted_by_person_id`,a.`capacity`,a.`accepted`,a.`ip`,"+
+			"d.`name` AS `document_name`,d.`revision`,p.`first_name`,p.`last_name`,p.`dob`,"+
+			"CONCAT(b.`first_name`,' ',b.`last_name`) AS `accepted_by_name`,e.`status` AS `entry_status`"+
+			" FROM `waiver_acceptances` a"+
+			" JOIN `documents` d ON d.`id`=a.`document_id`"+
+			" JOIN `persons` p ON p.`id`=a.`person_id`"+
+			" JOIN `persons` b ON b.`id`=a.`accepted_by_person_id`"+
+			" LEFT JOIN `entries` e ON e.`event_id`=a.`event_id` AND e.`person_id`=a.`person_id`"+
+			" WHERE a.`event_id`=:event_id ORDER BY p.`last_name`,p.`first_name`,d.`name`,d.`revision`",
+		map[string]interface{}{
+			"event_id": eventID,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list acceptances")
+	}
+	return records, nil
+} //ListWaiverAcceptances()
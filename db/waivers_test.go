@@ -0,0 +1,34 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func TestAgeOn(t *testing.T) {
+	on := time.Date(2024, 2, 27, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		dob string
+		age int
+	}{
+		{"2006-02-27", 18}, //birthday today
+		{"2006-02-28", 17}, //birthday tomorrow
+		{"2006-03-01", 17},
+		{"2006-01-31", 18},
+		{"1973-11-18", 50},
+		{"2004-02-29", 19}, //leap day
+	} {
+		age, err := db.AgeOn(tc.dob, on)
+		if err != nil {
+			t.Fatalf("AgeOn(%s) failed: %+v", tc.dob, err)
+		}
+		if age != tc.age {
+			t.Errorf("AgeOn(%s)=%d, expected %d", tc.dob, age, tc.age)
+		}
+	}
+	if _, err := db.AgeOn("27/02/2006", on); err == nil {
+		t.Errorf("invalid dob did not fail")
+	}
+}
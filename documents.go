@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+//maxDocumentSize limits uploads
+const maxDocumentSize = 100 << 20
+
+//postDocument uploads a revision of the document with URL params name and
+//by_person_id. The content is the request body, with URL param filename, or
+//multipart form file "file". It is streamed to the blob store, not buffered.
+func postDocument(httpRes http.ResponseWriter, httpReq *http.Request) {
+	query := httpReq.URL.Query()
+	req := db.UploadDocumentRequest{
+		Name:        query.Get("name"),
+		ByPersonID:  query.Get("by_person_id"),
+		Filename:    query.Get("filename"),
+		ContentType: httpReq.Header.Get("Content-Type"),
+	}
+	httpReq.Body = http.MaxBytesReader(httpRes, httpReq.Body, maxDocumentSize)
+	var content io.Reader = httpReq.Body
+	if mr, err := httpReq.MultipartReader(); err == nil {
+		content = nil
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if part.FormName() == "file" {
+				req.Filename = part.FileName()
+				req.ContentType = part.Header.Get("Content-Type")
+				content = part
+				break
+			}
+		}
+		if content == nil {
+			http.Error(httpRes, "missing multipart form file \"file\"", http.StatusBadRequest)
+			return
+		}
+	}
+	doc, err := db.UploadDocument(req, content)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to upload document: %+s", err), code)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(doc)
+}
+
+//getDocuments returns the latest revision of each document owned by URL
+//param by_person_id, or all revisions of the document with URL param name
+func getDocuments(ctx context.Context) ([]db.Document, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if params["by_person_id"] == "" {
+		return nil, errors.Errorc(http.StatusForbidden, "missing by_person_id")
+	}
+	if name, ok := params["name"]; ok {
+		return db.ListDocumentRevisions(name, params["by_person_id"])
+	}
+	return db.ListDocuments(params["filter"], params["by_person_id"])
+}
+
+//getDocument expects URL param by_person_id of the owner
+func getDocument(ctx context.Context) (*db.Document, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.AuthoriseDocument(params["id"], params["by_person_id"])
+}
+
+//getDocumentContent streams the content of a document revision to its owner
+//with URL param by_person_id. Others get the content through attachments,
+//waivers, photos or logos.
+func getDocumentContent(httpRes http.ResponseWriter, httpReq *http.Request) {
+	doc, err := db.AuthoriseDocument(mux.Vars(httpReq)["id"], httpReq.URL.Query().Get("by_person_id"))
+	if err == nil {
+		serveDocument(httpRes, httpReq, doc.ID)
+		return
+	}
+	code := http.StatusInternalServerError
+	if c := errors.Code(err); c > 0 {
+		code = c
+	}
+	http.Error(httpRes, fmt.Sprintf("failed to get document: %+s", err), code)
+}
+
+//serveDocument streams the content of a document revision, which never
+//changes, so the content ID is a strong ETag. The caller must authorise.
+func serveDocument(httpRes http.ResponseWriter, httpReq *http.Request, documentID string) {
+	doc, content, err := db.OpenDocument(documentID)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to get document: %+s", err), code)
+		return
+	}
+	defer content.Close()
+	serveContent(httpRes, httpReq, doc, content)
+}
+
+func serveContent(httpRes http.ResponseWriter, httpReq *http.Request, doc *db.Document, content io.Reader) {
+	filename := doc.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("%s-%d", doc.Name, doc.Revision)
+	}
+	httpRes.Header().Set("Content-Type", doc.ContentType)
+	httpRes.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	httpRes.Header().Set("X-Content-Type-Options", "nosniff")
+	httpRes.Header().Set("ETag", "\""+doc.ContentID+"\"")
+	httpRes.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	if rs, ok := content.(io.ReadSeeker); ok {
+		//supports range requests and If-None-Match
+		http.ServeContent(httpRes, httpReq, "", time.Time(doc.Timestamp), rs)
+		return
+	}
+	if httpReq.Header.Get("If-None-Match") == "\""+doc.ContentID+"\"" {
+		httpRes.WriteHeader(http.StatusNotModified)
+		return
+	}
+	httpRes.Header().Set("Content-Length", fmt.Sprintf("%d", doc.Size))
+	io.Copy(httpRes, content)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+//BankDetails tells the payer where to pay by EFT
+type BankDetails struct {
+	Bank          string `json:"bank"`
+	AccountName   string `json:"account_name"`
+	AccountNumber string `json:"account_number"`
+	BranchCode    string `json:"branch_code"`
+	Reference     string `json:"reference" doc:"Must be used as is, else the payment cannot be matched"`
+}
+
+func eftBankDetails(reference string) *BankDetails {
+	return &BankDetails{
+		Bank:          os.Getenv("EFT_BANK"),
+		AccountName:   os.Getenv("EFT_ACCOUNT_NAME"),
+		AccountNumber: os.Getenv("EFT_ACCOUNT_NUMBER"),
+		BranchCode:    os.Getenv("EFT_BRANCH_CODE"),
+		Reference:     reference,
+	}
+}
+
+//postBankStatement imports a CSV or OFX bank statement of the organisation
+//sent as the request body or as multipart form file "statement", and expects
+//URL param by_person_id of an organiser of the organisation
+func postBankStatement(httpRes http.ResponseWriter, httpReq *http.Request) {
+	httpReq.Body = http.MaxBytesReader(httpRes, httpReq.Body, 10<<20)
+	var r io.Reader = httpReq.Body
+	if f, _, err := httpReq.FormFile("statement"); err == nil {
+		defer f.Close()
+		r = f
+	}
+	lines, err := db.ParseBankStatement(r)
+	if err != nil {
+		http.Error(httpRes, fmt.Sprintf("invalid statement: %+s", err), http.StatusBadRequest)
+		return
+	}
+	result, err := db.ImportBankStatement(mux.Vars(httpReq)["id"], httpReq.URL.Query().Get("by_person_id"), lines)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		} else {
+			fmt.Printf("ERROR: failed to import statement: %+v\n", err)
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to import statement: %+s", err), code)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(result)
+}
+
+//getStatementLines expects URL param by_person_id of an organiser of the
+//organisation
+func getStatementLines(ctx context.Context) ([]db.StatementLine, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	status := params["status"]
+	if status == "" {
+		status = "review"
+	}
+	return db.ListStatementLines(params["id"], params["by_person_id"], status)
+}
+
+func postResolveStatementLine(ctx context.Context, req db.ResolveStatementLineRequest) (*db.StatementLine, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ResolveStatementLine(params["id"], req)
+}
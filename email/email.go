@@ -1,6 +1,7 @@
 package email
 
 import (
+	"io"
 	"os"
 	"strings"
 
@@ -35,6 +36,14 @@ type Message struct {
 	ContentType         string
 	Content             string
 	AttachmentFilenames []string
+	Attachments         []Attachment
+}
+
+//Attachment is a generated file attached from memory
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
 }
 
 func (msg *Message) Validate() error {
@@ -69,6 +78,11 @@ func (msg *Message) Validate() error {
 	if msg.Content == "" {
 		return errors.Errorf("missing content")
 	}
+	for index, a := range msg.Attachments {
+		if a.Filename == "" || len(a.Data) == 0 {
+			return errors.Errorf("invalid attachment[%d] without filename or data", index)
+		}
+	}
 	return nil
 }
 
@@ -116,6 +130,19 @@ func Send(msg Message) error {
 	for _, fn := range msg.AttachmentFilenames {
 		m.Attach(fn) //"/home/Alex/lolcat.jpg")
 	}
+	for _, a := range msg.Attachments {
+		data := a.Data
+		settings := []gomail.FileSetting{
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		}
+		if a.ContentType != "" {
+			settings = append(settings, gomail.SetHeader(map[string][]string{"Content-Type": {a.ContentType}}))
+		}
+		m.Attach(a.Filename, settings...)
+	}
 
 	d := gomail.NewDialer(smtpAddr, smtpPort, gmailUsername, gmailAppPassword)
 
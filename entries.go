@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+func postEventCategory(ctx context.Context, req db.NewEventCategoryRequest) (*db.EventCategory, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	c, err := db.AddEventCategory(params["id"], req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add category")
+	}
+	return c, nil
+}
+
+func getEventCategories(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	categories, err := db.ListEventCategories(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+func postEventForm(ctx context.Context, req db.SetEventFormRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.SetEventForm(params["id"], req); err != nil {
+		return errors.Wrapf(err, "failed to set event form")
+	}
+	return nil
+}
+
+func getEventForm(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	form, err := db.GetEventForm(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return form, nil
+}
+
+func postEntry(ctx context.Context, req db.NewEntryRequest) (*db.Entry, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	entry, err := db.AddEntry(params["id"], req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to enter")
+	}
+	return entry, nil
+}
+
+func getEntries(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.AuthoriseEventOrganiser(params["id"], params["by_person_id"]); err != nil {
+		return nil, err
+	}
+	entries, err := db.ListEntries(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func postEntryBib(ctx context.Context, req db.SetEntryBibRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEntryBib(params["id"], req)
+}
+
+func postEntryCheckIn(ctx context.Context, req db.CheckInEntryRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.CheckInEntry(params["id"], req)
+}
+
+//getEventAnswersCSV exports one row per entry with a column for each form
+//field, to an organiser given by URL param by_person_id
+func getEventAnswersCSV(httpRes http.ResponseWriter, httpReq *http.Request) {
+	eventID := mux.Vars(httpReq)["id"]
+	answers, err := db.ListEventAnswers(eventID, httpReq.URL.Query().Get("by_person_id"))
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to get answers: %+s", err), code)
+		return
+	}
+	form, err := db.GetEventForm(eventID)
+	if err != nil {
+		http.Error(httpRes, fmt.Sprintf("failed to get form: %+s", err), http.StatusInternalServerError)
+		return
+	}
+	entries, err := db.ListEntries(eventID)
+	if err != nil {
+		http.Error(httpRes, fmt.Sprintf("failed to get entries: %+s", err), http.StatusInternalServerError)
+		return
+	}
+	answersByEntry := map[string]map[string]string{}
+	for _, a := range answers {
+		if _, ok := answersByEntry[a.EntryID]; !ok {
+			answersByEntry[a.EntryID] = map[string]string{}
+		}
+		answersByEntry[a.EntryID][a.Key] = a.Value
+	}
+
+	httpRes.Header().Set("Content-Type", "text/csv")
+	httpRes.Header().Set("Content-Disposition", "attachment; filename=\"answers.csv\"")
+	w := csv.NewWriter(httpRes)
+	header := []string{"entry_id", "first_name", "last_name", "category", "status"}
+	for _, f := range form.Fields {
+		header = append(header, f.Label)
+	}
+	writeCSVText(w, header)
+	for _, e := range entries {
+		category := ""
+		if e.CategoryName != nil {
+			category = *e.CategoryName
+		}
+		row := []string{e.ID, e.FirstName, e.LastName, category, e.Status}
+		for _, f := range form.Fields {
+			row = append(row, answersByEntry[e.ID][f.Key])
+		}
+		writeCSVText(w, row)
+	}
+	w.Flush()
+} //getEventAnswersCSV()
+
+func getEntryTeam(ctx context.Context) (*db.Team, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.GetEntryTeam(params["id"], params["by_person_id"])
+}
+
+func postTeamResponse(ctx context.Context, req db.RespondTeamPlaceRequest) (*db.TeamMember, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.RespondTeamPlace(params["id"], req)
+}
+
+func postTeamSubstitute(ctx context.Context, req db.SubstituteTeamMemberRequest) (*db.Team, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SubstituteTeamMember(params["id"], req)
+}
+
+//getPersonTeams expects URL param by_person_id of the same person
+func getPersonTeams(ctx context.Context) ([]db.Team, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListPersonTeams(params["id"], params["by_person_id"])
+}
+
+func postEntryResult(ctx context.Context, req db.SetEntryResultRequest) (*db.EntryResult, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEntryResult(params["id"], req)
+}
+
+func getEventResults(ctx context.Context) ([]db.EntryResult, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListEventResults(params["id"])
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+	"github.com/jansemmelink/events/xlsx"
+)
+
+//rowWriter writes the rows of an export as XLSX or CSV
+type rowWriter interface {
+	WriteRow(cells []interface{}) error
+	Close() error
+}
+
+//csvRowWriter writes the cells as text like the other CSV exports
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+func (c csvRowWriter) WriteRow(cells []interface{}) error {
+	row := make([]string, len(cells))
+	for i, cell := range cells {
+		switch v := cell.(type) {
+		case nil:
+		case string:
+			row[i] = csvText(v)
+		case float64:
+			row[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case time.Time:
+			row[i] = v.Format(time.RFC3339)
+			if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 {
+				row[i] = v.Format("2006-01-02")
+			}
+		default:
+			row[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(row)
+}
+
+func (c csvRowWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+//csvText quotes text that spreadsheets would run as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+//writeCSVText writes a row of text cells, see csvText
+func writeCSVText(w *csv.Writer, cells []string) error {
+	row := make([]string, len(cells))
+	for i, cell := range cells {
+		row[i] = csvText(cell)
+	}
+	return w.Write(row)
+}
+
+//exportFilter expects URL param by_person_id of an organiser, with optional
+//sub_event_id and category_id to export part of the event
+func exportFilter(httpReq *http.Request) db.ExportFilter {
+	query := httpReq.URL.Query()
+	return db.ExportFilter{
+		EventID:    mux.Vars(httpReq)["id"],
+		SubEventID: query.Get("sub_event_id"),
+		CategoryID: query.Get("category_id"),
+		ByPersonID: query.Get("by_person_id"),
+	}
+}
+
+//startExport starts the file in the format of URL param format=xlsx|csv,
+//which is XLSX by default. It replies with an error and returns nil when
+//the export cannot start.
+func startExport(httpRes http.ResponseWriter, httpReq *http.Request, name string, header []string) rowWriter {
+	switch format := httpReq.URL.Query().Get("format"); format {
+	case "", "xlsx":
+		httpRes.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		httpRes.Header().Set("Content-Disposition", "attachment; filename=\""+name+".xlsx\"")
+		w, err := xlsx.NewWriter(httpRes, name, header)
+		if err != nil {
+			http.Error(httpRes, fmt.Sprintf("failed to start export: %+s", err), http.StatusInternalServerError)
+			return nil
+		}
+		return w
+	case "csv":
+		httpRes.Header().Set("Content-Type", "text/csv")
+		httpRes.Header().Set("Content-Disposition", "attachment; filename=\""+name+".csv\"")
+		w := csv.NewWriter(httpRes)
+		w.Write(header)
+		return csvRowWriter{w: w}
+	default:
+		http.Error(httpRes, fmt.Sprintf("invalid format \"%s\", expecting xlsx|csv", format), http.StatusBadRequest)
+		return nil
+	}
+}
+
+//exportFailed replies with the error when the export did not start
+func exportFailed(httpRes http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if c := errors.Code(err); c > 0 {
+		code = c
+	}
+	http.Error(httpRes, fmt.Sprintf("failed to export: %+s", err), code)
+}
+
+//endExport completes the file, or only logs errors once rows were sent
+func endExport(w rowWriter, err error) {
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		fmt.Printf("ERROR: failed to export: %+v\n", err)
+	}
+}
+
+//getEntriesExport exports all entries with the entrant, payment and the
+//answers to the event questions
+func getEntriesExport(httpRes http.ResponseWriter, httpReq *http.Request) {
+	filter := exportFilter(httpReq)
+	fields, err := db.ExportFields(filter)
+	if err != nil {
+		exportFailed(httpRes, err)
+		return
+	}
+	header := []string{"entry_id", "event", "bib", "category", "team", "crew", "first_name", "last_name", "gender", "dob", "age", "email", "phone", "status", "entered", "payment", "paid", "refunded"}
+	for _, f := range fields {
+		header = append(header, f.Label)
+	}
+	w := startExport(httpRes, httpReq, "entries", header)
+	if w == nil {
+		return
+	}
+	endExport(w, db.ExportEntries(filter, func(x db.ExportEntry) error {
+		payment := "none"
+		if x.PaymentStatus != nil {
+			payment = *x.PaymentStatus
+		}
+		row := []interface{}{
+			x.EntryID, x.EventName, optional(x.Bib), optional(x.CategoryName), optional(x.TeamName), optional(x.Crew),
+			x.FirstName, x.LastName, x.Gender, exportDate(x.Dob), x.Age, optional(x.Email), optional(x.Phone),
+			x.Status, time.Time(x.Created), payment, x.Paid().Number(), x.Refunded().Number(),
+		}
+		for _, f := range fields {
+			row = append(row, x.Answers[f.Key])
+		}
+		return w.WriteRow(row)
+	}))
+} //getEntriesExport()
+
+//getStartListExport exports the confirmed entries in start order
+func getStartListExport(httpRes http.ResponseWriter, httpReq *http.Request) {
+	filter := exportFilter(httpReq)
+	if err := filter.Validate(); err != nil {
+		exportFailed(httpRes, err)
+		return
+	}
+	w := startExport(httpRes, httpReq, "start-list", []string{"event", "category", "bib", "team", "first_name", "last_name", "crew", "gender", "age"})
+	if w == nil {
+		return
+	}
+	endExport(w, db.ExportStartList(filter, func(x db.ExportEntry) error {
+		return w.WriteRow([]interface{}{
+			x.EventName, optional(x.CategoryName), optional(x.Bib), optional(x.TeamName),
+			x.FirstName, x.LastName, optional(x.Crew), x.Gender, x.Age,
+		})
+	}))
+}
+
+//getResultsExport exports the ranked results
+func getResultsExport(httpRes http.ResponseWriter, httpReq *http.Request) {
+	filter := exportFilter(httpReq)
+	if err := filter.Validate(); err != nil {
+		exportFailed(httpRes, err)
+		return
+	}
+	w := startExport(httpRes, httpReq, "results", []string{"event", "position", "category", "category_position", "bib", "team", "first_name", "last_name", "crew", "status", "time"})
+	if w == nil {
+		return
+	}
+	endExport(w, db.ExportResults(filter, func(x db.ExportResult) error {
+		return w.WriteRow([]interface{}{
+			x.EventName, exportPosition(x.Position), optional(x.CategoryName), exportPosition(x.CategoryPosition), optional(x.Bib), optional(x.TeamName),
+			x.FirstName, x.LastName, optional(x.Crew), x.Status, x.Elapsed,
+		})
+	}))
+}
+
+//optional is the text of a nullable column
+func optional(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+//exportDate is a DATE column as date cell, or the text when not a date
+func exportDate(s string) interface{} {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t
+	}
+	return s
+}
+
+//exportPosition leaves the cell empty for entrants without a position
+func exportPosition(p int) interface{} {
+	if p == 0 {
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+func postOrganisation(ctx context.Context, req db.NewOrganisationRequest) (*db.Organisation, error) {
+	return db.AddOrganisation(req)
+}
+
+func getOrganisation(ctx context.Context) (*db.Organisation, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.GetOrganisation(params["id"])
+}
+
+//getOrganisationLogo streams the logo, which is shown on events and invoices
+func getOrganisationLogo(httpRes http.ResponseWriter, httpReq *http.Request) {
+	o, err := db.GetOrganisation(mux.Vars(httpReq)["id"])
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to get organisation: %+s", err), code)
+		return
+	}
+	if o.LogoDocumentID == nil {
+		http.Error(httpRes, "organisation has no logo", http.StatusNotFound)
+		return
+	}
+	serveDocument(httpRes, httpReq, *o.LogoDocumentID)
+}
+
+func postUpdateOrganisation(ctx context.Context, req db.UpdateOrganisationRequest) (*db.Organisation, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.UpdateOrganisation(params["id"], req)
+}
+
+func postOrganisationMember(ctx context.Context, req db.SetOrganisationMemberRequest) (*db.OrganisationMembership, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetOrganisationMember(params["id"], req)
+}
+
+func getOrganisationMembers(ctx context.Context) ([]db.OrganisationMembership, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListOrganisationMembers(params["id"], params["by_person_id"])
+}
+
+type RemoveOrganisationMemberRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Admin of the organisation, or the member leaving"`
+	PersonID   string `json:"person_id"`
+}
+
+func (req RemoveOrganisationMemberRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.PersonID == "" {
+		return errors.Errorf("missing person_id")
+	}
+	return nil
+}
+
+func postRemoveOrganisationMember(ctx context.Context, req RemoveOrganisationMemberRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.RemoveOrganisationMember(params["id"], req.PersonID, req.ByPersonID)
+}
+
+func getOrganisationEvents(ctx context.Context) ([]db.EventSummary, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListOrganisationEvents(params["id"])
+}
+
+//getPersonOrganisations expects URL param by_person_id of the same person
+func getPersonOrganisations(ctx context.Context) ([]db.OrganisationMembership, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListPersonOrganisations(params["id"], params["by_person_id"])
+}
+
+func postEventOrganisation(ctx context.Context, req db.SetEventOrganisationRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEventOrganisation(params["id"], req)
+}
+
+func getEventOrganisers(ctx context.Context) ([]db.EventOrganiserSummary, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListEventOrganisers(params["id"])
+}
+
+//getOrderInvoice returns the invoice to the payer or an organiser given by
+//URL param person_id
+func getOrderInvoice(ctx context.Context) (*db.Invoice, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if _, err := db.AuthoriseOrder(params["id"], params["person_id"]); err != nil {
+		return nil, err
+	}
+	return db.GetOrderInvoice(params["id"])
+}
+
+func getOrderInvoicePDF(httpRes http.ResponseWriter, httpReq *http.Request) {
+	orderID := mux.Vars(httpReq)["id"]
+	if _, err := db.AuthoriseOrder(orderID, httpReq.URL.Query().Get("person_id")); err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to get invoice: %+s", err), code)
+		return
+	}
+	inv, err := db.GetOrderInvoice(orderID)
+	if err != nil {
+		http.Error(httpRes, fmt.Sprintf("failed to get invoice: %+s", err), http.StatusNotFound)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/pdf")
+	httpRes.Header().Set("Content-Disposition", "attachment; filename=\"invoice-"+inv.Number+".pdf\"")
+	httpRes.Write(inv.PDF())
+}
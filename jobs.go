@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jansemmelink/events/db"
+)
+
+//jobScheduled wakes the job worker
+var jobScheduled = make(chan struct{}, 1)
+
+//wakeJobWorker runs jobs scheduled for now without waiting for the next check
+func wakeJobWorker() {
+	select {
+	case jobScheduled <- struct{}{}:
+	default: //worker already woken
+	}
+}
+
+//jobWorker runs the due jobs of the scheduler, woken when jobs are scheduled
+//and checking every 15 seconds for jobs that came due or were scheduled by
+//other instances
+func jobWorker() {
+	for {
+		for {
+			ran, err := db.RunNextJob()
+			if err != nil {
+				fmt.Printf("ERROR: failed to run jobs: %+v\n", err)
+				break
+			}
+			if !ran {
+				break
+			}
+		}
+		select {
+		case <-jobScheduled:
+		case <-time.After(15 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jansemmelink/events/db"
+)
+
+func getEventLedger(ctx context.Context) (*db.EventLedger, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.AuthoriseEventOrganiser(params["id"], params["by_person_id"]); err != nil {
+		return nil, err
+	}
+	return db.GetEventLedger(params["id"])
+}
+
+func getEventLedgerStatement(ctx context.Context) ([]db.LedgerStatementLine, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.AuthoriseEventOrganiser(params["id"], params["by_person_id"]); err != nil {
+		return nil, err
+	}
+	account := params["account"]
+	if account == "" {
+		account = db.AccountOrganiser
+	}
+	return db.GetEventLedgerStatement(params["id"], account)
+}
+
+func postEventPayout(ctx context.Context, req db.NewPayoutRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.AddPayout(params["id"], req)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+//maxNearbyKm limits the search radius of nearby queries
+const maxNearbyKm = 500
+
+func postLocation(ctx context.Context, req db.NewLocationRequest) (*db.Location, error) {
+	return db.AddLocation(req)
+}
+
+func getLocations(ctx context.Context) ([]db.Location, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListLocations(params["filter"])
+}
+
+func getLocation(ctx context.Context) (*db.Location, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.GetLocation(params["id"])
+}
+
+func postUpdateLocation(ctx context.Context, req db.NewLocationRequest) (*db.Location, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.UpdateLocation(params["id"], req)
+}
+
+//postDeleteLocation expects URL param by_person_id
+func postDeleteLocation(ctx context.Context) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.DeleteLocation(params["id"], params["by_person_id"])
+}
+
+func postMergeLocation(ctx context.Context, req db.MergeLocationRequest) (*db.Location, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.MergeLocation(params["id"], req)
+}
+
+func postEventLocation(ctx context.Context, req db.SetEventLocationRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEventLocation(params["id"], req)
+}
+
+//getNearbyLocations expects URL params lat, lon and km
+func getNearbyLocations(ctx context.Context) ([]db.NearbyLocation, error) {
+	lat, lon, km, err := nearbyParams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListLocationsNear(lat, lon, km)
+}
+
+//getNearbyEvents expects URL params lat, lon and km
+func getNearbyEvents(ctx context.Context) ([]db.NearbyEvent, error) {
+	lat, lon, km, err := nearbyParams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.ListEventsNear(lat, lon, km)
+}
+
+func nearbyParams(ctx context.Context) (lat, lon, km float64, err error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if lat, err = strconv.ParseFloat(params["lat"], 64); err != nil || lat < -90 || lat > 90 {
+		return 0, 0, 0, errors.Errorc(http.StatusBadRequest, "missing or invalid URL param lat")
+	}
+	if lon, err = strconv.ParseFloat(params["lon"], 64); err != nil || lon < -180 || lon > 180 {
+		return 0, 0, 0, errors.Errorc(http.StatusBadRequest, "missing or invalid URL param lon")
+	}
+	if km, err = strconv.ParseFloat(params["km"], 64); err != nil || km <= 0 || km > maxNearbyKm {
+		return 0, 0, 0, errors.Errorc(http.StatusBadRequest, "missing or invalid URL param km, expecting 0..500")
+	}
+	return lat, lon, km, nil
+}
@@ -4,16 +4,25 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"reflect"
 	"strings"
 
 	"github.com/go-msvc/errors"
 	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/blob"
 	"github.com/jansemmelink/events/db"
 )
 
 func main() {
+	fakePay := initPayments()
+	blobs, err := blob.NewFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("cannot store documents: %+v", err))
+	}
+	db.SetBlobStore(blobs)
+
 	r := mux.NewRouter()
 	r.HandleFunc("/auth/exists", auth(authGetExists)).Methods(http.MethodGet)
 	r.HandleFunc("/auth/register", auth(authPostRegister)).Methods(http.MethodPost)
@@ -23,13 +32,160 @@ func main() {
 	r.HandleFunc("/validate/password", auth(authPostValidatePassword)).Methods(http.MethodPost)
 	r.HandleFunc("/events", auth(eventsPostNewEvent)).Methods(http.MethodPost)
 	r.HandleFunc("/events", auth(getEventsList)).Methods(http.MethodGet)
+	r.HandleFunc("/events/nearby", auth(getNearbyEvents)).Methods(http.MethodGet)
 	r.HandleFunc("/event/{id}", auth(getEventDetails)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/times", auth(postEventTimes)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/stats", auth(getEventStats)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/waitlist", auth(postEventWaitlist)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/waitlist", auth(getEventWaitlist)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/waitlist/leave", auth(postEventWaitlistLeave)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/location", auth(postEventLocation)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/course", postEventCourse).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/course", auth(getEventCourse)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/course.geojson", auth(getEventCourseGeoJSON)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/course/delete", auth(postDeleteEventCourse)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/attachments", auth(postEventAttachment)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/attachments", auth(getEventAttachments)).Methods(http.MethodGet)
+	r.HandleFunc("/attachment/{id}/detach", auth(postDetachAttachment)).Methods(http.MethodPost)
+	r.HandleFunc("/attachment/{id}/link", auth(getAttachmentLink)).Methods(http.MethodGet)
+	r.HandleFunc("/attachment/{id}/download", getAttachmentDownload).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/waivers", auth(postEventWaiver)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/waivers", auth(getEventWaivers)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/waivers/acceptances", auth(getWaiverAcceptances)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/waivers/acceptances.csv", getWaiverAcceptancesCSV).Methods(http.MethodGet)
+	r.HandleFunc("/waiver/{id}/content", getWaiverContent).Methods(http.MethodGet)
+	r.HandleFunc("/waiver/{id}/remove", auth(postRemoveWaiver)).Methods(http.MethodPost)
+	r.HandleFunc("/waiver/{id}/accept", auth(postAcceptWaiver)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/photos", postEventPhoto).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/photos", auth(getEventPhotos)).Methods(http.MethodGet)
+	r.HandleFunc("/photo/{id}", auth(getPhoto)).Methods(http.MethodGet)
+	r.HandleFunc("/photo/{id}/{version:original|web|thumb}", getPhotoVersion).Methods(http.MethodGet)
+	r.HandleFunc("/photo/{id}/tags", auth(postPhotoTags)).Methods(http.MethodPost)
+	r.HandleFunc("/photo/{id}/moderate", auth(postModeratePhoto)).Methods(http.MethodPost)
+	r.HandleFunc("/photo/{id}/remove", auth(postRemovePhoto)).Methods(http.MethodPost)
+	r.HandleFunc("/documents", postDocument).Methods(http.MethodPost)
+	r.HandleFunc("/documents", auth(getDocuments)).Methods(http.MethodGet)
+	r.HandleFunc("/document/{id}", auth(getDocument)).Methods(http.MethodGet)
+	r.HandleFunc("/document/{id}/content", getDocumentContent).Methods(http.MethodGet)
+	r.HandleFunc("/locations", auth(postLocation)).Methods(http.MethodPost)
+	r.HandleFunc("/locations", auth(getLocations)).Methods(http.MethodGet)
+	r.HandleFunc("/locations/nearby", auth(getNearbyLocations)).Methods(http.MethodGet)
+	r.HandleFunc("/location/{id}", auth(getLocation)).Methods(http.MethodGet)
+	r.HandleFunc("/location/{id}", auth(postUpdateLocation)).Methods(http.MethodPost)
+	r.HandleFunc("/location/{id}/delete", auth(postDeleteLocation)).Methods(http.MethodPost)
+	r.HandleFunc("/location/{id}/merge", auth(postMergeLocation)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/categories", auth(postEventCategory)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/categories", auth(getEventCategories)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/form", auth(postEventForm)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/form", auth(getEventForm)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/pricing", auth(postEventPricing)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/pricing", auth(getEventPricing)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/promo-codes", auth(postPromoCode)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/promo-codes", auth(getPromoCodes)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/quote", auth(postEventQuote)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/checkout", auth(postCheckout)).Methods(http.MethodPost)
+	r.HandleFunc("/order/{id}", auth(getOrder)).Methods(http.MethodGet)
+	r.HandleFunc("/order/{id}/invoice", auth(getOrderInvoice)).Methods(http.MethodGet)
+	r.HandleFunc("/order/{id}/invoice.pdf", getOrderInvoicePDF).Methods(http.MethodGet)
+	r.HandleFunc("/organisations", auth(postOrganisation)).Methods(http.MethodPost)
+	r.HandleFunc("/organisation/{id}", auth(getOrganisation)).Methods(http.MethodGet)
+	r.HandleFunc("/organisation/{id}", auth(postUpdateOrganisation)).Methods(http.MethodPost)
+	r.HandleFunc("/organisation/{id}/logo", getOrganisationLogo).Methods(http.MethodGet)
+	r.HandleFunc("/organisation/{id}/members", auth(postOrganisationMember)).Methods(http.MethodPost)
+	r.HandleFunc("/organisation/{id}/members", auth(getOrganisationMembers)).Methods(http.MethodGet)
+	r.HandleFunc("/organisation/{id}/members/remove", auth(postRemoveOrganisationMember)).Methods(http.MethodPost)
+	r.HandleFunc("/organisation/{id}/events", auth(getOrganisationEvents)).Methods(http.MethodGet)
+	r.HandleFunc("/person/{id}/organisations", auth(getPersonOrganisations)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/organisation", auth(postEventOrganisation)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/organisers", auth(getEventOrganisers)).Methods(http.MethodGet)
+	r.HandleFunc("/organisation/{id}/membership-types", auth(postMembershipType)).Methods(http.MethodPost)
+	r.HandleFunc("/organisation/{id}/membership-types", auth(getMembershipTypes)).Methods(http.MethodGet)
+	r.HandleFunc("/membership-type/{id}", auth(postUpdateMembershipType)).Methods(http.MethodPost)
+	r.HandleFunc("/membership-type/{id}/renew", auth(postRenewMembership)).Methods(http.MethodPost)
+	r.HandleFunc("/organisation/{id}/memberships", auth(getOrganisationMemberships)).Methods(http.MethodGet)
+	r.HandleFunc("/organisation/{id}/memberships/import", postMembershipImport).Methods(http.MethodPost)
+	r.HandleFunc("/person/{id}/memberships", auth(getPersonMemberships)).Methods(http.MethodGet)
+	r.HandleFunc("/person/{id}/membership-status", auth(getMembershipStatus)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/membership", auth(postEventMembership)).Methods(http.MethodPost)
+	r.HandleFunc("/payment/{provider}/notify", paymentNotify).Methods(http.MethodPost)
+	if fakePay != nil {
+		r.HandleFunc("/payment/fake/pay", fakePay).Methods(http.MethodGet)
+	}
+	r.HandleFunc("/event/{id}/ledger", auth(getEventLedger)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/ledger/statement", auth(getEventLedgerStatement)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/payouts", auth(postEventPayout)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/refund-policy", auth(postEventRefundPolicy)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/refund-policy", auth(getEventRefundPolicy)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/refunds", auth(getEventRefunds)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/cancel", auth(postCancelEvent)).Methods(http.MethodPost)
+	r.HandleFunc("/entry/{id}/refund", auth(postRefundRequest)).Methods(http.MethodPost)
+	r.HandleFunc("/refund/{id}/decide", auth(postRefundDecision)).Methods(http.MethodPost)
+	r.HandleFunc("/refund/{id}/complete", auth(postRefundComplete)).Methods(http.MethodPost)
+	r.HandleFunc("/person/{id}/credit-notes", auth(getPersonCreditNotes)).Methods(http.MethodGet)
+	r.HandleFunc("/organisation/{id}/eft/statements", postBankStatement).Methods(http.MethodPost)
+	r.HandleFunc("/organisation/{id}/eft/lines", auth(getStatementLines)).Methods(http.MethodGet)
+	r.HandleFunc("/eft/line/{id}/resolve", auth(postResolveStatementLine)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/entries", auth(postEntry)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/entries", auth(getEntries)).Methods(http.MethodGet)
+	r.HandleFunc("/entry/{id}/bib", auth(postEntryBib)).Methods(http.MethodPost)
+	r.HandleFunc("/entry/{id}/check-in", auth(postEntryCheckIn)).Methods(http.MethodPost)
+	r.HandleFunc("/entry/{id}/team", auth(getEntryTeam)).Methods(http.MethodGet)
+	r.HandleFunc("/entry/{id}/team/respond", auth(postTeamResponse)).Methods(http.MethodPost)
+	r.HandleFunc("/entry/{id}/team/substitute", auth(postTeamSubstitute)).Methods(http.MethodPost)
+	r.HandleFunc("/person/{id}/teams", auth(getPersonTeams)).Methods(http.MethodGet)
+	r.HandleFunc("/entry/{id}/result", auth(postEntryResult)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/results", auth(getEventResults)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/transfer-policy", auth(postEventTransferPolicy)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/transfer-policy", auth(getEventTransferPolicy)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/transfers", auth(getEventTransfers)).Methods(http.MethodGet)
+	r.HandleFunc("/entry/{id}/transfers", auth(postOfferTransfer)).Methods(http.MethodPost)
+	r.HandleFunc("/entry/{id}/transfers", auth(getEntryTransfers)).Methods(http.MethodGet)
+	r.HandleFunc("/transfer/{id}/accept", auth(postAcceptTransfer)).Methods(http.MethodPost)
+	r.HandleFunc("/transfer/{id}/end", auth(postEndTransfer)).Methods(http.MethodPost)
+	r.HandleFunc("/person/{id}/transfers", auth(getPersonTransfers)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/answers.csv", getEventAnswersCSV).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/export/entries", getEntriesExport).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/export/start-list", getStartListExport).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/export/results", getResultsExport).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/announcements", auth(postAnnouncement)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/announcements", auth(getAnnouncements)).Methods(http.MethodGet)
+	r.HandleFunc("/announcement/{id}/recipients", auth(getAnnouncementRecipients)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/volunteer/roles", auth(postVolunteerRole)).Methods(http.MethodPost)
+	r.HandleFunc("/event/{id}/volunteer/roles", auth(getVolunteerRoles)).Methods(http.MethodGet)
+	r.HandleFunc("/event/{id}/volunteer/shifts", auth(getVolunteerShifts)).Methods(http.MethodGet)
+	r.HandleFunc("/volunteer/shifts", auth(postVolunteerShift)).Methods(http.MethodPost)
+	r.HandleFunc("/volunteer/shift/{id}/signup", auth(postVolunteerSignup)).Methods(http.MethodPost)
+	r.HandleFunc("/volunteer/shift/{id}/drop", auth(postVolunteerDrop)).Methods(http.MethodPost)
+	r.HandleFunc("/volunteer/shift/{id}/swap", auth(postVolunteerSwap)).Methods(http.MethodPost)
+	r.HandleFunc("/person/{id}/volunteering", auth(getPersonVolunteering)).Methods(http.MethodGet)
 	http.Handle("/", CORS(r))
+	go jobWorker()
+	go photoWorker()
 	http.ListenAndServe(":12345", nil)
 }
 
 type CtxParams struct{}
 
+//CtxClientIP is the IP address of the client making the request
+type CtxClientIP struct{}
+
+//clientIP is the remote address, or the client given by X-Forwarded-For when
+//the request came through a proxy on the local network
+func clientIP(httpReq *http.Request) string {
+	host, _, err := net.SplitHostPort(httpReq.RemoteAddr)
+	if err != nil {
+		host = httpReq.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsPrivate()) {
+		if forwarded := httpReq.Header.Get("X-Forwarded-For"); forwarded != "" {
+			if client := strings.TrimSpace(strings.Split(forwarded, ",")[0]); net.ParseIP(client) != nil {
+				return client
+			}
+		}
+	}
+	return host
+}
+
 func CORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
@@ -97,6 +253,7 @@ func auth(fnc interface{}) func(http.ResponseWriter, *http.Request) {
 			params[n] = v
 		}
 		ctx = context.WithValue(ctx, CtxParams{}, params)
+		ctx = context.WithValue(ctx, CtxClientIP{}, clientIP(httpReq))
 
 		//prepare fnc arguments
 		args := []reflect.Value{reflect.ValueOf(ctx)}
@@ -214,6 +371,7 @@ func eventsPostNewEvent(ctx context.Context, req db.NewEventRequest) (db.Event,
 	if err != nil {
 		return db.Event{}, errors.Wrapf(err, "failed to create new event")
 	}
+	return *event, nil
 }
 
 func getEventsList(ctx context.Context) (interface{}, error) {
@@ -229,11 +387,38 @@ func getEventsList(ctx context.Context) (interface{}, error) {
 func getEventDetails(ctx context.Context) (interface{}, error) {
 	params := ctx.Value(CtxParams{}).(map[string]string)
 	id := params["id"]
-	events, err := db.GetEvent(id)
+	details, err := db.GetEventDetails(id, params["person_id"])
 	if err != nil {
 		return nil, err
 	}
-	return events, nil
+	return details, nil
+}
+
+//getEventStats expects URL param by_person_id of an organiser
+func getEventStats(ctx context.Context) (*db.EventStats, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.GetEventStats(params["id"], params["by_person_id"])
+}
+
+func postEventWaitlist(ctx context.Context, req db.WaitlistRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.JoinWaitlist(params["id"], req)
+}
+
+func postEventWaitlistLeave(ctx context.Context, req db.WaitlistRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.LeaveWaitlist(params["id"], req)
+}
+
+//getEventWaitlist expects URL param by_person_id of an organiser
+func getEventWaitlist(ctx context.Context) ([]db.WaitlistEntry, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListWaitlist(params["id"], params["by_person_id"])
+}
+
+func postEventTimes(ctx context.Context, req db.SetEventTimesRequest) (*db.Event, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEventTimes(params["id"], req)
 }
 
 type Validator interface {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+func postMembershipType(ctx context.Context, req db.MembershipTypeRequest) (*db.MembershipType, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.AddMembershipType(params["id"], req)
+}
+
+func getMembershipTypes(ctx context.Context) ([]db.MembershipType, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListMembershipTypes(params["id"])
+}
+
+func postUpdateMembershipType(ctx context.Context, req db.MembershipTypeRequest) (*db.MembershipType, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.UpdateMembershipType(params["id"], req)
+}
+
+func postRenewMembership(ctx context.Context, req db.RenewMembershipRequest) (*CheckoutResponse, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	provider := paymentProvider.Name()
+	if req.PayBy == db.ProviderEFT {
+		provider = db.ProviderEFT
+	}
+	order, err := db.RenewMembership(params["id"], req, provider)
+	if err != nil {
+		return nil, errors.Wrapf(err, "renewal failed")
+	}
+	return startPayment(order, provider, "Membership")
+}
+
+//getPersonMemberships expects URL param by_person_id of the same person
+func getPersonMemberships(ctx context.Context) ([]db.Membership, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListPersonMemberships(params["id"], params["by_person_id"])
+}
+
+//getMembershipStatus includes the membership only when URL param by_person_id
+//is the same person or an organiser of the organisation
+func getMembershipStatus(ctx context.Context) (*db.MembershipStatus, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.GetMembershipStatus(params["id"], params["organisation_id"], params["date"], params["by_person_id"])
+}
+
+func getOrganisationMemberships(ctx context.Context) ([]db.Membership, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListOrganisationMemberships(params["id"], params["by_person_id"], params["date"])
+}
+
+func postEventMembership(ctx context.Context, req db.SetEventMembershipRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEventMembership(params["id"], req)
+}
+
+//postMembershipImport imports a membership list CSV, posted as the body or
+//as the file "list" of a multipart form
+func postMembershipImport(httpRes http.ResponseWriter, httpReq *http.Request) {
+	httpReq.Body = http.MaxBytesReader(httpRes, httpReq.Body, 10<<20)
+	var r io.Reader = httpReq.Body
+	if f, _, err := httpReq.FormFile("list"); err == nil {
+		defer f.Close()
+		r = f
+	}
+	rows, err := db.ParseMembershipCSV(r)
+	if err != nil {
+		http.Error(httpRes, fmt.Sprintf("invalid membership list: %+s", err), http.StatusBadRequest)
+		return
+	}
+	req := db.ImportMembershipsRequest{
+		ByPersonID: httpReq.URL.Query().Get("by_person_id"),
+		TypeID:     httpReq.URL.Query().Get("type_id"),
+	}
+	result, err := db.ImportMemberships(mux.Vars(httpReq)["id"], req, rows)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		} else {
+			fmt.Printf("ERROR: failed to import memberships: %+v\n", err)
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to import memberships: %+s", err), code)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(result)
+}
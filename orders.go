@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+	"github.com/jansemmelink/events/payment"
+)
+
+var (
+	apiURL          string
+	webURL          string
+	paymentProvider payment.Provider
+)
+
+//initPayments selects the payment provider from env PAYMENT_PROVIDER=payfast|fake
+//and returns the handler for the fake checkout page when using the fake. The
+//fake confirms payments without money, so it also needs EVENTS_DEV=true.
+func initPayments() http.HandlerFunc {
+	apiURL = os.Getenv("EVENTS_API_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:12345"
+	}
+	webURL = os.Getenv("EVENTS_WEB_URL")
+	if webURL == "" {
+		webURL = "http://localhost:3000"
+	}
+	switch os.Getenv("PAYMENT_PROVIDER") {
+	case "payfast":
+		pf, err := payment.NewPayFastFromEnv()
+		if err != nil {
+			panic(fmt.Sprintf("cannot use payfast: %+v", err))
+		}
+		paymentProvider = pf
+	case "fake":
+		if os.Getenv("EVENTS_DEV") != "true" {
+			panic("PAYMENT_PROVIDER=fake is only allowed with EVENTS_DEV=true")
+		}
+		secret := os.Getenv("FAKE_PAYMENT_SECRET")
+		if secret == "" {
+			secret = uuid.New().String()
+		}
+		fake := payment.Fake{Secret: secret, BaseURL: apiURL, NotifyURL: apiURL + "/payment/fake/notify"}
+		paymentProvider = fake
+		return fake.Pay
+	case "":
+		panic("missing env PAYMENT_PROVIDER, expecting payfast|fake")
+	default:
+		panic(fmt.Sprintf("unknown PAYMENT_PROVIDER=%s, expecting payfast|fake", os.Getenv("PAYMENT_PROVIDER")))
+	}
+	return nil
+}
+
+type CheckoutResponse struct {
+	Order       *db.Order    `json:"order"`
+	RedirectURL string       `json:"redirect_url,omitempty" doc:"Where to send the payer to pay online, empty when nothing is due"`
+	BankDetails *BankDetails `json:"bank_details,omitempty" doc:"Where to pay by EFT"`
+}
+
+func postCheckout(ctx context.Context, req db.CheckoutRequest) (*CheckoutResponse, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	provider := paymentProvider.Name()
+	if req.PayBy == db.ProviderEFT {
+		provider = db.ProviderEFT
+	}
+	order, err := db.Checkout(params["id"], req, provider)
+	if err != nil {
+		return nil, errors.Wrapf(err, "checkout failed")
+	}
+	return startPayment(order, provider, fmt.Sprintf("%d entries", len(req.Entries)))
+} //postCheckout()
+
+//startPayment gives the bank details for EFT or redirects the payer to the
+//payment provider to pay a pending order
+func startPayment(order *db.Order, provider string, description string) (*CheckoutResponse, error) {
+	res := CheckoutResponse{Order: order}
+	if order.Status != db.OrderPending {
+		return &res, nil
+	}
+	if provider == db.ProviderEFT {
+		res.BankDetails = eftBankDetails(order.Reference)
+		return &res, nil
+	}
+	payer, err := db.GetPerson(map[string]string{"id": order.PersonID})
+	if err != nil || payer == nil {
+		return nil, errors.Errorf("payer not found")
+	}
+	c := payment.Checkout{
+		OrderID:        order.ID,
+		AmountCents:    order.DueCents(),
+		Description:    description,
+		PayerFirstName: payer.Name,
+		PayerLastName:  payer.Surname,
+		ReturnURL:      webURL + "/order?id=" + order.ID,
+		CancelURL:      webURL + "/order?id=" + order.ID + "&cancelled=true",
+		NotifyURL:      apiURL + "/payment/" + paymentProvider.Name() + "/notify",
+	}
+	if payer.Email != nil {
+		c.PayerEmail = *payer.Email
+	}
+	if res.RedirectURL, err = paymentProvider.Checkout(c); err != nil {
+		return nil, errors.Wrapf(err, "failed to start payment")
+	}
+	return &res, nil
+} //startPayment()
+
+func getOrder(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	order, err := db.AuthoriseOrder(params["id"], params["person_id"])
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+//paymentNotify receives the signed callback from the payment provider
+func paymentNotify(httpRes http.ResponseWriter, httpReq *http.Request) {
+	if mux.Vars(httpReq)["provider"] != paymentProvider.Name() {
+		http.Error(httpRes, "unknown provider", http.StatusNotFound)
+		return
+	}
+	n, err := paymentProvider.VerifyCallback(httpReq)
+	if err != nil {
+		fmt.Printf("ERROR: rejected payment callback: %+v\n", err)
+		http.Error(httpRes, "invalid callback", http.StatusBadRequest)
+		return
+	}
+	if err := db.ProcessPayment(paymentProvider.Name(), *n); err != nil {
+		fmt.Printf("ERROR: failed to process payment %+v: %+v\n", *n, err)
+		if c := errors.Code(err); c >= 400 && c < 500 {
+			http.Error(httpRes, "rejected", c) //e.g. unknown order, retrying will not help
+			return
+		}
+		http.Error(httpRes, "failed to process", http.StatusInternalServerError) //provider will retry
+		return
+	}
+	httpRes.WriteHeader(http.StatusOK)
+}
@@ -14,7 +14,7 @@ type ormTable struct {
 	dbName         string       //name of database table
 	dbStructType   reflect.Type //struct generated to include db tags for read/insert
 	sqlSchema      string       //CREATE TABLE `...` (...) ...;
-...need mapping from user struct -> db col to iterate over when writing the SQL for INSERT...
+//todo: mapping from user struct -> db col to iterate over when writing the SQL for INSERT
 }
 
 func (ot ormTable) Name() string {
@@ -0,0 +1,131 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
+
+//Fake is a local payment provider for tests and development. Its checkout
+//URL is a page on our own server (see Pay) that pretends the payer paid and
+//posts a signed notification to our own notify url. Only checkout URLs it
+//signed are paid, so the order and amount cannot be changed by the payer.
+type Fake struct {
+	Secret    string //signs checkout URLs and notifications
+	BaseURL   string //where this server is reachable, e.g. "http://localhost:12345"
+	NotifyURL string //where this server receives notifications, the only place Pay posts to
+	RefundErr error  //returned by Refund when set, e.g. to test refused refunds
+}
+
+func (f Fake) Name() string {
+	return "fake"
+}
+
+func (f Fake) Checkout(c Checkout) (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid checkout")
+	}
+	v := url.Values{}
+	v.Set("order_id", c.OrderID)
+	v.Set("amount", formatCents(c.AmountCents))
+	v.Set("return_url", c.ReturnURL)
+	v.Set("signature", f.sign(v))
+	return f.BaseURL + "/payment/fake/pay?" + v.Encode(), nil
+}
+
+//Notification returns the signed form that the fake provider posts to the notify url
+func (f Fake) Notification(orderID string, amountCents int, status string) url.Values {
+	v := url.Values{}
+	v.Set("order_id", orderID)
+	v.Set("payment_id", uuid.New().String())
+	v.Set("amount", formatCents(amountCents))
+	v.Set("status", status)
+	v.Set("signature", f.sign(v))
+	return v
+}
+
+func (f Fake) VerifyCallback(httpReq *http.Request) (*Notification, error) {
+	if err := httpReq.ParseForm(); err != nil {
+		return nil, errors.Wrapf(err, "invalid notification")
+	}
+	v := httpReq.PostForm
+	signature := v.Get("signature")
+	v.Del("signature")
+	if !hmac.Equal([]byte(signature), []byte(f.sign(v))) {
+		return nil, errors.Errorc(http.StatusUnauthorized, "invalid notification signature")
+	}
+	n := Notification{
+		OrderID:     v.Get("order_id"),
+		ProviderRef: v.Get("payment_id"),
+		Status:      v.Get("status"),
+		Payload:     v.Encode(),
+	}
+	var err error
+	if n.AmountCents, err = parseCents(v.Get("amount")); err != nil {
+		return nil, errors.Wrapf(err, "invalid notification amount")
+	}
+	switch n.Status {
+	case StatusComplete, StatusFailed, StatusCancelled:
+	default:
+		return nil, errors.Errorf("invalid notification status \"%s\"", n.Status)
+	}
+	return &n, nil
+}
+
+//Refund succeeds unless RefundErr is set
+func (f Fake) Refund(r Refund) (string, error) {
+	if err := r.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid refund")
+	}
+	if f.RefundErr != nil {
+		return "", f.RefundErr
+	}
+	return "refund-" + uuid.New().String(), nil
+}
+
+//Pay is the HTTP handler for the checkout URL. It completes the payment
+//unless called with ?status=failed or ?status=cancelled.
+func (f Fake) Pay(httpRes http.ResponseWriter, httpReq *http.Request) {
+	q := httpReq.URL.Query()
+	status := q.Get("status")
+	if status == "" {
+		status = StatusComplete
+	}
+	signature := q.Get("signature")
+	signed := url.Values{}
+	for _, name := range []string{"order_id", "amount", "return_url"} {
+		signed.Set(name, q.Get(name))
+	}
+	if !hmac.Equal([]byte(signature), []byte(f.sign(signed))) {
+		http.Error(httpRes, "invalid checkout signature", http.StatusForbidden)
+		return
+	}
+	amountCents, err := parseCents(q.Get("amount"))
+	if err != nil {
+		http.Error(httpRes, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := http.PostForm(f.NotifyURL, f.Notification(q.Get("order_id"), amountCents, status))
+	if err != nil {
+		http.Error(httpRes, fmt.Sprintf("failed to notify: %s", err), http.StatusBadGateway)
+		return
+	}
+	res.Body.Close()
+	if q.Get("return_url") == "" {
+		fmt.Fprintf(httpRes, "Paid %s for order %s (notify status %d)\n", q.Get("amount"), q.Get("order_id"), res.StatusCode)
+		return
+	}
+	http.Redirect(httpRes, httpReq, q.Get("return_url"), http.StatusFound)
+}
+
+//sign is the HMAC of the fields sorted by name
+func (f Fake) sign(v url.Values) string {
+	mac := hmac.New(sha256.New, []byte(f.Secret))
+	mac.Write([]byte(v.Encode()))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
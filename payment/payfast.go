@@ -0,0 +1,245 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//PayFast is the redirect-style South African gateway: the payer is sent to
+//PayFast with a signed set of fields and PayFast posts a signed ITN (instant
+//transaction notification) to our notify_url
+type PayFast struct {
+	MerchantID  string
+	MerchantKey string
+	Passphrase  string //set in the PayFast account settings, required to sign
+	Host        string //"https://www.payfast.co.za" or the sandbox
+	Validate    bool   //confirm each ITN with the PayFast server
+	API         string //"https://api.payfast.co.za" used for refunds
+	Testing     bool   //use the sandbox in API calls
+}
+
+func NewPayFastFromEnv() (*PayFast, error) {
+	p := &PayFast{
+		MerchantID:  os.Getenv("PAYFAST_MERCHANT_ID"),
+		MerchantKey: os.Getenv("PAYFAST_MERCHANT_KEY"),
+		Passphrase:  os.Getenv("PAYFAST_PASSPHRASE"),
+		Host:        "https://www.payfast.co.za",
+		Validate:    true,
+		API:         "https://api.payfast.co.za",
+	}
+	if os.Getenv("PAYFAST_SANDBOX") == "true" {
+		p.Host = "https://sandbox.payfast.co.za"
+		p.Testing = true
+	}
+	if p.MerchantID == "" || p.MerchantKey == "" {
+		return nil, errors.Errorf("missing env PAYFAST_MERCHANT_ID or PAYFAST_MERCHANT_KEY")
+	}
+	if p.Passphrase == "" {
+		return nil, errors.Errorf("missing env PAYFAST_PASSPHRASE")
+	}
+	return p, nil
+}
+
+func (p PayFast) Name() string {
+	return "payfast"
+}
+
+func (p PayFast) Checkout(c Checkout) (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid checkout")
+	}
+	//fields must be in this order for the signature
+	fields := []field{
+		{"merchant_id", p.MerchantID},
+		{"merchant_key", p.MerchantKey},
+		{"return_url", c.ReturnURL},
+		{"cancel_url", c.CancelURL},
+		{"notify_url", c.NotifyURL},
+		{"name_first", c.PayerFirstName},
+		{"name_last", c.PayerLastName},
+		{"email_address", c.PayerEmail},
+		{"m_payment_id", c.OrderID},
+		{"amount", formatCents(c.AmountCents)},
+		{"item_name", c.Description},
+	}
+	nonEmpty := []field{}
+	for _, f := range fields {
+		f.value = strings.TrimSpace(f.value)
+		if f.value != "" {
+			nonEmpty = append(nonEmpty, f)
+		}
+	}
+	paramString := p.paramString(nonEmpty)
+	return p.Host + "/eng/process?" + paramString + "&signature=" + p.sign(paramString), nil
+}
+
+func (p PayFast) VerifyCallback(httpReq *http.Request) (*Notification, error) {
+	body, err := io.ReadAll(httpReq.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read ITN")
+	}
+	fields, err := parseOrderedForm(string(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ITN")
+	}
+	signature := ""
+	signed := []field{}
+	values := map[string]string{}
+	for _, f := range fields {
+		if f.name == "signature" {
+			signature = f.value
+			continue
+		}
+		signed = append(signed, f)
+		values[f.name] = f.value
+	}
+	paramString := p.paramString(signed)
+	if signature == "" || !hmac.Equal([]byte(signature), []byte(p.sign(paramString))) {
+		return nil, errors.Errorc(http.StatusUnauthorized, "invalid ITN signature")
+	}
+	if values["merchant_id"] != p.MerchantID {
+		return nil, errors.Errorc(http.StatusUnauthorized, "ITN for another merchant")
+	}
+	if p.Validate {
+		if err := p.validateWithServer(paramString); err != nil {
+			return nil, err
+		}
+	}
+
+	n := Notification{
+		OrderID:     values["m_payment_id"],
+		ProviderRef: values["pf_payment_id"],
+		Payload:     string(body),
+	}
+	if n.OrderID == "" || n.ProviderRef == "" {
+		return nil, errors.Errorf("ITN without m_payment_id or pf_payment_id")
+	}
+	if n.AmountCents, err = parseCents(values["amount_gross"]); err != nil {
+		return nil, errors.Wrapf(err, "invalid ITN amount_gross")
+	}
+	if fee := strings.TrimPrefix(values["amount_fee"], "-"); fee != "" {
+		if n.FeeCents, err = parseCents(fee); err != nil {
+			return nil, errors.Wrapf(err, "invalid ITN amount_fee")
+		}
+	}
+	switch values["payment_status"] {
+	case "COMPLETE":
+		n.Status = StatusComplete
+	case "CANCELLED":
+		n.Status = StatusCancelled
+	default:
+		n.Status = StatusFailed
+	}
+	return &n, nil
+} //PayFast.VerifyCallback()
+
+//Refund uses the PayFast refunds API, which is authenticated with a signature
+//over the headers and body fields sorted by name
+func (p PayFast) Refund(r Refund) (string, error) {
+	if err := r.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid refund")
+	}
+	timestamp := time.Now().Format("2006-01-02T15:04:05-07:00")
+	params := map[string]string{
+		"merchant-id": p.MerchantID,
+		"version":     "v1",
+		"timestamp":   timestamp,
+		"amount":      strconv.Itoa(r.AmountCents),
+		"reason":      r.Reason,
+		"passphrase":  p.Passphrase,
+	}
+	names := []string{}
+	for n := range params {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	signed := []field{}
+	for _, n := range names {
+		signed = append(signed, field{n, params[n]})
+	}
+	body := url.Values{}
+	body.Set("amount", params["amount"])
+	body.Set("reason", r.Reason)
+
+	u := p.API + "/refunds/" + url.PathEscape(r.PaymentRef)
+	if p.Testing {
+		u += "?testing=true"
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, u, strings.NewReader(body.Encode()))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create refund request")
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("merchant-id", p.MerchantID)
+	httpReq.Header.Set("version", "v1")
+	httpReq.Header.Set("timestamp", timestamp)
+	httpReq.Header.Set("signature", fmt.Sprintf("%x", md5.Sum([]byte(p.paramString(signed)))))
+	client := http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to request refund")
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("refund failed with HTTP %d: %s", res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(resBody, &result); err != nil {
+		return "", errors.Wrapf(err, "invalid refund response: %s", strings.TrimSpace(string(resBody)))
+	}
+	if result.Status != "success" {
+		return "", errors.Errorf("refund failed: %s", strings.TrimSpace(string(resBody)))
+	}
+	//PayFast keeps refunds under the payment, see /refunds/query/{pf_payment_id},
+	//and does not return a reference per refund, so each partial refund is
+	//identified by the payment and our refund id
+	return r.PaymentRef + "/" + r.ID, nil
+} //PayFast.Refund()
+
+func (p PayFast) paramString(fields []field) string {
+	s := ""
+	for i, f := range fields {
+		if i > 0 {
+			s += "&"
+		}
+		s += f.name + "=" + url.QueryEscape(f.value)
+	}
+	return s
+}
+
+func (p PayFast) sign(paramString string) string {
+	if p.Passphrase != "" {
+		paramString += "&passphrase=" + url.QueryEscape(p.Passphrase)
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(paramString)))
+}
+
+//validateWithServer posts the ITN back to PayFast which confirms that it sent it
+func (p PayFast) validateWithServer(paramString string) error {
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(p.Host+"/eng/query/validate", "application/x-www-form-urlencoded", strings.NewReader(paramString))
+	if err != nil {
+		return errors.Wrapf(err, "failed to validate ITN")
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if strings.TrimSpace(string(body)) != "VALID" {
+		return errors.Errorc(http.StatusUnauthorized, "ITN not confirmed by server")
+	}
+	return nil
+}
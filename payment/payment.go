@@ -0,0 +1,149 @@
+package payment
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-msvc/errors"
+)
+
+//Provider is a payment gateway where the payer is redirected to pay and
+//which then notifies us of the result with a signed callback
+type Provider interface {
+	Name() string
+
+	//Checkout returns the URL to redirect the payer to
+	Checkout(c Checkout) (redirectURL string, err error)
+
+	//VerifyCallback checks the signature of the callback request and returns
+	//the notification it contains. It must not trust anything unsigned.
+	VerifyCallback(httpReq *http.Request) (*Notification, error)
+
+	//Refund pays back all or part of a completed payment and returns the
+	//provider's reference for the refund
+	Refund(r Refund) (refundRef string, err error)
+}
+
+//Checkout describes what the payer must pay
+type Checkout struct {
+	OrderID        string
+	AmountCents    int
+	Description    string
+	PayerFirstName string
+	PayerLastName  string
+	PayerEmail     string
+	ReturnURL      string //where the payer goes after paying
+	CancelURL      string //where the payer goes after cancelling
+	NotifyURL      string //where the provider posts the callback
+}
+
+func (c Checkout) Validate() error {
+	if c.OrderID == "" {
+		return errors.Errorf("missing order id")
+	}
+	if c.AmountCents <= 0 {
+		return errors.Errorf("invalid amount %d cents", c.AmountCents)
+	}
+	if c.NotifyURL == "" {
+		return errors.Errorf("missing notify url")
+	}
+	return nil
+}
+
+//Refund describes what must be paid back
+type Refund struct {
+	ID          string //our unique id of the refund, an order may have several
+	OrderID     string
+	PaymentRef  string //ProviderRef of the payment being refunded
+	AmountCents int
+	Reason      string
+}
+
+func (r Refund) Validate() error {
+	if r.ID == "" {
+		return errors.Errorf("missing id")
+	}
+	if r.PaymentRef == "" {
+		return errors.Errorf("missing payment ref")
+	}
+	if r.AmountCents <= 0 {
+		return errors.Errorf("invalid amount %d cents", r.AmountCents)
+	}
+	return nil
+}
+
+//Notification is the verified result of a payment reported by the provider
+type Notification struct {
+	OrderID     string
+	ProviderRef string //unique reference of the payment at the provider
+	AmountCents int
+	FeeCents    int //deducted by the provider
+	Status      string
+	Payload     string //raw callback kept for audit
+}
+
+const (
+	StatusComplete  = "complete"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+//formatCents formats cents as "123.45" as used by most gateways
+func formatCents(cents int) string {
+	return strconv.Itoa(cents/100) + "." + strconv.Itoa(cents%100/10) + strconv.Itoa(cents%10)
+}
+
+//parseCents parses "123.45" or "123" into cents
+func parseCents(s string) (int, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ".", 2)
+	units, err := strconv.Atoi(parts[0])
+	if err != nil || units < 0 {
+		return 0, errors.Errorf("invalid amount \"%s\"", s)
+	}
+	cents := 0
+	if len(parts) == 2 {
+		frac := parts[1]
+		if len(frac) == 1 {
+			frac += "0"
+		}
+		if len(frac) != 2 {
+			return 0, errors.Errorf("invalid amount \"%s\"", s)
+		}
+		if cents, err = strconv.Atoi(frac); err != nil || cents < 0 {
+			return 0, errors.Errorf("invalid amount \"%s\"", s)
+		}
+	}
+	return units*100 + cents, nil
+}
+
+//field is one name=value pair of a form, kept in a list because some gateways
+//sign the fields in the order they are sent
+type field struct {
+	name  string
+	value string
+}
+
+//parseOrderedForm parses an application/x-www-form-urlencoded body keeping the field order
+func parseOrderedForm(body string) ([]field, error) {
+	fields := []field{}
+	for _, pair := range strings.Split(body, "&") {
+		if pair == "" {
+			continue
+		}
+		nv := strings.SplitN(pair, "=", 2)
+		name, err := url.QueryUnescape(nv[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid form field name")
+		}
+		value := ""
+		if len(nv) == 2 {
+			if value, err = url.QueryUnescape(nv[1]); err != nil {
+				return nil, errors.Wrapf(err, "invalid form field %s", name)
+			}
+		}
+		fields = append(fields, field{name: name, value: value})
+	}
+	return fields, nil
+}
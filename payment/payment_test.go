@@ -0,0 +1,208 @@
+package payment_test
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jansemmelink/events/payment"
+)
+
+func TestFakeProvider(t *testing.T) {
+	var notified *payment.Notification
+	fake := payment.Fake{Secret: "test-secret"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/payment/fake/pay", func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		fake.Pay(httpRes, httpReq) //with the URLs set below
+	})
+	mux.HandleFunc("/notify", func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		n, err := fake.VerifyCallback(httpReq)
+		if err != nil {
+			http.Error(httpRes, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		notified = n
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	fake.BaseURL = server.URL
+	fake.NotifyURL = server.URL + "/notify"
+
+	redirectURL, err := fake.Checkout(payment.Checkout{
+		OrderID:     "order-1",
+		AmountCents: 12345,
+		Description: "Entry",
+		NotifyURL:   "http://elsewhere.example.com/notify",
+	})
+	if err != nil {
+		t.Fatalf("checkout failed: %+v", err)
+	}
+
+	//the payer cannot change the order or amount
+	res, err := http.Get(strings.Replace(redirectURL, "amount=123.45", "amount=0.01", 1))
+	if err != nil {
+		t.Fatalf("pay failed: %+v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden || notified != nil {
+		t.Fatalf("paid tampered checkout: HTTP %d %+v", res.StatusCode, notified)
+	}
+
+	res, err = http.Get(redirectURL)
+	if err != nil {
+		t.Fatalf("pay failed: %+v", err)
+	}
+	res.Body.Close()
+	if notified == nil {
+		t.Fatalf("not notified")
+	}
+	if notified.OrderID != "order-1" || notified.AmountCents != 12345 || notified.Status != payment.StatusComplete || notified.ProviderRef == "" {
+		t.Fatalf("wrong notification: %+v", notified)
+	}
+
+	//tampered amount must be rejected
+	form := fake.Notification("order-1", 100, payment.StatusComplete)
+	form.Set("amount", "0.01")
+	httpReq := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(form.Encode()))
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := fake.VerifyCallback(httpReq); err == nil {
+		t.Fatalf("accepted tampered notification")
+	}
+}
+
+func TestPayFastITN(t *testing.T) {
+	pf := payment.PayFast{
+		MerchantID:  "10000100",
+		MerchantKey: "46f0cd694581a",
+		Passphrase:  "jt7NOE43FZPn",
+		Host:        "https://sandbox.payfast.co.za",
+		Validate:    false,
+	}
+	fields := [][2]string{
+		{"m_payment_id", "order-1"},
+		{"pf_payment_id", "1089250"},
+		{"payment_status", "COMPLETE"},
+		{"item_name", "Swartvlei entries"},
+		{"item_description", ""},
+		{"amount_gross", "250.50"},
+		{"amount_fee", "-5.76"},
+		{"amount_net", "244.74"},
+		{"name_first", "Jan"},
+		{"email_address", "jan@example.com"},
+		{"merchant_id", "10000100"},
+	}
+	body := ""
+	for i, f := range fields {
+		if i > 0 {
+			body += "&"
+		}
+		body += f[0] + "=" + url.QueryEscape(f[1])
+	}
+	signature := fmt.Sprintf("%x", md5.Sum([]byte(body+"&passphrase="+url.QueryEscape(pf.Passphrase))))
+
+	itn := func(body string) *http.Request {
+		httpReq := httptest.NewRequest(http.MethodPost, "/payment/payfast/notify", strings.NewReader(body))
+		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return httpReq
+	}
+	n, err := pf.VerifyCallback(itn(body + "&signature=" + signature))
+	if err != nil {
+		t.Fatalf("valid ITN rejected: %+v", err)
+	}
+	if n.OrderID != "order-1" || n.ProviderRef != "1089250" || n.AmountCents != 25050 || n.FeeCents != 576 || n.Status != payment.StatusComplete {
+		t.Fatalf("wrong notification: %+v", n)
+	}
+
+	if _, err := pf.VerifyCallback(itn(strings.Replace(body, "250.50", "2.50", 1) + "&signature=" + signature)); err == nil {
+		t.Fatalf("accepted ITN with changed amount")
+	}
+	if _, err := pf.VerifyCallback(itn(body)); err == nil {
+		t.Fatalf("accepted ITN without signature")
+	}
+}
+
+func TestPayFastCheckout(t *testing.T) {
+	pf := payment.PayFast{MerchantID: "10000100", MerchantKey: "46f0cd694581a", Passphrase: "x", Host: "https://sandbox.payfast.co.za"}
+	redirectURL, err := pf.Checkout(payment.Checkout{
+		OrderID:     "order-1",
+		AmountCents: 25005,
+		Description: "Swartvlei entries",
+		NotifyURL:   "https://events.example.com/payment/payfast/notify",
+	})
+	if err != nil {
+		t.Fatalf("checkout failed: %+v", err)
+	}
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		t.Fatalf("invalid redirect url: %+v", err)
+	}
+	if u.Path != "/eng/process" || u.Query().Get("amount") != "250.05" || u.Query().Get("signature") == "" {
+		t.Fatalf("wrong redirect url: %s", redirectURL)
+	}
+	if u.Query().Get("return_url") != "" {
+		t.Fatalf("empty fields must not be sent: %s", redirectURL)
+	}
+}
+
+func TestPayFastRefund(t *testing.T) {
+	var got *http.Request
+	var gotBody url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		got = httpReq
+		httpReq.ParseForm()
+		gotBody = httpReq.PostForm
+		if httpReq.URL.Path == "/refunds/unknown" {
+			http.Error(httpRes, `{"code":404}`, http.StatusNotFound)
+			return
+		}
+		if httpReq.URL.Path == "/refunds/refused" {
+			httpRes.Write([]byte(`{"code":200,"status":"failed","data":{"response":false,"message":"refund not allowed"}}`))
+			return
+		}
+		httpRes.Write([]byte(`{"code":200,"status":"success"}`))
+	}))
+	defer server.Close()
+
+	pf := payment.PayFast{MerchantID: "10000100", MerchantKey: "46f0cd694581a", Passphrase: "x", API: server.URL, Testing: true}
+	ref, err := pf.Refund(payment.Refund{ID: "r1", OrderID: "order-1", PaymentRef: "1089250", AmountCents: 12050, Reason: "withdrawn"})
+	if err != nil {
+		t.Fatalf("refund failed: %+v", err)
+	}
+	if ref != "1089250/r1" || got.URL.Path != "/refunds/1089250" || got.URL.Query().Get("testing") != "true" {
+		t.Fatalf("wrong request %s -> %s", got.URL, ref)
+	}
+	if gotBody.Get("amount") != "12050" || got.Header.Get("merchant-id") != "10000100" || len(got.Header.Get("signature")) != 32 {
+		t.Fatalf("wrong request %+v %+v", got.Header, gotBody)
+	}
+	ref2, err := pf.Refund(payment.Refund{ID: "r2", OrderID: "order-1", PaymentRef: "1089250", AmountCents: 5000, Reason: "withdrawn"})
+	if err != nil {
+		t.Fatalf("second refund failed: %+v", err)
+	}
+	if ref2 == ref {
+		t.Fatalf("partial refunds of one payment share reference %s", ref)
+	}
+	if _, err := pf.Refund(payment.Refund{ID: "r3", PaymentRef: "unknown", AmountCents: 100}); err == nil {
+		t.Fatalf("refund succeeded with HTTP error")
+	}
+	if _, err := pf.Refund(payment.Refund{ID: "r4", PaymentRef: "refused", AmountCents: 100}); err == nil {
+		t.Fatalf("refund succeeded when PayFast refused it")
+	}
+	if _, err := pf.Refund(payment.Refund{ID: "r5", PaymentRef: "1089250", AmountCents: 0}); err == nil {
+		t.Fatalf("refund of nothing succeeded")
+	}
+}
+
+func TestFakeRefund(t *testing.T) {
+	fake := payment.Fake{Secret: "test-secret"}
+	if ref, err := fake.Refund(payment.Refund{ID: "r1", PaymentRef: "p1", AmountCents: 100, Reason: "withdrawn"}); err != nil || ref == "" {
+		t.Fatalf("refund failed: %q %+v", ref, err)
+	}
+	fake.RefundErr = fmt.Errorf("refund refused")
+	if _, err := fake.Refund(payment.Refund{ID: "r1", PaymentRef: "p1", AmountCents: 100, Reason: "withdrawn"}); err != fake.RefundErr {
+		t.Fatalf("got %v instead of the injected error", err)
+	}
+}
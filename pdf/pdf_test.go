@@ -0,0 +1,64 @@
+package pdf_test
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/jansemmelink/events/pdf"
+)
+
+func TestDocument(t *testing.T) {
+	doc := pdf.New()
+	for i := 0; i < 2; i++ {
+		page := doc.AddPage()
+		page.Text(50, 50, pdf.HelveticaBold, 18, "TAX INVOICE")
+		page.Text(50, 80, pdf.Helvetica, 10, "Entry (10km) \\ Zoë")
+		page.TextRight(545, 80, pdf.Helvetica, 10, "R250.00")
+		page.Line(50, 90, 545, 90, 0.5)
+		page.Rect(50, 100, 495, 20, 0.9)
+	}
+	data := doc.Bytes()
+
+	if !bytes.HasPrefix(data, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatalf("not a PDF")
+	}
+	if !bytes.Contains(data, []byte(`(Entry \(10km\) \\ Zo\353)`)) {
+		t.Fatalf("text not escaped and encoded")
+	}
+	if !bytes.Contains(data, []byte("/Count 2")) {
+		t.Fatalf("not 2 pages")
+	}
+
+	//every xref entry must point at its object
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(data)
+	if m == nil {
+		t.Fatalf("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(data[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at xref", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(data[xref:], -1)
+	if len(entries) != 8 {
+		t.Fatalf("%d objects instead of 8", len(entries))
+	}
+	for i, e := range entries {
+		offset, _ := strconv.Atoi(string(e[1]))
+		if !bytes.HasPrefix(data[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))) {
+			t.Fatalf("xref of object %d points at wrong offset %d", i+1, offset)
+		}
+	}
+}
+
+func TestTextWidth(t *testing.T) {
+	//"0" is 556/1000 and " " is 278/1000 of the size
+	if w := pdf.TextWidth(pdf.Helvetica, 10, "00 0"); w != 19.46 {
+		t.Fatalf("width %v", w)
+	}
+	if pdf.TextWidth(pdf.HelveticaBold, 10, "Total") <= pdf.TextWidth(pdf.Helvetica, 10, "Total") {
+		t.Fatalf("bold not wider")
+	}
+}
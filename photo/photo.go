@@ -0,0 +1,139 @@
+package photo
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+
+	//decoders registered for image.Decode
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/go-msvc/errors"
+)
+
+//Sizes of the longest side of the versions made for the web
+const (
+	ThumbSize = 320
+	WebSize   = 1600
+)
+
+//MaxPixels limits the images that are decoded, so a small upload cannot
+//claim gigabytes of memory when it is decoded
+const MaxPixels = 50 * 1000 * 1000
+
+//Check reads the image header and fails when the image cannot be decoded
+func Check(r io.Reader) (image.Config, string, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return image.Config{}, "", errors.Wrapf(err, "not a jpeg, png or gif image")
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return image.Config{}, "", errors.Errorf("image %dx%d larger than %d pixels", config.Width, config.Height, MaxPixels)
+	}
+	return config, format, nil
+}
+
+//Decode decodes the image and returns its EXIF orientation, as phones rather
+//tag photos than rotate them. Orient the image after scaling it, which is
+//cheaper than orienting the full image.
+func Decode(data []byte) (image.Image, int, error) {
+	if _, _, err := Check(bytes.NewReader(data)); err != nil {
+		return nil, 0, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to decode image")
+	}
+	return img, Orientation(data), nil
+}
+
+//Scale reduces the image so its longest side is at most size, averaging the
+//source pixels that fall in each destination pixel. Smaller images are only
+//copied.
+func Scale(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	return scaleRows(scaleColumns(src, dw), dh)
+}
+
+//scaleColumns averages columns of src into w columns
+func scaleColumns(src *image.RGBA, w int) *image.RGBA {
+	sw, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		x0, x1 := x*sw/w, (x+1)*sw/w
+		if x1 == x0 {
+			x1 = x0 + 1
+		}
+		for y := 0; y < h; y++ {
+			var sum [4]int
+			row := src.Pix[y*src.Stride:]
+			for sx := x0; sx < x1; sx++ {
+				for c := 0; c < 4; c++ {
+					sum[c] += int(row[sx*4+c])
+				}
+			}
+			n := x1 - x0
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				d[c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+//scaleRows averages rows of src into h rows
+func scaleRows(src *image.RGBA, h int) *image.RGBA {
+	w, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sum := make([]int, w*4)
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for i := range sum {
+			sum[i] = 0
+		}
+		for sy := y0; sy < y1; sy++ {
+			row := src.Pix[sy*src.Stride : sy*src.Stride+w*4]
+			for i, v := range row {
+				sum[i] += int(v)
+			}
+		}
+		n := y1 - y0
+		d := dst.Pix[y*dst.Stride : y*dst.Stride+w*4]
+		for i := range d {
+			d[i] = uint8((sum[i] + n/2) / n)
+		}
+	}
+	return dst
+}
+
+//EncodeJPEG encodes the image for the web
+func EncodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, errors.Wrapf(err, "failed to encode jpeg")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+package photo_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/jansemmelink/events/photo"
+)
+
+func TestScale(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4000, 3000))
+	for x := 0; x < 4000; x++ {
+		for y := 0; y < 3000; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x % 2 * 255), A: 255})
+		}
+	}
+	scaled := photo.Scale(img, photo.WebSize)
+	if b := scaled.Bounds(); b.Dx() != 1600 || b.Dy() != 1200 {
+		t.Fatalf("scaled to %dx%d, expected 1600x1200", b.Dx(), b.Dy())
+	}
+	//alternating black and red columns average to dark red
+	if c := scaled.RGBAAt(800, 600); c.R < 120 || c.R > 135 || c.A != 255 {
+		t.Errorf("pixel is %+v, expected average red", c)
+	}
+
+	portrait := photo.Scale(image.NewRGBA(image.Rect(0, 0, 600, 1200)), photo.ThumbSize)
+	if b := portrait.Bounds(); b.Dx() != 160 || b.Dy() != 320 {
+		t.Errorf("portrait scaled to %dx%d, expected 160x320", b.Dx(), b.Dy())
+	}
+	small := photo.Scale(image.NewRGBA(image.Rect(0, 0, 100, 50)), photo.ThumbSize)
+	if b := small.Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Errorf("small image scaled to %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red := color.RGBA{R: 255, A: 255}
+	img.Set(0, 0, red) //top left
+	for o, exp := range map[int]image.Point{
+		1: {0, 0},
+		2: {2, 0},
+		3: {2, 1},
+		4: {0, 1},
+		5: {0, 0},
+		6: {1, 0},
+		7: {1, 2},
+		8: {0, 2},
+	} {
+		oriented := photo.Orient(img, o)
+		if o >= 5 && (oriented.Bounds().Dx() != 2 || oriented.Bounds().Dy() != 3) {
+			t.Errorf("orientation %d gave %v, expected 2x3", o, oriented.Bounds())
+		}
+		if oriented.At(exp.X, exp.Y) != red {
+			t.Errorf("orientation %d did not move top left to %v", o, exp)
+		}
+	}
+}
+
+//exifJPEG returns a jpeg with an EXIF orientation in big or little endian
+func exifJPEG(t *testing.T, order binary.ByteOrder, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8) //IFD0
+	order.PutUint16(tiff[8:], 1) //entries
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3) //short
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	jpg := buf.Bytes()
+	return append(append(append([]byte{}, jpg[:2]...), append(app1, segment...)...), jpg[2:]...)
+}
+
+func TestOrientation(t *testing.T) {
+	if o := photo.Orientation(exifJPEG(t, binary.BigEndian, 6)); o != 6 {
+		t.Errorf("big endian orientation %d, expected 6", o)
+	}
+	if o := photo.Orientation(exifJPEG(t, binary.LittleEndian, 8)); o != 8 {
+		t.Errorf("little endian orientation %d, expected 8", o)
+	}
+	img, o, err := photo.Decode(exifJPEG(t, binary.LittleEndian, 3))
+	if err != nil || o != 3 || img.Bounds().Dx() != 8 {
+		t.Errorf("decode gave %v, %d, %+v", img.Bounds(), o, err)
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if o := photo.Orientation(buf.Bytes()); o != 1 {
+		t.Errorf("png orientation %d, expected 1", o)
+	}
+	if _, _, err := photo.Decode([]byte("not an image")); err == nil {
+		t.Errorf("decoded text")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+//photoUploaded wakes the photo worker
+var photoUploaded = make(chan struct{}, 1)
+
+//postEventPhoto uploads a photo to the gallery with URL params by_person_id,
+//caption and filename. The content is the request body or multipart form
+//file "photo".
+func postEventPhoto(httpRes http.ResponseWriter, httpReq *http.Request) {
+	query := httpReq.URL.Query()
+	req := db.UploadPhotoRequest{
+		ByPersonID: query.Get("by_person_id"),
+		Caption:    query.Get("caption"),
+		Filename:   query.Get("filename"),
+	}
+	httpReq.Body = http.MaxBytesReader(httpRes, httpReq.Body, db.MaxPhotoSize)
+	var content io.Reader = httpReq.Body
+	if mr, err := httpReq.MultipartReader(); err == nil {
+		content = nil
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if part.FormName() == "photo" {
+				req.Filename = part.FileName()
+				content = part
+				break
+			}
+		}
+		if content == nil {
+			http.Error(httpRes, "missing multipart form file \"photo\"", http.StatusBadRequest)
+			return
+		}
+	}
+	p, err := db.UploadPhoto(mux.Vars(httpReq)["id"], req, content)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to upload photo: %+s", err), code)
+		return
+	}
+	select {
+	case photoUploaded <- struct{}{}:
+	default: //worker already woken
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(p)
+}
+
+//getEventPhotos expects optional URL params person_id (the viewer), bib,
+//entrant_id (to find the photos of a person's entry) and moderation
+func getEventPhotos(ctx context.Context) ([]db.Photo, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListEventPhotos(params["id"], db.PhotoFilter{
+		PersonID:   params["person_id"],
+		Bib:        params["bib"],
+		EntrantID:  params["entrant_id"],
+		Moderation: params["moderation"],
+	})
+}
+
+func getPhoto(ctx context.Context) (*db.Photo, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.AuthorisePhoto(params["id"], params["person_id"])
+}
+
+//getPhotoVersion streams the original, web or thumb version of a photo the
+//person with URL param person_id may see
+func getPhotoVersion(httpRes http.ResponseWriter, httpReq *http.Request) {
+	vars := mux.Vars(httpReq)
+	fail := func(err error) {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to get photo: %+s", err), code)
+	}
+	p, err := db.AuthorisePhoto(vars["id"], httpReq.URL.Query().Get("person_id"))
+	if err != nil {
+		fail(err)
+		return
+	}
+	documentID, err := p.VersionDocumentID(vars["version"])
+	if err != nil {
+		fail(err)
+		return
+	}
+	doc, content, err := db.OpenDocument(documentID)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer content.Close()
+	serveContent(httpRes, httpReq, doc, content)
+}
+
+func postPhotoTags(ctx context.Context, req db.TagPhotoRequest) (*db.Photo, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.TagPhoto(params["id"], req)
+}
+
+func postModeratePhoto(ctx context.Context, req db.ModeratePhotoRequest) (*db.Photo, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ModeratePhoto(params["id"], req)
+}
+
+//postRemovePhoto expects URL param by_person_id
+func postRemovePhoto(ctx context.Context) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.RemovePhoto(params["id"], params["by_person_id"])
+}
+
+//photoWorker makes the web and thumbnail versions of uploaded photos, woken
+//by uploads and checking every minute for photos of other instances
+func photoWorker() {
+	for {
+		for {
+			processed, err := db.ProcessNextPhoto()
+			if err != nil {
+				fmt.Printf("ERROR: failed to process photos: %+v\n", err)
+				break
+			}
+			if !processed {
+				break
+			}
+		}
+		select {
+		case <-photoUploaded:
+		case <-time.After(time.Minute):
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func postEventPricing(ctx context.Context, req db.SetEventPricingRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.SetEventPricing(params["id"], req); err != nil {
+		return errors.Wrapf(err, "failed to set event pricing")
+	}
+	return nil
+}
+
+func getEventPricing(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	pricing, err := db.GetEventPricing(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return pricing, nil
+}
+
+func postEventQuote(ctx context.Context, req db.QuoteRequest) (*db.Quote, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	quote, err := db.QuoteEntries(params["id"], req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to calculate price")
+	}
+	return quote, nil
+}
+
+func postPromoCode(ctx context.Context, req db.NewPromoCodeRequest) (*db.PromoCode, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	code, err := db.AddPromoCode(params["id"], req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add promo code")
+	}
+	return code, nil
+}
+
+func getPromoCodes(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.AuthoriseEventOrganiser(params["id"], params["by_person_id"]); err != nil {
+		return nil, err
+	}
+	codes, err := db.ListPromoCodes(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
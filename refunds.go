@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+	"github.com/jansemmelink/events/payment"
+)
+
+func postEventRefundPolicy(ctx context.Context, req db.SetRefundPolicyRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEventRefundPolicy(params["id"], req)
+}
+
+func getEventRefundPolicy(ctx context.Context) (*db.RefundPolicy, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.GetEventRefundPolicy(params["id"])
+}
+
+func postRefundRequest(ctx context.Context, req db.NewRefundRequest) (*db.Refund, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.RequestRefund(params["id"], req)
+}
+
+func getEventRefunds(ctx context.Context) ([]db.Refund, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.AuthoriseEventOrganiser(params["id"], params["by_person_id"]); err != nil {
+		return nil, err
+	}
+	return db.ListRefunds(params["id"], params["status"])
+}
+
+func postRefundDecision(ctx context.Context, req db.DecideRefundRequest) (*db.Refund, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	refund, err := db.DecideRefund(params["id"], req)
+	if err != nil {
+		return nil, err
+	}
+	return payRefund(refund), nil
+}
+
+type CompleteRefundRequest struct {
+	ByPersonID string `json:"by_person_id" doc:"Organiser of the event"`
+	Reference  string `json:"reference" doc:"Bank reference of the refund paid by hand"`
+}
+
+func (req CompleteRefundRequest) Validate() error {
+	if req.ByPersonID == "" {
+		return errors.Errorf("missing by_person_id")
+	}
+	if req.Reference == "" {
+		return errors.Errorf("missing reference")
+	}
+	return nil
+}
+
+//postRefundComplete records a cash refund paid by hand, e.g. for EFT orders
+//or after the provider failed
+func postRefundComplete(ctx context.Context, req CompleteRefundRequest) (*db.Refund, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	refund, err := db.GetRefund(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := db.IsEventOrganiser(refund.EventID, req.ByPersonID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.Errorc(http.StatusForbidden, "only organisers can complete refunds")
+	}
+	return db.CompleteRefund(refund.ID, req.Reference, nil)
+}
+
+func postCancelEvent(ctx context.Context, req db.CancelEventRequest) ([]db.Refund, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	refunds, err := db.CancelEvent(params["id"], req)
+	if err != nil {
+		return nil, err
+	}
+	for i := range refunds {
+		refunds[i] = *payRefund(&refunds[i])
+	}
+	return refunds, nil
+}
+
+//getPersonCreditNotes expects URL param by_person_id of the same person
+func getPersonCreditNotes(ctx context.Context) ([]db.CreditNote, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListPersonCreditNotes(params["id"], params["by_person_id"])
+}
+
+//payRefund pays an approved cash refund through the provider that took the
+//payment. EFT refunds stay approved until paid by hand.
+func payRefund(refund *db.Refund) *db.Refund {
+	if refund.Status != db.RefundApproved || refund.Method != db.RefundCash {
+		return refund
+	}
+	provider, paymentRef, err := db.RefundPayment(refund.ID)
+	if err != nil {
+		fmt.Printf("ERROR: cannot refund %s: %+v\n", refund.ID, err)
+		return refund
+	}
+	if provider != paymentProvider.Name() || paymentRef == "" {
+		return refund
+	}
+	refundRef, refundErr := paymentProvider.Refund(payment.Refund{
+		ID:          refund.ID,
+		OrderID:     refund.OrderID,
+		PaymentRef:  paymentRef,
+		AmountCents: refund.AmountCents,
+		Reason:      refund.Reason,
+	})
+	completed, err := db.CompleteRefund(refund.ID, refundRef, refundErr)
+	if err != nil {
+		fmt.Printf("ERROR: failed to record refund %s (ref %s, err %v): %+v\n", refund.ID, refundRef, refundErr, err)
+		return refund
+	}
+	return completed
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func postEventTransferPolicy(ctx context.Context, req db.SetTransferPolicyRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEventTransferPolicy(params["id"], req)
+}
+
+func getEventTransferPolicy(ctx context.Context) (*db.TransferPolicy, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.GetEventTransferPolicy(params["id"])
+}
+
+func postOfferTransfer(ctx context.Context, req db.OfferTransferRequest) (*db.EntryTransfer, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.OfferTransfer(params["id"], req)
+}
+
+type TransferResponse struct {
+	Transfer *db.EntryTransfer `json:"transfer"`
+	Payment  *CheckoutResponse `json:"payment,omitempty" doc:"How to pay the transfer fee"`
+}
+
+func postAcceptTransfer(ctx context.Context, req db.AcceptTransferRequest) (*TransferResponse, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	provider := paymentProvider.Name()
+	if req.PayBy == db.ProviderEFT {
+		provider = db.ProviderEFT
+	}
+	transfer, order, err := db.AcceptTransfer(params["id"], req, provider)
+	if err != nil {
+		return nil, errors.Wrapf(err, "transfer failed")
+	}
+	res := TransferResponse{Transfer: transfer}
+	if order != nil {
+		if res.Payment, err = startPayment(order, provider, "Entry transfer"); err != nil {
+			return nil, err
+		}
+	}
+	return &res, nil
+}
+
+func postEndTransfer(ctx context.Context, req db.EndTransferRequest) (*db.EntryTransfer, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.EndTransfer(params["id"], req)
+}
+
+func getEntryTransfers(ctx context.Context) ([]db.EntryTransfer, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListEntryTransfers(params["id"], params["by_person_id"])
+}
+
+func getEventTransfers(ctx context.Context) ([]db.EntryTransfer, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.AuthoriseEventOrganiser(params["id"], params["by_person_id"]); err != nil {
+		return nil, err
+	}
+	return db.ListEventTransfers(params["id"], params["status"])
+}
+
+//getPersonTransfers expects URL param by_person_id of the same person
+func getPersonTransfers(ctx context.Context) ([]db.EntryTransfer, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListPersonTransfers(params["id"], params["by_person_id"])
+}
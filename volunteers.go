@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-msvc/errors"
+	"github.com/jansemmelink/events/db"
+)
+
+func postVolunteerRole(ctx context.Context, req db.NewVolunteerRoleRequest) (*db.VolunteerRole, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	role, err := db.AddVolunteerRole(params["id"], req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add volunteer role")
+	}
+	return role, nil
+}
+
+func getVolunteerRoles(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	roles, err := db.ListVolunteerRoles(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func postVolunteerShift(ctx context.Context, req db.NewVolunteerShiftRequest) (*db.VolunteerShift, error) {
+	shift, err := db.AddVolunteerShift(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add volunteer shift")
+	}
+	return shift, nil
+}
+
+func getVolunteerShifts(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	shifts, err := db.ListVolunteerShifts(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return shifts, nil
+}
+
+func postVolunteerSignup(ctx context.Context, req db.VolunteerSignupRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.VolunteerSignup(params["id"], req); err != nil {
+		return errors.Wrapf(err, "failed to sign up")
+	}
+	return nil
+}
+
+func postVolunteerDrop(ctx context.Context, req db.VolunteerSignupRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.VolunteerDrop(params["id"], req); err != nil {
+		return errors.Wrapf(err, "failed to drop shift")
+	}
+	return nil
+}
+
+func postVolunteerSwap(ctx context.Context, req db.VolunteerSwapRequest) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	if err := db.VolunteerSwap(params["id"], req); err != nil {
+		return errors.Wrapf(err, "failed to swap shift")
+	}
+	return nil
+}
+
+func getPersonVolunteering(ctx context.Context) (interface{}, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	pv, err := db.GetPersonVolunteering(params["id"])
+	if err != nil {
+		return nil, err
+	}
+	return pv, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-msvc/errors"
+	"github.com/gorilla/mux"
+	"github.com/jansemmelink/events/db"
+)
+
+func postEventWaiver(ctx context.Context, req db.SetEventWaiverRequest) (*db.Waiver, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.SetEventWaiver(params["id"], req)
+}
+
+func getEventWaivers(ctx context.Context) ([]db.Waiver, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListEventWaivers(params["id"])
+}
+
+//getWaiverContent streams the document of a waiver, which anyone can read
+//before accepting it
+func getWaiverContent(httpRes http.ResponseWriter, httpReq *http.Request) {
+	w, err := db.GetWaiver(mux.Vars(httpReq)["id"])
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to get waiver: %+s", err), code)
+		return
+	}
+	serveDocument(httpRes, httpReq, w.DocumentID)
+}
+
+//postRemoveWaiver expects URL param by_person_id
+func postRemoveWaiver(ctx context.Context) error {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.RemoveEventWaiver(params["id"], params["by_person_id"])
+}
+
+//postAcceptWaiver records the acceptance with the IP address of the client
+func postAcceptWaiver(ctx context.Context, req db.AcceptWaiverRequest) (*db.WaiverAcceptance, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	req.IP = ctx.Value(CtxClientIP{}).(string)
+	a, err := db.AcceptWaiver(params["id"], req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to accept waiver")
+	}
+	return a, nil
+}
+
+//getWaiverAcceptances expects URL param by_person_id
+func getWaiverAcceptances(ctx context.Context) ([]db.WaiverAcceptanceRecord, error) {
+	params := ctx.Value(CtxParams{}).(map[string]string)
+	return db.ListWaiverAcceptances(params["id"], params["by_person_id"])
+}
+
+//getWaiverAcceptancesCSV exports the signed acceptance records of the event,
+//expects URL param by_person_id
+func getWaiverAcceptancesCSV(httpRes http.ResponseWriter, httpReq *http.Request) {
+	eventID := mux.Vars(httpReq)["id"]
+	records, err := db.ListWaiverAcceptances(eventID, httpReq.URL.Query().Get("by_person_id"))
+	if err != nil {
+		code := http.StatusInternalServerError
+		if c := errors.Code(err); c > 0 {
+			code = c
+		}
+		http.Error(httpRes, fmt.Sprintf("failed to get acceptances: %+s", err), code)
+		return
+	}
+
+	httpRes.Header().Set("Content-Type", "text/csv")
+	httpRes.Header().Set("Content-Disposition", "attachment; filename=\"waivers.csv\"")
+	w := csv.NewWriter(httpRes)
+	w.Write([]string{"person_id", "first_name", "last_name", "dob", "entry_status", "document", "revision", "document_id", "accepted", "accepted_by_person_id", "accepted_by", "capacity", "ip"})
+	for _, r := range records {
+		entryStatus := ""
+		if r.EntryStatus != nil {
+			entryStatus = *r.EntryStatus
+		}
+		writeCSVText(w, []string{
+			r.PersonID, r.FirstName, r.LastName, r.Dob, entryStatus,
+			r.DocumentName, strconv.Itoa(r.Revision), r.DocumentID,
+			r.Accepted.String(), r.AcceptedByPersonID, r.AcceptedByName, r.Capacity, r.IP,
+		})
+	}
+	w.Flush()
+} //getWaiverAcceptancesCSV()
@@ -0,0 +1,106 @@
+package xlsx_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/events/xlsx"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := xlsx.NewWriter(&buf, "Entries: 10km/21km", []string{"name", "age", "dob"})
+	if err != nil {
+		t.Fatalf("failed to start: %+v", err)
+	}
+	if err := w.WriteRow([]interface{}{"Zoë <& Jan>", 48, time.Date(1973, 11, 18, 0, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatalf("failed to write: %+v", err)
+	}
+	if err := w.WriteRow([]interface{}{"", nil, 12.5, true}); err != nil {
+		t.Fatalf("failed to write: %+v", err)
+	}
+	if err := w.WriteRow([]interface{}{struct{}{}}); err == nil {
+		t.Fatalf("wrote unsupported cell")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close: %+v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip: %+v", err)
+	}
+	parts := map[string][]byte{}
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		parts[f.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Fatalf("missing %s", name)
+		}
+		if err := xml.Unmarshal(parts[name], new(interface{})); err != nil {
+			t.Fatalf("invalid XML in %s: %+v", name, err)
+		}
+	}
+	if !bytes.Contains(parts["xl/workbook.xml"], []byte(`name="Entries- 10km-21km"`)) {
+		t.Fatalf("invalid sheet name: %s", parts["xl/workbook.xml"])
+	}
+
+	var sheet struct {
+		Rows []struct {
+			R     int `xml:"r,attr"`
+			Cells []struct {
+				R      string `xml:"r,attr"`
+				S      string `xml:"s,attr"`
+				T      string `xml:"t,attr"`
+				V      string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.Unmarshal(parts["xl/worksheets/sheet1.xml"], &sheet); err != nil {
+		t.Fatalf("invalid sheet: %+v", err)
+	}
+	if len(sheet.Rows) != 3 {
+		t.Fatalf("%d rows instead of 3", len(sheet.Rows))
+	}
+	header := sheet.Rows[0]
+	if len(header.Cells) != 3 || header.Cells[2].Inline != "dob" || header.Cells[2].S != "1" {
+		t.Fatalf("invalid header: %+v", header)
+	}
+	row := sheet.Rows[1].Cells
+	if row[0].Inline != "Zoë <& Jan>" || row[0].T != "inlineStr" {
+		t.Fatalf("invalid text: %+v", row[0])
+	}
+	if row[1].R != "B2" || row[1].V != "48" {
+		t.Fatalf("invalid number: %+v", row[1])
+	}
+	if row[2].V != "26986" || row[2].S != "2" {
+		t.Fatalf("invalid date: %+v", row[2])
+	}
+	row = sheet.Rows[2].Cells
+	if len(row) != 2 || row[0].R != "C3" || row[0].V != "12.5" || row[1].T != "b" || row[1].V != "1" {
+		t.Fatalf("invalid row 3: %+v", row)
+	}
+}
+
+func TestColumnName(t *testing.T) {
+	for i, name := range map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		if got := xlsx.ColumnName(i); got != name {
+			t.Fatalf("column %d is %s instead of %s", i, got, name)
+		}
+	}
+}
+
+func TestSerial(t *testing.T) {
+	loc := time.FixedZone("SAST", 2*60*60)
+	if s := xlsx.Serial(time.Date(2022, 6, 24, 18, 0, 0, 0, loc)); s != 44736.75 {
+		t.Fatalf("serial %v instead of 44736.75", s)
+	}
+}